@@ -0,0 +1,243 @@
+package admin
+
+// Admin HTTP API for inspecting and poking at a proxy's state
+// Meant to be served on its own localhost-only port, separate from the proxy
+//
+//   GET    /node                 Peer ID, addresses, and represented service
+//   GET    /pcache               Peer cache levels
+//   DELETE /pcache/<peer ID>     Evict a peer from the peer cache
+//   GET    /rcache               Registry cache entries
+//   DELETE /rcache               Flush the registry cache
+//   DELETE /rcache/<service>     Drop one service from the registry cache
+//   POST   /resolve/<service>    Drop cached state for a service and resolve it again
+//   GET    /<name>               Extra state registered with AddState()
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/libp2p/go-libp2p-core/peer"
+
+    "github.com/PhysarumSM/service-manager/logging"
+    "github.com/PhysarumSM/service-manager/resolver"
+)
+
+var log = logging.New("admin")
+
+type Server struct {
+    Resolver *resolver.Resolver
+
+    // Extra read-only state to expose, keyed by path
+    states map[string]func() interface{}
+    mux    sync.Mutex
+}
+
+// Constructor for Server
+// The resolver gives access to the LCA Manager and caches to inspect
+func NewServer(res *resolver.Resolver) *Server {
+    return &Server{
+        Resolver: res,
+        states: make(map[string]func() interface{}),
+    }
+}
+
+// Exposes the result of f as JSON under GET /<name>
+func (s *Server) AddState(name string, f func() interface{}) {
+    s.mux.Lock()
+    defer s.mux.Unlock()
+    s.states[name] = f
+}
+
+type nodeView struct {
+    ID          string
+    Addrs       []string
+    ServiceName string `json:",omitempty"`
+    ServiceHash string `json:",omitempty"`
+    DockerHash  string `json:",omitempty"`
+}
+
+type peerView struct {
+    ID       string
+    Service  string
+    Hash     string
+    RCount      uint
+    RTT         string
+    ServiceTime string
+    ErrorRate   float64
+    Inflight    uint
+    Breaker     string
+}
+
+type registryView struct {
+    ContentHash string
+    DockerHash  string
+    SoftRTT     string
+    HardRTT     string
+    Expiry      time.Time
+    Expired     bool
+    // Cached as not found in the registry
+    NotFound    bool
+}
+
+// Implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    log.Println("Got admin request:", r.Method, r.URL.Path)
+
+    path := strings.Trim(r.URL.Path, "/")
+    tokens := strings.SplitN(path, "/", 2)
+    arg := ""
+    if len(tokens) == 2 {
+        arg = tokens[1]
+    }
+
+    switch {
+    case tokens[0] == "node" && arg == "" && r.Method == http.MethodGet:
+        s.getNode(w)
+    case tokens[0] == "pcache" && arg == "" && r.Method == http.MethodGet:
+        s.getPeerCache(w)
+    case tokens[0] == "pcache" && arg != "" && r.Method == http.MethodDelete:
+        s.evictPeer(w, arg)
+    case tokens[0] == "rcache" && arg == "" && r.Method == http.MethodGet:
+        s.getRegistryCache(w)
+    case tokens[0] == "rcache" && r.Method == http.MethodDelete:
+        s.flushRegistryCache(w, arg)
+    case tokens[0] == "resolve" && arg != "" && r.Method == http.MethodPost:
+        s.resolve(w, arg)
+    case arg == "" && r.Method == http.MethodGet:
+        s.mux.Lock()
+        f, ok := s.states[tokens[0]]
+        s.mux.Unlock()
+        if !ok {
+            http.NotFound(w, r)
+            return
+        }
+        writeJSON(w, f())
+    default:
+        http.NotFound(w, r)
+    }
+}
+
+func (s *Server) getNode(w http.ResponseWriter) {
+    manager := s.Resolver.Manager
+    view := nodeView{
+        ID: manager.Host.Host.ID().Pretty(),
+        ServiceName: manager.ServiceName,
+        ServiceHash: manager.P2PHash,
+        DockerHash: manager.DockerHash,
+    }
+    for _, addr := range manager.Host.Host.Addrs() {
+        view.Addrs = append(view.Addrs, addr.String())
+    }
+    writeJSON(w, view)
+}
+
+func (s *Server) getPeerCache(w http.ResponseWriter) {
+    var levels [][]peerView
+    for _, level := range s.Resolver.PeerCache.Snapshot() {
+        views := []peerView{}
+        for _, p := range level {
+            views = append(views, peerView{
+                ID: p.Info.ID.Pretty(),
+                Service: p.Info.ServName,
+                Hash: p.Info.ServHash,
+                RCount: p.RCount,
+                RTT: p.Info.Perf.RTT.String(),
+                ServiceTime: p.ServiceTime.String(),
+                ErrorRate: p.ErrorRate,
+                Inflight: p.Inflight,
+                Breaker: p.Breaker.String(),
+            })
+        }
+        levels = append(levels, views)
+    }
+    writeJSON(w, levels)
+}
+
+func (s *Server) evictPeer(w http.ResponseWriter, idStr string) {
+    id, err := peer.Decode(idStr)
+    if err != nil {
+        http.Error(w, fmt.Sprintf("Invalid peer ID %s\n%v", idStr, err),
+                    http.StatusBadRequest)
+        return
+    }
+    log.Printf("Evicting peer %s from peer cache\n", id)
+    if !s.Resolver.PeerCache.RemovePeer(id) {
+        http.Error(w, fmt.Sprintf("Peer %s is not cached", id), http.StatusNotFound)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) getRegistryCache(w http.ResponseWriter) {
+    now := time.Now()
+    views := make(map[string]registryView)
+    for name, entry := range s.Resolver.RegistryCache.Entries() {
+        views[name] = registryView{
+            ContentHash: entry.Info.ContentHash,
+            DockerHash: entry.Info.DockerHash,
+            SoftRTT: entry.Info.NetworkSoftReq.RTT.String(),
+            HardRTT: entry.Info.NetworkHardReq.RTT.String(),
+            Expiry: entry.Expiry,
+            Expired: now.After(entry.Expiry),
+            NotFound: entry.NotFound,
+        }
+    }
+    writeJSON(w, views)
+}
+
+func (s *Server) flushRegistryCache(w http.ResponseWriter, servName string) {
+    if servName == "" {
+        log.Println("Flushing registry cache")
+        s.Resolver.RegistryCache.Flush()
+    } else {
+        log.Printf("Dropping %s from registry cache\n", servName)
+        s.Resolver.RegistryCache.Delete(servName)
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// Forgets everything cached about a service, then finds or allocates an
+// instance of it from scratch
+func (s *Server) resolve(w http.ResponseWriter, servName string) {
+    log.Printf("Forcing re-resolve of service %s\n", servName)
+    s.Resolver.RegistryCache.Delete(servName)
+
+    // Peers are matched by name as the service's hash may have changed
+    var evict []peer.ID
+    for _, level := range s.Resolver.PeerCache.Snapshot() {
+        for _, p := range level {
+            if p.Info.ServName == servName {
+                evict = append(evict, p.Info.ID)
+            }
+        }
+    }
+    for _, id := range evict {
+        s.Resolver.PeerCache.RemovePeer(id)
+    }
+
+    id, info, err := s.Resolver.Resolve(servName)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadGateway)
+        return
+    }
+    writeJSON(w, map[string]string{
+        "Peer": id.Pretty(),
+        "ContentHash": info.ContentHash,
+    })
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+    body, err := json.MarshalIndent(v, "", "    ")
+    if err != nil {
+        log.Printf("ERROR: Unable to encode admin response\n%v\n", err)
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.Write(append(body, '\n'))
+}
+
@@ -0,0 +1,79 @@
+package admin
+
+import (
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+
+    "github.com/libp2p/go-libp2p-core/test"
+
+    "github.com/PhysarumSM/common/p2putil"
+    "github.com/PhysarumSM/service-registry/registry"
+
+    "github.com/PhysarumSM/service-manager/pcache"
+    "github.com/PhysarumSM/service-manager/rcache"
+    "github.com/PhysarumSM/service-manager/resolver"
+)
+
+func TestServeHTTP(t *testing.T) {
+    id, err := test.RandPeerID()
+    if err != nil {
+        t.Fatalf("RandPeerID() failed: %v", err)
+    }
+    regCache := rcache.NewRegistryCache(context.Background(), nil, nil, 60)
+    regCache.Add("svc", registry.ServiceInfo{ContentHash: "svc-hash"})
+    regCache.Add("other", registry.ServiceInfo{ContentHash: "other-hash"})
+    peerCache := pcache.NewPeerCache(nil, regCache)
+    peerCache.AddPeer(p2putil.PeerInfo{ID: id, ServName: "svc", ServHash: "svc-hash"})
+
+    s := NewServer(resolver.NewResolver(nil, peerCache, regCache))
+    s.AddState("extra", func() interface{} {
+        return map[string]int{"Answer": 42}
+    })
+
+    // Run in order, each seeing the state left by the ones before
+    tests := []struct {
+        method  string
+        path    string
+        status  int
+        // Substrings expected in the response body
+        body    []string
+        // Substrings that mustn't be in the response body
+        notBody []string
+    }{
+        {http.MethodGet, "/pcache", http.StatusOK, []string{id.Pretty(), "svc-hash"}, nil},
+        {http.MethodGet, "/rcache", http.StatusOK, []string{"svc-hash", "other-hash"}, nil},
+        {http.MethodGet, "/extra", http.StatusOK, []string{`"Answer": 42`}, nil},
+        {http.MethodGet, "/missing", http.StatusNotFound, nil, nil},
+        {http.MethodPost, "/pcache", http.StatusNotFound, nil, nil},
+        {http.MethodDelete, "/pcache/not-a-peer-id", http.StatusBadRequest, nil, nil},
+        {http.MethodDelete, "/pcache/" + id.Pretty(), http.StatusNoContent, nil, nil},
+        {http.MethodDelete, "/pcache/" + id.Pretty(), http.StatusNotFound, nil, nil},
+        {http.MethodGet, "/pcache", http.StatusOK, nil, []string{id.Pretty()}},
+        {http.MethodDelete, "/rcache/svc", http.StatusNoContent, nil, nil},
+        {http.MethodGet, "/rcache", http.StatusOK, []string{"other-hash"}, []string{"svc-hash"}},
+        {http.MethodDelete, "/rcache", http.StatusNoContent, nil, nil},
+        {http.MethodGet, "/rcache", http.StatusOK, nil, []string{"other-hash"}},
+    }
+    for _, test := range tests {
+        name := test.method + " " + test.path
+        w := httptest.NewRecorder()
+        s.ServeHTTP(w, httptest.NewRequest(test.method, test.path, nil))
+        if w.Code != test.status {
+            t.Errorf("%s: status %d, want %d", name, w.Code, test.status)
+        }
+        body := w.Body.String()
+        for _, want := range test.body {
+            if !strings.Contains(body, want) {
+                t.Errorf("%s: body %q doesn't contain %q", name, body, want)
+            }
+        }
+        for _, unwanted := range test.notBody {
+            if strings.Contains(body, unwanted) {
+                t.Errorf("%s: body %q contains %q", name, body, unwanted)
+            }
+        }
+    }
+}
@@ -5,9 +5,10 @@ import (
     "encoding/json"
     "flag"
     "io/ioutil"
-    "log"
     "net/http"
     "os"
+    "os/signal"
+    "syscall"
     "time"
 
     "github.com/libp2p/go-libp2p-core/pnet"
@@ -18,22 +19,23 @@ import (
     "github.com/PhysarumSM/common/util"
     "github.com/PhysarumSM/service-manager/conf"
     "github.com/PhysarumSM/service-manager/lca"
+    "github.com/PhysarumSM/service-manager/logging"
 
     "github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-const defaultKeyFile = "~/.privKeyAlloc"
+var log = logging.New("allocator")
 
-func init() {
-    // Set up logging defaults
-    log.SetFlags(log.Ldate | log.Lmicroseconds | log.Lshortfile)
-}
+const defaultKeyFile = "~/.privKeyAlloc"
 
 func main () {
     var err error
 
     // Parse options
     configPath := flag.String("configfile", "../conf/conf.json", "path to config file to use")
+    stopServices := flag.Bool("stop-services", false,
+        "stop services started by this allocator when shutting down, instead of leaving them running")
+    logFlags := logging.AddFlags()
     var keyFlags util.KeyFlags
     var bootstraps *[]multiaddr.Multiaddr
     var psk *pnet.PSK
@@ -55,7 +57,13 @@ func main () {
 
     // Start Prometheus endpoint for stats collection
     http.Handle("/metrics", promhttp.Handler())
-    go http.ListenAndServe(":9101", nil)
+    metricsServer := &http.Server{Addr: ":9101"}
+    go func() {
+        err := metricsServer.ListenAndServe()
+        if err != nil && err != http.ErrServerClosed {
+            log.Printf("ERROR: Prometheus endpoint failed\n%v\n", err)
+        }
+    }()
 
     ctx := context.Background()
 
@@ -76,6 +84,10 @@ func main () {
         log.Fatalln(err)
     }
 
+    if err = logFlags.Configure(config.Logging); err != nil {
+        log.Fatalf("ERROR: Invalid logging configuration\n%s\n", err)
+    }
+
     // If CLI didn't specify any bootstraps, fallback to configuration file.
     // If configuration file doesn't contain bootstraps, fallback to
     // checking environment variables.
@@ -130,15 +142,45 @@ func main () {
         log.Fatalln(err)
     }
 
+    cullCtx, stopCulling := context.WithCancel(ctx)
+    cullDone := make(chan struct{})
     go func() {
+        defer close(cullDone)
         ticker := time.NewTicker(time.Minute)
+        defer ticker.Stop()
         for {
-            <-ticker.C
-            allocator.CullUnusedServices()
+            select {
+            case <-cullCtx.Done():
+                return
+            case <-ticker.C:
+                allocator.CullUnusedServices()
+            }
         }
     }()
 
     // Wait for connection
     log.Println("Waiting for requests...")
-    select {}
+
+    // Wait for a signal to shut down
+    // Further signals are left to their default behaviour, so a second one
+    // ends the process right away
+    sigs := make(chan os.Signal, 1)
+    signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+    sig := <-sigs
+    signal.Stop(sigs)
+    log.Printf("Got %s, shutting down (send again to force)\n", sig)
+
+    // Let any culling in progress finish before touching the services
+    stopCulling()
+    <-cullDone
+    if err = allocator.Shutdown(*stopServices); err != nil {
+        log.Printf("ERROR: Unable to shut down LCA Allocator cleanly\n%v\n", err)
+    }
+
+    shutdownCtx, cancel := context.WithTimeout(ctx, 5 * time.Second)
+    defer cancel()
+    if err = metricsServer.Shutdown(shutdownCtx); err != nil {
+        log.Printf("ERROR: Unable to shut down Prometheus endpoint cleanly\n%v\n", err)
+    }
+    log.Println("Shutdown complete")
 }
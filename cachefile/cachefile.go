@@ -0,0 +1,146 @@
+package cachefile
+
+// Saving the peer and registry caches to a local file and loading them back
+// on startup, so a restarted proxy doesn't pay for DHT lookups and
+// allocations that it had already done
+
+import (
+    "encoding/json"
+    "flag"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "time"
+
+    "github.com/PhysarumSM/service-manager/logging"
+    "github.com/PhysarumSM/service-manager/pcache"
+    "github.com/PhysarumSM/service-manager/rcache"
+)
+
+var log = logging.New("cachefile")
+
+// Bumped whenever the file format changes, older files are then ignored
+const version = 1
+
+type contents struct {
+    Version  int
+    Saved    time.Time
+    Registry map[string]rcache.Entry
+    Peers    []pcache.SavedPeer
+}
+
+// Writes both caches to path
+// The file is replaced atomically, so a crash while saving leaves the
+// previous file in place
+func Save(path string, peerCache *pcache.PeerCache, regCache *rcache.RegistryCache) error {
+    data, err := json.Marshal(contents{
+        Version: version,
+        Saved: time.Now(),
+        Registry: regCache.Entries(),
+        Peers: peerCache.SavedPeers(),
+    })
+    if err != nil {
+        return err
+    }
+
+    tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path) + ".tmp")
+    if err != nil {
+        return err
+    }
+    if _, err = tmp.Write(data); err != nil {
+        tmp.Close()
+        os.Remove(tmp.Name())
+        return err
+    }
+    if err = tmp.Close(); err != nil {
+        os.Remove(tmp.Name())
+        return err
+    }
+    return os.Rename(tmp.Name(), path)
+}
+
+// Restores both caches from path
+// A missing file isn't an error, there's just nothing to restore
+func Load(path string, peerCache *pcache.PeerCache, regCache *rcache.RegistryCache) error {
+    data, err := ioutil.ReadFile(path)
+    if os.IsNotExist(err) {
+        return nil
+    } else if err != nil {
+        return err
+    }
+
+    var c contents
+    if err = json.Unmarshal(data, &c); err != nil {
+        return fmt.Errorf("Unable to parse cache file %s\n%w", path, err)
+    }
+    if c.Version != version {
+        return fmt.Errorf("Cache file %s has version %d, expected %d",
+                            path, c.Version, version)
+    }
+
+    entries := regCache.Restore(c.Registry)
+    peers := peerCache.RestorePeers(c.Peers)
+    log.Printf("Restored %d registry entries and %d peers saved at %s\n",
+                entries, peers, c.Saved.Format(time.RFC3339))
+    return nil
+}
+
+// Command line options for saving the caches
+type Flags struct {
+    File         string
+    SaveInterval int
+}
+
+// Adds the cache file flags to the default flag set
+func AddFlags() *Flags {
+    var f Flags
+    flag.StringVar(&f.File, "cache-file", "",
+        "File to save the peer and registry caches to, and restore them from on startup")
+    flag.IntVar(&f.SaveInterval, "cache-save-interval", 60,
+        "Seconds between saves of the caches, 0 to only save on shutdown")
+    return &f
+}
+
+// Restores the caches from the file chosen by the flags, if any, and keeps
+// saving them every SaveInterval seconds
+// A file that can't be restored is logged, and the caches start out empty.
+// The returned function stops the periodic saves and saves one last time.
+func (f *Flags) Start(peerCache *pcache.PeerCache, regCache *rcache.RegistryCache) func() {
+    if f.File == "" {
+        return func() {}
+    }
+    if err := Load(f.File, peerCache, regCache); err != nil {
+        log.Printf("ERROR: Unable to restore caches from %s\n%v\n", f.File, err)
+    }
+
+    stop := make(chan struct{})
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
+        if f.SaveInterval <= 0 {
+            <-stop
+            return
+        }
+        ticker := time.NewTicker(time.Duration(f.SaveInterval) * time.Second)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-stop:
+                return
+            case <-ticker.C:
+                if err := Save(f.File, peerCache, regCache); err != nil {
+                    log.Printf("ERROR: Unable to save caches to %s\n%v\n", f.File, err)
+                }
+            }
+        }
+    }()
+
+    return func() {
+        close(stop)
+        <-done
+        if err := Save(f.File, peerCache, regCache); err != nil {
+            log.Printf("ERROR: Unable to save caches to %s\n%v\n", f.File, err)
+        }
+    }
+}
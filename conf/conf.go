@@ -2,6 +2,8 @@ package conf
 
 import (
     "github.com/PhysarumSM/common/p2putil"
+
+    "github.com/PhysarumSM/service-manager/logging"
 )
 
 type Config struct {
@@ -10,4 +12,254 @@ type Config struct {
         HardReq p2putil.PerfInd
     }
     Bootstraps []string
+    Routing    Routing
+    // Settings for services without an entry in Services
+    Defaults   ServiceConfig
+    // Per-service settings keyed by service name, fields left empty
+    // fall back to those in Defaults
+    Services   map[string]ServiceConfig
+    // Per-peer circuit breaker settings, unset fields use defaults
+    CircuitBreaker CircuitBreaker
+    // Limits on requests a service proxy accepts from each calling peer
+    CallerLimits CallerLimits
+    // When a service proxy should start another replica of its service
+    Scaling      Scaling
+    // Log levels and format, command line flags take precedence
+    Logging      logging.Config
+    // Peer cache levels and probing, scoring is set per service
+    PeerCache    PeerCache
+    // Caching of registry-service lookups, the TTL is set on the command line
+    RegistryCache RegistryCache
+}
+
+// Registry cache settings, see rcache.Config
+// Unset fields use defaults, negative values turn the feature off
+type RegistryCache struct {
+    // How long a service the registry doesn't know of is cached as not
+    // found, in seconds
+    NegativeTTLSecs  int
+    // How long past its expiry an entry is still served while it's being
+    // refreshed, in seconds
+    MaxStaleSecs     int
+    // How long before expiry entries in use are refreshed in the background,
+    // in seconds
+    RefreshAheadSecs int
+    // How recently an entry must have been looked up to be refreshed in the
+    // background, in seconds
+    HotSecs          int
+}
+
+// Peer cache settings, see pcache.PeerCacheConfig
+type PeerCache struct {
+    // Number of reliability levels, including the last level of peers due
+    // for removal
+    Levels             uint
+    // Time between probes of cached peers, in milliseconds
+    ProbeIntervalMs    int
+    // Longest time between probes of peers that aren't being used, in
+    // milliseconds
+    MaxProbeIntervalMs int
+    // Most peers cached at once, least recently used peers being evicted to
+    // make room
+    MaxPeers           uint
+    // Most peers cached at once for any one service
+    MaxPeersPerService uint
+}
+
+// How probes move a peer's reliability count (RCount), and with it the peer,
+// between peer cache levels, see pcache.PeerScoring
+// Numeric fields are pointers so that 0 can be set explicitly, fields left
+// out are nil
+type PeerScoring struct {
+    // RCount given to newly cached peers
+    InitialRCount *uint
+    // Highest RCount a peer can reach
+    MaxRCount     *uint
+    // Peers above this RCount move up a level, and peers in the top level
+    // below it move down
+    PromoteAbove  *uint
+    // Peers below this RCount move down a level
+    DemoteBelow   *uint
+    // RCount given to peers when they move down a level
+    ResetRCount   *uint
+    // RCount lost when a probe misses the soft requirement
+    Penalty       *uint
+    // RCount gained when a probe meets the soft requirement
+    Reward        *uint
+    // How probe results are combined into the performance a peer is ranked
+    // by and checked against, see pcache.NewScorer() for valid names
+    Scorer        string
+    // Weight of each new probe in the ewma and jitter scorers' averages
+    EWMAWeight    *float64
+    // Multiple of the RTT variation the jitter scorer adds to the RTT
+    JitterWeight  *float64
+    // Number of recent probes the loss scorer counts lost probes over
+    LossWindow    *uint
+    // Probes the loss scorer needs before it can drop a peer
+    LossMinProbes *uint
+    // Fraction of lost probes above which the loss scorer drops a peer
+    MaxLoss       *float64
+}
+
+// Fills in any fields s doesn't set from def
+func (s PeerScoring) Or(def PeerScoring) PeerScoring {
+    if s.InitialRCount == nil {
+        s.InitialRCount = def.InitialRCount
+    }
+    if s.MaxRCount == nil {
+        s.MaxRCount = def.MaxRCount
+    }
+    if s.PromoteAbove == nil {
+        s.PromoteAbove = def.PromoteAbove
+    }
+    if s.DemoteBelow == nil {
+        s.DemoteBelow = def.DemoteBelow
+    }
+    if s.ResetRCount == nil {
+        s.ResetRCount = def.ResetRCount
+    }
+    if s.Penalty == nil {
+        s.Penalty = def.Penalty
+    }
+    if s.Reward == nil {
+        s.Reward = def.Reward
+    }
+    if s.Scorer == "" {
+        s.Scorer = def.Scorer
+    }
+    if s.EWMAWeight == nil {
+        s.EWMAWeight = def.EWMAWeight
+    }
+    if s.JitterWeight == nil {
+        s.JitterWeight = def.JitterWeight
+    }
+    if s.LossWindow == nil {
+        s.LossWindow = def.LossWindow
+    }
+    if s.LossMinProbes == nil {
+        s.LossMinProbes = def.LossMinProbes
+    }
+    if s.MaxLoss == nil {
+        s.MaxLoss = def.MaxLoss
+    }
+    return s
+}
+
+// Load-triggered scale-out settings, see lca.ScalerConfig
+// Scaling is disabled unless MaxInFlight or LatencyMs is set
+type Scaling struct {
+    // Requests in flight to the service at once that trigger a scale-out
+    MaxInFlight  int
+    // Average service latency over the window that triggers a scale-out,
+    // in milliseconds
+    LatencyMs    int
+    // Sliding window over which latency is averaged, in seconds
+    WindowSecs   int
+    // Minimum requests seen within the window before latency is considered
+    MinRequests  int
+    // Minimum time between scale-out attempts, in seconds
+    CooldownSecs int
+}
+
+// Token bucket rate limit and concurrency limit, 0 means unlimited
+// Fields are pointers so that an override can set 0 to lift a limit it would
+// otherwise inherit, fields left out are nil
+type Limit struct {
+    // Sustained requests per second
+    Rate        *float64
+    // Requests allowed in a burst above Rate, defaults to 1 if Rate is set
+    Burst       *int
+    // Requests allowed in flight at once
+    MaxInFlight *int
+}
+
+// Limits on incoming requests per calling peer, see limiter.Limiter
+type CallerLimits struct {
+    // Limits for callers without an entry in Peers
+    Defaults Limit
+    // Per-caller limits keyed by peer ID, fields left out fall back to those
+    // in Defaults
+    Peers    map[string]Limit
+}
+
+// Fills in any fields l doesn't set from def
+func (l Limit) Or(def Limit) Limit {
+    if l.Rate == nil {
+        l.Rate = def.Rate
+    }
+    if l.Burst == nil {
+        l.Burst = def.Burst
+    }
+    if l.MaxInFlight == nil {
+        l.MaxInFlight = def.MaxInFlight
+    }
+    return l
+}
+
+// Circuit breaker settings, see pcache.BreakerConfig
+type CircuitBreaker struct {
+    // Fraction of failed requests (0 to 1) that opens a peer's breaker
+    ErrorRate      float64
+    // Minimum requests seen before a breaker can open
+    MinRequests    uint
+    // Sliding window over which request outcomes are counted, in seconds
+    WindowSecs     int
+    // How long a breaker stays open before probing the peer, in seconds
+    OpenSecs       int
+    // Successful probes needed to close a breaker again
+    HalfOpenProbes uint
+}
+
+// HTTP proxy request routing, in addition to the default of using the
+// first path segment as the service name
+type Routing struct {
+    // Use the Host header as the service name (virtual hosting)
+    HostHeader   bool
+    // Accept absolute-form URIs and CONNECT, so clients can set HTTP_PROXY
+    ForwardProxy bool
+    // Maps URL path prefixes to service names, longest prefix wins
+    PathPrefixes map[string]string
+}
+
+// Settings for how a proxy talks to a particular service
+type ServiceConfig struct {
+    // Strategy for balancing requests across cached instances of the
+    // service, see pcache.NewBalancer() for valid names
+    Balancer string
+    // Delay in milliseconds before a copy of an idempotent request is sent to
+    // the next-best cached instance, the first response is used and the other
+    // request is cancelled. 0 disables hedging unless HedgePercentile is set.
+    // A pointer so that a service can set 0 to turn off hedging enabled in
+    // Defaults, nil if left out.
+    HedgeDelayMs    *int
+    // Hedge after this percentile (0 to 100) of the service's observed
+    // request latency instead, once enough requests have been seen. Until
+    // then HedgeDelayMs is used, if set. A pointer like HedgeDelayMs.
+    HedgePercentile *float64
+    // Limits on requests this proxy sends to the service
+    Limit           Limit
+    // How cached instances of the service move between peer cache levels
+    PeerScoring     PeerScoring
+}
+
+// Returns the settings for the service servName, filling in any fields it
+// doesn't set from Defaults
+func (c *Config) ForService(servName string) ServiceConfig {
+    sc, ok := c.Services[servName]
+    if !ok {
+        return c.Defaults
+    }
+
+    if sc.Balancer == "" {
+        sc.Balancer = c.Defaults.Balancer
+    }
+    if sc.HedgeDelayMs == nil {
+        sc.HedgeDelayMs = c.Defaults.HedgeDelayMs
+    }
+    if sc.HedgePercentile == nil {
+        sc.HedgePercentile = c.Defaults.HedgePercentile
+    }
+    sc.Limit = sc.Limit.Or(c.Defaults.Limit)
+    sc.PeerScoring = sc.PeerScoring.Or(c.Defaults.PeerScoring)
+    return sc
 }
@@ -13,19 +13,19 @@ import (
     "errors"
     "fmt"
     "io"
-    "log"
     "strings"
     "syscall"
     "time"
 
-    "github.com/PhysarumSM/common/p2putil"
-    "github.com/PhysarumSM/service-registry/registry"
-
     "github.com/libp2p/go-msgio"
-    "github.com/libp2p/go-libp2p/p2p/protocol/ping"
     "github.com/libp2p/go-libp2p-core/network"
     "github.com/libp2p/go-libp2p-core/peer"
     "github.com/libp2p/go-libp2p-core/protocol"
+
+    "github.com/PhysarumSM/service-manager/logging"
+    "github.com/PhysarumSM/service-manager/metrics"
+    "github.com/PhysarumSM/service-manager/pcache"
+    "github.com/PhysarumSM/service-manager/tracing"
 )
 
 var chainSetupProtoID = protocol.ID("/ChainSetup/1.0")
@@ -62,6 +62,9 @@ type ChainMsg struct {
 
     // Arbitrary data that will need further decoding, depending on Type
     Data    []byte
+
+    // W3C traceparent of the span that sent a SetupRequest, empty otherwise
+    TraceParent string
 }
 
 func NewChainError(err error) *ChainMsg {
@@ -175,11 +178,8 @@ func DecodeChainData(msg *ChainMsg) (interface{}, error) {
         msgBytes := msg.Data
         return msgBytes, nil
     default:
-        return nil, fmt.Errorf("ERROR: Unknown chain message type: %d\n")
+        return nil, fmt.Errorf("ERROR: Unknown chain message type: %d\n", msg.Type)
     }
-
-    return nil, fmt.Errorf("ERROR: Should not reach this point... " +
-        "unless some message types are unimplemented\n")
 }
 
 func expectTypePrintErr(cm *ChainMsg, ct ChainMsgType) bool {
@@ -261,8 +261,13 @@ func sendError(cmsr *chainMsgCommunicator, err error) error {
     return nil
 }
 
-func sendSetupRequest(cmsr *chainMsgCommunicator, chainSpec []string) error {
+func sendSetupRequest(cmsr *chainMsgCommunicator, chainSpec []string,
+                        traceParent string) error {
     setupMsg := NewChainSetupRequest(chainSpec)
+    if setupMsg == nil {
+        return fmt.Errorf("Unable to create %s message\n", SetupRequest)
+    }
+    setupMsg.TraceParent = traceParent
     if err := cmsr.Send(setupMsg); err != nil {
         return fmt.Errorf("Attempt to send %s message failed\n%w\n", setupMsg.Type, err)
     }
@@ -270,28 +275,30 @@ func sendSetupRequest(cmsr *chainMsgCommunicator, chainSpec []string) error {
     return nil
 }
 
-func receiveSetupRequest(cmsr *chainMsgCommunicator) ([]string, error) {
+// Waits to receive a ChainMsg and verifies it is of type SetupRequest.
+// Returns the chain spec, and the sender's traceparent (if any).
+func receiveSetupRequest(cmsr *chainMsgCommunicator) ([]string, string, error) {
     msg, err := cmsr.Recv()
     if err != nil {
-        return nil, fmt.Errorf("Unable to receive chain message\n%w\n", err);
+        return nil, "", fmt.Errorf("Unable to receive chain message\n%w\n", err);
     }
 
     if !expectTypePrintErr(msg, SetupRequest) {
-        return nil, fmt.Errorf("Received ChainMsg was not type %s\n", SetupRequest)
+        return nil, "", fmt.Errorf("Received ChainMsg was not type %s\n", SetupRequest)
     }
 
     msgData, err := DecodeChainData(msg)
     if err != nil {
-        return nil, fmt.Errorf("Unable to decode chain message\n%w\n", err)
+        return nil, "", fmt.Errorf("Unable to decode chain message\n%w\n", err)
     }
 
     chainSpec, ok := msgData.([]string)
     if !ok {
-        return nil, fmt.Errorf("Expected data in %s message to be type '[]string', " +
+        return nil, "", fmt.Errorf("Expected data in %s message to be type '[]string', " +
                     "but was type '%T'\n", msg.Type, msgData)
     }
 
-    return chainSpec, nil
+    return chainSpec, msg.TraceParent, nil
 }
 
 // ACK message doesn't need a payload, but an optional string can be used for debugging
@@ -368,7 +375,10 @@ func receiveData(cmsr *chainMsgCommunicator) ([]byte, error) {
     return msgBytes, nil
 }
 
-func fwdStream2Stream(src, dst network.Stream) {
+func fwdStream2Stream(src, dst network.Stream, chain string) {
+    defer trackTunnel()()
+    rx := metrics.BytesForwarded.WithLabelValues(chain, "rx")
+    tx := metrics.BytesForwarded.WithLabelValues(chain, "tx")
     defer func() {
         log.Printf("Closing connection %s <=> %s\n",
             dst.Conn().LocalPeer(), dst.Conn().RemotePeer())
@@ -397,6 +407,7 @@ func fwdStream2Stream(src, dst network.Stream) {
             }
             return
         }
+        rx.Add(float64(len(msgBytes)))
 
         if err = sendData(dstComm, msgBytes); err != nil {
             if errors.Is(err, syscall.EINVAL) {
@@ -408,50 +419,36 @@ func fwdStream2Stream(src, dst network.Stream) {
             }
             return
         }
+        tx.Add(float64(len(msgBytes)))
     }
 }
 
-// TODO: Peer cache already does pings. Perhaps eventually migrate to using
-//       pcache to trigger disconnect events? E.g. Can use a callback function
-//       when a peer is evicted from the cache, or using an event bus.
-//       See: https://github.com/libp2p/go-eventbus
-func connQualMonitor(pid peer.ID, servInfo registry.ServiceInfo, stream network.Stream) {
-    p2pNode := manager.Host
-
-    for {
-        ticker := time.NewTicker(1 * time.Second) // Repeat each second
-
-        // Set timeout based on hard requirement
-        ctx, cancel := context.WithTimeout(p2pNode.Ctx, servInfo.NetworkHardReq.RTT * time.Nanosecond)
-        responseChan := ping.Ping(ctx, p2pNode.Host, pid)
-        result := <-responseChan
-
-        // If peer isn't up or doesn't meet hard requirements, remove it from
-        // the peer cache and terminate the connection underlying the stream
-        perf := p2putil.PerfInd{RTT: result.RTT}
-        if result.RTT == 0 || servInfo.NetworkHardReq.LessThan(perf) {
-            log.Printf("Ping result = %v; killing connection to peer %s\n", result.RTT, pid)
-            peerCache.RemovePeer(pid)
-            stream.Conn().Close()
-            ticker.Stop()
-            cancel()
-            return
-        }
-
-        <-ticker.C // Wait until second is up
-        cancel()
+// Reports the outcome of a chain setup through the peer pid to the peer
+// cache, so the peer is ranked by how long the rest of the chain takes to
+// answer and not just by its ping
+func observeSetup(pid peer.ID, start time.Time, err error) {
+    if err != nil {
+        peerCache.ObserveRequest(pid, 0, pcache.OutcomeFailure)
+        return
     }
+    peerCache.ObserveRequest(pid, time.Since(start), pcache.OutcomeSuccess)
 }
 
 // Function for source (client) proxy to begin chain setup operation
-func setupChain(chainSpec []string) (network.Stream, error) {
+// Each setup starts a new trace, continued by each proxy along the chain
+func setupChain(chainSpec []string) (stream network.Stream, err error) {
+    ctx, span := tracing.Start(context.Background(), tracing.Client, "chain setup")
+    defer func() {
+        span.SetError(err)
+        span.End()
+    }()
+    span.SetAttr("chain", strings.Join(chainSpec, "/"))
+
     if len(chainSpec) < 2 {
         return nil, fmt.Errorf("Chain spec must contain at least two tokens " +
             "(transport protocol and a service name)\n")
     }
 
-    var err error
-
     tpProto := chainSpec[0]
     servName := chainSpec[1]
 
@@ -467,27 +464,33 @@ func setupChain(chainSpec []string) (network.Stream, error) {
     log.Printf("Requested service is: %s\n", servName)
 
     // resolveService() only returns a peer that meets its service quality
-    peerProxyID, servInfo, err := resolveService(servName)
+    peerProxyID, _, err := resolveService(ctx, servName)
     if err != nil {
         err = fmt.Errorf("Unable to resolve service %s\n%w\n", servName, err)
         log.Printf("ERROR: %v", err)
         return nil, err
     }
+    setupStart := time.Now()
+    defer func() {
+        observeSetup(peerProxyID, setupStart, err)
+    }()
 
     // Send chain setup request
-    var stream network.Stream
-    if stream, err = createStream(peerProxyID, chainSetupProtoID); err != nil {
+    if stream, err = createStream(ctx, peerProxyID, chainSetupProtoID); err != nil {
         err = fmt.Errorf("Unable to open stream to peer %s\n%w\n", peerProxyID, err)
         log.Printf("ERROR: %v", err)
         return nil, err
     }
 
-    // Run background goroutine to monitor outgoing connection quality
-    go connQualMonitor(peerProxyID, servInfo, stream)
+    // Tear down the tunnel if the peer cache evicts the peer
+    tunnels.watch(peerProxyID, stream)
 
     sendRecv := NewChainMsgCommunicator(stream)
-    setupReq := NewChainSetupRequest(chainSpec)
-    sendRecv.Send(setupReq)
+    if err = sendSetupRequest(sendRecv, chainSpec, tracing.TraceParent(ctx)); err != nil {
+        log.Printf("ERROR: %v\n", err)
+        stream.Reset()
+        return nil, err
+    }
 
     // TODO: handleMsg() function that uses type switch and
     //       calls other functions to handle specific types
@@ -514,12 +517,21 @@ func chainSetupHandler(stream network.Stream) {
     // Input stream sender/receiver
     inSendRecv := NewChainMsgCommunicator(stream)
 
-    chainSpec, err := receiveSetupRequest(inSendRecv)
+    chainSpec, traceParent, err := receiveSetupRequest(inSendRecv)
     if err != nil {
         log.Printf("ERROR: receiveSetupRequest() failed\n%v\n", err)
         return
     }
 
+    log := log.With(logging.FieldChain, strings.Join(chainSpec, "/"))
+
+    // Continue the trace of whoever sent the request
+    ctx, span := tracing.Start(tracing.WithTraceParent(context.Background(), traceParent),
+                                tracing.Server, "chain setup")
+    defer span.End()
+    span.SetAttr("chain", strings.Join(chainSpec, "/"))
+    span.SetAttr("service", service)
+
     // Find ourself (the service this proxy represents) in the chain, what
     // transport protocol we should be using, and the next service in the
     // (if it exists).
@@ -558,10 +570,10 @@ func chainSetupHandler(stream network.Stream) {
         // Change protocol ID of input stream and invoke proper handler
         if tpProtoThis == "udp" {
             stream.SetProtocol(udpTunnelProtoID)
-            udpEndChainHandler(stream)
+            udpEndChainHandler(stream, strings.Join(chainSpec, "/"))
         } else if tpProtoThis == "tcp" {
             stream.SetProtocol(tcpTunnelProtoID)
-            tcpEndChainHandler(stream)
+            tcpEndChainHandler(stream, strings.Join(chainSpec, "/"))
         } else {
             log.Printf("ERROR: Unknown transport protocol\n")
         }
@@ -573,27 +585,33 @@ func chainSetupHandler(stream network.Stream) {
     // Dial the next service and forward the chain setup message.
     log.Printf("The next service is: %s %s\n", tpProto, nextServ)
     log.Println("Looking for service with name", nextServ, "in hash-lookup")
-    peerProxyID, servInfo, err := resolveService(nextServ)
+    peerProxyID, _, err := resolveService(ctx, nextServ)
     if err != nil {
         log.Printf("ERROR: Unable to resolve service %s\n%v\n", nextServ, err)
+        span.SetError(err)
         return
     }
 
     // Create output stream sender/receiver to next service
+    setupStart := time.Now()
     var outStream network.Stream
-    if outStream, err = createStream(peerProxyID, chainSetupProtoID); err != nil {
+    if outStream, err = createStream(ctx, peerProxyID, chainSetupProtoID); err != nil {
         log.Printf("ERROR: Unable to dial target peer %s\n%v\n", peerProxyID, err)
+        span.SetError(err)
+        observeSetup(peerProxyID, setupStart, err)
         return
     }
 
-    // Run background goroutine to monitor outgoing connection quality
-    go connQualMonitor(peerProxyID, servInfo, stream)
+    // Tear down the tunnel if the peer cache evicts the peer
+    tunnels.watch(peerProxyID, outStream)
 
     // Forward chain setup request
     log.Printf("Middle of chain reached, forwarding SetupRequest...\n")
     outSendRecv := NewChainMsgCommunicator(outStream)
-    if err = sendSetupRequest(outSendRecv, chainSpec); err != nil {
+    if err = sendSetupRequest(outSendRecv, chainSpec, tracing.TraceParent(ctx)); err != nil {
         log.Printf("ERROR: sendSetupRequest() failed\n%v\n", err)
+        span.SetError(err)
+        observeSetup(peerProxyID, setupStart, err)
         return
     }
 
@@ -601,8 +619,11 @@ func chainSetupHandler(stream network.Stream) {
     resMsg, err := receiveSetupACK(outSendRecv)
     if err != nil {
         log.Printf("ERROR: receiveSetupACK() failed\n%v\n", err)
+        span.SetError(err)
+        observeSetup(peerProxyID, setupStart, err)
         return
     }
+    observeSetup(peerProxyID, setupStart, nil)
 
     // NOTE: Passing messages back in the ACK is just for debugging.
     //       Append this service to the ACK data and ACK prev service.
@@ -615,10 +636,10 @@ func chainSetupHandler(stream network.Stream) {
     // Change protocol ID of input & output streams and invoke proper handler
     if tpProtoThis == "udp" {
         outStream.SetProtocol(udpTunnelProtoID)
-        udpMidChainHandler(stream, outStream)
+        udpMidChainHandler(stream, outStream, strings.Join(chainSpec, "/"))
     } else if tpProtoThis == "tcp" {
         outStream.SetProtocol(tcpTunnelProtoID)
-        tcpMidChainHandler(stream, outStream)
+        tcpMidChainHandler(stream, outStream, strings.Join(chainSpec, "/"))
     } else {
         log.Printf("ERROR: Unknown transport protocol\n")
     }
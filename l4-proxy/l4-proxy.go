@@ -5,12 +5,13 @@ import (
     "encoding/json"
     "flag"
     "fmt"
+    "io"
     "io/ioutil"
-    "log"
     "net"
     "net/http"
     "os"
     "strings"
+    "sync"
     "time"
 
     "github.com/libp2p/go-libp2p-core/network"
@@ -21,22 +22,27 @@ import (
     "github.com/multiformats/go-multiaddr"
 
     "github.com/PhysarumSM/common/p2pnode"
-    "github.com/PhysarumSM/common/p2putil"
     "github.com/PhysarumSM/common/util"
 
     "github.com/PhysarumSM/service-registry/registry"
 
+    "github.com/PhysarumSM/service-manager/admin"
+    "github.com/PhysarumSM/service-manager/cachefile"
     "github.com/PhysarumSM/service-manager/conf"
     "github.com/PhysarumSM/service-manager/lca"
+    "github.com/PhysarumSM/service-manager/limiter"
+    "github.com/PhysarumSM/service-manager/logging"
     "github.com/PhysarumSM/service-manager/pcache"
     "github.com/PhysarumSM/service-manager/rcache"
+    "github.com/PhysarumSM/service-manager/resolver"
+    "github.com/PhysarumSM/service-manager/tracing"
+
+    "github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-const defaultKeyFile = "~/.privKeyProxy"
+var log = logging.New("l4-proxy")
 
-func init() {
-    log.SetFlags(log.Ldate | log.Lmicroseconds | log.Lshortfile)
-}
+const defaultKeyFile = "~/.privKeyProxy"
 
 // TODO: Clean this shit up; decrease number of package-scoped variables.
 //       Terrible style and makes things harder to debug / maintain.
@@ -54,7 +60,7 @@ var service string
 var servEndpoint string
 
 // Global LCA Manager instance to handle peer search and allocation
-var manager lca.LCAManager
+var manager *lca.LCAManager
 
 // Global Peer Cache instance to cache connected peers
 var peerCache *pcache.PeerCache
@@ -62,100 +68,22 @@ var peerCache *pcache.PeerCache
 // Global Registry Cache instance to cache service registry info
 var registryCache *rcache.RegistryCache
 
+// Global Resolver instance to find or allocate service instances
+var serviceResolver *resolver.Resolver
+
 // Listens to the listening socket and redirects to remote addr
 type Forwarder struct {
     // Use TCPAddr instead for endpoint addresses?
     ListenAddr  string
+    // TCP listener or UDP socket, closed on shutdown
+    listener    io.Closer
     tcpWorker   func(net.Listener, []string)
     udpWorker   func(*net.UDPConn, []string)
 }
 
 // Maps a remote addr to existing Forwarder for that addr
 var serv2Fwd = make(map[string]Forwarder)
-
-func findOrAllocate(servName string, servInfo registry.ServiceInfo) (peer.ID, error) {
-    var err error
-    var id peer.ID
-    var perf p2putil.PerfInd
-    serviceHash := servInfo.ContentHash
-    dockerHash := servInfo.DockerHash
-
-    // 2. Search for cached instances
-    id, err = peerCache.GetPeer(serviceHash)
-    if err == nil {
-        log.Printf("Found cached peer with ID %s for service %s\n", id, servName)
-    } else {
-        // Search for an instance in the network, allocating a new one if need be.
-        // Maximum of 3 allocation attempts.
-        // TODO: It's totally possible for an allocation attempt to succeed,
-        // but the service takes a long time to come up, leading to subsequent
-        // allocation attempts. This is a future problem to solve.
-        startTime := time.Now()
-        for attempts := 0; attempts < 3 && id == peer.ID(""); attempts++ {
-            if attempts > 0 {
-                log.Printf("Unable to successfully find or allocate, retrying...")
-            }
-
-            // TODO: Always pass perf req into AllocService()
-            //       Need to combine AllocService and AllocBetterService
-            //       Need to obtain perf req from hash-lookup service
-            log.Println("Finding best existing service instance")
-            id, perf, err = manager.FindService(serviceHash)
-            if err != nil {
-                log.Println("Could not find, creating new service instance")
-                _, _, err = manager.AllocService(dockerHash)
-                if err != nil {
-                    log.Println("Service allocation failed\n", err)
-                    continue // Or return error right away?
-                }
-
-                // Re-do FindService() to ensure the new instance is connected
-                // to the network. Sleep 200ms or so to allow the service to
-                // come up. If not found, perform exponential backoff and attempt
-                // to re-find it (max 3 times). If it's still found, there may be
-                // something wrong with it (or it's taking too long to boot).
-                wait := 200 * time.Millisecond
-                time.Sleep(wait)
-                backoff, err := util.NewExpoBackoffAttempts(wait, time.Second, 5)
-                if err != nil {
-                    log.Printf("ERROR: Unable to create ExpoBackoffAttempts\n")
-                }
-                for backoff.Attempt() {
-                    id, perf, err = manager.FindService(serviceHash)
-                    if err == nil {
-                        break
-                    }
-                }
-            } else if servInfo.NetworkSoftReq.LessThan(perf) {
-                log.Printf("Found service's RTT (%s) is greater than requirement (%s)\n",
-                                perf.RTT, servInfo.NetworkSoftReq.RTT)
-                log.Println("Creating new service instance")
-                _, _, err = manager.AllocBetterService(dockerHash, perf)
-                if err != nil {
-                    log.Println("No services able to be created, using previously found peer")
-                }
-            }
-        }
-
-        if err == nil && id != peer.ID("") {
-            // Cache peer information and loop again
-            peerCache.AddPeer(p2putil.PeerInfo{
-                ID: id,
-                ServName: servName,
-                ServHash: serviceHash,
-            })
-
-            elapsedTime := time.Now().Sub(startTime)
-            log.Println("Find/alloc service took:", elapsedTime)
-        }
-    }
-
-    if id == peer.ID("") {
-        return peer.ID(""), fmt.Errorf("Unable to find or allocate service\n")
-    }
-
-    return id, nil
-}
+var fwdMux sync.Mutex
 
 // Returns the components of the URI, excluding the first and last '/'
 func splitURIPath(uriPath string) []string {
@@ -172,10 +100,17 @@ func splitURIPath(uriPath string) []string {
     return res
 }
 
-func createStream(targetPeer peer.ID, proto protocol.ID) (network.Stream, error) {
+// ctx only carries the trace to record the stream opening in
+func createStream(ctx context.Context, targetPeer peer.ID,
+                    proto protocol.ID) (network.Stream, error) {
+    _, span := tracing.Start(ctx, tracing.Internal, "stream open")
+    defer span.End()
+    span.SetAttr("peer.id", targetPeer.Pretty())
+
     p2pNode := manager.Host
     stream, err := p2pNode.Host.NewStream(p2pNode.Ctx, targetPeer, proto)
     if err != nil {
+        span.SetError(err)
         return nil, err
     }
 
@@ -186,20 +121,9 @@ func createStream(targetPeer peer.ID, proto protocol.ID) (network.Stream, error)
 // an appropriate peer that provides that service, allocating a new instance
 // if necessary.
 // Returns the peer's ID, the service's info, and any errors
-func resolveService(servName string) (peer.ID, registry.ServiceInfo, error) {
-    info, err := registryCache.GetOrRequestService(servName)
-    if err != nil {
-        return "", info, fmt.Errorf("ERROR: Hash lookup for service %s failed\n%s\n",
-                                    servName, err)
-    }
-
-    peerProxyID, err := findOrAllocate(servName, info)
-    if err != nil {
-        return "", info, fmt.Errorf("ERROR: Unable to find or allocate service %s (%s)\n%v\n",
-                                    servName, info.ContentHash, err)
-    }
-
-    return peerProxyID, info, nil
+func resolveService(ctx context.Context,
+                    servName string) (peer.ID, registry.ServiceInfo, error) {
+    return serviceResolver.ResolveContext(ctx, servName)
 }
 
 // Handles the setting up proxies to services
@@ -309,6 +233,18 @@ func main() {
     flag.StringVar(&configPath, "configfile", "../conf/conf.json", "Path to configuration file to use")
     var rcacheTTL int
     flag.IntVar(&rcacheTTL, "rcache-ttl", 3600, "Time-to-live in seconds for registry cache entries")
+    var promPort string
+    flag.StringVar(&promPort, "prometheus-port", "",
+        "Port to serve Prometheus metrics on at /metrics, disabled if empty")
+    var adminPort string
+    flag.StringVar(&adminPort, "admin-port", "",
+        "Local port for the admin API to listen on, disabled if empty")
+    var shutdownTimeout int
+    flag.IntVar(&shutdownTimeout, "shutdown-timeout", 30,
+        "Seconds to wait for open tunnels to finish when shutting down")
+    traceFlags := tracing.AddFlags()
+    logFlags := logging.AddFlags()
+    cacheFlags := cachefile.AddFlags()
 
     var keyFlags util.KeyFlags
     var bootstraps *[]multiaddr.Multiaddr
@@ -365,6 +301,15 @@ func main() {
     }
     configFile.Close()
 
+    if err = logFlags.Configure(config.Logging); err != nil {
+        log.Fatalf("ERROR: Invalid logging configuration\n%s\n", err)
+    }
+
+    callerLimiter, err := limiter.NewCallerLimiter(config)
+    if err != nil {
+        log.Fatalf("ERROR: Invalid caller limits\n%s\n", err)
+    }
+
     if len(*bootstraps) == 0 {
         if len(config.Bootstraps) == 0 {
             envBootstraps, err := util.GetEnvBootstraps()
@@ -421,20 +366,124 @@ func main() {
     if err != nil {
         log.Fatalf("ERROR: Unable to create LCA Manager\n%s", err)
     }
+    manager.Limiter = callerLimiter
+
+    // Spans are attributed to the service this proxy represents, if any
+    traceName := "l4-proxy"
+    if mode == "service" {
+        traceName = service
+    }
+    if err = traceFlags.Init(traceName); err != nil {
+        log.Fatalf("ERROR: Unable to start tracing\n%s\n", err)
+    }
+
+    if mode == "service" {
+        scalerConfig, enabled, err := lca.NewScalerConfig(config.Scaling)
+        if err != nil {
+            log.Fatalf("ERROR: Invalid scaling configuration\n%s\n", err)
+        }
+        if enabled {
+            manager.Scaler, err = lca.NewScaler(manager, scalerConfig)
+            if err != nil {
+                log.Fatalf("ERROR: Unable to set up scaling\n%s\n", err)
+            }
+        }
+    }
 
     // Setup registry cache
     registryCache = rcache.NewRegistryCache(manager.Host.Ctx, manager.Host.Host,
         manager.Host.RoutingDiscovery, rcacheTTL)
+    registryCache.Configure(config)
+    manager.Registry = registryCache
 
     // Create peer cache instance and start cache update loop
     log.Println("Launching proxy PeerCache instance")
     peerCache = pcache.NewPeerCache(&manager.Host, registryCache)
-    go peerCache.UpdateCache()
+    if err = peerCache.Configure(config); err != nil {
+        log.Fatalf("ERROR: Invalid peer cache configuration\n%s\n", err)
+    }
+    saveCaches := cacheFlags.Start(peerCache, registryCache)
+    cacheCtx, stopCache := context.WithCancel(manager.Host.Ctx)
+    go peerCache.UpdateCache(cacheCtx)
+    go registryCache.UpdateCache(cacheCtx)
+    cacheEvents, unsubscribe := peerCache.Subscribe(tunnelEventBuffer)
+    tunnels.start(manager.Host.Host.Network(), cacheEvents)
+
+    serviceResolver = resolver.NewResolver(manager, peerCache, registryCache)
+
+    // Setup admin API, on a separate port so it's never exposed by accident
+    var adminHTTPServer *http.Server
+    if adminPort != "" {
+        adminServer := admin.NewServer(serviceResolver)
+        adminServer.AddState("forwarders", forwarderState)
+        log.Println("Starting admin API on 127.0.0.1:" + adminPort)
+        adminHTTPServer = &http.Server{
+            Addr: "127.0.0.1:" + adminPort,
+            Handler: adminServer,
+        }
+        go serve(adminHTTPServer)
+    }
+
+    var promServer *http.Server
+    if promPort != "" {
+        promMux := http.NewServeMux()
+        promMux.Handle("/metrics", promhttp.Handler())
+        log.Println("Starting Prometheus endpoint on :" + promPort)
+        promServer = &http.Server{Addr: ":" + promPort, Handler: promMux}
+        go serve(promServer)
+    }
 
     // Setup HTTP control service
     // This port number must be fixed in order for the proxy to be portable
     // Docker must route this port to an available one externally
     log.Println("Starting HTTP control endpoint on:", ctrlHost + ":" + port)
-    http.HandleFunc("/", requestHandler)
-    log.Fatal(http.ListenAndServe(ctrlHost + ":" + port, nil))
+    ctrlServer := &http.Server{
+        Addr: ctrlHost + ":" + port,
+        Handler: http.HandlerFunc(requestHandler),
+    }
+    go serve(ctrlServer)
+
+    sig := waitForSignal()
+    log.Printf("Got %s, shutting down (send again to force)\n", sig)
+    shutdownCtx, cancel := context.WithTimeout(context.Background(),
+                                        time.Duration(shutdownTimeout) * time.Second)
+    defer cancel()
+
+    // Stop advertising and setting up new tunnels, then let open ones drain
+    manager.StopAdvertising()
+    if err = ctrlServer.Shutdown(shutdownCtx); err != nil {
+        log.Printf("ERROR: Unable to shut down HTTP control endpoint cleanly\n%v\n", err)
+    }
+    closeForwarders()
+    if err = waitForTunnels(shutdownCtx); err != nil {
+        log.Printf("ERROR: Tunnels still open at shutdown, closing them\n%v\n", err)
+    }
+    stopCache()
+    saveCaches()
+    unsubscribe()
+    if adminHTTPServer != nil {
+        adminHTTPServer.Close()
+    }
+    // Closing the node resets any streams still open
+    if err = manager.Shutdown(shutdownCtx); err != nil {
+        log.Printf("ERROR: Unable to shut down LCA Manager cleanly\n%v\n", err)
+    }
+    if promServer != nil {
+        promServer.Close()
+    }
+    if err = tracing.Shutdown(shutdownCtx); err != nil {
+        log.Printf("ERROR: Unable to export remaining trace spans\n%v\n", err)
+    }
+    log.Println("Shutdown complete")
+}
+
+// Returns the listening address of each active forwarder, for the admin API
+func forwarderState() interface{} {
+    fwdMux.Lock()
+    defer fwdMux.Unlock()
+    state := make(map[string]string, len(serv2Fwd))
+    for key, fwd := range serv2Fwd {
+        state[key] = fwd.ListenAddr
+    }
+    return state
 }
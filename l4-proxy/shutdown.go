@@ -0,0 +1,73 @@
+package main
+
+// Graceful shutdown
+// Forwarders stop accepting new connections, and tunnels already set up are
+// given a chance to finish before the node is closed
+
+import (
+    "context"
+    "net/http"
+    "os"
+    "os/signal"
+    "sync/atomic"
+    "syscall"
+    "time"
+)
+
+// Number of forwarding goroutines currently running, across all tunnels
+var activeTunnels int64
+
+// Records a forwarding goroutine as running
+// Use as "defer trackTunnel()()" at the start of the goroutine
+func trackTunnel() func() {
+    atomic.AddInt64(&activeTunnels, 1)
+    return func() {
+        atomic.AddInt64(&activeTunnels, -1)
+    }
+}
+
+// Closes all forwarders' listening sockets so no new tunnels are set up
+func closeForwarders() {
+    fwdMux.Lock()
+    defer fwdMux.Unlock()
+    for key, fwd := range serv2Fwd {
+        log.Printf("Closing forwarder for %s on %s\n", key, fwd.ListenAddr)
+        if err := fwd.listener.Close(); err != nil {
+            log.Printf("ERROR: Unable to close forwarder for %s\n%v\n", key, err)
+        }
+        delete(serv2Fwd, key)
+    }
+}
+
+// Waits for open tunnels to finish, or ctx to expire
+func waitForTunnels(ctx context.Context) error {
+    ticker := time.NewTicker(100 * time.Millisecond)
+    defer ticker.Stop()
+    for atomic.LoadInt64(&activeTunnels) > 0 {
+        select {
+        case <-ctx.Done():
+            return ctx.Err()
+        case <-ticker.C:
+        }
+    }
+    return nil
+}
+
+// Runs an HTTP server until it's shut down
+func serve(server *http.Server) {
+    err := server.ListenAndServe()
+    if err != nil && err != http.ErrServerClosed {
+        log.Printf("ERROR: HTTP server on %s failed\n%v\n", server.Addr, err)
+    }
+}
+
+// Blocks until the process is asked to terminate
+// Further signals are left to their default behaviour, so a second one ends
+// the process right away
+func waitForSignal() os.Signal {
+    sigs := make(chan os.Signal, 1)
+    signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+    sig := <-sigs
+    signal.Stop(sigs)
+    return sig
+}
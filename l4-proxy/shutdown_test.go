@@ -0,0 +1,43 @@
+package main
+
+import (
+    "context"
+    "testing"
+    "time"
+)
+
+func TestWaitForTunnels(t *testing.T) {
+    tests := []struct {
+        name string
+        // Time the tunnel stays open, 0 for no tunnel
+        open    time.Duration
+        timeout time.Duration
+        err     error
+    }{
+        {"no tunnels", 0, time.Second, nil},
+        {"tunnel closes", 150 * time.Millisecond, time.Second, nil},
+        {"tunnel stays open", time.Second, 150 * time.Millisecond, context.DeadlineExceeded},
+    }
+    for _, test := range tests {
+        done := make(chan struct{})
+        if test.open > 0 {
+            untrack := trackTunnel()
+            go func() {
+                time.Sleep(test.open)
+                untrack()
+                close(done)
+            }()
+        } else {
+            close(done)
+        }
+
+        ctx, cancel := context.WithTimeout(context.Background(), test.timeout)
+        err := waitForTunnels(ctx)
+        cancel()
+        if err != test.err {
+            t.Errorf("%s: waitForTunnels() = %v, want %v", test.name, err, test.err)
+        }
+        // Leave no tunnel behind for the next case
+        <-done
+    }
+}
@@ -4,13 +4,14 @@ import (
     "errors"
     "fmt"
     "io"
-    "log"
     "net"
     "strings"
     "syscall"
 
     "github.com/libp2p/go-libp2p-core/network"
     "github.com/libp2p/go-libp2p-core/protocol"
+
+    "github.com/PhysarumSM/service-manager/metrics"
 )
 
 var tcpTunnelProtoID = protocol.ID("/LCATunnelTCP/1.0")
@@ -20,7 +21,9 @@ const MAX_TCP_TUNNEL_PAYLOAD = 0xffff - 20 - 20 // Max uint16 - Min TCP header s
 // TODO: Only difference between this and udpFwdStream2Conn is
 //       the dstAddr param and WriteTo() in the body... can they
 //       be somehow merged?
-func tcpFwdStream2Conn(src network.Stream, dst net.Conn) {
+func tcpFwdStream2Conn(src network.Stream, dst net.Conn, chain string) {
+    defer trackTunnel()()
+    rx := metrics.BytesForwarded.WithLabelValues(chain, "rx")
     // Not shared amongst multiple clients, safe to close upstream connection
     defer func() {
         log.Printf("Closing connection %s <=> %s\n", dst.LocalAddr(), dst.RemoteAddr())
@@ -48,6 +51,7 @@ func tcpFwdStream2Conn(src network.Stream, dst net.Conn) {
         }
 
         nBytes = len(data)
+        rx.Add(float64(nBytes))
         nBytesW = 0
         for nBytesW < nBytes {
             n, err = dst.Write(data)
@@ -67,7 +71,12 @@ func tcpFwdStream2Conn(src network.Stream, dst net.Conn) {
 }
 
 // TODO: This now seems identical to udpFwdConn2Stream... except payload size. Merge the two?
-func tcpFwdConn2Stream(src net.Conn, dst network.Stream) {
+func tcpFwdConn2Stream(src net.Conn, dst network.Stream, chain string) {
+    defer trackTunnel()()
+    // Each TCP tunnel has exactly one of these at each proxy along the chain
+    metrics.ActiveTunnels.WithLabelValues("tcp").Inc()
+    defer metrics.ActiveTunnels.WithLabelValues("tcp").Dec()
+    tx := metrics.BytesForwarded.WithLabelValues(chain, "tx")
     defer func() {
         log.Printf("Closing connection %s <=> %s\n",
             dst.Conn().LocalPeer(), dst.Conn().RemotePeer())
@@ -106,6 +115,7 @@ func tcpFwdConn2Stream(src net.Conn, dst network.Stream) {
             }
             return
         }
+        tx.Add(float64(nBytes))
     }
 }
 
@@ -124,8 +134,9 @@ func tcpFwdConnToServ(lConn net.Conn, chainSpec []string) {
 
     // Forward data in each direction
     // Closing will be done within the tcpFwd* functions
-    go tcpFwdConn2Stream(lConn, rConn)
-    go tcpFwdStream2Conn(rConn, lConn)
+    chain := strings.Join(chainSpec, "/")
+    go tcpFwdConn2Stream(lConn, rConn, chain)
+    go tcpFwdStream2Conn(rConn, lConn, chain)
 }
 
 // Implementation of TCP service proxy. Invoked by the source proxy in the
@@ -140,12 +151,13 @@ func tcpServiceProxy(listen net.Listener, chainSpec []string) {
     for {
         conn, err := listen.Accept()
         if err != nil {
-            if err == syscall.EINVAL {
-                log.Printf("Listener (%s) closed", listen.Addr())
-                break
+            if ne, ok := err.(net.Error); ok && ne.Temporary() {
+                log.Printf("Listener (%s) unable to accept connection\n%v\n", listen.Addr(), err)
+                continue
             }
-            log.Printf("Listener (%s) unable to accept connection\n%v\n", listen.Addr(), err)
-            continue
+            // Listener closed, e.g. on shutdown
+            log.Printf("Listener (%s) closed", listen.Addr())
+            break
         }
 
         // Forward connection
@@ -163,6 +175,8 @@ func tcpServiceProxy(listen net.Listener, chainSpec []string) {
 func openTCPProxy(chainSpec []string) (string, error) {
     var listenAddr string
     serviceKey := strings.Join(chainSpec, "/")
+    fwdMux.Lock()
+    defer fwdMux.Unlock()
     if _, exists := serv2Fwd[serviceKey]; !exists {
         listen, err := net.Listen("tcp", ctrlHost + ":") // automatically choose port
         if err != nil {
@@ -172,6 +186,7 @@ func openTCPProxy(chainSpec []string) (string, error) {
         listenAddr = listen.Addr().String()
         serv2Fwd[serviceKey] = Forwarder {
             ListenAddr: listenAddr,
+            listener: listen,
             tcpWorker: tcpServiceProxy,
         }
         go serv2Fwd[serviceKey].tcpWorker(listen, chainSpec)
@@ -184,7 +199,7 @@ func openTCPProxy(chainSpec []string) (string, error) {
 
 // Handler for tcpTunnelProtoID (i.e. invoked at destination proxy)
 // Make a connection to the local service and forward data to/from it
-func tcpEndChainHandler(stream network.Stream) {
+func tcpEndChainHandler(stream network.Stream, chain string) {
     // Resolve and open connection to destination service
     rAddr, err := net.ResolveTCPAddr("tcp", servEndpoint)
     if err != nil {
@@ -199,11 +214,11 @@ func tcpEndChainHandler(stream network.Stream) {
     }
 
     // Forward data in each direction
-    go tcpFwdStream2Conn(stream, rConn)
-    go tcpFwdConn2Stream(rConn, stream)
+    go tcpFwdStream2Conn(stream, rConn, chain)
+    go tcpFwdConn2Stream(rConn, stream, chain)
 }
 
-func tcpMidChainHandler(inStream, outStream network.Stream) {
+func tcpMidChainHandler(inStream, outStream network.Stream, chain string) {
     // Resolve and open connection to destination service
     rAddr, err := net.ResolveTCPAddr("tcp", servEndpoint)
     if err != nil {
@@ -218,8 +233,8 @@ func tcpMidChainHandler(inStream, outStream network.Stream) {
     }
 
     // Forward data in each direction
-    go tcpFwdStream2Conn(inStream, rConn)
-    go tcpFwdConn2Stream(rConn, outStream)
-    go fwdStream2Stream(outStream, inStream)
+    go tcpFwdStream2Conn(inStream, rConn, chain)
+    go tcpFwdConn2Stream(rConn, outStream, chain)
+    go fwdStream2Stream(outStream, inStream, chain)
 }
 
@@ -0,0 +1,79 @@
+/* Tears down tunnels through peers that the peer cache evicts, relying on
+ * the cache's own probing rather than pinging each tunnel's next hop.
+ */
+
+package main
+
+import (
+    "sync"
+
+    "github.com/libp2p/go-libp2p-core/network"
+    "github.com/libp2p/go-libp2p-core/peer"
+
+    "github.com/PhysarumSM/service-manager/pcache"
+)
+
+// Size of the peer cache event buffer, large enough to ride out a cache
+// update evicting many peers at once
+// Evictions that don't fit are held back by the cache rather than dropped,
+// so no tunnel is left running through an evicted peer
+const tunnelEventBuffer = 256
+
+type tunnelMonitor struct {
+    mux     sync.Mutex
+    // Outgoing tunnel streams by the peer they go to
+    streams map[peer.ID]map[network.Stream]struct{}
+}
+
+var tunnels = tunnelMonitor{streams: make(map[peer.ID]map[network.Stream]struct{})}
+
+// Starts tearing down tunnels through evicted peers until the events channel
+// is closed
+// Streams are forgotten as they close, so only open tunnels are tracked
+func (m *tunnelMonitor) start(node network.Network, events <-chan pcache.Event) {
+    node.Notify(&network.NotifyBundle{ClosedStreamF: m.closedStream})
+    go m.run(events)
+}
+
+// Tracks stream as a tunnel to the peer pid
+func (m *tunnelMonitor) watch(pid peer.ID, stream network.Stream) {
+    m.mux.Lock()
+    defer m.mux.Unlock()
+    if m.streams[pid] == nil {
+        m.streams[pid] = make(map[network.Stream]struct{})
+    }
+    m.streams[pid][stream] = struct{}{}
+}
+
+func (m *tunnelMonitor) closedStream(n network.Network, stream network.Stream) {
+    pid := stream.Conn().RemotePeer()
+    m.mux.Lock()
+    defer m.mux.Unlock()
+    if streams, ok := m.streams[pid]; ok {
+        delete(streams, stream)
+        if len(streams) == 0 {
+            delete(m.streams, pid)
+        }
+    }
+}
+
+func (m *tunnelMonitor) run(events <-chan pcache.Event) {
+    for e := range events {
+        if !e.Unhealthy() {
+            continue
+        }
+
+        m.mux.Lock()
+        streams := m.streams[e.Peer.ID]
+        delete(m.streams, e.Peer.ID)
+        m.mux.Unlock()
+
+        // Terminate the connection underlying each stream, so tunnels
+        // through the peer fail fast and can be set up again elsewhere
+        for stream := range streams {
+            log.Printf("Peer %s evicted (%s); killing tunnel connection\n",
+                        e.Peer.ID, e.Reason)
+            stream.Conn().Close()
+        }
+    }
+}
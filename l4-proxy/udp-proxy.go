@@ -4,7 +4,6 @@ import (
     "errors"
     "fmt"
     "io"
-    "log"
     "net"
     "strings"
     "sync"
@@ -13,6 +12,8 @@ import (
     //"github.com/libp2p/go-msgio"
     "github.com/libp2p/go-libp2p-core/network"
     "github.com/libp2p/go-libp2p-core/protocol"
+
+    "github.com/PhysarumSM/service-manager/metrics"
 )
 
 var udpTunnelProtoID = protocol.ID("/LCATunnelUDP/1.0")
@@ -28,7 +29,13 @@ const MAX_UDP_TUNNEL_PAYLOAD = 0xffff - 8 - 20 // Max uint16 - UDP header size -
 // object requires an extra parameter, dstAddr. If dstAddr is not nil, then
 // consider dst to be type *net.UDPConn and use WriteTo() instead of Write().
 
-func udpFwdStream2Conn(src network.Stream, dst net.Conn, dstAddr net.Addr) {
+func udpFwdStream2Conn(src network.Stream, dst net.Conn, dstAddr net.Addr, chain string) {
+    defer trackTunnel()()
+    // Each UDP tunnel (per client) has exactly one of these at each proxy
+    // along the chain
+    metrics.ActiveTunnels.WithLabelValues("udp").Inc()
+    defer metrics.ActiveTunnels.WithLabelValues("udp").Dec()
+    rx := metrics.BytesForwarded.WithLabelValues(chain, "rx")
     if dstAddr == nil {
         // Not shared amongst multiple clients, safe to close upstream connection
         defer func() {
@@ -58,6 +65,7 @@ func udpFwdStream2Conn(src network.Stream, dst net.Conn, dstAddr net.Addr) {
         }
 
         nBytes = len(data)
+        rx.Add(float64(nBytes))
         nBytesW = 0
         for nBytesW < nBytes {
             if dstAddr != nil {
@@ -80,7 +88,9 @@ func udpFwdStream2Conn(src network.Stream, dst net.Conn, dstAddr net.Addr) {
     }
 }
 
-func udpFwdConn2Stream(src net.Conn, dst network.Stream) {
+func udpFwdConn2Stream(src net.Conn, dst network.Stream, chain string) {
+    defer trackTunnel()()
+    tx := metrics.BytesForwarded.WithLabelValues(chain, "tx")
     defer func() {
         log.Printf("Closing connection %s <=> %s\n",
             dst.Conn().LocalPeer(), dst.Conn().RemotePeer())
@@ -117,6 +127,7 @@ func udpFwdConn2Stream(src net.Conn, dst network.Stream) {
             }
             return
         }
+        tx.Add(float64(nBytes))
     }
 }
 
@@ -128,6 +139,8 @@ func udpServiceProxy(lConn *net.UDPConn, chainSpec []string) {
     }()
 
     var err error
+    chain := strings.Join(chainSpec, "/")
+    tx := metrics.BytesForwarded.WithLabelValues(chain, "tx")
 
     // Since there's no per-client UDP connection object, we'll need to do some
     // manual demultiplexing. Create a separate outgoing P2P stream, wrapped in
@@ -135,6 +148,16 @@ func udpServiceProxy(lConn *net.UDPConn, chainSpec []string) {
     client2ChainComm := make(map[string]*chainMsgCommunicator)
     var mapMtx sync.Mutex
 
+    // UDP has no notion of a client being done, so tear down the clients'
+    // streams along with the listening socket
+    defer func() {
+        mapMtx.Lock()
+        defer mapMtx.Unlock()
+        for _, comm := range client2ChainComm {
+            comm.GetStream().Reset()
+        }
+    }()
+
     // Use callbacks to remove streams from client2ChainComm
     netCBs := network.NotifyBundle{}
     netCBs.ClosedStreamF = func(net network.Network, stream network.Stream) {
@@ -201,7 +224,7 @@ func udpServiceProxy(lConn *net.UDPConn, chainSpec []string) {
             client2ChainComm[from.String()] = dstComm
 
             // Create separate goroutine to handle reverse path
-            go udpFwdStream2Conn(rConn, lConn, from)
+            go udpFwdStream2Conn(rConn, lConn, from, chain)
         }
         mapMtx.Unlock()
 
@@ -239,12 +262,14 @@ func udpServiceProxy(lConn *net.UDPConn, chainSpec []string) {
                 mapMtx.Lock()
                 dstComm = NewChainMsgCommunicator(rConn)
                 client2ChainComm[from.String()] = dstComm
-                go udpFwdStream2Conn(rConn, lConn, from)
+                go udpFwdStream2Conn(rConn, lConn, from, chain)
                 writeRetry = true
                 mapMtx.Unlock()
                 continue
             }
 
+            tx.Add(float64(nBytes))
+
             // This is really shit code that can be easily fixed with a goto...
             break
         }
@@ -256,6 +281,8 @@ func udpServiceProxy(lConn *net.UDPConn, chainSpec []string) {
 func openUDPProxy(chainSpec []string) (string, error) {
     var listenAddr string
     servChainKey := strings.Join(chainSpec, "/")
+    fwdMux.Lock()
+    defer fwdMux.Unlock()
     if _, exists := serv2Fwd[servChainKey]; !exists {
         udpAddr, err := net.ResolveUDPAddr("udp", ctrlHost + ":") // choose port
         if err != nil {
@@ -270,6 +297,7 @@ func openUDPProxy(chainSpec []string) (string, error) {
         listenAddr = lConn.LocalAddr().String()
         serv2Fwd[servChainKey] = Forwarder {
             ListenAddr: listenAddr,
+            listener: lConn,
             udpWorker: udpServiceProxy,
         }
 
@@ -299,7 +327,7 @@ func udpResolveAndDial(endpoint string) (net.Conn, error) {
 
 // Handler for udpTunnelProtoID (i.e. invoked at destination proxy)
 // Make a connection to the local service and forward data to/from it
-func udpEndChainHandler(stream network.Stream) {
+func udpEndChainHandler(stream network.Stream, chain string) {
     log.Printf("Invoked new UDP EndChainHandler\n")
 
     rConn, err := udpResolveAndDial(servEndpoint)
@@ -310,11 +338,11 @@ func udpEndChainHandler(stream network.Stream) {
 
     // Forward data in each direction
     // Closing will be done within udpFwd* functions
-    go udpFwdStream2Conn(stream, rConn, nil)
-    go udpFwdConn2Stream(rConn, stream)
+    go udpFwdStream2Conn(stream, rConn, nil, chain)
+    go udpFwdConn2Stream(rConn, stream, chain)
 }
 
-func udpMidChainHandler(inStream, outStream network.Stream) {
+func udpMidChainHandler(inStream, outStream network.Stream, chain string) {
     log.Printf("Invoked new UDP MidChainHandler\n")
 
     rConn, err := udpResolveAndDial(servEndpoint)
@@ -326,8 +354,8 @@ func udpMidChainHandler(inStream, outStream network.Stream) {
     // Forward data from the inStream to the service, from the service to the
     // outStream, and from the outStream back to inStream.
     // Closing will be done within udpFwd* functions
-    go udpFwdStream2Conn(inStream, rConn, nil)
-    go udpFwdConn2Stream(rConn, outStream)
-    go fwdStream2Stream(outStream, inStream)
+    go udpFwdStream2Conn(inStream, rConn, nil, chain)
+    go udpFwdConn2Stream(rConn, outStream, chain)
+    go fwdStream2Stream(outStream, inStream, chain)
 }
 
@@ -0,0 +1,34 @@
+package lca
+
+// Bookkeeping for the allocator's Prometheus metrics
+// The services map only knows containers by ID, so the image each was
+// started from is remembered here to label the per-image gauge
+
+import (
+    "sync"
+
+    "github.com/PhysarumSM/service-manager/metrics"
+)
+
+// Image of each running container, by container ID
+var containerImages = make(map[string]string)
+var containerImagesMutex sync.Mutex
+
+// Records a newly started container
+func trackContainer(cid string, imageName string) {
+    containerImagesMutex.Lock()
+    defer containerImagesMutex.Unlock()
+    containerImages[cid] = imageName
+    metrics.AllocatorContainers.WithLabelValues(imageName).Inc()
+}
+
+// Records that a container was stopped, for whatever reason
+func untrackContainer(cid string) {
+    containerImagesMutex.Lock()
+    defer containerImagesMutex.Unlock()
+    if imageName, ok := containerImages[cid]; ok {
+        delete(containerImages, cid)
+        metrics.AllocatorContainers.WithLabelValues(imageName).Dec()
+    }
+    metrics.AllocatorContainerIdle.DeleteLabelValues(cid)
+}
@@ -0,0 +1,107 @@
+package lca
+
+import (
+    "fmt"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "testing"
+
+    "github.com/PhysarumSM/service-manager/metrics"
+
+    "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTrackContainer(t *testing.T) {
+    gauge := metrics.AllocatorContainers.WithLabelValues("test-image")
+    before := testutil.ToFloat64(gauge)
+
+    trackContainer("cid1", "test-image")
+    trackContainer("cid2", "test-image")
+    untrackContainer("cid1")
+    // Stopping a container twice, or one that was never tracked, changes
+    // nothing
+    untrackContainer("cid1")
+    untrackContainer("untracked")
+
+    if got := testutil.ToFloat64(gauge) - before; got != 1 {
+        t.Errorf("Containers gauge went up by %v, want 1", got)
+    }
+    untrackContainer("cid2")
+}
+
+// Returns the port of a metrics server answering with body
+func metricsServer(t *testing.T, body string) (*httptest.Server, string) {
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        fmt.Fprintln(w, body)
+    }))
+    u, err := url.Parse(server.URL)
+    if err != nil {
+        t.Fatalf("Unable to parse test server URL: %v", err)
+    }
+    return server, u.Port()
+}
+
+func TestCullMetrics(t *testing.T) {
+    busy, busyPort := metricsServer(t, "5")
+    defer busy.Close()
+    idle, idlePort := metricsServer(t, "120")
+    defer idle.Close()
+    garbled, garbledPort := metricsServer(t, "not a number")
+    defer garbled.Close()
+    // Nothing listens on a port once its listener is closed
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatalf("Listen() failed: %v", err)
+    }
+    _, closedPort, _ := net.SplitHostPort(l.Addr().String())
+    l.Close()
+
+    tests := []struct {
+        port   string
+        cid    string
+        // Why the container is culled, empty if it's kept
+        reason string
+    }{
+        {busyPort, "cid-busy", ""},
+        {idlePort, "cid-idle", "idle"},
+        {garbledPort, "cid-garbled", "conversion_error"},
+        {closedPort, "cid-closed", "unreachable"},
+    }
+    lca := &LCAAllocator{services: make(map[string]string)}
+    before := make(map[string]float64)
+    for _, test := range tests {
+        lca.services[test.port] = test.cid
+        trackContainer(test.cid, "cull-image")
+        if test.reason != "" {
+            before[test.reason] = testutil.ToFloat64(metrics.AllocatorCulls.WithLabelValues(test.reason))
+        }
+    }
+    containers := metrics.AllocatorContainers.WithLabelValues("cull-image")
+    if got := testutil.ToFloat64(containers); got != 4 {
+        t.Fatalf("Containers gauge = %v, want 4", got)
+    }
+
+    lca.CullUnusedServices()
+    for _, test := range tests {
+        _, kept := lca.services[test.port]
+        if kept != (test.reason == "") {
+            t.Errorf("%s: kept %v, want %v", test.cid, kept, test.reason == "")
+        }
+        if test.reason == "" {
+            continue
+        }
+        culls := metrics.AllocatorCulls.WithLabelValues(test.reason)
+        if got := testutil.ToFloat64(culls) - before[test.reason]; got != 1 {
+            t.Errorf("%s: %s culls went up by %v, want 1", test.cid, test.reason, got)
+        }
+    }
+    if got := testutil.ToFloat64(containers); got != 1 {
+        t.Errorf("Containers gauge after culling = %v, want 1", got)
+    }
+    if got := testutil.ToFloat64(metrics.AllocatorContainerIdle.WithLabelValues("cid-busy")); got != 5 {
+        t.Errorf("Idle time of cid-busy = %v, want 5", got)
+    }
+    untrackContainer("cid-busy")
+}
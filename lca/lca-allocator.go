@@ -3,14 +3,15 @@ package lca
 import (
     "bufio"
     "context"
+    "encoding/json"
     "fmt"
     "io/ioutil"
-    "log"
     "net/http"
-    "regexp"
+    "runtime"
     "strconv"
     "strings"
     "sync"
+    "time"
 
     "github.com/libp2p/go-libp2p-core/network"
 
@@ -19,6 +20,8 @@ import (
     "github.com/PhysarumSM/common/p2pnode"
     "github.com/PhysarumSM/common/util"
     "github.com/PhysarumSM/docker-driver/docker_driver"
+
+    "github.com/PhysarumSM/service-manager/metrics"
 )
 
 // Alias for p2pnode.Node for type safety
@@ -34,29 +37,38 @@ type LCAAllocator struct {
 func cmdStartProgram(bootstraps []multiaddr.Multiaddr, sPsk string, imageName string,
          services map[string]string, servicesMutex *sync.Mutex,
          rw *bufio.ReadWriter) string {
+    startTime := time.Now()
     _, err := docker_driver.PullImage(imageName)
     if err != nil {
         log.Println("Error calling Docker PullImage()\n", err)
+        metrics.AllocatorAllocations.WithLabelValues("pull_failure").Inc()
         return LCAPErrAllocFail
     }
+    metrics.AllocatorPullDuration.Observe(time.Since(startTime).Seconds())
+
+    // Failing to get the address to run on is counted as a port failure
     ipAddress, err := util.GetIPAddress()
     if err != nil {
         log.Println("Error getting IP address\n", err)
+        metrics.AllocatorAllocations.WithLabelValues("port_failure").Inc()
         return LCAPErrAllocFail
     }
     pp, err := util.GetFreePort()
     if err != nil {
         log.Println("Error getting free port for proxy\n", err)
+        metrics.AllocatorAllocations.WithLabelValues("port_failure").Inc()
         return LCAPErrAllocFail
     }
     sp, err := util.GetFreePort()
     if err != nil {
         log.Println("Error getting free port for service\n", err)
+        metrics.AllocatorAllocations.WithLabelValues("port_failure").Inc()
         return LCAPErrAllocFail
     }
     mp, err := util.GetFreePort()
     if err != nil {
         log.Println("Error getting free port for service\n", err)
+        metrics.AllocatorAllocations.WithLabelValues("port_failure").Inc()
         return LCAPErrAllocFail
     }
     proxyPort := strconv.Itoa(pp)
@@ -79,11 +91,15 @@ func cmdStartProgram(bootstraps []multiaddr.Multiaddr, sPsk string, imageName st
             "P2P_PSK=" + sPsk,
         },
     }
+    startTime = time.Now()
     cid, err := docker_driver.RunContainer(cfg)
     if err != nil {
         log.Println("Error calling Docker RunContainer()\n", err)
+        metrics.AllocatorAllocations.WithLabelValues("run_failure").Inc()
         return LCAPErrAllocFail
     }
+    metrics.AllocatorStartDuration.Observe(time.Since(startTime).Seconds())
+    metrics.AllocatorAllocations.WithLabelValues("success").Inc()
     err = write(rw, fmt.Sprintf("%s\n", ipAddress + ":" + servicePort))
     if err != nil {
         log.Println("Error writing to buffer\n", err)
@@ -93,12 +109,99 @@ func cmdStartProgram(bootstraps []multiaddr.Multiaddr, sPsk string, imageName st
     servicesMutex.Lock()
     services[metricsPort] = cid
     servicesMutex.Unlock()
+    trackContainer(cid, imageName)
 
     log.Println("Started new service", imageName, "with metric at", metricsPort)
 
     return ""
 }
 
+// Stops and deletes a container started by this allocator
+// Returns the reply to send back
+func cmdStopProgram(cid string, services map[string]string,
+         servicesMutex *sync.Mutex) string {
+    servicesMutex.Lock()
+    defer servicesMutex.Unlock()
+    for metricsPort, c := range services {
+        if c != cid {
+            continue
+        }
+        delete(services, metricsPort)
+        untrackContainer(cid)
+        if _, err := docker_driver.StopContainer(cid); err != nil {
+            log.Println("Error calling Docker StopContainer()\n", err)
+            return LCAPErrStopFail
+        }
+        if _, err := docker_driver.DeleteContainer(cid); err != nil {
+            log.Println("Error calling Docker DeleteContainer()\n", err)
+            return LCAPErrStopFail
+        }
+        log.Println("Stopped service with metrics port", metricsPort, "and cid", cid)
+        return LCAAPReplyOK
+    }
+    return LCAPErrUnknownProgram
+}
+
+// Resources of an allocator's host and the services it's running
+type AllocatorCapacity struct {
+    NumCPU       int
+    // Memory in bytes, 0 if unknown
+    MemTotal     uint64
+    MemAvailable uint64
+    Services     []Service
+}
+
+// Returns the JSON-encoded capacity of this allocator as the reply
+func cmdGetCapacity(services map[string]string, servicesMutex *sync.Mutex) string {
+    capacity := AllocatorCapacity{NumCPU: runtime.NumCPU(), Services: []Service{}}
+    capacity.MemTotal, capacity.MemAvailable = readMemInfo()
+
+    servicesMutex.Lock()
+    for metricsPort, cid := range services {
+        capacity.Services = append(capacity.Services, Service{metricsPort, cid})
+    }
+    servicesMutex.Unlock()
+
+    reply, err := json.Marshal(capacity)
+    if err != nil {
+        log.Println("Error encoding capacity\n", err)
+        return LCAPErrUnrecognized
+    }
+    return string(reply)
+}
+
+// Reads total and available memory from /proc/meminfo
+// Returns zeroes where it's unable to (e.g. not on Linux)
+func readMemInfo() (uint64, uint64) {
+    data, err := ioutil.ReadFile("/proc/meminfo")
+    if err != nil {
+        return 0, 0
+    }
+    return parseMemInfo(string(data))
+}
+
+// Parses total and available memory, in bytes, out of /proc/meminfo's contents
+func parseMemInfo(data string) (uint64, uint64) {
+    var total, avail uint64
+    for _, line := range strings.Split(data, "\n") {
+        fields := strings.Fields(line)
+        if len(fields) < 2 {
+            continue
+        }
+        kb, err := strconv.ParseUint(fields[1], 10, 64)
+        if err != nil {
+            continue
+        }
+        switch fields[0] {
+        case "MemTotal:":
+            total = kb * 1024
+        case "MemAvailable:":
+            avail = kb * 1024
+        }
+    }
+    return total, avail
+}
+
 // Generator function for LCA handler function
 // Used to allow the handler to remember the bootstraps and PSK
 func NewLCAHandler(bootstraps []multiaddr.Multiaddr, sPsk string,
@@ -120,13 +223,17 @@ func NewLCAHandler(bootstraps []multiaddr.Multiaddr, sPsk string,
             return
         }
 
-        r := regexp.MustCompile("(.*?)\\s(.*?)$")
-        match := r.FindStringSubmatch(str)
+        // Commands are of the form "<command> [argument]"
+        tokens := strings.SplitN(str, " ", 2)
+        cmd, arg := tokens[0], ""
+        if len(tokens) == 2 {
+            arg = tokens[1]
+        }
         // Respond to command
-        switch match[1] {
+        switch cmd {
             case LCAAPCmdStartProgram: {
-                imageName := match[2]
-                log.Println("Received command", match[1], "starting image:", match[2])
+                imageName := arg
+                log.Println("Received command", cmd, "starting image:", imageName)
                 result := cmdStartProgram(bootstraps, sPsk,
                           imageName, services, servicesMutex, rw)
                 if result != "" {
@@ -136,6 +243,21 @@ func NewLCAHandler(bootstraps []multiaddr.Multiaddr, sPsk string,
                     }
                 }
             }
+            case LCAAPCmdStopProgram: {
+                log.Println("Received command", cmd, "stopping container:", arg)
+                result := cmdStopProgram(arg, services, servicesMutex)
+                err = write(rw, result)
+                if err != nil {
+                    log.Println("Error writing to buffer\n", err)
+                }
+            }
+            case LCAAPCmdGetCapacity: {
+                log.Println("Received command", cmd)
+                err = write(rw, cmdGetCapacity(services, servicesMutex))
+                if err != nil {
+                    log.Println("Error writing to buffer\n", err)
+                }
+            }
             default: {
                 err = write(rw, LCAPErrUnrecognized)
                 if err != nil {
@@ -207,8 +329,14 @@ type Service struct {
     Cid string
 }
 
+// A service to cull and why, the reason being used as a metric label
+type cullCandidate struct {
+    Service
+    reason string
+}
+
 func (lca *LCAAllocator) CullUnusedServices() {
-    var servicesToCull []Service
+    var servicesToCull []cullCandidate
     lca.servicesMutex.Lock()
     defer lca.servicesMutex.Unlock()
     for metricsPort, cid := range lca.services {
@@ -218,26 +346,31 @@ func (lca *LCAAllocator) CullUnusedServices() {
         }
         if err != nil {
             log.Printf("Adding %s to cull list because resp error\n", cid)
-            servicesToCull = append(servicesToCull, Service{metricsPort, cid})
+            servicesToCull = append(servicesToCull,
+                                cullCandidate{Service{metricsPort, cid}, "unreachable"})
             continue
         }
         body, err := ioutil.ReadAll(resp.Body)
         if err != nil {
             log.Printf("Adding %s to cull list because read error\n", cid)
-            servicesToCull = append(servicesToCull, Service{metricsPort, cid})
+            servicesToCull = append(servicesToCull,
+                                cullCandidate{Service{metricsPort, cid}, "unreachable"})
             continue
         }
         tslsrString := strings.TrimSpace(string(body))
         tslsr, err := strconv.ParseInt(tslsrString, 10, 64)
         if err != nil {
             log.Printf("Adding %s to cull list because conv error\n", cid)
-            servicesToCull = append(servicesToCull, Service{metricsPort, cid})
+            servicesToCull = append(servicesToCull,
+                                cullCandidate{Service{metricsPort, cid}, "conversion_error"})
             continue
         }
+        metrics.AllocatorContainerIdle.WithLabelValues(cid).Set(float64(tslsr))
         if (tslsr > 60) {
             log.Printf("Adding %s to cull list because over time\n", cid)
             log.Printf("Got %d while limit is %d\n", tslsr, 60)
-            servicesToCull = append(servicesToCull, Service{metricsPort, cid})
+            servicesToCull = append(servicesToCull,
+                                cullCandidate{Service{metricsPort, cid}, "idle"})
             continue
         }
     }
@@ -245,6 +378,8 @@ func (lca *LCAAllocator) CullUnusedServices() {
         log.Printf("Culling service with metrics port %s and cid %s\n",
             service.MetricsPort, service.Cid)
         delete(lca.services, service.MetricsPort)
+        untrackContainer(service.Cid)
+        metrics.AllocatorCulls.WithLabelValues(service.reason).Inc()
         docker_driver.StopContainer(service.Cid)
         docker_driver.DeleteContainer(service.Cid)
     }
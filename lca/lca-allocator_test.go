@@ -0,0 +1,61 @@
+package lca
+
+import (
+    "encoding/json"
+    "sync"
+    "testing"
+)
+
+func TestParseMemInfo(t *testing.T) {
+    tests := []struct {
+        name  string
+        data  string
+        total uint64
+        avail uint64
+    }{
+        {
+            "linux",
+            "MemTotal:       16318464 kB\nMemFree:         1234567 kB\n" +
+                "MemAvailable:    8159232 kB\nBuffers:          123456 kB\n",
+            16318464 * 1024, 8159232 * 1024,
+        },
+        {"no available", "MemTotal: 1024 kB\n", 1024 * 1024, 0},
+        {"garbage", "MemTotal: lots\nnonsense\n\n", 0, 0},
+        {"empty", "", 0, 0},
+    }
+    for _, test := range tests {
+        total, avail := parseMemInfo(test.data)
+        if total != test.total || avail != test.avail {
+            t.Errorf("%s: parseMemInfo() = (%d, %d), want (%d, %d)",
+                        test.name, total, avail, test.total, test.avail)
+        }
+    }
+}
+
+func TestCmdGetCapacity(t *testing.T) {
+    var mux sync.Mutex
+    services := map[string]string{"9001": "cid1"}
+    var capacity AllocatorCapacity
+    if err := json.Unmarshal([]byte(cmdGetCapacity(services, &mux)), &capacity); err != nil {
+        t.Fatalf("cmdGetCapacity() reply doesn't parse: %v", err)
+    }
+    if capacity.NumCPU < 1 {
+        t.Errorf("NumCPU = %d, want at least 1", capacity.NumCPU)
+    }
+    want := Service{MetricsPort: "9001", Cid: "cid1"}
+    if len(capacity.Services) != 1 || capacity.Services[0] != want {
+        t.Errorf("Services = %+v, want [%+v]", capacity.Services, want)
+    }
+}
+
+func TestCmdStopUnknownProgram(t *testing.T) {
+    var mux sync.Mutex
+    services := map[string]string{"9001": "cid1"}
+    if reply := cmdStopProgram("other", services, &mux); reply != LCAPErrUnknownProgram {
+        t.Errorf("cmdStopProgram() = %q, want %q", reply, LCAPErrUnknownProgram)
+    }
+    // Containers this allocator didn't start are left alone
+    if len(services) != 1 {
+        t.Errorf("cmdStopProgram() changed services to %v", services)
+    }
+}
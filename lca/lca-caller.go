@@ -0,0 +1,131 @@
+package lca
+
+// Verifying the service a calling proxy claims to represent
+// The claim in HeaderCallerService is only passed on to the backend if the
+// calling peer advertises that service's hash, the same way proxies find
+// instances of a service. Results are cached so only the first request from
+// a caller waits on the lookup.
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "time"
+
+    "github.com/libp2p/go-libp2p-core/peer"
+
+    "github.com/PhysarumSM/service-registry/registry"
+
+    "github.com/PhysarumSM/service-manager/rcache"
+)
+
+const (
+    // How long a verified claim is trusted before it's checked again
+    callerServiceTTL = 5 * time.Minute
+    // How long a claim that didn't check out is rejected without checking
+    // again, so a peer can't make every request cost a DHT lookup
+    callerServiceNegativeTTL = 30 * time.Second
+    // Time allowed for looking up the service's providers
+    callerServiceTimeout = 10 * time.Second
+    // Number of cached claims before expired ones start getting dropped
+    maxCallerServices = 1024
+)
+
+type callerService struct {
+    ok     bool
+    expiry time.Time
+}
+
+// Removes HeaderCallerService from req unless caller advertises that service
+func (lca *LCAManager) verifyCallerService(ctx context.Context, req *http.Request,
+                                            caller peer.ID) {
+    servName := req.Header.Get(HeaderCallerService)
+    if servName == "" {
+        return
+    }
+    if !lca.callerProvides(ctx, caller, servName) {
+        log.Printf("WARNING: Peer %s claims to be service %s but doesn't provide it, " +
+                    "dropping %s\n", caller, servName, HeaderCallerService)
+        req.Header.Del(HeaderCallerService)
+    }
+}
+
+// Returns whether caller advertises the service servName, using the cached
+// answer if there is one
+func (lca *LCAManager) callerProvides(ctx context.Context, caller peer.ID, servName string) bool {
+    key := caller.Pretty() + " " + servName
+    now := time.Now()
+    lca.callerMux.Lock()
+    cached, ok := lca.callerServices[key]
+    lca.callerMux.Unlock()
+    if ok && now.Before(cached.expiry) {
+        return cached.ok
+    }
+
+    check := lca.checkProvider
+    if check == nil {
+        check = lca.advertises
+    }
+    provides, err := check(ctx, caller, servName)
+    if err != nil {
+        // Not necessarily the caller's fault, so the answer isn't cached
+        log.Printf("ERROR: Unable to verify that peer %s provides %s\n%v\n",
+                    caller, servName, err)
+        return false
+    }
+
+    ttl := callerServiceTTL
+    if !provides {
+        ttl = callerServiceNegativeTTL
+    }
+    lca.callerMux.Lock()
+    defer lca.callerMux.Unlock()
+    if lca.callerServices == nil {
+        lca.callerServices = make(map[string]callerService)
+    }
+    if len(lca.callerServices) >= maxCallerServices {
+        for k, c := range lca.callerServices {
+            if now.After(c.expiry) {
+                delete(lca.callerServices, k)
+            }
+        }
+    }
+    lca.callerServices[key] = callerService{ok: provides, expiry: now.Add(ttl)}
+    return provides
+}
+
+// Looks up servName's hash in the registry and whether caller is among the
+// peers advertising it
+func (lca *LCAManager) advertises(ctx context.Context, caller peer.ID,
+                                    servName string) (bool, error) {
+    var info registry.ServiceInfo
+    var err error
+    if lca.Registry != nil {
+        info, err = lca.Registry.GetOrRequestServiceNoTouch(servName)
+        if errors.Is(err, rcache.ErrNotFound) {
+            return false, nil
+        }
+    } else {
+        info, err = registry.GetServiceWithHostRouting(lca.Host.Ctx, lca.Host.Host,
+                                                        lca.Host.RoutingDiscovery, servName)
+    }
+    if err != nil {
+        return false, err
+    }
+
+    ctx, cancel := context.WithTimeout(ctx, callerServiceTimeout)
+    defer cancel()
+    peerChan, err := lca.Host.RoutingDiscovery.FindPeers(ctx, info.ContentHash)
+    if err != nil {
+        return false, err
+    }
+    found := false
+    for p := range peerChan {
+        if p.ID == caller {
+            // Stop the lookup, then drain what it already found
+            found = true
+            cancel()
+        }
+    }
+    return found, nil
+}
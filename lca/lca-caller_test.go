@@ -0,0 +1,82 @@
+package lca
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+
+    "github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestVerifyCallerService(t *testing.T) {
+    tests := []struct {
+        name     string
+        claimed  string
+        provides bool
+        err      error
+        want     string
+        // Checks made for two requests in a row
+        checks   int
+    }{
+        {"no claim", "", false, nil, "", 0},
+        {"provides service", "svc", true, nil, "svc", 1},
+        {"doesn't provide service", "svc", false, nil, "", 1},
+        // Failed checks aren't cached
+        {"check failed", "svc", false, errors.New("unreachable"), "", 2},
+    }
+    for _, test := range tests {
+        checks := 0
+        lca := &LCAManager{}
+        lca.checkProvider = func(ctx context.Context, caller peer.ID,
+                                    servName string) (bool, error) {
+            checks++
+            if caller != peer.ID("caller") || servName != test.claimed {
+                t.Errorf("%s: checked %s for %s, want caller for %s",
+                            test.name, caller, servName, test.claimed)
+            }
+            return test.provides, test.err
+        }
+
+        for i := 0; i < 2; i++ {
+            req := httptest.NewRequest(http.MethodGet, "http://svc/", nil)
+            if test.claimed != "" {
+                req.Header.Set(HeaderCallerService, test.claimed)
+            }
+            lca.verifyCallerService(context.Background(), req, peer.ID("caller"))
+            if got := req.Header.Get(HeaderCallerService); got != test.want {
+                t.Errorf("%s: %s = %q, want %q", test.name, HeaderCallerService, got, test.want)
+            }
+        }
+        if checks != test.checks {
+            t.Errorf("%s: checked %d times, want %d", test.name, checks, test.checks)
+        }
+    }
+}
+
+func TestCallerProvidesPerCaller(t *testing.T) {
+    lca := &LCAManager{}
+    lca.checkProvider = func(ctx context.Context, caller peer.ID,
+                                servName string) (bool, error) {
+        return caller == peer.ID("real") && servName == "svc", nil
+    }
+
+    tests := []struct {
+        caller   peer.ID
+        servName string
+        want     bool
+    }{
+        {peer.ID("real"), "svc", true},
+        // One caller's verified claim doesn't carry over to another
+        {peer.ID("other"), "svc", false},
+        {peer.ID("real"), "other", false},
+        {peer.ID("real"), "svc", true},
+    }
+    for _, test := range tests {
+        if got := lca.callerProvides(context.Background(), test.caller, test.servName); got != test.want {
+            t.Errorf("callerProvides(%s, %s) = %v, want %v",
+                        test.caller, test.servName, got, test.want)
+        }
+    }
+}
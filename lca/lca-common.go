@@ -3,7 +3,6 @@ package lca
 import (
     "bufio"
     _ "errors"
-    "log"
     "strings"
 
     "github.com/libp2p/go-libp2p-core/protocol"
@@ -11,8 +10,11 @@ import (
     "github.com/multiformats/go-multiaddr"
 
     "github.com/PhysarumSM/common/util"
+
+    "github.com/PhysarumSM/service-manager/logging"
 )
 
+var log = logging.New("lca")
 
 // Useful defaults
 var (
@@ -28,6 +30,13 @@ var (
 // Commands
 const (
     LCAAPCmdStartProgram = "start-program"
+    LCAAPCmdStopProgram = "stop-program"
+    LCAAPCmdGetCapacity = "get-capacity"
+)
+
+// Replies
+const (
+    LCAAPReplyOK = "OK"
 )
 
 // Errors
@@ -37,6 +46,8 @@ const (
     LCAPErrUnrecognized = "Error: unrecognized command"
     LCAPErrAllocFail = "Error: allocation failed"
     LCAPErrDeadProgram = "Error: program non-responsive"
+    LCAPErrUnknownProgram = "Error: no such program"
+    LCAPErrStopFail = "Error: stopping program failed"
 )
 
 // Initialize defaults
@@ -54,9 +65,6 @@ func init() {
 
     LCAAllocatorProtocolID = protocol.ID("/LCAAllocator/1.0")
     LCAAllocatorRendezvous = "QmQJRHSU69L6W2SwNiKekpUHbxHPXi57tWGRWJaD5NsRxS"
-
-    // Set up logging defaults
-    log.SetFlags(log.Ldate | log.Lmicroseconds | log.Lshortfile)
 }
 
 func write(rw *bufio.ReadWriter, msg string) error {
@@ -0,0 +1,130 @@
+package lca
+
+// Forwarding headers added to HTTP requests as they pass through proxies
+// Lets backends see who the original caller was, which proxies the request
+// went through, and which service (and libp2p peer) is calling them.
+
+import (
+    "net"
+    "net/http"
+    "strings"
+
+    "github.com/libp2p/go-libp2p-core/peer"
+
+    "github.com/multiformats/go-multiaddr"
+)
+
+// Headers identifying the calling proxy
+//   - HeaderCallerPeerID is set by the receiving (service-side) proxy from
+//     the authenticated libp2p connection, so backends can trust it.
+//   - HeaderCallerService is the service the calling proxy represents. Set
+//     by the calling proxy, and only passed on by the receiving proxy if the
+//     caller advertises that service, see verifyCallerService(). Empty if
+//     the caller is in anonymous mode.
+const (
+    HeaderCallerPeerID = "X-Physarum-Caller-Peer-Id"
+    HeaderCallerService = "X-Physarum-Caller-Service"
+)
+
+// Appends the standard forwarding headers for one proxy hop
+//   - forAddr: address of whoever sent the request to this proxy, may be
+//              empty if unknown (e.g. the request originated in-process)
+//   - by: identifier of this proxy, typically its peer ID
+func AddForwardedHeaders(req *http.Request, forAddr string, by string) {
+    if forAddr != "" {
+        if prior, ok := req.Header["X-Forwarded-For"]; ok {
+            forAddr = strings.Join(prior, ", ") + ", " + forAddr
+        }
+        req.Header.Set("X-Forwarded-For", forAddr)
+    }
+
+    // Host and protocol are those seen by the first proxy, don't overwrite
+    if req.Header.Get("X-Forwarded-Host") == "" && req.Host != "" {
+        req.Header.Set("X-Forwarded-Host", req.Host)
+    }
+    if req.Header.Get("X-Forwarded-Proto") == "" {
+        req.Header.Set("X-Forwarded-Proto", "http")
+    }
+
+    // RFC 7239 Forwarded header, one element per hop
+    elems := []string{}
+    if forAddr != "" {
+        elems = append(elems, "for=" + forwardedNode(lastAddr(forAddr)))
+    }
+    elems = append(elems, "by=" + forwardedNode(by))
+    if req.Host != "" {
+        elems = append(elems, "host=" + quoteIfNeeded(req.Host))
+    }
+    elems = append(elems, "proto=http")
+    req.Header.Add("Forwarded", strings.Join(elems, ";"))
+
+    // RFC 7230 Via header, uses the proxy identifier as pseudonym
+    req.Header.Add("Via", "1.1 " + by)
+}
+
+// Discards any caller identity headers and sets them to identify this proxy
+// Used by the calling proxy before a request leaves over libp2p, so local
+// clients can't impersonate another service.
+func (lca *LCAManager) SetCallerHeaders(req *http.Request) {
+    req.Header.Del(HeaderCallerPeerID)
+    req.Header.Del(HeaderCallerService)
+    req.Header.Set(HeaderCallerPeerID, lca.Host.Host.ID().Pretty())
+    if lca.ServiceName != "" {
+        req.Header.Set(HeaderCallerService, lca.ServiceName)
+    }
+}
+
+// Overwrites the caller's peer ID with the one the request actually came from
+// Used by the service-side proxy; the caller-supplied value is never trusted.
+func setVerifiedCaller(req *http.Request, caller peer.ID) {
+    req.Header.Set(HeaderCallerPeerID, caller.Pretty())
+}
+
+// Returns the IP address of a multiaddr, or "unknown" if it has none
+func multiaddrIP(addr multiaddr.Multiaddr) string {
+    if addr == nil {
+        return "unknown"
+    }
+    if ip, err := addr.ValueForProtocol(multiaddr.P_IP4); err == nil {
+        return ip
+    }
+    if ip, err := addr.ValueForProtocol(multiaddr.P_IP6); err == nil {
+        return ip
+    }
+    return "unknown"
+}
+
+// Returns the last address in a comma-separated X-Forwarded-For style list
+func lastAddr(addrs string) string {
+    tokens := strings.Split(addrs, ",")
+    return strings.TrimSpace(tokens[len(tokens)-1])
+}
+
+// Formats a node for the Forwarded header
+// IPv6 addresses must be bracketed, and peer IDs are "obfuscated" identifiers
+// which must begin with an underscore.
+func forwardedNode(node string) string {
+    if node == "unknown" {
+        return node
+    }
+    if ip := net.ParseIP(node); ip != nil {
+        if ip.To4() == nil {
+            return "\"[" + node + "]\""
+        }
+        return node
+    }
+    if host, port, err := net.SplitHostPort(node); err == nil {
+        if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+            host = "[" + host + "]"
+        }
+        return "\"" + host + ":" + port + "\""
+    }
+    return "_" + node
+}
+
+func quoteIfNeeded(s string) string {
+    if strings.ContainsAny(s, ":[]\" ;,") {
+        return "\"" + strings.ReplaceAll(s, "\"", "\\\"") + "\""
+    }
+    return s
+}
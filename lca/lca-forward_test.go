@@ -0,0 +1,121 @@
+package lca
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "testing"
+)
+
+func TestForwardedNode(t *testing.T) {
+    tests := []struct {
+        node string
+        want string
+    }{
+        {"unknown", "unknown"},
+        {"10.0.0.1", "10.0.0.1"},
+        {"::1", "\"[::1]\""},
+        {"10.0.0.1:8080", "\"10.0.0.1:8080\""},
+        {"[::1]:8080", "\"[::1]:8080\""},
+        {"QmPeer", "_QmPeer"},
+    }
+    for _, test := range tests {
+        if got := forwardedNode(test.node); got != test.want {
+            t.Errorf("forwardedNode(%q) = %q, want %q", test.node, got, test.want)
+        }
+    }
+}
+
+func TestQuoteIfNeeded(t *testing.T) {
+    tests := []struct {
+        s    string
+        want string
+    }{
+        {"example.com", "example.com"},
+        {"example.com:8080", "\"example.com:8080\""},
+        {"a\"b c", "\"a\\\"b c\""},
+    }
+    for _, test := range tests {
+        if got := quoteIfNeeded(test.s); got != test.want {
+            t.Errorf("quoteIfNeeded(%q) = %q, want %q", test.s, got, test.want)
+        }
+    }
+}
+
+func TestLastAddr(t *testing.T) {
+    tests := []struct {
+        addrs string
+        want  string
+    }{
+        {"10.0.0.1", "10.0.0.1"},
+        {"10.0.0.1, 10.0.0.2", "10.0.0.2"},
+        {"10.0.0.1,10.0.0.2 ", "10.0.0.2"},
+    }
+    for _, test := range tests {
+        if got := lastAddr(test.addrs); got != test.want {
+            t.Errorf("lastAddr(%q) = %q, want %q", test.addrs, got, test.want)
+        }
+    }
+}
+
+func TestAddForwardedHeaders(t *testing.T) {
+    tests := []struct {
+        name    string
+        header  http.Header
+        forAddr string
+        want    http.Header
+    }{
+        {
+            name: "first hop",
+            header: http.Header{},
+            forAddr: "10.0.0.1",
+            want: http.Header{
+                "X-Forwarded-For": {"10.0.0.1"},
+                "X-Forwarded-Host": {"svc:8080"},
+                "X-Forwarded-Proto": {"http"},
+                "Forwarded": {"for=10.0.0.1;by=_QmProxy;host=\"svc:8080\";proto=http"},
+                "Via": {"1.1 QmProxy"},
+            },
+        },
+        {
+            name: "second hop",
+            header: http.Header{
+                "X-Forwarded-For": {"10.0.0.1"},
+                "X-Forwarded-Host": {"original"},
+                "X-Forwarded-Proto": {"https"},
+                "Forwarded": {"for=10.0.0.1;by=_QmFirst;host=original;proto=https"},
+                "Via": {"1.1 QmFirst"},
+            },
+            forAddr: "10.0.0.2",
+            want: http.Header{
+                "X-Forwarded-For": {"10.0.0.1, 10.0.0.2"},
+                "X-Forwarded-Host": {"original"},
+                "X-Forwarded-Proto": {"https"},
+                "Forwarded": {
+                    "for=10.0.0.1;by=_QmFirst;host=original;proto=https",
+                    "for=10.0.0.2;by=_QmProxy;host=\"svc:8080\";proto=http",
+                },
+                "Via": {"1.1 QmFirst", "1.1 QmProxy"},
+            },
+        },
+        {
+            name: "in-process caller",
+            header: http.Header{},
+            forAddr: "",
+            want: http.Header{
+                "X-Forwarded-Host": {"svc:8080"},
+                "X-Forwarded-Proto": {"http"},
+                "Forwarded": {"by=_QmProxy;host=\"svc:8080\";proto=http"},
+                "Via": {"1.1 QmProxy"},
+            },
+        },
+    }
+    for _, test := range tests {
+        req := httptest.NewRequest(http.MethodGet, "http://svc:8080/path", nil)
+        req.Header = test.header
+        AddForwardedHeaders(req, test.forAddr, "QmProxy")
+        if !reflect.DeepEqual(req.Header, test.want) {
+            t.Errorf("%s: got headers %v, want %v", test.name, req.Header, test.want)
+        }
+    }
+}
@@ -11,17 +11,25 @@ import (
     "net/http"
     "regexp"
     "runtime/debug"
+    "strconv"
     "strings"
     "sync"
+    "sync/atomic"
     "time"
-    "log"
 
     "github.com/libp2p/go-libp2p-core/network"
     "github.com/libp2p/go-libp2p-core/peer"
+    "github.com/libp2p/go-libp2p-discovery"
 
     "github.com/PhysarumSM/common/p2pnode"
     "github.com/PhysarumSM/common/p2putil"
     "github.com/PhysarumSM/service-registry/registry"
+
+    "github.com/PhysarumSM/service-manager/limiter"
+    "github.com/PhysarumSM/service-manager/pcache"
+    "github.com/PhysarumSM/service-manager/logging"
+    "github.com/PhysarumSM/service-manager/rcache"
+    "github.com/PhysarumSM/service-manager/tracing"
 )
 
 //  for p2pnode.Node and also related
@@ -30,9 +38,32 @@ type LCAManager struct {
     Host       p2pnode.Node
     // Identifier hash for the service this node is responsible for
     P2PHash    string
+    // Human-readable name of the service this node is responsible for
+    // Empty if running in "anonymous mode"
+    ServiceName string
     // Variable to keep track of "time of last serviced request"
     Tolsr time.Time
     TolsrMux sync.Mutex
+    // Docker image hash of the service, used to start more replicas of it
+    // Empty if running in "anonymous mode"
+    DockerHash string
+    // Limits on incoming requests per calling peer, nil for no limits
+    Limiter *limiter.Limiter
+    // Starts replicas of the service when it's overloaded, nil to disable
+    Scaler *Scaler
+    // Used to look up the services callers claim to represent, queries
+    // registry-service directly if nil
+    Registry *rcache.RegistryCache
+
+    // Cancels advertising of the service
+    stopAdvertising context.CancelFunc
+    // Number of requests currently being handled by RequestHandler
+    handling int64
+    // Caller service claims already checked, keyed by peer ID and service
+    callerServices map[string]callerService
+    callerMux      sync.Mutex
+    // Checks a caller service claim, replaced in tests
+    checkProvider  func(ctx context.Context, caller peer.ID, servName string) (bool, error)
 }
 
 // Stub
@@ -174,6 +205,19 @@ func (lca *LCAManager) AllocService(serviceHash string) (peer.ID, p2putil.PerfIn
 //  - Latency to candidate peer
 //  - Any errors
 func (lca *LCAManager) FindService(serviceHash string) (peer.ID, p2putil.PerfInd, error) {
+    peers, err := lca.FindServices(serviceHash)
+    if err != nil {
+        return peer.ID(""), p2putil.PerfInd{}, err
+    }
+
+    return peers[0].ID, peers[0].Perf, nil
+}
+
+// Finds all reachable service instances by pinging other LCA Manager instances
+// Returns:
+//  - Candidate peers sorted by latency, lowest first
+//  - Any errors
+func (lca *LCAManager) FindServices(serviceHash string) ([]p2putil.PeerInfo, error) {
     log.Println("Finding providers for:", serviceHash)
 
     // Setup context
@@ -183,33 +227,78 @@ func (lca *LCAManager) FindService(serviceHash string) (peer.ID, p2putil.PerfInd
     // Find peers
     peerChan, err := lca.Host.RoutingDiscovery.FindPeers(ctx, serviceHash)
     if err != nil {
-        return peer.ID(""), p2putil.PerfInd{}, err
+        return nil, err
     }
 
     peers := p2putil.SortPeers(peerChan, lca.Host)
     if len(peers) > 0 {
-        return peers[0].ID, peers[0].Perf, nil
+        return peers, nil
     }
 
-    return peer.ID(""), p2putil.PerfInd{}, errors.New("Could not find peer offering service")
+    return nil, errors.New("Could not find peer offering service")
 }
 
 // TODO: Move this outside of LCAManager to a more general structure or library?
 //       It's not relevant to controlling the lifecycle of virtual resources.
-func (lca *LCAManager) Request(pid peer.ID, req *http.Request) (*http.Response, error) {
+// The request is aborted if either the node's or the request's context is done
+// The request's trace-context headers are set to continue any trace in its
+// context
+// The request's body is always closed, even if the request fails
+func (lca *LCAManager) Request(pid peer.ID, req *http.Request) (resp *http.Response, err error) {
+    traceCtx, span := tracing.Start(req.Context(), tracing.Client, "p2p request")
+    defer func() {
+        span.SetError(err)
+        if resp != nil {
+            span.SetAttr("http.status_code", strconv.Itoa(resp.StatusCode))
+        }
+        span.End()
+    }()
+    span.SetAttr("peer.id", pid.Pretty())
+    span.SetAttr("http.method", req.Method)
+
     // Setup context
     ctx, cancel := context.WithCancel(lca.Host.Ctx)
     defer cancel()
+    reqCtx := req.Context()
+    go func() {
+        select {
+        case <-reqCtx.Done():
+            cancel()
+        case <-ctx.Done():
+        }
+    }()
 
     log.Println("Attempting to contact peer with pid:", pid)
+    _, streamSpan := tracing.Start(traceCtx, tracing.Internal, "stream open")
     stream, err := lca.Host.Host.NewStream(ctx, pid, LCAManagerRequestProtID)
+    streamSpan.SetError(err)
+    streamSpan.End()
     if err != nil {
+        // req.Write() closes the body otherwise, callers shouldn't have to
+        // tell whether it got that far
+        if req.Body != nil {
+            req.Body.Close()
+        }
+        if reqCtx.Err() != nil {
+            return nil, reqCtx.Err()
+        }
         return nil, errors.New("Error: could not connect to microservice peer")
     }
     defer stream.Reset()
 
+    // Reading from the stream below blocks, reset it to unblock the
+    // reader if the request gets cancelled part way through
+    go func() {
+        <-ctx.Done()
+        stream.Reset()
+    }()
+
+    tracing.Inject(traceCtx, req.Header)
     err = req.Write(stream)
     if err != nil {
+        if reqCtx.Err() != nil {
+            return nil, reqCtx.Err()
+        }
         return nil, errors.New(LCASErrWriteFail)
     }
 
@@ -224,10 +313,13 @@ func (lca *LCAManager) Request(pid peer.ID, req *http.Request) (*http.Response,
     //       fit into a single Response.
     bodyBuf, err := ioutil.ReadAll(stream)
     if err != nil {
+        if reqCtx.Err() != nil {
+            return nil, reqCtx.Err()
+        }
         return nil, fmt.Errorf("Unable to read from stream\n%w\n", err)
     }
     r := bufio.NewReader(bytes.NewBuffer(bodyBuf))
-    resp, err := http.ReadResponse(r, req)
+    resp, err = http.ReadResponse(r, req)
     if err != nil {
         if resp != nil && resp.Body != nil {
             resp.Body.Close()
@@ -238,6 +330,23 @@ func (lca *LCAManager) Request(pid peer.ID, req *http.Request) (*http.Response,
     return resp, nil
 }
 
+// Returns how the outcome of Request() reflects on the peer
+// Transport errors, timeouts, and 5xx responses count as failures. Requests
+// abandoned by the caller, including hedged requests that lost the race,
+// don't count either way since the peer may or may not have been at fault.
+func RequestOutcome(req *http.Request, resp *http.Response, err error) pcache.Outcome {
+    if err != nil {
+        if req.Context().Err() == context.Canceled {
+            return pcache.OutcomeCancelled
+        }
+        return pcache.OutcomeFailure
+    }
+    if resp.StatusCode >= http.StatusInternalServerError {
+        return pcache.OutcomeFailure
+    }
+    return pcache.OutcomeSuccess
+}
+
 // TODO: Finish this function
 // LCAManagerHandler generator function
 // Used to allow the Handler to remember the service address
@@ -245,6 +354,8 @@ func (lca *LCAManager) Request(pid peer.ID, req *http.Request) (*http.Response,
 // that it is still up then sends the service address back to the requester.
 func RequestHandler(address string, lca *LCAManager) func(network.Stream) {
     return func(stream network.Stream) {
+        atomic.AddInt64(&lca.handling, 1)
+        defer atomic.AddInt64(&lca.handling, -1)
         defer stream.Close()
         defer func() {
             // Don't crash the whole program if panic() called
@@ -280,6 +391,34 @@ func RequestHandler(address string, lca *LCAManager) func(network.Stream) {
             panic(err)
         }
 
+        // Record this hop, and who the request came from according to the
+        // libp2p connection (rather than whatever the caller claims)
+        AddForwardedHeaders(req, multiaddrIP(stream.Conn().RemoteMultiaddr()),
+            lca.Host.Host.ID().Pretty())
+        caller := stream.Conn().RemotePeer()
+        setVerifiedCaller(req, caller)
+        lca.verifyCallerService(lca.Host.Ctx, req, caller)
+        log := log.With(logging.FieldPeer, caller.Pretty())
+
+        ctx, span := tracing.Start(tracing.Extract(req.Context(), req.Header),
+                                    tracing.Server, "handle p2p request")
+        defer span.End()
+        span.SetAttr("caller.peer.id", caller.Pretty())
+        span.SetAttr("http.method", req.Method)
+
+        if lca.Limiter != nil {
+            release, wait, ok := lca.Limiter.Acquire(caller.Pretty())
+            if !ok {
+                log.Printf("Rejecting request from %s, over its limits\n", caller)
+                resp := limiter.NewResponse(req, wait)
+                if err = resp.Write(stream); err != nil {
+                    log.Printf("ERROR: Unable to write response\n%v\n", err)
+                }
+                return
+            }
+            defer release()
+        }
+
         // URL.RequestURI() includes path?query (URL.Path only has the path)
         tokens := strings.SplitN(req.URL.RequestURI(), "/", 3)
         log.Println(tokens)
@@ -303,7 +442,22 @@ func RequestHandler(address string, lca *LCAManager) func(network.Stream) {
         log.Println("Proxying request to service, request", req.URL)
         outreq := new(http.Request)
         *outreq = *req
+        var done func()
+        if lca.Scaler != nil {
+            done = lca.Scaler.Begin()
+        }
+        upstreamCtx, upstreamSpan := tracing.Start(ctx, tracing.Client, "upstream round trip")
+        outreq.Header = req.Header.Clone()
+        tracing.Inject(upstreamCtx, outreq.Header)
         resp, err := http.DefaultTransport.RoundTrip(outreq)
+        upstreamSpan.SetError(err)
+        if resp != nil {
+            upstreamSpan.SetAttr("http.status_code", strconv.Itoa(resp.StatusCode))
+        }
+        upstreamSpan.End()
+        if done != nil {
+            done()
+        }
         if resp != nil {
             defer resp.Body.Close()
         }
@@ -357,7 +511,14 @@ func NewLCAManager(ctx context.Context, cfg p2pnode.Config,
             return nil, err
         }
         node.P2PHash = info.ContentHash
-        node.Host.Advertise(node.P2PHash)
+        node.ServiceName = serviceName
+        node.DockerHash = info.DockerHash
+
+        // Advertise under a separate context so advertising can be stopped
+        // ahead of shutting down the node
+        var advCtx context.Context
+        advCtx, node.stopAdvertising = context.WithCancel(node.Host.Ctx)
+        discovery.Advertise(advCtx, node.Host.RoutingDiscovery, node.P2PHash)
     }
 
     return &node, nil
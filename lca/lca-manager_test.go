@@ -0,0 +1,43 @@
+package lca
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+
+    "github.com/PhysarumSM/service-manager/pcache"
+)
+
+func TestRequestOutcome(t *testing.T) {
+    cancelled, cancel := context.WithCancel(context.Background())
+    cancel()
+    expired, cancel := context.WithTimeout(context.Background(), 0)
+    defer cancel()
+
+    tests := []struct {
+        name   string
+        ctx    context.Context
+        status int
+        err    error
+        want   pcache.Outcome
+    }{
+        {"ok", context.Background(), http.StatusOK, nil, pcache.OutcomeSuccess},
+        {"client error", context.Background(), http.StatusNotFound, nil, pcache.OutcomeSuccess},
+        {"server error", context.Background(), http.StatusBadGateway, nil, pcache.OutcomeFailure},
+        {"transport error", context.Background(), 0, errors.New("reset"), pcache.OutcomeFailure},
+        {"timed out", expired, 0, context.DeadlineExceeded, pcache.OutcomeFailure},
+        {"cancelled", cancelled, 0, context.Canceled, pcache.OutcomeCancelled},
+    }
+    for _, test := range tests {
+        req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(test.ctx)
+        var resp *http.Response
+        if test.err == nil {
+            resp = &http.Response{StatusCode: test.status}
+        }
+        if got := RequestOutcome(req, resp, test.err); got != test.want {
+            t.Errorf("%s: RequestOutcome() = %v, want %v", test.name, got, test.want)
+        }
+    }
+}
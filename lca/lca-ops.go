@@ -0,0 +1,93 @@
+package lca
+
+// Operator functions for talking to specific LCA Allocators
+// Used by smctl, but usable by any LCA Manager
+
+import (
+    "bufio"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "strings"
+
+    "github.com/libp2p/go-libp2p-core/peer"
+
+    "github.com/PhysarumSM/common/p2putil"
+)
+
+// Finds all reachable LCA Allocators
+// Returns the allocators sorted by latency, lowest first, and any errors
+func (lca *LCAManager) FindAllocators() ([]p2putil.PeerInfo, error) {
+    ctx, cancel := context.WithCancel(lca.Host.Ctx)
+    defer cancel()
+
+    peerChan, err := lca.Host.RoutingDiscovery.FindPeers(ctx, LCAAllocatorRendezvous)
+    if err != nil {
+        return nil, err
+    }
+
+    peers := p2putil.SortPeers(peerChan, lca.Host)
+    if len(peers) == 0 {
+        return nil, errors.New("Could not find any allocators")
+    }
+    return peers, nil
+}
+
+// Sends a single command to an allocator and returns its reply
+func (lca *LCAManager) allocatorCommand(allocator peer.ID, cmd string) (string, error) {
+    stream, err := lca.Host.Host.NewStream(lca.Host.Ctx, allocator, LCAAllocatorProtocolID)
+    if err != nil {
+        return "", fmt.Errorf("Unable to contact allocator %s\n%w\n", allocator, err)
+    }
+    defer stream.Close()
+
+    rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+    if err = write(rw, cmd); err != nil {
+        stream.Reset()
+        return "", errors.New(LCASErrWriteFail)
+    }
+    reply, err := read(rw)
+    if err != nil {
+        stream.Reset()
+        return "", errors.New(LCASErrReadFail)
+    }
+    if strings.HasPrefix(reply, "Error:") {
+        return "", errors.New(reply)
+    }
+    return reply, nil
+}
+
+// Asks a specific allocator to start an instance of a service
+// Returns the new service's in-container IP:port pair, and any errors
+func (lca *LCAManager) AllocServiceOn(allocator peer.ID, serviceHash string) (string, error) {
+    log.Println("Attempting to contact peer with pid:", allocator)
+    stream, err := lca.Host.Host.NewStream(lca.Host.Ctx, allocator, LCAAllocatorProtocolID)
+    if err != nil {
+        return "", fmt.Errorf("Unable to contact allocator %s\n%w\n", allocator, err)
+    }
+    defer stream.Reset()
+
+    return requestAlloc(stream, serviceHash)
+}
+
+// Asks a specific allocator to stop a container it started
+func (lca *LCAManager) StopServiceOn(allocator peer.ID, cid string) error {
+    _, err := lca.allocatorCommand(allocator,
+                    fmt.Sprintf("%s %s", LCAAPCmdStopProgram, cid))
+    return err
+}
+
+// Gets an allocator's resources and the services it's running
+func (lca *LCAManager) GetCapacity(allocator peer.ID) (AllocatorCapacity, error) {
+    var capacity AllocatorCapacity
+    reply, err := lca.allocatorCommand(allocator, LCAAPCmdGetCapacity)
+    if err != nil {
+        return capacity, err
+    }
+    if err = json.Unmarshal([]byte(reply), &capacity); err != nil {
+        return capacity, fmt.Errorf("Unable to parse capacity from allocator %s\n%w\n",
+                                    allocator, err)
+    }
+    return capacity, nil
+}
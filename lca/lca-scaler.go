@@ -0,0 +1,167 @@
+package lca
+
+// Load-triggered scale-out
+// Tracks concurrency and latency of requests a service proxy sends to its
+// own service, and asks nearby allocators to start another replica when the
+// service looks overloaded
+
+import (
+    "errors"
+    "fmt"
+    "sync"
+    "time"
+
+    "github.com/libp2p/go-libp2p-core/peer"
+
+    "github.com/PhysarumSM/common/p2putil"
+
+    "github.com/PhysarumSM/service-manager/conf"
+)
+
+type ScalerConfig struct {
+    // Requests in flight at once that trigger a scale-out, 0 to ignore
+    MaxInFlight int
+    // Average latency over Window that triggers a scale-out, 0 to ignore
+    Latency     time.Duration
+    // Length of the sliding window that latencies are averaged over
+    Window      time.Duration
+    // Minimum requests within Window before latency is considered
+    MinRequests int
+    // Minimum time between scale-out attempts, successful or not
+    Cooldown    time.Duration
+}
+
+// Converts the configuration file's settings, using defaults for any unset
+// Returns false if scaling isn't enabled
+func NewScalerConfig(cfg conf.Scaling) (ScalerConfig, bool, error) {
+    sc := ScalerConfig{
+        MaxInFlight: cfg.MaxInFlight,
+        Latency: time.Duration(cfg.LatencyMs) * time.Millisecond,
+        Window: 30 * time.Second,
+        MinRequests: 10,
+        Cooldown: 60 * time.Second,
+    }
+    if cfg.WindowSecs != 0 {
+        sc.Window = time.Duration(cfg.WindowSecs) * time.Second
+    }
+    if cfg.MinRequests != 0 {
+        sc.MinRequests = cfg.MinRequests
+    }
+    if cfg.CooldownSecs != 0 {
+        sc.Cooldown = time.Duration(cfg.CooldownSecs) * time.Second
+    }
+
+    if sc.MaxInFlight < 0 || sc.Latency < 0 || sc.Window < 0 ||
+            sc.MinRequests < 0 || sc.Cooldown < 0 {
+        return sc, false, fmt.Errorf("Scaling settings must not be negative")
+    }
+    return sc, sc.MaxInFlight > 0 || sc.Latency > 0, nil
+}
+
+type latencySample struct {
+    when    time.Time
+    latency time.Duration
+}
+
+type Scaler struct {
+    cfg       ScalerConfig
+    lca       *LCAManager
+    inflight  int
+    // Latencies within the sliding window, oldest first
+    samples   []latencySample
+    // Sum of latencies in samples
+    total     time.Duration
+    lastScale time.Time
+    scaling   bool
+    mux       sync.Mutex
+    // Starts a replica, lca.AllocService unless replaced by tests
+    alloc     func(serviceHash string) (peer.ID, p2putil.PerfInd, error)
+}
+
+// Creates a Scaler that replicates the service lca is responsible for
+func NewScaler(lca *LCAManager, cfg ScalerConfig) (*Scaler, error) {
+    if lca.DockerHash == "" {
+        return nil, errors.New("Scaling requires a service to replicate")
+    }
+    return &Scaler{cfg: cfg, lca: lca, alloc: lca.AllocService}, nil
+}
+
+// Records the start of a request to the service
+// The returned function must be called once the service has responded
+func (s *Scaler) Begin() func() {
+    start := time.Now()
+    s.mux.Lock()
+    s.inflight++
+    overloaded := s.cfg.MaxInFlight > 0 && s.inflight > s.cfg.MaxInFlight
+    if overloaded {
+        s.scaleOutLocked(fmt.Sprintf("%d requests in flight", s.inflight))
+    }
+    s.mux.Unlock()
+
+    var once sync.Once
+    return func() {
+        once.Do(func() {
+            s.end(start)
+        })
+    }
+}
+
+func (s *Scaler) end(start time.Time) {
+    now := time.Now()
+    s.mux.Lock()
+    defer s.mux.Unlock()
+    s.inflight--
+    if s.cfg.Latency == 0 {
+        return
+    }
+
+    latency := now.Sub(start)
+    s.samples = append(s.samples, latencySample{when: now, latency: latency})
+    s.total += latency
+    i := 0
+    for i < len(s.samples) && now.Sub(s.samples[i].when) > s.cfg.Window {
+        s.total -= s.samples[i].latency
+        i++
+    }
+    s.samples = s.samples[i:]
+
+    if len(s.samples) >= s.cfg.MinRequests && len(s.samples) > 0 {
+        avg := s.total / time.Duration(len(s.samples))
+        if avg > s.cfg.Latency {
+            s.scaleOutLocked(fmt.Sprintf("average latency %s", avg))
+        }
+    }
+}
+
+// Starts another replica in the background, unless one is already being
+// started or the cooldown hasn't passed
+// Must be called with s.mux held
+func (s *Scaler) scaleOutLocked(reason string) {
+    if s.scaling || time.Since(s.lastScale) < s.cfg.Cooldown {
+        return
+    }
+    s.scaling = true
+    s.lastScale = time.Now()
+
+    log.Printf("Service %s overloaded (%s), requesting another replica\n",
+                s.lca.ServiceName, reason)
+    go func() {
+        id, _, err := s.alloc(s.lca.DockerHash)
+        if err != nil {
+            log.Printf("ERROR: Unable to scale out service %s\n%v\n",
+                        s.lca.ServiceName, err)
+        } else {
+            log.Printf("Allocator %s started another replica of %s\n",
+                        id, s.lca.ServiceName)
+        }
+
+        s.mux.Lock()
+        defer s.mux.Unlock()
+        s.scaling = false
+        // Start the cooldown from when the replica came up, and judge
+        // latency afresh now that load will be shared
+        s.lastScale = time.Now()
+        s.samples = s.samples[:0]
+        s.total = 0
+    }()
+}
@@ -0,0 +1,175 @@
+package lca
+
+import (
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/libp2p/go-libp2p-core/peer"
+
+    "github.com/PhysarumSM/common/p2putil"
+
+    "github.com/PhysarumSM/service-manager/conf"
+)
+
+// Returns a Scaler that counts scale-outs instead of allocating replicas
+func newTestScaler(t *testing.T, cfg ScalerConfig) (*Scaler, func() int) {
+    s, err := NewScaler(&LCAManager{ServiceName: "svc", DockerHash: "svc"}, cfg)
+    if err != nil {
+        t.Fatalf("NewScaler() failed: %v", err)
+    }
+    var mux sync.Mutex
+    allocs := 0
+    s.alloc = func(serviceHash string) (peer.ID, p2putil.PerfInd, error) {
+        mux.Lock()
+        allocs++
+        mux.Unlock()
+        return peer.ID("allocator"), p2putil.PerfInd{}, nil
+    }
+    count := func() int {
+        // Waits for any scale-out under way to finish
+        deadline := time.Now().Add(time.Second)
+        for {
+            s.mux.Lock()
+            scaling := s.scaling
+            s.mux.Unlock()
+            if !scaling {
+                break
+            }
+            if time.Now().After(deadline) {
+                t.Fatalf("Scale-out still under way")
+            }
+            time.Sleep(time.Millisecond)
+        }
+        mux.Lock()
+        defer mux.Unlock()
+        return allocs
+    }
+    return s, count
+}
+
+func TestNewScalerConfig(t *testing.T) {
+    tests := []struct {
+        name    string
+        cfg     conf.Scaling
+        want    ScalerConfig
+        enabled bool
+        err     bool
+    }{
+        {
+            "off",
+            conf.Scaling{},
+            ScalerConfig{Window: 30 * time.Second, MinRequests: 10, Cooldown: time.Minute},
+            false, false,
+        },
+        {
+            "in flight",
+            conf.Scaling{MaxInFlight: 5},
+            ScalerConfig{MaxInFlight: 5, Window: 30 * time.Second, MinRequests: 10,
+                        Cooldown: time.Minute},
+            true, false,
+        },
+        {
+            "latency",
+            conf.Scaling{LatencyMs: 200, WindowSecs: 10, MinRequests: 3, CooldownSecs: 5},
+            ScalerConfig{Latency: 200 * time.Millisecond, Window: 10 * time.Second,
+                        MinRequests: 3, Cooldown: 5 * time.Second},
+            true, false,
+        },
+        {"negative", conf.Scaling{MaxInFlight: -1}, ScalerConfig{}, false, true},
+    }
+    for _, test := range tests {
+        sc, enabled, err := NewScalerConfig(test.cfg)
+        if (err != nil) != test.err {
+            t.Errorf("%s: NewScalerConfig() error = %v, want error %v", test.name, err, test.err)
+            continue
+        }
+        if err != nil {
+            continue
+        }
+        if sc != test.want || enabled != test.enabled {
+            t.Errorf("%s: NewScalerConfig() = (%+v, %v), want (%+v, %v)",
+                        test.name, sc, enabled, test.want, test.enabled)
+        }
+    }
+}
+
+func TestScalerInFlight(t *testing.T) {
+    s, allocs := newTestScaler(t, ScalerConfig{MaxInFlight: 2})
+    var ends []func()
+    for i := 0; i < 2; i++ {
+        ends = append(ends, s.Begin())
+    }
+    if n := allocs(); n != 0 {
+        t.Errorf("Scaled out %d times at the limit, want 0", n)
+    }
+    ends = append(ends, s.Begin())
+    if n := allocs(); n != 1 {
+        t.Errorf("Scaled out %d times over the limit, want 1", n)
+    }
+
+    // Ending a request more than once only counts it once
+    for _, end := range ends {
+        end()
+        end()
+    }
+    s.mux.Lock()
+    inflight := s.inflight
+    s.mux.Unlock()
+    if inflight != 0 {
+        t.Errorf("%d requests in flight after all ended, want 0", inflight)
+    }
+}
+
+func TestScalerLatency(t *testing.T) {
+    tests := []struct {
+        name      string
+        latencies []time.Duration
+        allocs    int
+    }{
+        {"too few requests", []time.Duration{time.Second, time.Second}, 0},
+        {"fast enough", []time.Duration{50 * time.Millisecond, 50 * time.Millisecond,
+                                        150 * time.Millisecond}, 0},
+        {"too slow", []time.Duration{50 * time.Millisecond, 200 * time.Millisecond,
+                                    200 * time.Millisecond}, 1},
+    }
+    for _, test := range tests {
+        s, allocs := newTestScaler(t, ScalerConfig{
+            Latency: 100 * time.Millisecond,
+            Window: time.Minute,
+            MinRequests: 3,
+        })
+        for _, latency := range test.latencies {
+            s.mux.Lock()
+            s.inflight++
+            s.mux.Unlock()
+            s.end(time.Now().Add(-latency))
+        }
+        if n := allocs(); n != test.allocs {
+            t.Errorf("%s: scaled out %d times, want %d", test.name, n, test.allocs)
+        }
+    }
+}
+
+func TestScalerCooldown(t *testing.T) {
+    s, allocs := newTestScaler(t, ScalerConfig{MaxInFlight: 1, Cooldown: time.Minute})
+    overload := func() {
+        first, second := s.Begin(), s.Begin()
+        first()
+        second()
+    }
+
+    overload()
+    overload()
+    if n := allocs(); n != 1 {
+        t.Errorf("Scaled out %d times within the cooldown, want 1", n)
+    }
+
+    s.mux.Lock()
+    s.lastScale = time.Now().Add(-2 * time.Minute)
+    s.mux.Unlock()
+    overload()
+    if n := allocs(); n != 2 {
+        t.Errorf("Scaled out %d times after the cooldown, want 2", n)
+    }
+}
@@ -0,0 +1,108 @@
+package lca
+
+// Graceful shutdown of LCA Managers and Allocators
+
+import (
+    "context"
+    "sync/atomic"
+    "time"
+
+    "github.com/PhysarumSM/common/p2pnode"
+    "github.com/PhysarumSM/docker-driver/docker_driver"
+)
+
+// How often to check whether in-flight requests have finished
+const drainPollInterval = 100 * time.Millisecond
+
+// Stops advertising the service this node is responsible for, so clients
+// stop finding it once existing DHT records expire
+// Does nothing in "anonymous mode"
+func (lca *LCAManager) StopAdvertising() {
+    if lca.stopAdvertising != nil {
+        log.Printf("Stopping advertisement of service %s\n", lca.ServiceName)
+        lca.stopAdvertising()
+    }
+}
+
+// Stops advertising, stops accepting new requests, and waits for requests
+// already being handled to finish before closing the node
+// If ctx expires first, the node is closed anyway and ctx's error returned
+func (lca *LCAManager) Shutdown(ctx context.Context) error {
+    lca.StopAdvertising()
+    lca.Host.Host.RemoveStreamHandler(LCAManagerRequestProtID)
+
+    err := waitUntil(ctx, func() bool {
+        return atomic.LoadInt64(&lca.handling) == 0
+    })
+    if err != nil {
+        log.Printf("ERROR: Requests still in flight at shutdown\n%v\n", err)
+    }
+
+    if cerr := closeNode(&lca.Host); cerr != nil && err == nil {
+        err = cerr
+    }
+    return err
+}
+
+// Stops accepting allocation requests and closes the node
+// If stopServices is set, services started by this allocator are stopped as
+// well. Otherwise they're left running, since each one has its own proxy and
+// keeps serving clients without the allocator.
+func (lca *LCAAllocator) Shutdown(stopServices bool) error {
+    lca.Host.Host.RemoveStreamHandler(LCAAllocatorProtocolID)
+
+    if stopServices {
+        lca.StopServices()
+    } else {
+        lca.servicesMutex.Lock()
+        for metricsPort, cid := range lca.services {
+            log.Printf("Leaving service with metrics port %s and cid %s running\n",
+                metricsPort, cid)
+        }
+        lca.servicesMutex.Unlock()
+    }
+
+    return closeNode(&lca.Host)
+}
+
+// Stops and deletes all services started by this allocator
+func (lca *LCAAllocator) StopServices() {
+    lca.servicesMutex.Lock()
+    defer lca.servicesMutex.Unlock()
+    for metricsPort, cid := range lca.services {
+        log.Printf("Stopping service with metrics port %s and cid %s\n",
+            metricsPort, cid)
+        delete(lca.services, metricsPort)
+        untrackContainer(cid)
+        if _, err := docker_driver.StopContainer(cid); err != nil {
+            log.Printf("ERROR: Unable to stop container %s\n%v\n", cid, err)
+        }
+        if _, err := docker_driver.DeleteContainer(cid); err != nil {
+            log.Printf("ERROR: Unable to delete container %s\n%v\n", cid, err)
+        }
+    }
+}
+
+// Cancels the node's context, stopping any remaining advertisements, and
+// closes its DHT and host
+func closeNode(node *p2pnode.Node) error {
+    node.Close()
+    if err := node.DHT.Close(); err != nil {
+        log.Printf("ERROR: Unable to close DHT\n%v\n", err)
+    }
+    return node.Host.Close()
+}
+
+// Polls done until it returns true or ctx expires
+func waitUntil(ctx context.Context, done func() bool) error {
+    ticker := time.NewTicker(drainPollInterval)
+    defer ticker.Stop()
+    for !done() {
+        select {
+        case <-ctx.Done():
+            return ctx.Err()
+        case <-ticker.C:
+        }
+    }
+    return nil
+}
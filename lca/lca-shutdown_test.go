@@ -0,0 +1,37 @@
+package lca
+
+import (
+    "context"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+func TestWaitUntil(t *testing.T) {
+    tests := []struct {
+        name string
+        // Polls after which done returns true, -1 for never
+        polls   int64
+        timeout time.Duration
+        err     error
+    }{
+        {"already done", 0, time.Second, nil},
+        {"done after a few polls", 2, time.Second, nil},
+        {"never done", -1, 3 * drainPollInterval, context.DeadlineExceeded},
+    }
+    for _, test := range tests {
+        ctx, cancel := context.WithTimeout(context.Background(), test.timeout)
+        var calls int64
+        err := waitUntil(ctx, func() bool {
+            n := atomic.AddInt64(&calls, 1) - 1
+            return test.polls >= 0 && n >= test.polls
+        })
+        cancel()
+        if err != test.err {
+            t.Errorf("%s: waitUntil() = %v, want %v", test.name, err, test.err)
+        }
+        if test.polls >= 0 && calls != test.polls+1 {
+            t.Errorf("%s: done called %d times, want %d", test.name, calls, test.polls+1)
+        }
+    }
+}
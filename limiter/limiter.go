@@ -0,0 +1,225 @@
+package limiter
+
+// Token bucket rate limits and max-in-flight limits, keyed by string
+// The HTTP proxy keys on target service name, and the service proxy's
+// request handler keys on the calling peer's ID
+
+import (
+    "fmt"
+    "io/ioutil"
+    "math"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/PhysarumSM/service-manager/conf"
+)
+
+const (
+    // Number of keys tracked before idle ones start getting dropped
+    maxIdleKeys = 1024
+    // Minimum time between sweeps for idle keys
+    sweepInterval = time.Minute
+)
+
+type Limiter struct {
+    def       Limit
+    overrides map[string]Limit
+
+    entries   map[string]*entry
+    lastSweep time.Time
+    mux       sync.Mutex
+}
+
+// Limits applied to a key, 0 means unlimited
+type Limit struct {
+    // Sustained requests per second
+    Rate        float64
+    // Requests allowed in a burst above Rate, at least 1
+    Burst       int
+    // Requests allowed in flight at once
+    MaxInFlight int
+}
+
+// Limit state for a single key
+type entry struct {
+    limit    Limit
+    tokens   float64
+    last     time.Time
+    inflight int
+}
+
+// Creates a Limiter applying def to every key, except those in overrides
+// Fields left out of an override fall back to those in def, an override can
+// set 0 to lift a limit in def
+func NewLimiter(def conf.Limit, overrides map[string]conf.Limit) (*Limiter, error) {
+    lim := &Limiter{
+        overrides: make(map[string]Limit),
+        entries: make(map[string]*entry),
+        lastSweep: time.Now(),
+    }
+    var err error
+    if lim.def, err = NewLimit(def); err != nil {
+        return nil, err
+    }
+    for key, l := range overrides {
+        if lim.overrides[key], err = NewLimit(l.Or(def)); err != nil {
+            return nil, fmt.Errorf("%s: %w", key, err)
+        }
+    }
+    return lim, nil
+}
+
+// Creates a Limiter for outgoing requests keyed by service name
+func NewServiceLimiter(config conf.Config) (*Limiter, error) {
+    overrides := make(map[string]conf.Limit)
+    for servName, sc := range config.Services {
+        overrides[servName] = sc.Limit
+    }
+    return NewLimiter(config.Defaults.Limit, overrides)
+}
+
+// Creates a Limiter for incoming requests keyed by calling peer ID
+func NewCallerLimiter(config conf.Config) (*Limiter, error) {
+    return NewLimiter(config.CallerLimits.Defaults, config.CallerLimits.Peers)
+}
+
+// Converts the configuration file's limits, leaving any unset unlimited
+func NewLimit(cfg conf.Limit) (Limit, error) {
+    var l Limit
+    if cfg.Rate != nil {
+        l.Rate = *cfg.Rate
+    }
+    if cfg.Burst != nil {
+        l.Burst = *cfg.Burst
+    }
+    if cfg.MaxInFlight != nil {
+        l.MaxInFlight = *cfg.MaxInFlight
+    }
+    if l.Rate < 0 || l.Burst < 0 || l.MaxInFlight < 0 {
+        return l, fmt.Errorf("Limits must not be negative")
+    }
+    if l.Burst < 1 {
+        l.Burst = 1
+    }
+    return l, nil
+}
+
+// Returns the limits that apply to key
+func (lim *Limiter) Limit(key string) Limit {
+    l, ok := lim.overrides[key]
+    if !ok {
+        return lim.def
+    }
+    return l
+}
+
+// Reserves a slot for a request under key
+// If allowed, the returned function must be called once the request is done.
+// If not, returns false and how long the caller should wait before retrying.
+func (lim *Limiter) Acquire(key string) (func(), time.Duration, bool) {
+    limit := lim.Limit(key)
+    if limit.Rate == 0 && limit.MaxInFlight == 0 {
+        return func() {}, 0, true
+    }
+
+    lim.mux.Lock()
+    defer lim.mux.Unlock()
+    now := time.Now()
+    lim.sweepLocked(now)
+
+    e, ok := lim.entries[key]
+    if !ok {
+        e = &entry{limit: limit, tokens: float64(limit.Burst), last: now}
+        lim.entries[key] = e
+    }
+
+    if limit.MaxInFlight > 0 && e.inflight >= limit.MaxInFlight {
+        // No telling when a request will finish, suggest trying again shortly
+        return nil, time.Second, false
+    }
+
+    if limit.Rate > 0 {
+        e.refill(now)
+        if e.tokens < 1 {
+            wait := time.Duration((1 - e.tokens) / limit.Rate * float64(time.Second))
+            return nil, wait, false
+        }
+        e.tokens--
+    }
+
+    e.inflight++
+    var once sync.Once
+    release := func() {
+        once.Do(func() {
+            lim.mux.Lock()
+            defer lim.mux.Unlock()
+            e.inflight--
+        })
+    }
+    return release, 0, true
+}
+
+// Adds the tokens accumulated since the bucket was last refilled
+func (e *entry) refill(now time.Time) {
+    e.tokens += now.Sub(e.last).Seconds() * e.limit.Rate
+    if max := float64(e.limit.Burst); e.tokens > max {
+        e.tokens = max
+    }
+    e.last = now
+}
+
+// Drops keys with nothing in flight and a full bucket, as they would behave
+// the same as a fresh entry
+// Must be called with lim.mux held
+func (lim *Limiter) sweepLocked(now time.Time) {
+    if len(lim.entries) < maxIdleKeys || now.Sub(lim.lastSweep) < sweepInterval {
+        return
+    }
+    lim.lastSweep = now
+
+    for key, e := range lim.entries {
+        if e.inflight > 0 {
+            continue
+        }
+        if e.limit.Rate > 0 {
+            e.refill(now)
+            if e.tokens < float64(e.limit.Burst) {
+                continue
+            }
+        }
+        delete(lim.entries, key)
+    }
+}
+
+// Returns the value for a Retry-After header, in whole seconds (at least 1)
+func RetryAfter(wait time.Duration) string {
+    secs := int64(math.Ceil(wait.Seconds()))
+    if secs < 1 {
+        secs = 1
+    }
+    return strconv.FormatInt(secs, 10)
+}
+
+// Builds a 429 Too Many Requests response for req
+func NewResponse(req *http.Request, wait time.Duration) *http.Response {
+    body := fmt.Sprintf("%d %s\n", http.StatusTooManyRequests,
+                        http.StatusText(http.StatusTooManyRequests))
+    return &http.Response{
+        StatusCode: http.StatusTooManyRequests,
+        Status: fmt.Sprintf("%d %s", http.StatusTooManyRequests,
+                            http.StatusText(http.StatusTooManyRequests)),
+        Proto: "HTTP/1.1",
+        ProtoMajor: 1,
+        ProtoMinor: 1,
+        Header: http.Header{
+            "Content-Type": {"text/plain; charset=utf-8"},
+            "Retry-After": {RetryAfter(wait)},
+        },
+        Body: ioutil.NopCloser(strings.NewReader(body)),
+        ContentLength: int64(len(body)),
+        Request: req,
+    }
+}
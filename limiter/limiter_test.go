@@ -0,0 +1,336 @@
+package limiter
+
+import (
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+
+    "github.com/PhysarumSM/service-manager/conf"
+)
+
+func rate(r float64) *float64 {
+    return &r
+}
+
+func count(n int) *int {
+    return &n
+}
+
+func TestNewLimiter(t *testing.T) {
+    tests := []struct {
+        name      string
+        def       conf.Limit
+        overrides map[string]conf.Limit
+        wantErr   bool
+    }{
+        {"unlimited", conf.Limit{}, nil, false},
+        {"limited", conf.Limit{Rate: rate(10), Burst: count(5), MaxInFlight: count(2)},
+            map[string]conf.Limit{"a": {Rate: rate(1)}}, false},
+        {"negative rate", conf.Limit{Rate: rate(-1)}, nil, true},
+        {"negative burst", conf.Limit{Burst: count(-1)}, nil, true},
+        {"negative in flight", conf.Limit{MaxInFlight: count(-1)}, nil, true},
+        {"negative override", conf.Limit{}, map[string]conf.Limit{"a": {Rate: rate(-1)}}, true},
+    }
+    for _, test := range tests {
+        _, err := NewLimiter(test.def, test.overrides)
+        if (err != nil) != test.wantErr {
+            t.Errorf("%s: NewLimiter() returned error %v, want error: %v",
+                        test.name, err, test.wantErr)
+        }
+    }
+}
+
+func TestLimit(t *testing.T) {
+    def := conf.Limit{Rate: rate(10), Burst: count(5), MaxInFlight: count(2)}
+    lim, err := NewLimiter(def, map[string]conf.Limit{
+        "rate": {Rate: rate(1)},
+        "all": {Rate: rate(1), Burst: count(1), MaxInFlight: count(1)},
+        "unlimited": {Rate: rate(0), MaxInFlight: count(0)},
+    })
+    if err != nil {
+        t.Fatalf("NewLimiter() failed: %v", err)
+    }
+
+    tests := []struct {
+        key  string
+        want Limit
+    }{
+        {"other", Limit{Rate: 10, Burst: 5, MaxInFlight: 2}},
+        // Fields an override leaves out come from the default
+        {"rate", Limit{Rate: 1, Burst: 5, MaxInFlight: 2}},
+        {"all", Limit{Rate: 1, Burst: 1, MaxInFlight: 1}},
+        // Setting 0 lifts a limit rather than inheriting it
+        {"unlimited", Limit{Rate: 0, Burst: 5, MaxInFlight: 0}},
+    }
+    for _, test := range tests {
+        if got := lim.Limit(test.key); got != test.want {
+            t.Errorf("Limit(%q) = %+v, want %+v", test.key, got, test.want)
+        }
+    }
+}
+
+func TestAcquireRate(t *testing.T) {
+    tests := []struct {
+        limit   conf.Limit
+        allowed int
+    }{
+        {conf.Limit{}, 100},
+        // Burst defaults to 1 when only a rate is set
+        {conf.Limit{Rate: rate(1)}, 1},
+        {conf.Limit{Rate: rate(1), Burst: count(3)}, 3},
+        {conf.Limit{Rate: rate(0.5), Burst: count(2)}, 2},
+    }
+    for _, test := range tests {
+        lim, err := NewLimiter(test.limit, nil)
+        if err != nil {
+            t.Fatalf("NewLimiter() failed: %v", err)
+        }
+        limit := lim.Limit("key")
+
+        allowed := 0
+        var wait time.Duration
+        for i := 0; i < 100; i++ {
+            release, w, ok := lim.Acquire("key")
+            if !ok {
+                wait = w
+                break
+            }
+            release()
+            allowed++
+        }
+        if allowed != test.allowed {
+            t.Errorf("%+v: Acquire() allowed %d requests, want %d",
+                        limit, allowed, test.allowed)
+        }
+        // Waiting for the next token takes at most 1/Rate
+        if limit.Rate > 0 {
+            max := time.Duration(float64(time.Second) / limit.Rate)
+            if wait <= 0 || wait > max {
+                t.Errorf("%+v: Acquire() wait = %v, want in (0, %v]", limit, wait, max)
+            }
+        }
+    }
+}
+
+func TestOverrideLiftsLimit(t *testing.T) {
+    lim, err := NewLimiter(conf.Limit{Rate: rate(1), MaxInFlight: count(1)},
+                            map[string]conf.Limit{"trusted": {Rate: rate(0), MaxInFlight: count(0)}})
+    if err != nil {
+        t.Fatalf("NewLimiter() failed: %v", err)
+    }
+
+    tests := []struct {
+        key     string
+        allowed int
+    }{
+        {"other", 1},
+        {"trusted", 100},
+    }
+    for _, test := range tests {
+        allowed := 0
+        for i := 0; i < 100; i++ {
+            if _, _, ok := lim.Acquire(test.key); !ok {
+                break
+            }
+            allowed++
+        }
+        if allowed != test.allowed {
+            t.Errorf("Acquire(%q) allowed %d requests, want %d", test.key, allowed, test.allowed)
+        }
+    }
+}
+
+func TestAcquireRefill(t *testing.T) {
+    lim, err := NewLimiter(conf.Limit{Rate: rate(1), Burst: count(2)}, nil)
+    if err != nil {
+        t.Fatalf("NewLimiter() failed: %v", err)
+    }
+    for i := 0; i < 2; i++ {
+        lim.Acquire("key")
+    }
+    if _, _, ok := lim.Acquire("key"); ok {
+        t.Fatalf("Acquire() succeeded with an empty bucket")
+    }
+
+    tests := []struct {
+        elapsed time.Duration
+        allowed int
+    }{
+        {500 * time.Millisecond, 0},
+        {time.Second, 1},
+        // The bucket never holds more than Burst tokens
+        {time.Minute, 2},
+    }
+    for _, test := range tests {
+        lim.mux.Lock()
+        e := lim.entries["key"]
+        e.tokens = 0
+        e.last = time.Now().Add(-test.elapsed)
+        lim.mux.Unlock()
+
+        allowed := 0
+        for i := 0; i < 10; i++ {
+            if _, _, ok := lim.Acquire("key"); !ok {
+                break
+            }
+            allowed++
+        }
+        if allowed != test.allowed {
+            t.Errorf("Acquire() after %v allowed %d requests, want %d",
+                        test.elapsed, allowed, test.allowed)
+        }
+    }
+}
+
+func TestAcquireMaxInFlight(t *testing.T) {
+    lim, err := NewLimiter(conf.Limit{MaxInFlight: count(2)}, nil)
+    if err != nil {
+        t.Fatalf("NewLimiter() failed: %v", err)
+    }
+
+    first, _, ok := lim.Acquire("key")
+    if !ok {
+        t.Fatalf("Acquire() #1 failed")
+    }
+    if _, _, ok := lim.Acquire("key"); !ok {
+        t.Fatalf("Acquire() #2 failed")
+    }
+    if _, wait, ok := lim.Acquire("key"); ok || wait <= 0 {
+        t.Errorf("Acquire() over MaxInFlight = (%v, %v), want a wait and false", wait, ok)
+    }
+    // Keys are limited separately
+    if _, _, ok := lim.Acquire("other"); !ok {
+        t.Errorf("Acquire() for another key failed")
+    }
+
+    // Releasing more than once only frees one slot
+    first()
+    first()
+    if _, _, ok := lim.Acquire("key"); !ok {
+        t.Errorf("Acquire() after release failed")
+    }
+    if _, _, ok := lim.Acquire("key"); ok {
+        t.Errorf("Acquire() succeeded after a double release")
+    }
+}
+
+func TestSweep(t *testing.T) {
+    lim, err := NewLimiter(conf.Limit{Rate: rate(1), Burst: count(1), MaxInFlight: count(10)}, nil)
+    if err != nil {
+        t.Fatalf("NewLimiter() failed: %v", err)
+    }
+    for i := 0; i < maxIdleKeys; i++ {
+        release, _, _ := lim.Acquire(fmt.Sprintf("idle-%d", i))
+        release()
+    }
+    lim.Acquire("inflight")
+    release, _, _ := lim.Acquire("empty")
+    release()
+
+    lim.mux.Lock()
+    lim.lastSweep = lim.lastSweep.Add(-sweepInterval)
+    for key, e := range lim.entries {
+        if key != "empty" {
+            e.last = e.last.Add(-time.Minute)
+        }
+    }
+    lim.mux.Unlock()
+
+    // Sweeps happen on the next Acquire
+    release, _, _ = lim.Acquire("new")
+    release()
+
+    tests := []struct {
+        key  string
+        kept bool
+    }{
+        {"idle-0", false},
+        {"inflight", true},
+        // Its bucket hasn't refilled, so it'd behave differently if dropped
+        {"empty", true},
+        {"new", true},
+    }
+    lim.mux.Lock()
+    defer lim.mux.Unlock()
+    for _, test := range tests {
+        if _, ok := lim.entries[test.key]; ok != test.kept {
+            t.Errorf("%s: entry kept: %v, want %v", test.key, ok, test.kept)
+        }
+    }
+}
+
+func TestServiceAndCallerLimiters(t *testing.T) {
+    config := conf.Config{
+        Defaults: conf.ServiceConfig{Limit: conf.Limit{Rate: rate(10)}},
+        Services: map[string]conf.ServiceConfig{
+            "svc": {Limit: conf.Limit{MaxInFlight: count(1)}},
+            "exempt": {Limit: conf.Limit{Rate: rate(0)}},
+        },
+        CallerLimits: conf.CallerLimits{
+            Defaults: conf.Limit{MaxInFlight: count(5)},
+            Peers: map[string]conf.Limit{
+                "QmPeer": {Rate: rate(2)},
+                "QmTrusted": {MaxInFlight: count(0)},
+            },
+        },
+    }
+
+    services, err := NewServiceLimiter(config)
+    if err != nil {
+        t.Fatalf("NewServiceLimiter() failed: %v", err)
+    }
+    callers, err := NewCallerLimiter(config)
+    if err != nil {
+        t.Fatalf("NewCallerLimiter() failed: %v", err)
+    }
+
+    tests := []struct {
+        name string
+        lim  *Limiter
+        key  string
+        want Limit
+    }{
+        {"service", services, "svc", Limit{Rate: 10, Burst: 1, MaxInFlight: 1}},
+        {"other service", services, "other", Limit{Rate: 10, Burst: 1}},
+        {"exempt service", services, "exempt", Limit{Burst: 1}},
+        {"caller", callers, "QmPeer", Limit{Rate: 2, Burst: 1, MaxInFlight: 5}},
+        {"other caller", callers, "QmOther", Limit{Burst: 1, MaxInFlight: 5}},
+        {"trusted caller", callers, "QmTrusted", Limit{Burst: 1}},
+    }
+    for _, test := range tests {
+        if got := test.lim.Limit(test.key); got != test.want {
+            t.Errorf("%s: Limit(%q) = %+v, want %+v", test.name, test.key, got, test.want)
+        }
+    }
+}
+
+func TestRetryAfter(t *testing.T) {
+    tests := []struct {
+        wait time.Duration
+        want string
+    }{
+        {0, "1"},
+        {100 * time.Millisecond, "1"},
+        {time.Second, "1"},
+        {1500 * time.Millisecond, "2"},
+        {10 * time.Second, "10"},
+    }
+    for _, test := range tests {
+        if got := RetryAfter(test.wait); got != test.want {
+            t.Errorf("RetryAfter(%v) = %q, want %q", test.wait, got, test.want)
+        }
+    }
+}
+
+func TestNewResponse(t *testing.T) {
+    req := httptest.NewRequest(http.MethodGet, "http://svc/", nil)
+    resp := NewResponse(req, 2500 * time.Millisecond)
+    if resp.StatusCode != http.StatusTooManyRequests {
+        t.Errorf("StatusCode = %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+    }
+    if got := resp.Header.Get("Retry-After"); got != "3" {
+        t.Errorf("Retry-After = %q, want %q", got, "3")
+    }
+}
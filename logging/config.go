@@ -0,0 +1,92 @@
+package logging
+
+// Setting up logging from the command line and configuration file
+
+import (
+    "flag"
+    "fmt"
+    "strings"
+)
+
+// Logging settings, as found in the configuration file
+type Config struct {
+    // Level for all packages: debug, info (default), warn, or error
+    Level    string
+    // Per-package levels keyed by package name (e.g. "pcache"), overriding
+    // Level
+    Packages map[string]string
+    // Output format: text (default) or json
+    Format   string
+}
+
+// Applies the levels and format in config
+func Configure(config Config) error {
+    if config.Level != "" {
+        level, err := ParseLevel(config.Level)
+        if err != nil {
+            return err
+        }
+        SetLevel(level)
+    }
+    for pkg, levelStr := range config.Packages {
+        level, err := ParseLevel(levelStr)
+        if err != nil {
+            return fmt.Errorf("Invalid level for package %s\n%w", pkg, err)
+        }
+        SetPackageLevel(pkg, level)
+    }
+    if config.Format != "" {
+        f, err := ParseFormat(config.Format)
+        if err != nil {
+            return err
+        }
+        SetFormat(f)
+    }
+    return nil
+}
+
+// Command line options for logging
+type Flags struct {
+    Level    string
+    Packages string
+    Format   string
+}
+
+// Adds the logging flags to the default flag set
+func AddFlags() *Flags {
+    var f Flags
+    flag.StringVar(&f.Level, "log-level", "",
+        "Log level for all packages: debug, info, warn, or error (default info)")
+    flag.StringVar(&f.Packages, "log-packages", "",
+        "Comma-separated per-package log levels, e.g. 'pcache=debug,rcache=warn'")
+    flag.StringVar(&f.Format, "log-format", "",
+        "Log output format: text or json (default text)")
+    return &f
+}
+
+// Applies the logging settings in config, with any set by the flags taking
+// precedence
+func (f *Flags) Configure(config Config) error {
+    if f.Level != "" {
+        config.Level = f.Level
+    }
+    if f.Format != "" {
+        config.Format = f.Format
+    }
+    if f.Packages != "" {
+        packages := make(map[string]string)
+        for pkg, level := range config.Packages {
+            packages[pkg] = level
+        }
+        for _, token := range strings.Split(f.Packages, ",") {
+            kv := strings.SplitN(strings.TrimSpace(token), "=", 2)
+            if len(kv) != 2 || kv[0] == "" {
+                return fmt.Errorf("Invalid per-package log level %q, " +
+                                    "expected PACKAGE=LEVEL", token)
+            }
+            packages[kv[0]] = kv[1]
+        }
+        config.Packages = packages
+    }
+    return Configure(config)
+}
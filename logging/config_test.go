@@ -0,0 +1,72 @@
+package logging
+
+import (
+    "testing"
+)
+
+func TestFlagsConfigure(t *testing.T) {
+    tests := []struct {
+        name    string
+        flags   Flags
+        config  Config
+        err     bool
+        level   Level
+        pkgs    map[string]Level
+        format  Format
+    }{
+        {"nothing set", Flags{}, Config{}, false, Info, map[string]Level{}, Text},
+        {
+            "config only",
+            Flags{},
+            Config{Level: "warn", Packages: map[string]string{"pcache": "debug"}, Format: "json"},
+            false, Warn, map[string]Level{"pcache": Debug}, JSON,
+        },
+        {
+            "flags override config",
+            Flags{Level: "error", Packages: "pcache=info, rcache=debug", Format: "text"},
+            Config{Level: "warn", Packages: map[string]string{"pcache": "debug", "lca": "warn"},
+                    Format: "json"},
+            false, Error, map[string]Level{"pcache": Info, "rcache": Debug, "lca": Warn}, Text,
+        },
+        {"bad level", Flags{Level: "loud"}, Config{}, true, Info, nil, Text},
+        {"bad package level", Flags{Packages: "pcache=loud"}, Config{}, true, Info, nil, Text},
+        {"malformed packages", Flags{Packages: "pcache"}, Config{}, true, Info, nil, Text},
+        {"bad format", Flags{}, Config{Format: "xml"}, true, Info, nil, Text},
+    }
+    for _, test := range tests {
+        _, restore := capture()
+        err := test.flags.Configure(test.config)
+        if (err != nil) != test.err {
+            t.Errorf("%s: Configure() error = %v, want error %v", test.name, err, test.err)
+        }
+        if err == nil {
+            settingsMux.RLock()
+            if defaultLevel != test.level || format != test.format {
+                t.Errorf("%s: level %s and format %d, want %s and %d", test.name,
+                            defaultLevel, format, test.level, test.format)
+            }
+            if len(pkgLevels) != len(test.pkgs) {
+                t.Errorf("%s: package levels %v, want %v", test.name, pkgLevels, test.pkgs)
+            }
+            for pkg, level := range test.pkgs {
+                if pkgLevels[pkg] != level {
+                    t.Errorf("%s: %s level %s, want %s", test.name, pkg, pkgLevels[pkg], level)
+                }
+            }
+            settingsMux.RUnlock()
+        }
+        restore()
+    }
+
+    // The config passed in is left as it was
+    config := Config{Packages: map[string]string{"pcache": "debug"}}
+    _, restore := capture()
+    defer restore()
+    flags := Flags{Packages: "rcache=warn"}
+    if err := flags.Configure(config); err != nil {
+        t.Fatalf("Configure() failed: %v", err)
+    }
+    if len(config.Packages) != 1 {
+        t.Errorf("Configure() changed the config's packages to %v", config.Packages)
+    }
+}
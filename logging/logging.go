@@ -0,0 +1,316 @@
+package logging
+
+// Leveled logging shared by all packages
+//
+// Each package declares its own logger named after itself:
+//   var log = logging.New("pcache")
+// The logger has the same Printf/Println/Fatalf/... methods as the standard
+// library's log package, so existing calls keep working. Those log at INFO,
+// unless the message starts with "ERROR" or "WARNING", in which case they log
+// at that level. Debugf() and friends log at DEBUG.
+//
+// Levels can be set globally and per package, and output can be plain text or
+// one JSON object per line. Fields such as the peer ID, service name, or chain
+// spec can be attached to a logger with With().
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    stdlog "log"
+    "os"
+    "path/filepath"
+    "runtime"
+    "strings"
+    "sync"
+    "time"
+)
+
+type Level int
+
+const (
+    Debug Level = iota
+    Info
+    Warn
+    Error
+)
+
+func (l Level) String() string {
+    switch l {
+    case Debug:
+        return "DEBUG"
+    case Info:
+        return "INFO"
+    case Warn:
+        return "WARN"
+    case Error:
+        return "ERROR"
+    default:
+        return fmt.Sprintf("%d", l)
+    }
+}
+
+// Parses a level name, case insensitive
+func ParseLevel(s string) (Level, error) {
+    switch strings.ToLower(s) {
+    case "debug":
+        return Debug, nil
+    case "info":
+        return Info, nil
+    case "warn", "warning":
+        return Warn, nil
+    case "error":
+        return Error, nil
+    default:
+        return Info, fmt.Errorf("Unknown log level %q, expected one of " +
+                                "debug, info, warn, error", s)
+    }
+}
+
+type Format int
+
+const (
+    Text Format = iota
+    JSON
+)
+
+// Parses an output format name, "text" or "json"
+func ParseFormat(s string) (Format, error) {
+    switch strings.ToLower(s) {
+    case "text":
+        return Text, nil
+    case "json":
+        return JSON, nil
+    default:
+        return Text, fmt.Errorf("Unknown log format %q, expected text or json", s)
+    }
+}
+
+// Common field names
+const (
+    FieldPeer    = "peer"
+    FieldService = "service"
+    FieldChain   = "chain"
+)
+
+// Global logging settings, shared by all loggers
+var (
+    settingsMux  sync.RWMutex
+    defaultLevel = Info
+    pkgLevels    = make(map[string]Level)
+    format       = Text
+    // Guarded by outputMux rather than settingsMux so that writes are never
+    // interleaved
+    output    io.Writer = os.Stderr
+    outputMux sync.Mutex
+)
+
+// Sets the level for packages without their own level
+func SetLevel(level Level) {
+    settingsMux.Lock()
+    defer settingsMux.Unlock()
+    defaultLevel = level
+}
+
+// Sets the level for the package pkg, overriding the default level
+func SetPackageLevel(pkg string, level Level) {
+    settingsMux.Lock()
+    defer settingsMux.Unlock()
+    pkgLevels[pkg] = level
+}
+
+func SetFormat(f Format) {
+    settingsMux.Lock()
+    defer settingsMux.Unlock()
+    format = f
+}
+
+func SetOutput(w io.Writer) {
+    outputMux.Lock()
+    defer outputMux.Unlock()
+    output = w
+}
+
+func enabled(pkg string, level Level) bool {
+    settingsMux.RLock()
+    defer settingsMux.RUnlock()
+    min, ok := pkgLevels[pkg]
+    if !ok {
+        min = defaultLevel
+    }
+    return level >= min
+}
+
+func currentFormat() Format {
+    settingsMux.RLock()
+    defer settingsMux.RUnlock()
+    return format
+}
+
+type field struct {
+    key   string
+    value string
+}
+
+type Logger struct {
+    pkg    string
+    fields []field
+}
+
+// Constructor for Logger
+// pkg names the package the logger is for, and is what per-package levels
+// are matched against
+func New(pkg string) *Logger {
+    return &Logger{pkg: pkg}
+}
+
+// Returns a copy of the logger that adds key=value to every message
+func (l *Logger) With(key string, value string) *Logger {
+    fields := make([]field, len(l.fields), len(l.fields) + 1)
+    copy(fields, l.fields)
+    return &Logger{pkg: l.pkg, fields: append(fields, field{key, value})}
+}
+
+// Writes msg if level is enabled for the logger's package
+// Must be called directly by the exported methods, so that the caller's file
+// and line are reported correctly
+func (l *Logger) output(level Level, msg string) {
+    if !enabled(l.pkg, level) {
+        return
+    }
+
+    caller := ""
+    if _, file, line, ok := runtime.Caller(2); ok {
+        caller = fmt.Sprintf("%s:%d", filepath.Base(file), line)
+    }
+    l.write(time.Now(), level, caller, msg)
+}
+
+func (l *Logger) write(now time.Time, level Level, caller string, msg string) {
+    msg = strings.TrimRight(msg, "\n")
+
+    var buf []byte
+    if currentFormat() == JSON {
+        entry := map[string]string{
+            "time": now.Format(time.RFC3339Nano),
+            "level": strings.ToLower(level.String()),
+            "pkg": l.pkg,
+            "msg": msg,
+        }
+        if caller != "" {
+            entry["caller"] = caller
+        }
+        for _, f := range l.fields {
+            entry[f.key] = f.value
+        }
+        var err error
+        if buf, err = json.Marshal(entry); err != nil {
+            buf = []byte(fmt.Sprintf("{\"msg\":%q}", msg))
+        }
+    } else {
+        var sb strings.Builder
+        sb.WriteString(now.Format("2006/01/02 15:04:05.000000 "))
+        sb.WriteString(fmt.Sprintf("%-5s %s ", level, l.pkg))
+        if caller != "" {
+            sb.WriteString(caller + ": ")
+        }
+        sb.WriteString(msg)
+        for _, f := range l.fields {
+            sb.WriteString(fmt.Sprintf(" %s=%s", f.key, f.value))
+        }
+        buf = []byte(sb.String())
+    }
+
+    outputMux.Lock()
+    defer outputMux.Unlock()
+    output.Write(append(buf, '\n'))
+}
+
+// Picks the level for messages logged through the standard log-style methods
+func inferLevel(msg string) Level {
+    upper := strings.ToUpper(strings.TrimSpace(msg))
+    switch {
+    case strings.HasPrefix(upper, "ERROR"):
+        return Error
+    case strings.HasPrefix(upper, "WARN"):
+        return Warn
+    default:
+        return Info
+    }
+}
+
+// Methods compatible with the standard library's log package
+
+func (l *Logger) Print(v ...interface{}) {
+    msg := fmt.Sprint(v...)
+    l.output(inferLevel(msg), msg)
+}
+
+func (l *Logger) Printf(format string, v ...interface{}) {
+    msg := fmt.Sprintf(format, v...)
+    l.output(inferLevel(msg), msg)
+}
+
+func (l *Logger) Println(v ...interface{}) {
+    msg := fmt.Sprintln(v...)
+    l.output(inferLevel(msg), msg)
+}
+
+func (l *Logger) Fatal(v ...interface{}) {
+    l.output(Error, fmt.Sprint(v...))
+    os.Exit(1)
+}
+
+func (l *Logger) Fatalf(format string, v ...interface{}) {
+    l.output(Error, fmt.Sprintf(format, v...))
+    os.Exit(1)
+}
+
+func (l *Logger) Fatalln(v ...interface{}) {
+    l.output(Error, fmt.Sprintln(v...))
+    os.Exit(1)
+}
+
+// Methods logging at a specific level
+
+func (l *Logger) Debugf(format string, v ...interface{}) {
+    l.output(Debug, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Debugln(v ...interface{}) {
+    l.output(Debug, fmt.Sprintln(v...))
+}
+
+func (l *Logger) Infof(format string, v ...interface{}) {
+    l.output(Info, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Warnf(format string, v ...interface{}) {
+    l.output(Warn, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Errorf(format string, v ...interface{}) {
+    l.output(Error, fmt.Sprintf(format, v...))
+}
+
+// Messages logged by dependencies through the standard log package are
+// passed through a logger for the "std" package, so they follow the same
+// levels and format
+var stdLogger = New("std")
+
+type stdWriter struct{}
+
+func (stdWriter) Write(p []byte) (int, error) {
+    msg := string(p)
+    level := inferLevel(msg)
+    if enabled(stdLogger.pkg, level) {
+        // The caller can't be known from here
+        stdLogger.write(time.Now(), level, "", msg)
+    }
+    return len(p), nil
+}
+
+func init() {
+    stdlog.SetFlags(0)
+    stdlog.SetOutput(stdWriter{})
+}
@@ -0,0 +1,147 @@
+package logging
+
+import (
+    "bytes"
+    "encoding/json"
+    "os"
+    "strings"
+    "testing"
+)
+
+// Sends output to a buffer and returns a function restoring the default
+// settings
+func capture() (*bytes.Buffer, func()) {
+    var buf bytes.Buffer
+    SetOutput(&buf)
+    return &buf, func() {
+        settingsMux.Lock()
+        defaultLevel = Info
+        pkgLevels = make(map[string]Level)
+        format = Text
+        settingsMux.Unlock()
+        SetOutput(os.Stderr)
+    }
+}
+
+func TestInferLevel(t *testing.T) {
+    tests := []struct {
+        msg  string
+        want Level
+    }{
+        {"ERROR: Unable to connect\nrefused\n", Error},
+        {"Error: could not connect to microservice peer", Error},
+        {"  error after leading space", Error},
+        {"WARNING: Peer cache subscriber too slow", Warn},
+        {"warn: lowercase", Warn},
+        {"Adding new peer", Info},
+        {"Not an ERROR at the start", Info},
+        {"", Info},
+    }
+    for _, test := range tests {
+        if got := inferLevel(test.msg); got != test.want {
+            t.Errorf("inferLevel(%q) = %s, want %s", test.msg, got, test.want)
+        }
+    }
+}
+
+func TestParseLevel(t *testing.T) {
+    tests := []struct {
+        s    string
+        want Level
+        err  bool
+    }{
+        {"debug", Debug, false},
+        {"INFO", Info, false},
+        {"warn", Warn, false},
+        {"Warning", Warn, false},
+        {"error", Error, false},
+        {"verbose", Info, true},
+        {"", Info, true},
+    }
+    for _, test := range tests {
+        got, err := ParseLevel(test.s)
+        if got != test.want || (err != nil) != test.err {
+            t.Errorf("ParseLevel(%q) = (%s, %v), want (%s, error %v)",
+                        test.s, got, err, test.want, test.err)
+        }
+    }
+}
+
+func TestLevels(t *testing.T) {
+    buf, restore := capture()
+    defer restore()
+    SetLevel(Warn)
+    SetPackageLevel("chatty", Debug)
+
+    tests := []struct {
+        pkg     string
+        log     func(l *Logger)
+        written bool
+    }{
+        {"quiet", func(l *Logger) { l.Println("Adding new peer") }, false},
+        {"quiet", func(l *Logger) { l.Printf("WARNING: slow\n") }, true},
+        {"quiet", func(l *Logger) { l.Errorf("failed") }, true},
+        {"quiet", func(l *Logger) { l.Debugln("details") }, false},
+        {"chatty", func(l *Logger) { l.Debugf("details") }, true},
+        {"chatty", func(l *Logger) { l.Print("Adding new peer") }, true},
+    }
+    for i, test := range tests {
+        buf.Reset()
+        test.log(New(test.pkg))
+        if written := buf.Len() > 0; written != test.written {
+            t.Errorf("#%d (%s): written %v, want %v: %q", i, test.pkg, written,
+                        test.written, buf.String())
+        }
+    }
+}
+
+func TestFormats(t *testing.T) {
+    buf, restore := capture()
+    defer restore()
+    l := New("pcache").With(FieldPeer, "QmPeer").With(FieldService, "svc")
+
+    l.Printf("ERROR: Probe failed\n")
+    text := buf.String()
+    for _, want := range []string{"ERROR", "pcache", "logging_test.go:",
+                                    "ERROR: Probe failed peer=QmPeer service=svc\n"} {
+        if !strings.Contains(text, want) {
+            t.Errorf("Text output %q doesn't contain %q", text, want)
+        }
+    }
+
+    buf.Reset()
+    SetFormat(JSON)
+    l.Println("Adding new peer")
+    var entry map[string]string
+    if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+        t.Fatalf("JSON output %q doesn't parse: %v", buf.String(), err)
+    }
+    want := map[string]string{
+        "level": "info",
+        "pkg": "pcache",
+        "msg": "Adding new peer",
+        FieldPeer: "QmPeer",
+        FieldService: "svc",
+    }
+    for k, v := range want {
+        if entry[k] != v {
+            t.Errorf("JSON output has %s = %q, want %q", k, entry[k], v)
+        }
+    }
+    if !strings.HasPrefix(entry["caller"], "logging_test.go:") {
+        t.Errorf("JSON output has caller %q, want logging_test.go", entry["caller"])
+    }
+}
+
+func TestWithDoesntShareFields(t *testing.T) {
+    buf, restore := capture()
+    defer restore()
+    base := New("pkg").With("a", "1")
+    first := base.With("b", "2")
+    base.With("c", "3")
+
+    first.Println("msg")
+    if out := buf.String(); !strings.Contains(out, "a=1 b=2") || strings.Contains(out, "c=3") {
+        t.Errorf("Output %q, want fields a=1 b=2 only", out)
+    }
+}
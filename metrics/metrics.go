@@ -0,0 +1,152 @@
+package metrics
+
+// Prometheus metrics for the proxies and allocator
+// Metrics are registered with the default registry, so they're served by
+// promhttp.Handler() along with the Go runtime and process metrics
+
+import (
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "physarum"
+
+var (
+    // HTTP proxy requests by service and response status code
+    ProxyRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+        Namespace: namespace,
+        Subsystem: "proxy",
+        Name: "requests_total",
+        Help: "HTTP proxy requests by service and response status code",
+    }, []string{"service", "code"})
+
+    // Latency of HTTP requests sent over P2P streams, by service
+    P2PRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+        Namespace: namespace,
+        Subsystem: "p2p",
+        Name: "request_duration_seconds",
+        Help: "Latency of HTTP requests sent to service instances over libp2p",
+        Buckets: prometheus.ExponentialBuckets(0.001, 2, 15),
+    }, []string{"service"})
+
+    // Time taken to find or allocate a service instance, by outcome
+    FindAllocDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+        Namespace: namespace,
+        Subsystem: "resolver",
+        Name: "find_alloc_duration_seconds",
+        Help: "Time taken to find or allocate a service instance, by outcome " +
+            "(cached, found, allocated, failed)",
+        Buckets: prometheus.ExponentialBuckets(0.001, 2, 16),
+    }, []string{"outcome"})
+
+    // Peer cache lookups by result (hit, miss)
+    PeerCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+        Namespace: namespace,
+        Subsystem: "pcache",
+        Name: "lookups_total",
+        Help: "Peer cache lookups by result (hit, miss)",
+    }, []string{"result"})
+
+    // Number of peers in each peer cache level
+    PeerCacheLevelPeers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+        Namespace: namespace,
+        Subsystem: "pcache",
+        Name: "level_peers",
+        Help: "Number of peers in each peer cache level",
+    }, []string{"level"})
+
+    // Peer cache events by type
+    PeerCacheEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+        Namespace: namespace,
+        Subsystem: "pcache",
+        Name: "events_total",
+        Help: "Peer cache events by type (added, promoted, demoted, evicted)",
+    }, []string{"type"})
+
+    // Registry cache lookups by result (hit, miss, stale, negative)
+    RegistryCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+        Namespace: namespace,
+        Subsystem: "rcache",
+        Name: "lookups_total",
+        Help: "Registry cache lookups by result (hit, miss, stale, negative)",
+    }, []string{"result"})
+
+    // Open L4 tunnels through this proxy, by transport protocol
+    ActiveTunnels = promauto.NewGaugeVec(prometheus.GaugeOpts{
+        Namespace: namespace,
+        Subsystem: "l4",
+        Name: "active_tunnels",
+        Help: "Open TCP/UDP tunnels through this proxy",
+    }, []string{"protocol"})
+
+    // Bytes forwarded through L4 tunnels, by chain and direction (rx for
+    // bytes received over P2P streams, tx for bytes sent over them)
+    BytesForwarded = promauto.NewCounterVec(prometheus.CounterOpts{
+        Namespace: namespace,
+        Subsystem: "l4",
+        Name: "bytes_forwarded_total",
+        Help: "Bytes forwarded through tunnels by chain and direction " +
+            "(rx: received over libp2p, tx: sent over libp2p)",
+    }, []string{"chain", "direction"})
+
+    // Containers started by this allocator that are still running, by image
+    AllocatorContainers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+        Namespace: namespace,
+        Subsystem: "allocator",
+        Name: "containers",
+        Help: "Running containers started by this allocator, by image",
+    }, []string{"image"})
+
+    // Allocation requests by outcome (success, pull_failure, port_failure,
+    // run_failure)
+    AllocatorAllocations = promauto.NewCounterVec(prometheus.CounterOpts{
+        Namespace: namespace,
+        Subsystem: "allocator",
+        Name: "allocations_total",
+        Help: "Allocation requests by outcome " +
+            "(success, pull_failure, port_failure, run_failure)",
+    }, []string{"outcome"})
+
+    // Time taken to pull a service's image
+    AllocatorPullDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+        Namespace: namespace,
+        Subsystem: "allocator",
+        Name: "pull_duration_seconds",
+        Help: "Time taken to pull a service's image",
+        Buckets: prometheus.ExponentialBuckets(0.01, 2, 15),
+    })
+
+    // Time taken to start a service's container
+    AllocatorStartDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+        Namespace: namespace,
+        Subsystem: "allocator",
+        Name: "start_duration_seconds",
+        Help: "Time taken to start a service's container",
+        Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+    })
+
+    // Containers culled by reason (unreachable, conversion_error, idle)
+    AllocatorCulls = promauto.NewCounterVec(prometheus.CounterOpts{
+        Namespace: namespace,
+        Subsystem: "allocator",
+        Name: "culls_total",
+        Help: "Containers culled by reason (unreachable, conversion_error, idle)",
+    }, []string{"reason"})
+
+    // Trace spans dropped because the export queue was full
+    TracingDroppedSpans = promauto.NewCounter(prometheus.CounterOpts{
+        Namespace: namespace,
+        Subsystem: "tracing",
+        Name: "dropped_spans_total",
+        Help: "Trace spans dropped because the export queue was full",
+    })
+
+    // Seconds since each container last served a request, as reported by its
+    // proxy's metrics port
+    AllocatorContainerIdle = promauto.NewGaugeVec(prometheus.GaugeOpts{
+        Namespace: namespace,
+        Subsystem: "allocator",
+        Name: "container_idle_seconds",
+        Help: "Seconds since each container last served a request",
+    }, []string{"container"})
+)
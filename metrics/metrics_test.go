@@ -0,0 +1,73 @@
+package metrics
+
+import (
+    "strings"
+    "testing"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsLint(t *testing.T) {
+    collectors := map[string]prometheus.Collector{
+        "ProxyRequests": ProxyRequests,
+        "P2PRequestDuration": P2PRequestDuration,
+        "FindAllocDuration": FindAllocDuration,
+        "PeerCacheLookups": PeerCacheLookups,
+        "PeerCacheLevelPeers": PeerCacheLevelPeers,
+        "PeerCacheEvents": PeerCacheEvents,
+        "RegistryCacheLookups": RegistryCacheLookups,
+        "ActiveTunnels": ActiveTunnels,
+        "BytesForwarded": BytesForwarded,
+        "AllocatorContainers": AllocatorContainers,
+        "AllocatorAllocations": AllocatorAllocations,
+        "AllocatorPullDuration": AllocatorPullDuration,
+        "AllocatorStartDuration": AllocatorStartDuration,
+        "AllocatorCulls": AllocatorCulls,
+        "TracingDroppedSpans": TracingDroppedSpans,
+        "AllocatorContainerIdle": AllocatorContainerIdle,
+    }
+
+    // Vectors only report the label values they've seen
+    ProxyRequests.WithLabelValues("svc", "200")
+    P2PRequestDuration.WithLabelValues("svc")
+    FindAllocDuration.WithLabelValues("cached")
+    PeerCacheLookups.WithLabelValues("hit")
+    PeerCacheLevelPeers.WithLabelValues("0")
+    PeerCacheEvents.WithLabelValues("added")
+    RegistryCacheLookups.WithLabelValues("hit")
+    ActiveTunnels.WithLabelValues("tcp")
+    BytesForwarded.WithLabelValues("chain", "rx")
+    AllocatorContainers.WithLabelValues("image")
+    AllocatorAllocations.WithLabelValues("success")
+    AllocatorCulls.WithLabelValues("idle")
+    AllocatorContainerIdle.WithLabelValues("cid")
+
+    for name, c := range collectors {
+        if n := testutil.CollectAndCount(c); n == 0 {
+            t.Errorf("%s: nothing collected", name)
+        }
+        problems, err := testutil.CollectAndLint(c)
+        if err != nil {
+            t.Errorf("%s: CollectAndLint() failed: %v", name, err)
+        }
+        for _, p := range problems {
+            t.Errorf("%s: %s", name, p.Text)
+        }
+    }
+
+    // Everything is under the physarum namespace
+    families, err := prometheus.DefaultGatherer.Gather()
+    if err != nil {
+        t.Fatalf("Gather() failed: %v", err)
+    }
+    found := 0
+    for _, f := range families {
+        if strings.HasPrefix(f.GetName(), namespace + "_") {
+            found++
+        }
+    }
+    if found != len(collectors) {
+        t.Errorf("Found %d %s metrics, want %d", found, namespace, len(collectors))
+    }
+}
@@ -0,0 +1,161 @@
+package pcache
+
+// Load balancing strategies for choosing between several cached peers
+// offering the same service
+
+import (
+    "fmt"
+    "math/rand"
+    "sync"
+    "time"
+)
+
+// Names of the available balancing strategies
+const (
+    BalancerFirst = "first"
+    BalancerRoundRobin = "round-robin"
+    BalancerLeastOutstanding = "least-outstanding"
+    BalancerP2C = "p2c"
+    BalancerWeighted = "weighted"
+)
+
+// A cached peer being considered by a Balancer
+type Candidate struct {
+    RPeerInfo
+    // Number of requests currently outstanding to the peer
+    Inflight uint
+}
+
+// Picks a peer out of the candidates for a service
+// Candidates are ordered from most to least preferred by the cache, and are
+// never empty. Returns the index of the chosen candidate.
+type Balancer interface {
+    Pick(candidates []Candidate) int
+}
+
+// Returns a new Balancer given its name
+// An empty name returns the default, BalancerFirst
+func NewBalancer(name string) (Balancer, error) {
+    switch name {
+    case "", BalancerFirst:
+        return FirstBalancer{}, nil
+    case BalancerRoundRobin:
+        return NewRoundRobinBalancer(), nil
+    case BalancerLeastOutstanding:
+        return LeastOutstandingBalancer{}, nil
+    case BalancerP2C:
+        return NewP2CBalancer(), nil
+    case BalancerWeighted:
+        return NewWeightedBalancer(), nil
+    default:
+        return nil, fmt.Errorf("Unknown balancer: %s", name)
+    }
+}
+
+// Always picks the most preferred peer
+type FirstBalancer struct{}
+
+func (b FirstBalancer) Pick(candidates []Candidate) int {
+    return 0
+}
+
+// Cycles through the candidates for each service
+type RoundRobinBalancer struct {
+    next map[string]uint
+    mux  sync.Mutex
+}
+
+func NewRoundRobinBalancer() *RoundRobinBalancer {
+    return &RoundRobinBalancer{next: make(map[string]uint)}
+}
+
+func (b *RoundRobinBalancer) Pick(candidates []Candidate) int {
+    hash := candidates[0].Info.ServHash
+    b.mux.Lock()
+    defer b.mux.Unlock()
+    i := b.next[hash] % uint(len(candidates))
+    b.next[hash] = i + 1
+    return int(i)
+}
+
+// Picks the peer with the fewest requests in flight
+// Ties go to the more preferred peer
+type LeastOutstandingBalancer struct{}
+
+func (b LeastOutstandingBalancer) Pick(candidates []Candidate) int {
+    best := 0
+    for i, c := range candidates {
+        if c.Inflight < candidates[best].Inflight {
+            best = i
+        }
+    }
+    return best
+}
+
+// Power of two choices: picks two peers at random and uses the one with
+// the better performance (RTT plus service time), falling back to the
+// number of requests in flight on ties
+type P2CBalancer struct {
+    rng *rand.Rand
+    mux sync.Mutex
+}
+
+func NewP2CBalancer() *P2CBalancer {
+    return &P2CBalancer{rng: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (b *P2CBalancer) Pick(candidates []Candidate) int {
+    if len(candidates) == 1 {
+        return 0
+    }
+
+    b.mux.Lock()
+    i := b.rng.Intn(len(candidates))
+    j := b.rng.Intn(len(candidates) - 1)
+    b.mux.Unlock()
+    if j >= i {
+        j++
+    }
+
+    ci, cj := candidates[i], candidates[j]
+    pi, pj := ci.EffectivePerf(), cj.EffectivePerf()
+    if pi.Equal(pj) {
+        if cj.Inflight < ci.Inflight {
+            return j
+        }
+        return i
+    }
+    if pj.LessThan(pi) {
+        return j
+    }
+    return i
+}
+
+// Picks peers at random, weighted by their reliability (RCount)
+type WeightedBalancer struct {
+    rng *rand.Rand
+    mux sync.Mutex
+}
+
+func NewWeightedBalancer() *WeightedBalancer {
+    return &WeightedBalancer{rng: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (b *WeightedBalancer) Pick(candidates []Candidate) int {
+    // Add 1 to each weight so peers with an RCount of 0 still get a chance
+    total := uint(0)
+    for _, c := range candidates {
+        total += c.RCount + 1
+    }
+
+    b.mux.Lock()
+    n := uint(b.rng.Int63n(int64(total)))
+    b.mux.Unlock()
+    for i, c := range candidates {
+        if n < c.RCount + 1 {
+            return i
+        }
+        n -= c.RCount + 1
+    }
+    return len(candidates) - 1
+}
@@ -0,0 +1,175 @@
+package pcache
+
+import (
+    "testing"
+    "time"
+
+    "github.com/PhysarumSM/common/p2putil"
+)
+
+func candidate(hash string, rtt time.Duration, rcount uint, inflight uint) Candidate {
+    return Candidate{
+        RPeerInfo: RPeerInfo{
+            RCount: rcount,
+            Info: p2putil.PeerInfo{ServHash: hash, Perf: p2putil.PerfInd{RTT: rtt}},
+        },
+        Inflight: inflight,
+    }
+}
+
+func TestNewBalancer(t *testing.T) {
+    tests := []struct {
+        name    string
+        wantErr bool
+    }{
+        {"", false},
+        {BalancerFirst, false},
+        {BalancerRoundRobin, false},
+        {BalancerLeastOutstanding, false},
+        {BalancerP2C, false},
+        {BalancerWeighted, false},
+        {"random", true},
+    }
+    for _, test := range tests {
+        b, err := NewBalancer(test.name)
+        if (err != nil) != test.wantErr {
+            t.Errorf("NewBalancer(%q) returned error %v, want error: %v",
+                        test.name, err, test.wantErr)
+        } else if err == nil && b == nil {
+            t.Errorf("NewBalancer(%q) returned no balancer", test.name)
+        }
+    }
+}
+
+func TestFirstBalancer(t *testing.T) {
+    candidates := []Candidate{
+        candidate("a", 5 * time.Millisecond, 50, 10),
+        candidate("a", 1 * time.Millisecond, 90, 0),
+    }
+    if i := (FirstBalancer{}).Pick(candidates); i != 0 {
+        t.Errorf("Pick() = %d, want 0", i)
+    }
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+    b := NewRoundRobinBalancer()
+    a := []Candidate{candidate("a", 0, 0, 0), candidate("a", 0, 0, 0), candidate("a", 0, 0, 0)}
+    other := []Candidate{candidate("b", 0, 0, 0), candidate("b", 0, 0, 0)}
+
+    // Each service cycles through its own candidates independently
+    steps := []struct {
+        candidates []Candidate
+        want       int
+    }{
+        {a, 0}, {a, 1}, {other, 0}, {a, 2}, {other, 1}, {a, 0}, {other, 0},
+        // Fewer candidates than last time wraps around
+        {a[:2], 1}, {a[:2], 0},
+    }
+    for n, step := range steps {
+        if i := b.Pick(step.candidates); i != step.want {
+            t.Errorf("Pick() #%d for %s = %d, want %d",
+                        n, step.candidates[0].Info.ServHash, i, step.want)
+        }
+    }
+}
+
+func TestLeastOutstandingBalancer(t *testing.T) {
+    tests := []struct {
+        inflight []uint
+        want     int
+    }{
+        {[]uint{0}, 0},
+        {[]uint{3, 1, 2}, 1},
+        // Ties go to the more preferred peer
+        {[]uint{2, 1, 1}, 1},
+        {[]uint{0, 0}, 0},
+    }
+    for _, test := range tests {
+        var candidates []Candidate
+        for _, n := range test.inflight {
+            candidates = append(candidates, candidate("a", 0, 0, n))
+        }
+        if i := (LeastOutstandingBalancer{}).Pick(candidates); i != test.want {
+            t.Errorf("Pick() with in flight %v = %d, want %d", test.inflight, i, test.want)
+        }
+    }
+}
+
+func TestP2CBalancer(t *testing.T) {
+    // With two candidates both are always compared, so the choice is
+    // deterministic
+    tests := []struct {
+        name       string
+        candidates []Candidate
+        want       int
+    }{
+        {
+            name: "single candidate",
+            candidates: []Candidate{candidate("a", 10 * time.Millisecond, 0, 5)},
+            want: 0,
+        },
+        {
+            name: "faster peer",
+            candidates: []Candidate{
+                candidate("a", 10 * time.Millisecond, 0, 0),
+                candidate("a", 5 * time.Millisecond, 0, 5),
+            },
+            want: 1,
+        },
+        {
+            name: "equal performance, fewer in flight",
+            candidates: []Candidate{
+                candidate("a", 5 * time.Millisecond, 0, 3),
+                candidate("a", 5 * time.Millisecond, 0, 1),
+            },
+            want: 1,
+        },
+    }
+    b := NewP2CBalancer()
+    for _, test := range tests {
+        for n := 0; n < 20; n++ {
+            if i := b.Pick(test.candidates); i != test.want {
+                t.Errorf("%s: Pick() = %d, want %d", test.name, i, test.want)
+                break
+            }
+        }
+    }
+}
+
+func TestP2CBalancerServiceTime(t *testing.T) {
+    // A fast network doesn't make up for a slow service
+    slow := candidate("a", 1 * time.Millisecond, 0, 0)
+    slow.ServiceTime = 50 * time.Millisecond
+    fast := candidate("a", 5 * time.Millisecond, 0, 0)
+    fast.ServiceTime = 1 * time.Millisecond
+
+    if i := NewP2CBalancer().Pick([]Candidate{slow, fast}); i != 1 {
+        t.Errorf("Pick() = %d, want 1", i)
+    }
+}
+
+func TestWeightedBalancer(t *testing.T) {
+    b := NewWeightedBalancer()
+    candidates := []Candidate{
+        candidate("a", 0, 0, 0),
+        candidate("a", 0, 99, 0),
+    }
+
+    const picks = 10000
+    counts := make([]int, len(candidates))
+    for n := 0; n < picks; n++ {
+        i := b.Pick(candidates)
+        if i < 0 || i >= len(candidates) {
+            t.Fatalf("Pick() = %d, out of range", i)
+        }
+        counts[i]++
+    }
+
+    // Weights are RCount + 1, so 1 in 101 picks should go to the first peer
+    if counts[0] == 0 {
+        t.Errorf("Peer with an RCount of 0 was never picked")
+    }
+    if counts[0] > picks / 20 {
+        t.Errorf("Peer with an RCount of 0 was picked %d times out of %d", counts[0], picks)
+    }
+}
@@ -0,0 +1,307 @@
+package pcache
+
+// Per-peer circuit breakers fed by request outcomes
+// Catches peers that answer pings but fail requests, which the ping-based
+// cache updates alone would keep in rotation
+
+import (
+    "fmt"
+    "sync"
+    "time"
+
+    "github.com/libp2p/go-libp2p-core/peer"
+
+    "github.com/PhysarumSM/service-manager/conf"
+)
+
+type BreakerState int
+const (
+    // Requests flow normally
+    BreakerClosed BreakerState = iota
+    // Requests are blocked until the open timeout passes
+    BreakerOpen
+    // A limited number of probe requests are let through to test the peer
+    BreakerHalfOpen
+)
+
+func (state BreakerState) String() string {
+    switch state {
+    case BreakerClosed:
+        return "closed"
+    case BreakerOpen:
+        return "open"
+    case BreakerHalfOpen:
+        return "half-open"
+    default:
+        return fmt.Sprintf("%d", state)
+    }
+}
+
+type BreakerConfig struct {
+    // Fraction of failed requests within Window that opens the breaker
+    ErrorRate      float64
+    // Minimum number of requests within Window before the breaker can open
+    MinRequests    uint
+    // Length of the sliding window that outcomes are counted over
+    Window         time.Duration
+    // How long the breaker stays open before letting a probe through
+    OpenTimeout    time.Duration
+    // Number of successful probes needed to close the breaker again
+    HalfOpenProbes uint
+}
+
+// Returns the breaker settings used when none are configured
+func DefaultBreakerConfig() BreakerConfig {
+    return BreakerConfig{
+        ErrorRate: 0.5,
+        MinRequests: 10,
+        Window: 30 * time.Second,
+        OpenTimeout: 10 * time.Second,
+        HalfOpenProbes: 1,
+    }
+}
+
+// Converts the configuration file's settings, using defaults for any unset
+func NewBreakerConfig(cfg conf.CircuitBreaker) (BreakerConfig, error) {
+    bc := DefaultBreakerConfig()
+    if cfg.ErrorRate != 0 {
+        bc.ErrorRate = cfg.ErrorRate
+    }
+    if cfg.MinRequests != 0 {
+        bc.MinRequests = cfg.MinRequests
+    }
+    if cfg.WindowSecs != 0 {
+        bc.Window = time.Duration(cfg.WindowSecs) * time.Second
+    }
+    if cfg.OpenSecs != 0 {
+        bc.OpenTimeout = time.Duration(cfg.OpenSecs) * time.Second
+    }
+    if cfg.HalfOpenProbes != 0 {
+        bc.HalfOpenProbes = cfg.HalfOpenProbes
+    }
+
+    if bc.ErrorRate <= 0 || bc.ErrorRate > 1 {
+        return bc, fmt.Errorf("Circuit breaker error rate must be in (0, 1], got %v",
+                                bc.ErrorRate)
+    }
+    if bc.Window <= 0 || bc.OpenTimeout <= 0 {
+        return bc, fmt.Errorf("Circuit breaker window and open time must be positive")
+    }
+    return bc, nil
+}
+
+type outcome struct {
+    when    time.Time
+    success bool
+}
+
+type CircuitBreaker struct {
+    cfg      BreakerConfig
+    state    BreakerState
+    // Outcomes within the sliding window, oldest first
+    outcomes []outcome
+    // When the breaker last opened
+    openedAt time.Time
+    // Probes let through and probes succeeded while half-open
+    probes   uint
+    passed   uint
+    mux      sync.Mutex
+}
+
+func NewCircuitBreaker(cfg BreakerConfig) *CircuitBreaker {
+    return &CircuitBreaker{cfg: cfg}
+}
+
+// Returns the breaker's current state, moving from open to half-open if the
+// open timeout has passed
+func (cb *CircuitBreaker) State() BreakerState {
+    cb.mux.Lock()
+    defer cb.mux.Unlock()
+    return cb.stateLocked(time.Now())
+}
+
+func (cb *CircuitBreaker) stateLocked(now time.Time) BreakerState {
+    if cb.state == BreakerOpen && now.Sub(cb.openedAt) >= cb.cfg.OpenTimeout {
+        cb.state = BreakerHalfOpen
+        cb.probes = 0
+        cb.passed = 0
+    }
+    return cb.state
+}
+
+// Returns whether a request may be sent, without reserving a probe
+func (cb *CircuitBreaker) Available() bool {
+    cb.mux.Lock()
+    defer cb.mux.Unlock()
+    switch cb.stateLocked(time.Now()) {
+    case BreakerClosed:
+        return true
+    case BreakerHalfOpen:
+        return cb.probes < cb.cfg.HalfOpenProbes
+    default:
+        return false
+    }
+}
+
+// Reserves the right to send a request, returns false if it's not allowed
+// While half-open, each call uses up one of the allowed probes
+func (cb *CircuitBreaker) Acquire() bool {
+    cb.mux.Lock()
+    defer cb.mux.Unlock()
+    switch cb.stateLocked(time.Now()) {
+    case BreakerClosed:
+        return true
+    case BreakerHalfOpen:
+        if cb.probes < cb.cfg.HalfOpenProbes {
+            cb.probes++
+            return true
+        }
+        return false
+    default:
+        return false
+    }
+}
+
+// Gives back a probe reserved with Acquire() whose request was cancelled
+// before it completed, so it neither closes nor reopens the breaker
+func (cb *CircuitBreaker) Release() {
+    cb.mux.Lock()
+    defer cb.mux.Unlock()
+    // Probes not yet passed are still outstanding, as a failed one would
+    // have reopened the breaker
+    if cb.stateLocked(time.Now()) == BreakerHalfOpen && cb.probes > cb.passed {
+        cb.probes--
+    }
+}
+
+// Records the outcome of a request and updates the breaker's state
+func (cb *CircuitBreaker) Record(success bool) {
+    cb.mux.Lock()
+    defer cb.mux.Unlock()
+    now := time.Now()
+
+    switch cb.stateLocked(now) {
+    case BreakerHalfOpen:
+        if !success {
+            cb.open(now)
+            return
+        }
+        cb.passed++
+        if cb.passed >= cb.cfg.HalfOpenProbes {
+            cb.state = BreakerClosed
+            cb.outcomes = cb.outcomes[:0]
+        }
+        return
+    case BreakerOpen:
+        // Late result from before the breaker opened, nothing to learn
+        return
+    }
+
+    cb.outcomes = append(cb.outcomes, outcome{when: now, success: success})
+    cb.prune(now)
+
+    failures := uint(0)
+    for _, o := range cb.outcomes {
+        if !o.success {
+            failures++
+        }
+    }
+    total := uint(len(cb.outcomes))
+    if total >= cb.cfg.MinRequests &&
+            float64(failures) / float64(total) >= cb.cfg.ErrorRate {
+        cb.open(now)
+    }
+}
+
+// Returns whether the breaker is closed with no outcomes in its window,
+// i.e. it holds no information worth keeping
+func (cb *CircuitBreaker) idle() bool {
+    cb.mux.Lock()
+    defer cb.mux.Unlock()
+    now := time.Now()
+    cb.prune(now)
+    return cb.stateLocked(now) == BreakerClosed && len(cb.outcomes) == 0
+}
+
+func (cb *CircuitBreaker) open(now time.Time) {
+    cb.state = BreakerOpen
+    cb.openedAt = now
+    cb.outcomes = cb.outcomes[:0]
+}
+
+// Drops outcomes that have fallen out of the window
+func (cb *CircuitBreaker) prune(now time.Time) {
+    i := 0
+    for i < len(cb.outcomes) && now.Sub(cb.outcomes[i].when) > cb.cfg.Window {
+        i++
+    }
+    cb.outcomes = cb.outcomes[i:]
+}
+
+// Sets the settings used for breakers created from now on
+func (cache *PeerCache) SetBreakerConfig(cfg BreakerConfig) {
+    cache.mux.Lock()
+    defer cache.mux.Unlock()
+    cache.breakerCfg = cfg
+}
+
+// Returns the circuit breaker state for a peer
+func (cache *PeerCache) BreakerState(id peer.ID) BreakerState {
+    cache.mux.Lock()
+    cb, ok := cache.breakers[id]
+    cache.mux.Unlock()
+    if !ok {
+        return BreakerClosed
+    }
+    return cb.State()
+}
+
+// Returns whether requests may currently be sent to a peer
+func (cache *PeerCache) BreakerAvailable(id peer.ID) bool {
+    cache.mux.Lock()
+    cb, ok := cache.breakers[id]
+    cache.mux.Unlock()
+    return !ok || cb.Available()
+}
+
+// Reserves the right to send a request to a peer, as GetPeer() does for the
+// peer it returns
+// Returns false if the peer's breaker isn't letting requests through. While
+// half-open, each reservation uses up one of the allowed probes.
+func (cache *PeerCache) AcquireBreaker(id peer.ID) bool {
+    cache.mux.Lock()
+    cb, ok := cache.breakers[id]
+    cache.mux.Unlock()
+    return !ok || cb.Acquire()
+}
+
+// Must be called with cache.mux held
+func (cache *PeerCache) breakerAvailableLocked(id peer.ID) bool {
+    cb, ok := cache.breakers[id]
+    return !ok || cb.Available()
+}
+
+// Returns the breaker for a peer, creating it if needed
+// Must be called with cache.mux held
+func (cache *PeerCache) breakerLocked(id peer.ID) *CircuitBreaker {
+    cb, ok := cache.breakers[id]
+    if !ok {
+        cb = NewCircuitBreaker(cache.breakerCfg)
+        cache.breakers[id] = cb
+    }
+    return cb
+}
+
+// Forgets breakers that hold no information, called on each cache update
+// Breakers of peers that aren't cached are also forgotten once their open
+// timeout has passed, since they may never get the probes that would close
+// them, and would otherwise pile up as instances come and go
+// Must be called with cache.mux held
+func (cache *PeerCache) pruneBreakersLocked() {
+    for id, cb := range cache.breakers {
+        _, cached := cache.peers[id]
+        if cb.idle() || (!cached && cb.State() == BreakerHalfOpen) {
+            delete(cache.breakers, id)
+        }
+    }
+}
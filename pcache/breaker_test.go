@@ -0,0 +1,269 @@
+package pcache
+
+import (
+    "context"
+    "testing"
+    "time"
+
+    "github.com/libp2p/go-libp2p-core/peer"
+
+    "github.com/PhysarumSM/service-manager/conf"
+    "github.com/PhysarumSM/service-manager/rcache"
+)
+
+// Returns a cache that's never started, for testing its bookkeeping
+func newTestCache() *PeerCache {
+    return NewPeerCache(nil, rcache.NewRegistryCache(context.Background(), nil, nil, 60))
+}
+
+func testBreakerConfig() BreakerConfig {
+    return BreakerConfig{
+        ErrorRate: 0.5,
+        MinRequests: 4,
+        Window: time.Minute,
+        OpenTimeout: time.Minute,
+        HalfOpenProbes: 2,
+    }
+}
+
+// Moves an open breaker past its open timeout
+func expireOpen(cb *CircuitBreaker) {
+    cb.mux.Lock()
+    cb.openedAt = cb.openedAt.Add(-cb.cfg.OpenTimeout)
+    cb.mux.Unlock()
+}
+
+func TestNewBreakerConfig(t *testing.T) {
+    tests := []struct {
+        name    string
+        cfg     conf.CircuitBreaker
+        want    BreakerConfig
+        wantErr bool
+    }{
+        {
+            name: "defaults",
+            want: DefaultBreakerConfig(),
+        },
+        {
+            name: "overrides",
+            cfg: conf.CircuitBreaker{ErrorRate: 0.25, MinRequests: 5, WindowSecs: 60,
+                                        OpenSecs: 5, HalfOpenProbes: 3},
+            want: BreakerConfig{ErrorRate: 0.25, MinRequests: 5, Window: time.Minute,
+                                OpenTimeout: 5 * time.Second, HalfOpenProbes: 3},
+        },
+        {
+            name: "error rate above 1",
+            cfg: conf.CircuitBreaker{ErrorRate: 1.5},
+            wantErr: true,
+        },
+        {
+            name: "negative error rate",
+            cfg: conf.CircuitBreaker{ErrorRate: -0.5},
+            wantErr: true,
+        },
+        {
+            name: "negative window",
+            cfg: conf.CircuitBreaker{WindowSecs: -1},
+            wantErr: true,
+        },
+    }
+    for _, test := range tests {
+        got, err := NewBreakerConfig(test.cfg)
+        if test.wantErr {
+            if err == nil {
+                t.Errorf("%s: NewBreakerConfig() = %+v, want error", test.name, got)
+            }
+            continue
+        }
+        if err != nil {
+            t.Errorf("%s: NewBreakerConfig() failed: %v", test.name, err)
+        } else if got != test.want {
+            t.Errorf("%s: NewBreakerConfig() = %+v, want %+v", test.name, got, test.want)
+        }
+    }
+}
+
+func TestBreakerOpens(t *testing.T) {
+    tests := []struct {
+        name     string
+        outcomes []bool
+        want     BreakerState
+    }{
+        {"no requests", nil, BreakerClosed},
+        {"all succeed", []bool{true, true, true, true, true}, BreakerClosed},
+        {"too few requests", []bool{false, false, false}, BreakerClosed},
+        {"error rate reached", []bool{true, false, true, false}, BreakerOpen},
+        {"error rate not reached", []bool{true, false, true, true, true}, BreakerClosed},
+        {"all fail", []bool{false, false, false, false}, BreakerOpen},
+    }
+    for _, test := range tests {
+        cb := NewCircuitBreaker(testBreakerConfig())
+        for _, success := range test.outcomes {
+            cb.Record(success)
+        }
+        if state := cb.State(); state != test.want {
+            t.Errorf("%s: State() = %s, want %s", test.name, state, test.want)
+        }
+        if available := cb.Available(); available != (test.want == BreakerClosed) {
+            t.Errorf("%s: Available() = %v in state %s", test.name, available, test.want)
+        }
+    }
+}
+
+func TestBreakerWindow(t *testing.T) {
+    cb := NewCircuitBreaker(testBreakerConfig())
+    for i := 0; i < 3; i++ {
+        cb.Record(false)
+    }
+    // Failures that have fallen out of the window don't count
+    cb.mux.Lock()
+    for i := range cb.outcomes {
+        cb.outcomes[i].when = cb.outcomes[i].when.Add(-2 * cb.cfg.Window)
+    }
+    cb.mux.Unlock()
+    cb.Record(false)
+    if state := cb.State(); state != BreakerClosed {
+        t.Errorf("State() = %s, want %s", state, BreakerClosed)
+    }
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+    tests := []struct {
+        name     string
+        outcomes []bool
+        want     BreakerState
+    }{
+        {"all probes succeed", []bool{true, true}, BreakerClosed},
+        {"one probe succeeds", []bool{true}, BreakerHalfOpen},
+        {"probe fails", []bool{false}, BreakerOpen},
+        {"second probe fails", []bool{true, false}, BreakerOpen},
+    }
+    for _, test := range tests {
+        cb := NewCircuitBreaker(testBreakerConfig())
+        for i := 0; i < 4; i++ {
+            cb.Record(false)
+        }
+        if cb.Acquire() {
+            t.Errorf("%s: Acquire() succeeded while open", test.name)
+        }
+        expireOpen(cb)
+        if state := cb.State(); state != BreakerHalfOpen {
+            t.Fatalf("%s: State() after open timeout = %s, want %s",
+                        test.name, state, BreakerHalfOpen)
+        }
+
+        // Only HalfOpenProbes requests are let through
+        for i := uint(0); i < cb.cfg.HalfOpenProbes; i++ {
+            if !cb.Acquire() {
+                t.Errorf("%s: Acquire() for probe %d failed", test.name, i)
+            }
+        }
+        if cb.Available() || cb.Acquire() {
+            t.Errorf("%s: more than %d probes let through", test.name, cb.cfg.HalfOpenProbes)
+        }
+
+        for _, success := range test.outcomes {
+            cb.Record(success)
+        }
+        if state := cb.State(); state != test.want {
+            t.Errorf("%s: State() = %s, want %s", test.name, state, test.want)
+        }
+    }
+}
+
+func TestBreakerClosesWithCleanWindow(t *testing.T) {
+    cb := NewCircuitBreaker(testBreakerConfig())
+    for i := 0; i < 4; i++ {
+        cb.Record(false)
+    }
+    expireOpen(cb)
+    cb.Acquire()
+    cb.Acquire()
+    cb.Record(true)
+    cb.Record(true)
+
+    // Failures from before the breaker opened are forgotten, so these alone
+    // are too few to open it again
+    for i := 0; i < 3; i++ {
+        cb.Record(false)
+    }
+    if state := cb.State(); state != BreakerClosed {
+        t.Errorf("State() = %s, want %s", state, BreakerClosed)
+    }
+}
+
+func TestPruneBreakers(t *testing.T) {
+    cache := newTestCache()
+    cache.SetBreakerConfig(testBreakerConfig())
+    cached := peer.ID("cached")
+    cache.peers[cached] = &RPeerInfo{}
+
+    tests := []struct {
+        name    string
+        id      peer.ID
+        setup   func(cb *CircuitBreaker)
+        kept    bool
+    }{
+        {"idle", peer.ID("idle"), func(cb *CircuitBreaker) {}, false},
+        {"recent outcomes", peer.ID("recent"), func(cb *CircuitBreaker) {
+            cb.Record(true)
+        }, true},
+        {"open", peer.ID("open"), openBreaker, true},
+        {"uncached past open timeout", peer.ID("expired"), func(cb *CircuitBreaker) {
+            openBreaker(cb)
+            expireOpen(cb)
+        }, false},
+        {"cached past open timeout", cached, func(cb *CircuitBreaker) {
+            openBreaker(cb)
+            expireOpen(cb)
+        }, true},
+    }
+
+    cache.mux.Lock()
+    defer cache.mux.Unlock()
+    for _, test := range tests {
+        test.setup(cache.breakerLocked(test.id))
+    }
+    cache.pruneBreakersLocked()
+    for _, test := range tests {
+        if _, ok := cache.breakers[test.id]; ok != test.kept {
+            t.Errorf("%s: breaker kept: %v, want %v", test.name, ok, test.kept)
+        }
+    }
+}
+
+func TestAcquireBreaker(t *testing.T) {
+    cache := newTestCache()
+    cache.SetBreakerConfig(testBreakerConfig())
+    if !cache.AcquireBreaker(peer.ID("unknown")) {
+        t.Errorf("AcquireBreaker() failed for a peer without a breaker")
+    }
+
+    id := peer.ID("half-open")
+    cache.mux.Lock()
+    cb := cache.breakerLocked(id)
+    cache.mux.Unlock()
+    openBreaker(cb)
+    if cache.AcquireBreaker(id) {
+        t.Errorf("AcquireBreaker() succeeded while open")
+    }
+    expireOpen(cb)
+    for i := uint(0); i < cb.cfg.HalfOpenProbes; i++ {
+        if !cache.AcquireBreaker(id) {
+            t.Errorf("AcquireBreaker() for probe %d failed", i)
+        }
+    }
+    if cache.AcquireBreaker(id) {
+        t.Errorf("AcquireBreaker() let more than %d probes through", cb.cfg.HalfOpenProbes)
+    }
+    // Checking availability doesn't use up probes
+    if cache.BreakerAvailable(id) {
+        t.Errorf("BreakerAvailable() = true with all probes in use")
+    }
+}
+
+func openBreaker(cb *CircuitBreaker) {
+    for i := uint(0); i < cb.cfg.MinRequests; i++ {
+        cb.Record(false)
+    }
+}
@@ -0,0 +1,78 @@
+package pcache
+
+// Keeping the cache bounded, and probing peers that aren't being used less
+// often, so a proxy talking to many services doesn't flood them with pings
+
+import (
+    "time"
+
+    "github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Records that a peer was picked or sent a request
+// A peer whose probes were backed off is probed again soon
+// Must be called with cache.mux held
+func (cache *PeerCache) touchLocked(id peer.ID) {
+    p, ok := cache.peers[id]
+    if !ok {
+        return
+    }
+    now := time.Now()
+    p.lastUsed = now
+    if p.probeEvery > cache.config.ProbeInterval {
+        p.probeEvery = cache.config.ProbeInterval
+        if next := now.Add(p.probeEvery); next.Before(p.nextProbe) {
+            p.nextProbe = next
+        }
+    }
+}
+
+// Schedules a peer's next probe after probing it
+// The time between probes doubles, up to MaxProbeInterval, for as long as the
+// peer goes unused between probes
+// Must be called with cache.mux held
+func (cache *PeerCache) scheduleProbeLocked(p *RPeerInfo, now time.Time) {
+    if p.lastUsed.Before(p.lastProbe) {
+        p.probeEvery *= 2
+        if p.probeEvery > cache.config.MaxProbeInterval {
+            p.probeEvery = cache.config.MaxProbeInterval
+        }
+    } else {
+        p.probeEvery = cache.config.ProbeInterval
+    }
+    p.lastProbe = now
+    p.nextProbe = now.Add(p.probeEvery)
+}
+
+// Evicts least recently used peers until there's room for another peer
+// offering the service hash
+// Must be called with cache.mux held
+func (cache *PeerCache) makeRoomLocked(hash string) {
+    if max := cache.config.MaxPeersPerService; max > 0 {
+        for uint(len(cache.byHash[hash])) >= max {
+            cache.evictLocked(cache.lruLocked(cache.byHash[hash]), EvictCapacity)
+        }
+    }
+    if max := cache.config.MaxPeers; max > 0 {
+        for uint(len(cache.peers)) >= max {
+            var lru *RPeerInfo
+            for _, p := range cache.peers {
+                if lru == nil || p.lastUsed.Before(lru.lastUsed) {
+                    lru = p
+                }
+            }
+            cache.evictLocked(lru, EvictCapacity)
+        }
+    }
+}
+
+// Returns the least recently used of the peers ids, which must not be empty
+func (cache *PeerCache) lruLocked(ids map[peer.ID]struct{}) *RPeerInfo {
+    var lru *RPeerInfo
+    for id := range ids {
+        if p := cache.peers[id]; lru == nil || p.lastUsed.Before(lru.lastUsed) {
+            lru = p
+        }
+    }
+    return lru
+}
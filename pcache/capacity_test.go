@@ -0,0 +1,128 @@
+package pcache
+
+import (
+    "testing"
+    "time"
+
+    "github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestLRUEviction(t *testing.T) {
+    tests := []struct {
+        name       string
+        maxPeers   uint
+        perService uint
+        // Service hash of the peer added to the full cache
+        hash       string
+        evicted    peer.ID
+    }{
+        // "b" is the least recently used overall
+        {"cache full", 3, 0, "other", peer.ID("b")},
+        // "a" is the least recently used of the service's peers
+        {"service full", 0, 2, "svc", peer.ID("a")},
+        {"room left", 4, 3, "svc", peer.ID("")},
+    }
+    for _, test := range tests {
+        cache := newTestCache()
+        cache.mux.Lock()
+        cache.config.MaxPeers = test.maxPeers
+        cache.config.MaxPeersPerService = test.perService
+        cache.mux.Unlock()
+
+        cache.AddPeer(testPeer("a"))
+        b := testPeer("b")
+        b.ServHash = "other"
+        cache.AddPeer(b)
+        cache.AddPeer(testPeer("c"))
+        // Last used: b, then a, then c
+        now := time.Now()
+        cache.mux.Lock()
+        cache.peers[peer.ID("b")].lastUsed = now.Add(-3 * time.Minute)
+        cache.peers[peer.ID("a")].lastUsed = now.Add(-2 * time.Minute)
+        cache.peers[peer.ID("c")].lastUsed = now.Add(-time.Minute)
+        cache.mux.Unlock()
+
+        events, unsubscribe := cache.Subscribe(10)
+        added := testPeer("new")
+        added.ServHash = test.hash
+        cache.AddPeer(added)
+        unsubscribe()
+
+        var evicted peer.ID
+        for e := range events {
+            if e.Type == PeerEvicted {
+                if e.Reason != EvictCapacity || e.Unhealthy() {
+                    t.Errorf("%s: %s evicted as %s, want %s", test.name, e.Peer.ID,
+                                e.Reason, EvictCapacity)
+                }
+                evicted = e.Peer.ID
+            }
+        }
+        if evicted != test.evicted {
+            t.Errorf("%s: evicted %q, want %q", test.name, evicted, test.evicted)
+        }
+        cache.mux.Lock()
+        _, ok := cache.peers[added.ID]
+        cache.mux.Unlock()
+        if !ok {
+            t.Errorf("%s: new peer not added", test.name)
+        }
+    }
+}
+
+func TestGetPeerKeepsPeersRecent(t *testing.T) {
+    cache := newTestCache()
+    cache.AddPeer(testPeer("a"))
+    old := time.Now().Add(-time.Minute)
+    cache.mux.Lock()
+    cache.peers[peer.ID("a")].lastUsed = old
+    cache.mux.Unlock()
+
+    if _, err := cache.GetPeer("svc"); err != nil {
+        t.Fatalf("GetPeer() failed: %v", err)
+    }
+    cache.mux.Lock()
+    defer cache.mux.Unlock()
+    if !cache.peers[peer.ID("a")].lastUsed.After(old) {
+        t.Errorf("GetPeer() didn't mark the peer as used")
+    }
+}
+
+func TestProbeBackoff(t *testing.T) {
+    cache := newTestCache()
+    cache.mux.Lock()
+    defer cache.mux.Unlock()
+    cache.config.ProbeInterval = time.Second
+    cache.config.MaxProbeInterval = 5 * time.Second
+    p := cache.newPeerLocked(testPeer("a"))
+    cache.insertPeerLocked(p)
+
+    // Each probe while unused doubles the time to the next, up to the max
+    // The peer counts as used when it's added, so the first probe keeps the
+    // base interval
+    added := time.Now().Add(-time.Hour)
+    p.lastUsed, p.lastProbe = added, added
+    now := added.Add(time.Second)
+    for _, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second,
+                                        5 * time.Second, 5 * time.Second} {
+        cache.scheduleProbeLocked(p, now)
+        if p.probeEvery != want || !p.nextProbe.Equal(now.Add(want)) {
+            t.Errorf("Unused peer probed every %s, next at +%s, want %s", p.probeEvery,
+                        p.nextProbe.Sub(now), want)
+        }
+        now = now.Add(want)
+    }
+
+    // Using the peer brings the next probe forward right away
+    cache.touchLocked(p.Info.ID)
+    if p.probeEvery != time.Second || p.nextProbe.After(time.Now().Add(time.Second)) {
+        t.Errorf("Used peer probed every %s, next in %s, want 1s",
+                    p.probeEvery, time.Until(p.nextProbe))
+    }
+
+    // Peers used between probes keep the base interval
+    cache.scheduleProbeLocked(p, time.Now())
+    if p.probeEvery != time.Second {
+        t.Errorf("Used peer probed every %s after a probe, want 1s", p.probeEvery)
+    }
+}
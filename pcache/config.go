@@ -0,0 +1,39 @@
+package pcache
+
+// Applying configuration file settings to a PeerCache
+
+import (
+    "fmt"
+
+    "github.com/PhysarumSM/service-manager/conf"
+)
+
+// Sets up the cache's levels, balancing strategies and circuit breakers from
+// a config
+func (cache *PeerCache) Configure(config conf.Config) error {
+    b, err := NewBalancer(config.Defaults.Balancer)
+    if err != nil {
+        return err
+    }
+    cache.SetDefaultBalancer(b)
+
+    for servName := range config.Services {
+        b, err = NewBalancer(config.ForService(servName).Balancer)
+        if err != nil {
+            return fmt.Errorf("Service %s: %w", servName, err)
+        }
+        cache.SetBalancer(servName, b)
+    }
+
+    bc, err := NewBreakerConfig(config.CircuitBreaker)
+    if err != nil {
+        return err
+    }
+    cache.SetBreakerConfig(bc)
+
+    pc, err := NewPeerCacheConfig(config)
+    if err != nil {
+        return err
+    }
+    return cache.SetConfig(pc)
+}
@@ -0,0 +1,202 @@
+package pcache
+
+// Events published as peers move through the cache
+// Lets callers react to a peer going bad, e.g. tearing down tunnels through
+// it, without running their own ping loops
+
+import (
+    "fmt"
+    "sync"
+
+    "github.com/libp2p/go-libp2p-core/peer"
+
+    "github.com/PhysarumSM/common/p2putil"
+
+    "github.com/PhysarumSM/service-manager/metrics"
+)
+
+type EventType int
+const (
+    // Peer was added to the cache
+    PeerAdded EventType = iota
+    // Peer moved up a level
+    PeerPromoted
+    // Peer moved down a level
+    PeerDemoted
+    // Peer was removed from the cache
+    PeerEvicted
+)
+
+func (t EventType) String() string {
+    switch t {
+    case PeerAdded:
+        return "added"
+    case PeerPromoted:
+        return "promoted"
+    case PeerDemoted:
+        return "demoted"
+    case PeerEvicted:
+        return "evicted"
+    default:
+        return fmt.Sprintf("%d", t)
+    }
+}
+
+// Reasons a peer is evicted
+const (
+    // Peer stopped answering probes
+    EvictUnreachable = "unreachable"
+    // Peer no longer meets its service's hard requirement
+    EvictHardReq = "hard-requirement"
+    // Peer fell to the last level
+    EvictUnreliable = "unreliable"
+    // Peer was removed with RemovePeer(), e.g. through the admin API
+    EvictRemoved = "removed"
+    // Peer was the least recently used when the cache was full
+    EvictCapacity = "capacity"
+)
+
+type Event struct {
+    Type   EventType
+    Peer   p2putil.PeerInfo
+    // Level the peer moved out of, -1 for PeerAdded
+    From   int
+    // Level the peer moved into, -1 for PeerEvicted
+    To     int
+    // Why the peer was evicted, one of the Evict* constants, for PeerEvicted
+    Reason string
+}
+
+// Returns whether the event means the peer shouldn't be used anymore
+// Peers evicted only to make room are still fine to use
+func (e Event) Unhealthy() bool {
+    return e.Type == PeerEvicted && e.Reason != EvictCapacity
+}
+
+type subscriber struct {
+    events  chan Event
+    once    sync.Once
+    // Evictions that didn't fit in the channel's buffer, oldest first, at
+    // most one per peer
+    pending []Event
+    // Index into pending by peer
+    pendingIdx map[peer.ID]int
+}
+
+// Returns a channel receiving the cache's events, and a function that stops
+// them and closes the channel
+// Events are published while the cache is locked, so they're dropped rather
+// than sent if the channel's buffer of bufSize events is full. Evictions are
+// never dropped: they're held back and delivered, before any newer events, as
+// the buffer frees up, checked on each event and each cache update. Only the
+// latest eviction held back for a peer is kept. Subscribers should still keep
+// up by handing off any slow work.
+func (cache *PeerCache) Subscribe(bufSize int) (<-chan Event, func()) {
+    sub := &subscriber{events: make(chan Event, bufSize)}
+    cache.mux.Lock()
+    defer cache.mux.Unlock()
+    cache.subscribers[sub] = struct{}{}
+
+    unsubscribe := func() {
+        sub.once.Do(func() {
+            cache.mux.Lock()
+            defer cache.mux.Unlock()
+            delete(cache.subscribers, sub)
+            sub.pending, sub.pendingIdx = nil, nil
+            close(sub.events)
+        })
+    }
+    return sub.events, unsubscribe
+}
+
+// Must be called with cache.mux held
+func (cache *PeerCache) publishLocked(e Event) {
+    metrics.PeerCacheEvents.WithLabelValues(e.Type.String()).Inc()
+    for sub := range cache.subscribers {
+        // Held back evictions go first, so events arrive in order
+        if sub.flushPending() && sub.trySend(e) {
+            continue
+        }
+        if e.Type == PeerEvicted {
+            sub.holdEviction(e)
+            continue
+        }
+        log.Printf("WARNING: Peer cache subscriber too slow, dropped %s event for peer %s\n",
+                    e.Type, e.Peer.ID)
+    }
+}
+
+// Delivers held back evictions to all subscribers as far as their buffers
+// allow
+// Must be called with cache.mux held
+func (cache *PeerCache) flushPendingLocked() {
+    for sub := range cache.subscribers {
+        sub.flushPending()
+    }
+}
+
+// Sends the event if there's room in the buffer, returning whether it did
+func (sub *subscriber) trySend(e Event) bool {
+    select {
+    case sub.events <- e:
+        return true
+    default:
+        return false
+    }
+}
+
+// Sends as many held back evictions as fit in the buffer, returning whether
+// none are left
+// Must be called with cache.mux held
+func (sub *subscriber) flushPending() bool {
+    sent := 0
+    for sent < len(sub.pending) && sub.trySend(sub.pending[sent]) {
+        delete(sub.pendingIdx, sub.pending[sent].Peer.ID)
+        sent++
+    }
+    if sent > 0 {
+        sub.pending = sub.pending[sent:]
+        for i, e := range sub.pending {
+            sub.pendingIdx[e.Peer.ID] = i
+        }
+    }
+    return len(sub.pending) == 0
+}
+
+// Holds back an eviction the subscriber's buffer has no room for, replacing
+// any earlier one for the same peer
+// Must be called with cache.mux held
+func (sub *subscriber) holdEviction(e Event) {
+    if sub.pendingIdx == nil {
+        sub.pendingIdx = make(map[peer.ID]int)
+    }
+    if i, ok := sub.pendingIdx[e.Peer.ID]; ok {
+        sub.pending[i] = e
+        return
+    }
+    if len(sub.pending) == 0 {
+        log.Printf("WARNING: Peer cache subscriber too slow, holding back evictions\n")
+    }
+    sub.pendingIdx[e.Peer.ID] = len(sub.pending)
+    sub.pending = append(sub.pending, e)
+}
+
+// Helpers for publishing each type of event
+// Must be called with cache.mux held
+
+func (cache *PeerCache) publishAddedLocked(p RPeerInfo, to uint) {
+    cache.publishLocked(Event{Type: PeerAdded, Peer: p.Info, From: -1, To: int(to)})
+}
+
+func (cache *PeerCache) publishMovedLocked(p RPeerInfo, from uint, to uint) {
+    t := PeerDemoted
+    if to < from {
+        t = PeerPromoted
+    }
+    cache.publishLocked(Event{Type: t, Peer: p.Info, From: int(from), To: int(to)})
+}
+
+func (cache *PeerCache) publishEvictedLocked(p RPeerInfo, from uint, reason string) {
+    cache.publishLocked(Event{Type: PeerEvicted, Peer: p.Info, From: int(from), To: -1,
+                                Reason: reason})
+}
@@ -0,0 +1,124 @@
+package pcache
+
+import (
+    "testing"
+
+    "github.com/libp2p/go-libp2p-core/peer"
+
+    "github.com/PhysarumSM/common/p2putil"
+)
+
+type wantEvent struct {
+    t      EventType
+    id     peer.ID
+    from   int
+    to     int
+    reason string
+}
+
+// Checks the next events on the channel without waiting for any
+func expectEvents(t *testing.T, name string, events <-chan Event, want []wantEvent) {
+    for _, w := range want {
+        select {
+        case e := <-events:
+            if e.Type != w.t || e.Peer.ID != w.id || e.From != w.from || e.To != w.to ||
+                    e.Reason != w.reason {
+                t.Errorf("%s: got %s for %s (%d to %d, %q), want %s for %s (%d to %d, %q)",
+                            name, e.Type, e.Peer.ID, e.From, e.To, e.Reason,
+                            w.t, w.id, w.from, w.to, w.reason)
+            }
+        default:
+            t.Errorf("%s: no event, want %s for %s", name, w.t, w.id)
+        }
+    }
+    select {
+    case e := <-events:
+        t.Errorf("%s: unexpected event %s for %s", name, e.Type, e.Peer.ID)
+    default:
+    }
+}
+
+func testPeer(id string) p2putil.PeerInfo {
+    return p2putil.PeerInfo{ID: peer.ID(id), ServName: "svc", ServHash: "svc"}
+}
+
+func TestEventOrder(t *testing.T) {
+    cache := newTestCache()
+    events, unsubscribe := cache.Subscribe(10)
+    defer unsubscribe()
+
+    cache.AddPeer(testPeer("a"))
+    cache.AddPeer(testPeer("b"))
+    cache.RemovePeer(peer.ID("a"))
+    cache.mux.Lock()
+    p := cache.peers[peer.ID("b")]
+    p.Level = 0
+    cache.publishMovedLocked(*p, 1, 0)
+    cache.mux.Unlock()
+
+    expectEvents(t, "in order", events, []wantEvent{
+        {PeerAdded, peer.ID("a"), -1, 1, ""},
+        {PeerAdded, peer.ID("b"), -1, 1, ""},
+        {PeerEvicted, peer.ID("a"), 1, -1, EvictRemoved},
+        {PeerPromoted, peer.ID("b"), 1, 0, ""},
+    })
+}
+
+func TestEvictionsHeldBack(t *testing.T) {
+    cache := newTestCache()
+    events, unsubscribe := cache.Subscribe(1)
+    defer unsubscribe()
+
+    // Fills the buffer, so the rest of the additions are dropped and the
+    // evictions held back
+    cache.AddPeer(testPeer("a"))
+    cache.AddPeer(testPeer("b"))
+    cache.RemovePeer(peer.ID("a"))
+    cache.RemovePeer(peer.ID("b"))
+    // Only the latest eviction of a peer is kept
+    cache.AddPeer(testPeer("a"))
+    cache.mux.Lock()
+    cache.evictLocked(cache.peers[peer.ID("a")], EvictUnreachable)
+    cache.mux.Unlock()
+    expectEvents(t, "full buffer", events, []wantEvent{
+        {PeerAdded, peer.ID("a"), -1, 1, ""},
+    })
+
+    // Held back evictions go out before newer events as room frees up
+    cache.AddPeer(testPeer("c"))
+    expectEvents(t, "first flush", events, []wantEvent{
+        {PeerEvicted, peer.ID("a"), 1, -1, EvictUnreachable},
+    })
+    cache.mux.Lock()
+    cache.flushPendingLocked()
+    cache.mux.Unlock()
+    expectEvents(t, "second flush", events, []wantEvent{
+        {PeerEvicted, peer.ID("b"), 1, -1, EvictRemoved},
+    })
+
+    // Nothing left held back, so events are sent straight away again
+    cache.RemovePeer(peer.ID("c"))
+    expectEvents(t, "caught up", events, []wantEvent{
+        {PeerEvicted, peer.ID("c"), 1, -1, EvictRemoved},
+    })
+}
+
+func TestEventUnhealthy(t *testing.T) {
+    tests := []struct {
+        e    Event
+        want bool
+    }{
+        {Event{Type: PeerAdded}, false},
+        {Event{Type: PeerDemoted}, false},
+        {Event{Type: PeerEvicted, Reason: EvictUnreachable}, true},
+        {Event{Type: PeerEvicted, Reason: EvictRemoved}, true},
+        // Evicted only to make room
+        {Event{Type: PeerEvicted, Reason: EvictCapacity}, false},
+    }
+    for _, test := range tests {
+        if got := test.e.Unhealthy(); got != test.want {
+            t.Errorf("%s (%s).Unhealthy() = %v, want %v", test.e.Type, test.e.Reason,
+                        got, test.want)
+        }
+    }
+}
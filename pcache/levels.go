@@ -0,0 +1,245 @@
+package pcache
+
+// Settings for the cache's reliability levels and how peers move between them
+
+import (
+    "fmt"
+    "time"
+
+    "github.com/PhysarumSM/service-manager/conf"
+)
+
+// How probe results change a peer's RCount, and when the RCount moves the
+// peer between levels
+type PeerScoring struct {
+    // RCount given to newly cached peers
+    InitialRCount uint
+    // Highest RCount a peer can reach
+    MaxRCount     uint
+    // Peers above this RCount move up a level, and peers in the top level
+    // below it move down
+    PromoteAbove  uint
+    // Peers below this RCount move down a level
+    DemoteBelow   uint
+    // RCount given to peers when they move down a level
+    ResetRCount   uint
+    // RCount lost when a probe misses the service's soft requirement
+    Penalty       uint
+    // RCount gained when a probe meets the service's soft requirement
+    Reward        uint
+    // Combines each peer's probe results into the performance it's ranked
+    // by and checked against the service's requirements
+    Scorer        Scorer
+}
+
+// Returns the scoring used when none is configured
+func DefaultPeerScoring() PeerScoring {
+    return PeerScoring{
+        // Start new peers in the middle so they don't immediately get kicked
+        // to the last level upon cache update
+        InitialRCount: 50,
+        MaxRCount: 100,
+        PromoteAbove: 90,
+        DemoteBelow: 10,
+        // Reset to the middle when dropping to penalize inconsistency, while
+        // giving a buffer so peers don't chain drop to the last level
+        ResetRCount: 50,
+        Penalty: 10,
+        Reward: 1,
+        Scorer: RCountScorer{},
+    }
+}
+
+// Converts the configuration file's settings, using defaults for any unset
+func NewPeerScoring(cfg conf.PeerScoring) (PeerScoring, error) {
+    s := DefaultPeerScoring()
+    if cfg.InitialRCount != nil {
+        s.InitialRCount = *cfg.InitialRCount
+    }
+    if cfg.MaxRCount != nil {
+        s.MaxRCount = *cfg.MaxRCount
+    }
+    if cfg.PromoteAbove != nil {
+        s.PromoteAbove = *cfg.PromoteAbove
+    }
+    if cfg.DemoteBelow != nil {
+        s.DemoteBelow = *cfg.DemoteBelow
+    }
+    if cfg.ResetRCount != nil {
+        s.ResetRCount = *cfg.ResetRCount
+    }
+    if cfg.Penalty != nil {
+        s.Penalty = *cfg.Penalty
+    }
+    if cfg.Reward != nil {
+        s.Reward = *cfg.Reward
+    }
+    var err error
+    if s.Scorer, err = NewScorer(cfg); err != nil {
+        return s, err
+    }
+    return s, s.validate()
+}
+
+// Checks that peers can move between levels with these settings
+func (s PeerScoring) validate() error {
+    if s.Scorer == nil {
+        return fmt.Errorf("No scorer set")
+    }
+    if s.PromoteAbove >= s.MaxRCount {
+        return fmt.Errorf("PromoteAbove (%d) must be below MaxRCount (%d), " +
+                            "or peers can never be promoted", s.PromoteAbove, s.MaxRCount)
+    }
+    if s.DemoteBelow >= s.PromoteAbove {
+        return fmt.Errorf("DemoteBelow (%d) must be below PromoteAbove (%d)",
+                            s.DemoteBelow, s.PromoteAbove)
+    }
+    if s.InitialRCount < s.DemoteBelow || s.InitialRCount > s.PromoteAbove {
+        return fmt.Errorf("InitialRCount (%d) must be between DemoteBelow (%d) " +
+                            "and PromoteAbove (%d)", s.InitialRCount, s.DemoteBelow,
+                            s.PromoteAbove)
+    }
+    if s.ResetRCount < s.DemoteBelow || s.ResetRCount > s.PromoteAbove {
+        return fmt.Errorf("ResetRCount (%d) must be between DemoteBelow (%d) " +
+                            "and PromoteAbove (%d)", s.ResetRCount, s.DemoteBelow,
+                            s.PromoteAbove)
+    }
+    return nil
+}
+
+type PeerCacheConfig struct {
+    // Number of levels, the last holding peers due for removal
+    Levels             uint
+    // Time between probes of the cached peers
+    ProbeInterval      time.Duration
+    // Peers that aren't being used are probed less often, doubling the time
+    // between probes each time up to this
+    MaxProbeInterval   time.Duration
+    // Most peers cached at once, 0 for no limit
+    MaxPeers           uint
+    // Most peers cached at once for any one service, 0 for no limit
+    MaxPeersPerService uint
+    // Scoring for services without their own
+    Scoring            PeerScoring
+    // Scoring per service name
+    Services           map[string]PeerScoring
+}
+
+// Returns the cache settings used when none are configured
+func DefaultPeerCacheConfig() PeerCacheConfig {
+    return PeerCacheConfig{
+        // Level 0: performant and reliable
+        // Level 1: performant but not reliable
+        // Level 2: not performant and not reliable
+        Levels: 3,
+        ProbeInterval: 1 * time.Second,
+        MaxProbeInterval: 30 * time.Second,
+        MaxPeers: 1000,
+        MaxPeersPerService: 20,
+        Scoring: DefaultPeerScoring(),
+        Services: make(map[string]PeerScoring),
+    }
+}
+
+// Converts the configuration file's settings, using defaults for any unset
+// Scoring set under Defaults applies to all services, and can be overridden
+// per service
+func NewPeerCacheConfig(config conf.Config) (PeerCacheConfig, error) {
+    pc := DefaultPeerCacheConfig()
+    if config.PeerCache.Levels != 0 {
+        pc.Levels = config.PeerCache.Levels
+    }
+    if config.PeerCache.ProbeIntervalMs < 0 {
+        return pc, fmt.Errorf("ProbeIntervalMs must not be negative")
+    } else if config.PeerCache.ProbeIntervalMs != 0 {
+        pc.ProbeInterval = time.Duration(config.PeerCache.ProbeIntervalMs) * time.Millisecond
+    }
+    if config.PeerCache.MaxProbeIntervalMs < 0 {
+        return pc, fmt.Errorf("MaxProbeIntervalMs must not be negative")
+    } else if config.PeerCache.MaxProbeIntervalMs != 0 {
+        pc.MaxProbeInterval = time.Duration(config.PeerCache.MaxProbeIntervalMs) * time.Millisecond
+    }
+    if config.PeerCache.MaxPeers != 0 {
+        pc.MaxPeers = config.PeerCache.MaxPeers
+    }
+    if config.PeerCache.MaxPeersPerService != 0 {
+        pc.MaxPeersPerService = config.PeerCache.MaxPeersPerService
+    }
+
+    var err error
+    pc.Scoring, err = NewPeerScoring(config.Defaults.PeerScoring)
+    if err != nil {
+        return pc, err
+    }
+    for servName := range config.Services {
+        pc.Services[servName], err = NewPeerScoring(config.ForService(servName).PeerScoring)
+        if err != nil {
+            return pc, fmt.Errorf("Service %s: %w", servName, err)
+        }
+    }
+    return pc, pc.validate()
+}
+
+// Checks settings that aren't specific to a service's scoring, along with
+// the scoring itself
+func (pc PeerCacheConfig) validate() error {
+    // Needs a level for new peers and a last level for peers due for removal
+    if pc.Levels < 2 {
+        return fmt.Errorf("Peer cache needs at least 2 levels, got %d", pc.Levels)
+    }
+    if pc.ProbeInterval <= 0 {
+        return fmt.Errorf("Probe interval must be positive, got %v", pc.ProbeInterval)
+    }
+    if pc.MaxProbeInterval < pc.ProbeInterval {
+        return fmt.Errorf("MaxProbeIntervalMs (%v) must be at least ProbeIntervalMs (%v)",
+                            pc.MaxProbeInterval, pc.ProbeInterval)
+    }
+    if err := pc.Scoring.validate(); err != nil {
+        return err
+    }
+    for servName, s := range pc.Services {
+        if err := s.validate(); err != nil {
+            return fmt.Errorf("Service %s: %w", servName, err)
+        }
+    }
+    return nil
+}
+
+// Applies new cache settings, or returns an error leaving the current ones in
+// place if they aren't valid
+// If the number of levels shrinks, peers in the removed levels are moved to
+// the new last level, and so are dropped on the next update
+// Only the scoring can be set per service, the other settings apply to the
+// whole cache
+func (cache *PeerCache) SetConfig(pc PeerCacheConfig) error {
+    if err := pc.validate(); err != nil {
+        return err
+    }
+    cache.mux.Lock()
+    defer cache.mux.Unlock()
+    cache.NLevels = pc.Levels
+    cache.config = pc
+
+    for _, p := range cache.peers {
+        if p.Level >= pc.Levels {
+            p.Level = pc.Levels - 1
+        }
+        // Start afresh with the new scorers, from the last known performance
+        p.resetScore(cache.scoringLocked(p.Info.ServName).Scorer)
+    }
+    return nil
+}
+
+// Returns the scoring for the service servName
+func (cache *PeerCache) scoringLocked(servName string) PeerScoring {
+    if s, ok := cache.config.Services[servName]; ok {
+        return s
+    }
+    return cache.config.Scoring
+}
+
+func (cache *PeerCache) probeInterval() time.Duration {
+    cache.mux.Lock()
+    defer cache.mux.Unlock()
+    return cache.config.ProbeInterval
+}
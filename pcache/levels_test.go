@@ -0,0 +1,215 @@
+package pcache
+
+import (
+    "testing"
+    "time"
+
+    "github.com/PhysarumSM/service-manager/conf"
+)
+
+func TestNewPeerScoring(t *testing.T) {
+    zeroDemote := DefaultPeerScoring()
+    zeroDemote.DemoteBelow = 0
+    zeroDemote.Penalty = 0
+
+    tests := []struct {
+        name    string
+        cfg     conf.PeerScoring
+        want    PeerScoring
+        wantErr bool
+    }{
+        {
+            name: "defaults",
+            want: DefaultPeerScoring(),
+        },
+        {
+            // 0 is a value of its own, not a fallback to the default
+            name: "explicit zeroes",
+            cfg: conf.PeerScoring{DemoteBelow: uintPtr(0), Penalty: uintPtr(0)},
+            want: zeroDemote,
+        },
+        {
+            name: "promote at max",
+            cfg: conf.PeerScoring{PromoteAbove: uintPtr(100)},
+            wantErr: true,
+        },
+        {
+            name: "demote above promote",
+            cfg: conf.PeerScoring{DemoteBelow: uintPtr(95)},
+            wantErr: true,
+        },
+        {
+            name: "initial below demote",
+            cfg: conf.PeerScoring{InitialRCount: uintPtr(5)},
+            wantErr: true,
+        },
+        {
+            name: "reset above promote",
+            cfg: conf.PeerScoring{ResetRCount: uintPtr(95)},
+            wantErr: true,
+        },
+        {
+            name: "invalid scorer",
+            cfg: conf.PeerScoring{Scorer: "median"},
+            wantErr: true,
+        },
+    }
+    for _, test := range tests {
+        got, err := NewPeerScoring(test.cfg)
+        if test.wantErr {
+            if err == nil {
+                t.Errorf("%s: NewPeerScoring() = %+v, want error", test.name, got)
+            }
+            continue
+        }
+        if err != nil {
+            t.Errorf("%s: NewPeerScoring() failed: %v", test.name, err)
+        } else if got != test.want {
+            t.Errorf("%s: NewPeerScoring() = %+v, want %+v", test.name, got, test.want)
+        }
+    }
+}
+
+func TestNewPeerCacheConfig(t *testing.T) {
+    tests := []struct {
+        name    string
+        cfg     conf.PeerCache
+        check   func(pc PeerCacheConfig) bool
+        wantErr bool
+    }{
+        {
+            name: "defaults",
+            check: func(pc PeerCacheConfig) bool {
+                def := DefaultPeerCacheConfig()
+                return pc.Levels == def.Levels && pc.ProbeInterval == def.ProbeInterval &&
+                        pc.MaxProbeInterval == def.MaxProbeInterval
+            },
+        },
+        {
+            name: "overrides",
+            cfg: conf.PeerCache{Levels: 4, ProbeIntervalMs: 500, MaxProbeIntervalMs: 2000,
+                                MaxPeers: 10, MaxPeersPerService: 2},
+            check: func(pc PeerCacheConfig) bool {
+                return pc.Levels == 4 && pc.ProbeInterval == 500 * time.Millisecond &&
+                        pc.MaxProbeInterval == 2 * time.Second && pc.MaxPeers == 10 &&
+                        pc.MaxPeersPerService == 2
+            },
+        },
+        {
+            name: "one level",
+            cfg: conf.PeerCache{Levels: 1},
+            wantErr: true,
+        },
+        {
+            name: "negative probe interval",
+            cfg: conf.PeerCache{ProbeIntervalMs: -1},
+            wantErr: true,
+        },
+        {
+            name: "max probe interval below probe interval",
+            cfg: conf.PeerCache{ProbeIntervalMs: 2000, MaxProbeIntervalMs: 1000},
+            wantErr: true,
+        },
+    }
+    for _, test := range tests {
+        pc, err := NewPeerCacheConfig(conf.Config{PeerCache: test.cfg})
+        if test.wantErr {
+            if err == nil {
+                t.Errorf("%s: NewPeerCacheConfig() = %+v, want error", test.name, pc)
+            }
+            continue
+        }
+        if err != nil {
+            t.Errorf("%s: NewPeerCacheConfig() failed: %v", test.name, err)
+        } else if !test.check(pc) {
+            t.Errorf("%s: NewPeerCacheConfig() = %+v", test.name, pc)
+        }
+    }
+}
+
+func TestServiceScoring(t *testing.T) {
+    config := conf.Config{
+        Defaults: conf.ServiceConfig{
+            PeerScoring: conf.PeerScoring{Penalty: uintPtr(20), Reward: uintPtr(2)},
+        },
+        Services: map[string]conf.ServiceConfig{
+            "svc": {PeerScoring: conf.PeerScoring{Penalty: uintPtr(0)}},
+        },
+    }
+    pc, err := NewPeerCacheConfig(config)
+    if err != nil {
+        t.Fatalf("NewPeerCacheConfig() failed: %v", err)
+    }
+
+    cache := newTestCache()
+    if err := cache.SetConfig(pc); err != nil {
+        t.Fatalf("SetConfig() failed: %v", err)
+    }
+    tests := []struct {
+        servName string
+        penalty  uint
+        reward   uint
+    }{
+        {"other", 20, 2},
+        // Fields the service leaves unset come from Defaults
+        {"svc", 0, 2},
+    }
+    cache.mux.Lock()
+    defer cache.mux.Unlock()
+    for _, test := range tests {
+        s := cache.scoringLocked(test.servName)
+        if s.Penalty != test.penalty || s.Reward != test.reward {
+            t.Errorf("%s: scoring has Penalty %d and Reward %d, want %d and %d",
+                        test.servName, s.Penalty, s.Reward, test.penalty, test.reward)
+        }
+    }
+}
+
+func TestSetConfigValidates(t *testing.T) {
+    tests := []struct {
+        name   string
+        modify func(pc *PeerCacheConfig)
+        ok     bool
+    }{
+        {"defaults", func(pc *PeerCacheConfig) {}, true},
+        {"one level", func(pc *PeerCacheConfig) { pc.Levels = 1 }, false},
+        {"no levels", func(pc *PeerCacheConfig) { pc.Levels = 0 }, false},
+        {"no probe interval", func(pc *PeerCacheConfig) { pc.ProbeInterval = 0 }, false},
+        {"max probe interval too short", func(pc *PeerCacheConfig) {
+            pc.MaxProbeInterval = pc.ProbeInterval / 2
+        }, false},
+        {"bad scoring", func(pc *PeerCacheConfig) { pc.Scoring.DemoteBelow = 95 }, false},
+        {"bad service scoring", func(pc *PeerCacheConfig) {
+            s := DefaultPeerScoring()
+            s.InitialRCount = 0
+            pc.Services["svc"] = s
+        }, false},
+        {"no scorer", func(pc *PeerCacheConfig) { pc.Scoring.Scorer = nil }, false},
+    }
+    for _, test := range tests {
+        cache := newTestCache()
+        pc := DefaultPeerCacheConfig()
+        pc.Levels = 4
+        if err := cache.SetConfig(pc); err != nil {
+            t.Fatalf("%s: SetConfig() failed: %v", test.name, err)
+        }
+
+        pc = DefaultPeerCacheConfig()
+        test.modify(&pc)
+        err := cache.SetConfig(pc)
+        if (err == nil) != test.ok {
+            t.Errorf("%s: SetConfig() error = %v, want ok %v", test.name, err, test.ok)
+        }
+        // Invalid settings leave the current ones in place
+        want := uint(4)
+        if test.ok {
+            want = pc.Levels
+        }
+        cache.mux.Lock()
+        levels := cache.NLevels
+        cache.mux.Unlock()
+        if levels != want {
+            t.Errorf("%s: cache has %d levels, want %d", test.name, levels, want)
+        }
+    }
+}
@@ -4,21 +4,23 @@ import (
     "context"
     "errors"
     "sort"
+    "strconv"
     "sync"
     "time"
-    "log"
 
     "github.com/libp2p/go-libp2p/p2p/protocol/ping"
     "github.com/libp2p/go-libp2p-core/peer"
 
     "github.com/PhysarumSM/common/p2pnode"
     "github.com/PhysarumSM/common/p2putil"
+    "github.com/PhysarumSM/service-registry/registry"
+
+    "github.com/PhysarumSM/service-manager/logging"
+    "github.com/PhysarumSM/service-manager/metrics"
     "github.com/PhysarumSM/service-manager/rcache"
 )
 
-func init() {
-    log.SetFlags(log.Ldate | log.Lmicroseconds | log.Lshortfile)
-}
+var log = logging.New("pcache")
 
 var rcacheDefaultTTL = 600 // Seconds
 
@@ -28,26 +30,77 @@ var rcacheDefaultTTL = 600 // Seconds
 type RPeerInfo struct {
     RCount  uint
     Info    p2putil.PeerInfo
+    // Level the peer is in, 0 being the most reliable
+    Level   uint
+
+    // Average time the service takes to answer on top of the network RTT,
+    // measured from requests through the peer, 0 until one completes
+    ServiceTime time.Duration
+    // Average fraction of requests through the peer that failed
+    ErrorRate   float64
+
+    // Probe results so far, kept up to date with Info.Perf
+    score      PeerScore
+    // When the peer was last picked or sent a request, or added
+    lastUsed   time.Time
+    // When the peer was last probed, the time between its probes, and when
+    // it's next due
+    lastProbe  time.Time
+    probeEvery time.Duration
+    nextProbe  time.Time
+    // Whether the peer was probed since being restored, see RestorePeers()
+    verified   bool
 }
 
 // PeerCache holds the performance requirements
 // and peer levels based on reliability
 type PeerCache struct {
     NLevels uint
-    Levels  [][]RPeerInfo
 
     // Private variables
     node    *p2pnode.Node
     mux     sync.Mutex
-    rmax    uint
+    config  PeerCacheConfig
+
+    // Cached peers by ID, each offering a single service
+    peers   map[peer.ID]*RPeerInfo
+    // IDs of the cached peers offering each service, by service hash
+    byHash  map[string]map[peer.ID]struct{}
 
     // Pointer to a registry cache
     // Has its own internal mutex, so don't need to lock the struct-local mutex
     rcache  *rcache.RegistryCache
+
+    // Load balancing strategy per service name, and for all other services
+    balancers       map[string]Balancer
+    defaultBalancer Balancer
+
+    // Number of requests currently outstanding per peer
+    inflight        map[peer.ID]uint
+
+    // Circuit breakers fed by request outcomes, per peer
+    breakers        map[peer.ID]*CircuitBreaker
+    breakerCfg      BreakerConfig
+
+    // Receivers of the cache's events
+    subscribers     map[*subscriber]struct{}
+
+    // Probes a peer, probePeer unless replaced by tests
+    probe           func(ctx context.Context, info p2putil.PeerInfo) probeResult
 }
 
+// Compares the peers' performance as last reported by their scores, adjusted
+// by what requests through them have seen
 func (l *RPeerInfo) LessThan(r RPeerInfo) bool {
-    return l.Info.Perf.LessThan(r.Info.Perf)
+    return l.EffectivePerf().LessThan(r.EffectivePerf())
+}
+
+// Ranks peers by level, then by performance within a level
+func ranksBefore(l *RPeerInfo, r *RPeerInfo) bool {
+    if l.Level != r.Level {
+        return l.Level < r.Level
+    }
+    return l.LessThan(*r)
 }
 
 // Constructor for PeerCache
@@ -59,209 +112,480 @@ func NewPeerCache(node *p2pnode.Node, regCache *rcache.RegistryCache) *PeerCache
 
     peerCache := PeerCache{rcache: regCache}
 
-    // This is hardcoded for now as there really isn't
-    // need for any more levels than three
-    // Level 0: performant and reliable
-    // Level 1: performant but not reliable
-    // Level 2: not performant and not reliable
-    peerCache.NLevels = 3
-    peerCache.Levels = [][]RPeerInfo{}
-    for i := uint(0); i < peerCache.NLevels; i++ {
-        peerCache.Levels = append(peerCache.Levels, []RPeerInfo{})
-    }
+    // Uses the default settings until SetConfig() or Configure() is called
+    peerCache.config = DefaultPeerCacheConfig()
+    peerCache.NLevels = peerCache.config.Levels
     // Private variables
     peerCache.node = node
-    // Look for top 3 cache results when deleting
-    peerCache.rmax = 3
+    peerCache.peers = make(map[peer.ID]*RPeerInfo)
+    peerCache.byHash = make(map[string]map[peer.ID]struct{})
+    peerCache.balancers = make(map[string]Balancer)
+    peerCache.defaultBalancer = FirstBalancer{}
+    peerCache.inflight = make(map[peer.ID]uint)
+    peerCache.breakers = make(map[peer.ID]*CircuitBreaker)
+    peerCache.breakerCfg = DefaultBreakerConfig()
+    peerCache.subscribers = make(map[*subscriber]struct{})
+    peerCache.probe = peerCache.probePeer
     return &peerCache
 }
 
-// Helper function "add peer to slice"
-func apts(s []RPeerInfo, p RPeerInfo) []RPeerInfo {
-    s = append(s, p)
-    return s
+// Sets the load balancing strategy used for the service servName
+func (cache *PeerCache) SetBalancer(servName string, b Balancer) {
+    cache.mux.Lock()
+    defer cache.mux.Unlock()
+    cache.balancers[servName] = b
+}
+
+// Sets the load balancing strategy used for services without their own
+func (cache *PeerCache) SetDefaultBalancer(b Balancer) {
+    cache.mux.Lock()
+    defer cache.mux.Unlock()
+    cache.defaultBalancer = b
 }
 
-// Helper function "remove peer from slice"
-func rpfs(s []RPeerInfo, i uint) []RPeerInfo {
-    s[len(s)-1], s[i] = s[i], s[len(s)-1]
-    return s[:len(s)-1]
+// Records the start of a request to a peer, used for balancing
+// Every call must be paired with a call to EndRequest
+func (cache *PeerCache) StartRequest(id peer.ID) {
+    cache.mux.Lock()
+    defer cache.mux.Unlock()
+    cache.inflight[id]++
+    cache.touchLocked(id)
 }
 
-func (cache *PeerCache) AddPeer(pInfo p2putil.PeerInfo) {
-    log.Println("Adding new peer with ID and service", pInfo.ID, pInfo.ServHash)
-    // Add peer to cache in second lowest level
+// Records the end of a request to a peer previously passed to StartRequest
+// outcome is fed to the peer's circuit breaker, cancelled requests counting
+// neither for nor against it. latency is how long the request took, or 0 if
+// it didn't complete, and is used to rank the peer.
+func (cache *PeerCache) EndRequest(id peer.ID, latency time.Duration, outcome Outcome) {
     cache.mux.Lock()
     defer cache.mux.Unlock()
-    cache.Levels[cache.NLevels-2] = apts(cache.Levels[cache.NLevels-2],
-        RPeerInfo{
-            // Set RCount to 50 so it doesn't immediately get kicked
-            // to the last level upon cache update
-            RCount: 50,
-            Info: pInfo,
-        },
-    )
+    if cache.inflight[id] <= 1 {
+        delete(cache.inflight, id)
+    } else {
+        cache.inflight[id]--
+    }
+
+    cache.observeRequestLocked(id, latency, outcome)
+}
+
+// State of a cached peer, as reported by Snapshot
+type PeerState struct {
+    RPeerInfo
+    // Requests currently outstanding to the peer
+    Inflight uint
+    // State of the peer's circuit breaker
+    Breaker  BreakerState
 }
 
-func (cache *PeerCache) RemovePeer(id peer.ID) {
+// Returns a copy of the cache levels, best peer first within each level,
+// along with each peer's request state
+func (cache *PeerCache) Snapshot() [][]PeerState {
     cache.mux.Lock()
     defer cache.mux.Unlock()
-    for l := uint(0); l < (cache.NLevels-1); l++ {
-        count := uint(0)
-        for i, p := range cache.Levels[l] {
-            // In each cache level look at the first rmax peers
-            if count < cache.rmax {
-                // Check if the current peer is the one to delete
-                if id == p.Info.ID {
-                    cache.Levels[l] = rpfs(cache.Levels[l], uint(i))
-                    // No need to decrement i after rpfs since we're going to return
-                    return
-                }
-                count++
-            } else {
-                // Go to next level
-                break
-            }
+    levels := make([][]PeerState, cache.NLevels)
+    for l := range levels {
+        levels[l] = []PeerState{}
+    }
+    for _, p := range cache.sortedLocked(cache.peers) {
+        state := PeerState{RPeerInfo: *p, Inflight: cache.inflight[p.Info.ID]}
+        if cb, ok := cache.breakers[p.Info.ID]; ok {
+            state.Breaker = cb.State()
         }
+        levels[p.Level] = append(levels[p.Level], state)
     }
+    return levels
+}
+
+// Returns the peers in ranked order
+func (cache *PeerCache) sortedLocked(peers map[peer.ID]*RPeerInfo) []*RPeerInfo {
+    sorted := make([]*RPeerInfo, 0, len(peers))
+    for _, p := range peers {
+        sorted = append(sorted, p)
+    }
+    sort.Slice(sorted, func(i, j int) bool {
+        return ranksBefore(sorted[i], sorted[j])
+    })
+    return sorted
+}
+
+// Adds a peer to the cache, in the second lowest level
+// Does nothing if the peer is already cached, returning false
+func (cache *PeerCache) AddPeer(pInfo p2putil.PeerInfo) bool {
+    cache.mux.Lock()
+    defer cache.mux.Unlock()
+    if _, ok := cache.peers[pInfo.ID]; ok {
+        return false
+    }
+    cache.addPeerLocked(pInfo)
+    return true
+}
+
+// Adds a peer to the cache, or updates it if it's already cached
+// An updated peer keeps its level and RCount, and its new performance is fed
+// to its score as if it were a probe result
+func (cache *PeerCache) UpsertPeer(pInfo p2putil.PeerInfo) {
+    cache.mux.Lock()
+    defer cache.mux.Unlock()
+    p, ok := cache.peers[pInfo.ID]
+    if !ok {
+        cache.addPeerLocked(pInfo)
+        return
+    }
+
+    if p.Info.ServHash != pInfo.ServHash {
+        cache.unindexLocked(p)
+        p.Info.ServHash = pInfo.ServHash
+        cache.indexLocked(p)
+    }
+    p.Info.ServName = pInfo.ServName
+    if pInfo.Perf.RTT > 0 {
+        p.score.Observe(pInfo.Perf.RTT)
+        p.Info.Perf = p.score.Perf()
+        // Just found to be up, no need to wait for a probe
+        p.verified = true
+    }
+}
+
+func (cache *PeerCache) addPeerLocked(pInfo p2putil.PeerInfo) *RPeerInfo {
+    p := cache.newPeerLocked(pInfo)
+    cache.insertPeerLocked(p)
+    return p
+}
+
+// Returns a newly cached peer, not yet added to the cache
+func (cache *PeerCache) newPeerLocked(pInfo p2putil.PeerInfo) *RPeerInfo {
+    scoring := cache.scoringLocked(pInfo.ServName)
+    now := time.Now()
+    p := &RPeerInfo{
+        RCount: scoring.InitialRCount,
+        Info: pInfo,
+        Level: cache.NLevels-2,
+        lastUsed: now,
+        lastProbe: now,
+        probeEvery: cache.config.ProbeInterval,
+        nextProbe: now,
+        verified: true,
+    }
+    p.resetScore(scoring.Scorer)
+    return p
+}
+
+// Adds a peer from newPeerLocked() to the cache, making room for it if needed
+func (cache *PeerCache) insertPeerLocked(p *RPeerInfo) {
+    log.Println("Adding new peer with ID and service", p.Info.ID, p.Info.ServHash)
+    cache.makeRoomLocked(p.Info.ServHash)
+    cache.peers[p.Info.ID] = p
+    cache.indexLocked(p)
+    cache.publishAddedLocked(*p, p.Level)
+}
+
+// Removes a peer from the cache, whatever level it's in
+// Returns false if the peer wasn't cached
+func (cache *PeerCache) RemovePeer(id peer.ID) bool {
+    cache.mux.Lock()
+    defer cache.mux.Unlock()
+    p, ok := cache.peers[id]
+    if !ok {
+        return false
+    }
+    cache.evictLocked(p, EvictRemoved)
+    return true
+}
+
+func (cache *PeerCache) evictLocked(p *RPeerInfo, reason string) {
+    delete(cache.peers, p.Info.ID)
+    cache.unindexLocked(p)
+    cache.publishEvictedLocked(*p, p.Level, reason)
+}
+
+func (cache *PeerCache) indexLocked(p *RPeerInfo) {
+    ids, ok := cache.byHash[p.Info.ServHash]
+    if !ok {
+        ids = make(map[peer.ID]struct{})
+        cache.byHash[p.Info.ServHash] = ids
+    }
+    ids[p.Info.ID] = struct{}{}
+}
+
+func (cache *PeerCache) unindexLocked(p *RPeerInfo) {
+    if ids, ok := cache.byHash[p.Info.ServHash]; ok {
+        delete(ids, p.Info.ID)
+        if len(ids) == 0 {
+            delete(cache.byHash, p.Info.ServHash)
+        }
+    }
+}
+
+// Returns the cached peers offering the service that can take requests,
+// best first
+// Leaves out the last level (non-performant peers due for removal), restored
+// peers yet to be probed, and peers whose circuit breaker isn't letting
+// requests through
+func (cache *PeerCache) candidatesLocked(hash string) []Candidate {
+    peers := make(map[peer.ID]*RPeerInfo)
+    for id := range cache.byHash[hash] {
+        p := cache.peers[id]
+        if p.Level < cache.NLevels-1 && p.verified && cache.breakerAvailableLocked(id) {
+            peers[id] = p
+        }
+    }
+
+    var candidates []Candidate
+    for _, p := range cache.sortedLocked(peers) {
+        candidates = append(candidates,
+            Candidate{RPeerInfo: *p, Inflight: cache.inflight[p.Info.ID]})
+    }
+    return candidates
 }
 
 // Gets a reliable peer from cache
+// All cached peers offering the service are considered, and one is chosen
+// using the service's balancing strategy
 func (cache *PeerCache) GetPeer(hash string) (peer.ID, error) {
-    // Search levels starting from level 0 (most reliable)
-    // omitting the last level (non-performant peers due for removal)
     cache.mux.Lock()
     defer cache.mux.Unlock()
-    for l := uint(0); l < (cache.NLevels-1); l++ {
-        for _, p := range cache.Levels[l] {
-            // Return the first performant peer
-            if p.Info.ServHash == hash {
-                log.Println("Getting peer with ID", p.Info.ID, "from pcache")
-                return p.Info.ID, nil
+    candidates := cache.candidatesLocked(hash)
+    if len(candidates) == 0 {
+        metrics.PeerCacheLookups.WithLabelValues("miss").Inc()
+        return peer.ID(""), errors.New("No suitable peer found in cache")
+    }
+
+    // Prefer peers meeting the service's soft requirement, if any do
+    // Judged by the same performance peers are ranked by, so service time and
+    // errors count against a peer as well as its RTT
+    // Uses whatever is in the registry cache to avoid blocking on a request
+    servName := candidates[0].Info.ServName
+    if servInfo, ok := cache.rcache.Get(servName); ok {
+        var performant []Candidate
+        for _, c := range candidates {
+            if !servInfo.NetworkSoftReq.LessThan(c.EffectivePerf()) {
+                performant = append(performant, c)
             }
         }
+        if len(performant) > 0 {
+            candidates = performant
+        }
+    }
+
+    balancer, ok := cache.balancers[servName]
+    if !ok {
+        balancer = cache.defaultBalancer
+    }
+    p := candidates[balancer.Pick(candidates)]
+    if cb, ok := cache.breakers[p.Info.ID]; ok && !cb.Acquire() {
+        // Another request took the last half-open probe since the check above
+        metrics.PeerCacheLookups.WithLabelValues("miss").Inc()
+        return peer.ID(""), errors.New("No suitable peer found in cache")
+    }
+    metrics.PeerCacheLookups.WithLabelValues("hit").Inc()
+    cache.touchLocked(p.Info.ID)
+    log.Debugln("Getting peer with ID", p.Info.ID, "from pcache")
+    return p.Info.ID, nil
+}
+
+// Returns up to n cached peers offering the service, best first
+// Peers are ranked by cache level, then by performance within a level, and
+// those whose circuit breaker isn't letting requests through are left out.
+// Unlike GetPeer no balancing is done and no half-open probes are used up.
+func (cache *PeerCache) GetPeers(hash string, n int) []Candidate {
+    cache.mux.Lock()
+    defer cache.mux.Unlock()
+    candidates := cache.candidatesLocked(hash)
+    if len(candidates) > n {
+        candidates = candidates[:n]
+    }
+    return candidates
+}
+
+// Maximum number of peers probed at once by updateCache
+const maxConcurrentProbes = 32
+
+// Outcome of probing a cached peer
+type probeResult struct {
+    perf     p2putil.PerfInd
+    servInfo registry.ServiceInfo
+}
+
+// Pings a peer to check its performance, with the timeout based on its
+// service's hard performance requirement
+func (cache *PeerCache) probePeer(ctx context.Context, info p2putil.PeerInfo) probeResult {
+    servInfo, err := cache.rcache.GetOrRequestServiceNoTouch(info.ServName)
+    if err != nil {
+        log.Printf("ERROR: Unable to get service information for %s\n%v\n",
+                    info.ServName, err)
     }
-    return peer.ID(""), errors.New("No suitable peer found in cache")
+
+    pingCtx, pingCanc := context.WithTimeout(ctx, servInfo.NetworkHardReq.RTT)
+    defer pingCanc()
+    result := <-ping.Ping(pingCtx, cache.node.Host, info.ID)
+    return probeResult{perf: p2putil.PerfInd{RTT: result.RTT}, servInfo: servInfo}
 }
 
+// Probes the cached peers that are due concurrently, without holding the
+// cache lock
+// Returns the result for each peer probed
+func (cache *PeerCache) probePeers(ctx context.Context) map[peer.ID]probeResult {
+    cache.mux.Lock()
+    now := time.Now()
+    var peers []p2putil.PeerInfo
+    for _, p := range cache.peers {
+        if !now.Before(p.nextProbe) {
+            peers = append(peers, p.Info)
+        }
+    }
+    cache.mux.Unlock()
+
+    results := make(map[peer.ID]probeResult, len(peers))
+    var resultsMux sync.Mutex
+    var wg sync.WaitGroup
+    sem := make(chan struct{}, maxConcurrentProbes)
+    for _, info := range peers {
+        wg.Add(1)
+        sem <- struct{}{}
+        go func(info p2putil.PeerInfo) {
+            defer wg.Done()
+            defer func() { <-sem }()
+            res := cache.probe(ctx, info)
+            resultsMux.Lock()
+            results[info.ID] = res
+            resultsMux.Unlock()
+        }(info)
+    }
+    wg.Wait()
+    return results
+}
 
 // Helper function that updates RCounts and changes peer reliability levels in cache
+// Peers are probed without holding the lock, so lookups never wait on the
+// network, and the results are then applied all at once
 func (cache *PeerCache) updateCache() {
-    cache.mux.Lock()
-    defer cache.mux.Unlock()
     // Setup context
     ctx, cancel := context.WithCancel(cache.node.Ctx)
     defer cancel()
+    results := cache.probePeers(ctx)
+
+    cache.mux.Lock()
+    defer cache.mux.Unlock()
+    // Catch subscribers up on evictions held back since the last update
+    cache.flushPendingLocked()
     nLevels := cache.NLevels
+    now := time.Now()
     // First pass: update RCounts
-    for l := uint(0); l < nLevels; l++ {
-        for i := 0; i < len(cache.Levels[l]); i++ {
-            // Ping peers to check performance
-            peerRlb := &cache.Levels[l][i]
-            servInfo, err := cache.rcache.GetOrRequestService(peerRlb.Info.ServName)
-            if err != nil {
-                log.Printf("ERROR: Unable to get service information for %s\n%v\n",
-                            peerRlb.Info.ServName, err)
-            }
+    for _, p := range cache.peers {
+        res, ok := results[p.Info.ID]
+        if !ok {
+            // Not due yet, or added while probing
+            continue
+        }
+        cache.scheduleProbeLocked(p, now)
+        servInfo := res.servInfo
+        scoring := cache.scoringLocked(p.Info.ServName)
+        p.score.Observe(res.perf.RTT)
+        perf := p.score.Perf()
 
-            // Set pnig timeout based on service's hard performance requirement
-            pingCtx, pingCanc := context.WithTimeout(ctx, servInfo.NetworkHardReq.RTT)
-            defer pingCanc()
-            responseChan := ping.Ping(pingCtx, cache.node.Host, peerRlb.Info.ID)
-            result := <-responseChan
-
-            // If peer isn't up or doesn't meet hard requirements remove from cache
-            perf := p2putil.PerfInd{RTT: result.RTT}
-            if result.RTT == 0 || servInfo.NetworkHardReq.LessThan(perf) {
-                cache.Levels[l] = rpfs(cache.Levels[l], uint(i))
-                // Decrement i to account for rpfs
-                i--
-            // If peer is up and doesn't meet requirements decrement RCount by 10
-            } else if servInfo.NetworkSoftReq.LessThan(perf) {
-                peerRlb.Info.Perf = perf
-                if peerRlb.RCount < 10 {
-                    peerRlb.RCount = 0
-                } else {
-                    peerRlb.RCount -= 10
-                }
-            // If it does meet requirements then increment RCount
+        // If peer isn't up or doesn't meet hard requirements remove from cache
+        if p.score.Down() {
+            cache.evictLocked(p, EvictUnreachable)
+        } else if perf.RTT == 0 {
+            // Scorer tolerates the lost probes, but there's no answer to
+            // judge the peer by yet
+            continue
+        } else if servInfo.NetworkHardReq.LessThan(perf) {
+            cache.evictLocked(p, EvictHardReq)
+        // If peer is up and doesn't meet requirements penalize its RCount
+        } else if servInfo.NetworkSoftReq.LessThan(perf) {
+            p.verified = true
+            p.Info.Perf = perf
+            if p.RCount < scoring.Penalty {
+                p.RCount = 0
             } else {
-                peerRlb.Info.Perf = perf
-                if peerRlb.RCount < 100 {
-                    peerRlb.RCount++
-                }
+                p.RCount -= scoring.Penalty
+            }
+        // If it does meet requirements then reward its RCount
+        } else {
+            p.verified = true
+            p.Info.Perf = perf
+            p.RCount += scoring.Reward
+            if p.RCount > scoring.MaxRCount {
+                p.RCount = scoring.MaxRCount
             }
         }
     }
 
     // Second pass: move updated peers into appropriate new levels
-    // Move peers in top level down if they become unreliable
-    for i := 0; i < len(cache.Levels[0]); i++ {
-        if cache.Levels[0][i].RCount < 90 {
-            // Set RCount to 50 when dropping to penalize inconsistency
-            cache.Levels[0][i].RCount = 50
-            cache.Levels[1] = apts(cache.Levels[1], cache.Levels[0][i])
-            cache.Levels[0] = rpfs(cache.Levels[0], uint(i))
-            // Decrement i to account for rpfs
-            i--
-        }
-    }
-
-    // Move peers in middle level(s) to appropriate new levels
-    for l := uint(1); l < (cache.NLevels-1); l++ {
-        for i := 0; i < len(cache.Levels[l]); i++ {
-            if cache.Levels[l][i].RCount > 90 {
+    // Each peer moves at most one level per update
+    for _, p := range cache.peers {
+        scoring := cache.scoringLocked(p.Info.ServName)
+        from := p.Level
+        if p.Level == 0 {
+            // Move peers in top level down if they become unreliable
+            if p.RCount < scoring.PromoteAbove {
+                // Reset RCount when dropping to penalize inconsistency
+                p.RCount = scoring.ResetRCount
+                p.Level++
+            }
+        } else if p.Level < nLevels-1 {
+            // Move peers in middle level(s) to appropriate new levels
+            if p.RCount > scoring.PromoteAbove {
                 // Do not change RCount when promoting so consistently
                 // reliable peers get promoted quickly
-                cache.Levels[l-1] = apts(cache.Levels[l-1], cache.Levels[l][i])
-                cache.Levels[l] = rpfs(cache.Levels[l], uint(i))
-                // Decrement i to account for rpfs
-                i--
-            } else if cache.Levels[l][i].RCount < 10 {
-                // Set RCount to 50 when dropping to give a slight
+                p.Level--
+            } else if p.RCount < scoring.DemoteBelow {
+                // Reset RCount when dropping to give a slight
                 // buffer so nodes do not chain drop to the last level
                 // while it is recovering
-                cache.Levels[l][i].RCount = 50
-                cache.Levels[l+1] = apts(cache.Levels[l+1], cache.Levels[l][i])
-                cache.Levels[l] = rpfs(cache.Levels[l], uint(i))
-                // Decrement i to account for rpfs
-                i--
+                p.RCount = scoring.ResetRCount
+                p.Level++
             }
         }
+        if p.Level != from {
+            cache.publishMovedLocked(*p, from, p.Level)
+        }
     }
 
+    // Forget circuit breakers that have nothing to say
+    cache.pruneBreakersLocked()
+
     // Remove all peers in last level (unreliable peers)
-    cache.Levels[nLevels-1] = cache.Levels[nLevels-1][0:0]
-    // Third pass: sort elements based on performance
-    for l := uint(0); l < nLevels; l++ {
-        sort.Slice(cache.Levels[l], func(i, j int) bool {
-            return cache.Levels[l][i].LessThan(cache.Levels[l][j])
-        })
+    for _, p := range cache.peers {
+        if p.Level == nLevels-1 {
+            cache.evictLocked(p, EvictUnreliable)
+        }
+    }
+
+    counts := make([]int, nLevels)
+    for _, p := range cache.peers {
+        counts[p.Level]++
+    }
+    for l, count := range counts {
+        metrics.PeerCacheLevelPeers.WithLabelValues(strconv.Itoa(l)).Set(float64(count))
     }
 }
 
 
 // Takes care of adding new peers and updating cache levels
-// UpdateCache ideally is run in a separate goroutine
-func (cache *PeerCache) UpdateCache() {
+// UpdateCache ideally is run in a separate goroutine, and returns once ctx
+// or the node's context is cancelled
+func (cache *PeerCache) UpdateCache(ctx context.Context) {
     // Start a timer to track when to run update
     log.Println("Launching cache update function")
-    ticker := time.NewTicker(1 * time.Second)
+    ticker := time.NewTicker(cache.probeInterval())
+    defer ticker.Stop()
     for {
-        if cache.node.Ctx.Err() != nil {
-            ticker.Stop()
+        if ctx.Err() != nil || cache.node.Ctx.Err() != nil {
+            log.Println("Stopping cache update function")
             return
         }
         select {
+        case <-ctx.Done():
         case <-cache.node.Ctx.Done():
-            ticker.Stop()
-            return
         case <-ticker.C:
             // Kill ticker to prevent ticking while updating cache
             ticker.Stop()
             cache.updateCache()
             // Create new ticker to restart ticking after update
-            ticker = time.NewTicker(1 * time.Second)
+            // Picks up any change to the probe interval
+            ticker = time.NewTicker(cache.probeInterval())
         }
     }
 }
@@ -0,0 +1,213 @@
+package pcache
+
+import (
+    "testing"
+    "time"
+
+    "github.com/libp2p/go-libp2p-core/peer"
+
+    "github.com/PhysarumSM/common/p2putil"
+    "github.com/PhysarumSM/service-registry/registry"
+)
+
+func TestGetPeerSoftRequirement(t *testing.T) {
+    type cachedPeer struct {
+        id          string
+        level       uint
+        rtt         time.Duration
+        serviceTime time.Duration
+        errorRate   float64
+    }
+    tests := []struct {
+        name  string
+        peers []cachedPeer
+        want  peer.ID
+    }{
+        {
+            "meets requirement",
+            []cachedPeer{{"top", 0, 20 * time.Millisecond, 0, 0},
+                        {"other", 1, 30 * time.Millisecond, 0, 0}},
+            peer.ID("top"),
+        },
+        {
+            // Low RTT, but requests take too long to serve
+            "slow service",
+            []cachedPeer{{"slow", 0, 10 * time.Millisecond, 200 * time.Millisecond, 0},
+                        {"fast", 1, 50 * time.Millisecond, 0, 0}},
+            peer.ID("fast"),
+        },
+        {
+            "failing requests",
+            []cachedPeer{{"flaky", 0, 60 * time.Millisecond, 0, 0.5},
+                        {"fast", 1, 50 * time.Millisecond, 0, 0}},
+            peer.ID("fast"),
+        },
+        {
+            // Falls back to every candidate when none meet it
+            "none meet requirement",
+            []cachedPeer{{"slow", 0, 10 * time.Millisecond, 200 * time.Millisecond, 0},
+                        {"far", 1, 150 * time.Millisecond, 0, 0}},
+            peer.ID("slow"),
+        },
+    }
+    for _, test := range tests {
+        cache := newTestCache()
+        cache.rcache.Add("svc", registry.ServiceInfo{
+            ContentHash: "svc",
+            NetworkSoftReq: p2putil.PerfInd{RTT: 100 * time.Millisecond},
+        })
+        cache.mux.Lock()
+        for _, cp := range test.peers {
+            info := testPeer(cp.id)
+            info.Perf.RTT = cp.rtt
+            p := cache.newPeerLocked(info)
+            p.Level = cp.level
+            p.ServiceTime = cp.serviceTime
+            p.ErrorRate = cp.errorRate
+            cache.insertPeerLocked(p)
+        }
+        cache.mux.Unlock()
+
+        id, err := cache.GetPeer("svc")
+        if err != nil || id != test.want {
+            t.Errorf("%s: GetPeer() = (%s, %v), want (%s, nil)", test.name, id, err, test.want)
+        }
+    }
+}
+
+func TestAddPeerDedupes(t *testing.T) {
+    cache := newTestCache()
+    if !cache.AddPeer(testPeer("a")) {
+        t.Errorf("AddPeer() = false for a new peer")
+    }
+    cache.mux.Lock()
+    cache.peers[peer.ID("a")].Level = 0
+    cache.mux.Unlock()
+    if cache.AddPeer(testPeer("a")) {
+        t.Errorf("AddPeer() = true for a cached peer")
+    }
+
+    // The cached peer is left where it was
+    cache.mux.Lock()
+    defer cache.mux.Unlock()
+    if n := len(cache.peers); n != 1 {
+        t.Errorf("%d peers cached, want 1", n)
+    }
+    if level := cache.peers[peer.ID("a")].Level; level != 0 {
+        t.Errorf("Peer moved to level %d, want 0", level)
+    }
+}
+
+func TestUpsertPeer(t *testing.T) {
+    cache := newTestCache()
+    cache.AddPeer(testPeer("a"))
+    cache.mux.Lock()
+    cache.peers[peer.ID("a")].verified = false
+    cache.mux.Unlock()
+
+    // The same peer now offering another service, just found to be up
+    moved := p2putil.PeerInfo{ID: peer.ID("a"), ServName: "other", ServHash: "other",
+                                Perf: p2putil.PerfInd{RTT: 10 * time.Millisecond}}
+    cache.UpsertPeer(moved)
+    if got := cache.GetPeers("svc", 10); len(got) != 0 {
+        t.Errorf("GetPeers(svc) = %d peers after the peer moved, want 0", len(got))
+    }
+    got := cache.GetPeers("other", 10)
+    if len(got) != 1 || got[0].Info.ID != moved.ID || got[0].Info.ServName != "other" {
+        t.Errorf("GetPeers(other) = %+v, want the moved peer", got)
+    }
+
+    cache.UpsertPeer(testPeer("b"))
+    if got := cache.GetPeers("svc", 10); len(got) != 1 || got[0].Info.ID != peer.ID("b") {
+        t.Errorf("GetPeers(svc) = %+v, want the upserted peer", got)
+    }
+}
+
+func TestRemovePeer(t *testing.T) {
+    tests := []struct {
+        name  string
+        level uint
+    }{
+        {"top level", 0},
+        {"middle level", 1},
+        {"last level", 2},
+    }
+    for _, test := range tests {
+        cache := newTestCache()
+        cache.AddPeer(testPeer("a"))
+        cache.mux.Lock()
+        cache.peers[peer.ID("a")].Level = test.level
+        cache.mux.Unlock()
+
+        if !cache.RemovePeer(peer.ID("a")) {
+            t.Errorf("%s: RemovePeer() = false for a cached peer", test.name)
+        }
+        if cache.RemovePeer(peer.ID("a")) {
+            t.Errorf("%s: RemovePeer() = true for a removed peer", test.name)
+        }
+        cache.mux.Lock()
+        n, indexed := len(cache.peers), len(cache.byHash["svc"])
+        cache.mux.Unlock()
+        if n != 0 || indexed != 0 {
+            t.Errorf("%s: %d peers cached and %d indexed after removal, want 0",
+                        test.name, n, indexed)
+        }
+    }
+}
+
+func TestGetPeers(t *testing.T) {
+    cache := newTestCache()
+    cache.SetBreakerConfig(testBreakerConfig())
+    type cachedPeer struct {
+        id          string
+        level       uint
+        rtt         time.Duration
+        unverified  bool
+        openBreaker bool
+    }
+    for _, cp := range []cachedPeer{
+        {"slow", 1, 50 * time.Millisecond, false, false},
+        {"fast", 1, 10 * time.Millisecond, false, false},
+        {"top", 0, 90 * time.Millisecond, false, false},
+        // Left out
+        {"due for removal", 2, time.Millisecond, false, false},
+        {"unprobed", 0, time.Millisecond, true, false},
+        {"failing", 0, time.Millisecond, false, true},
+    } {
+        info := testPeer(cp.id)
+        info.Perf.RTT = cp.rtt
+        cache.mux.Lock()
+        p := cache.newPeerLocked(info)
+        p.Level = cp.level
+        p.verified = !cp.unverified
+        cache.insertPeerLocked(p)
+        if cp.openBreaker {
+            openBreaker(cache.breakerLocked(p.Info.ID))
+        }
+        cache.mux.Unlock()
+    }
+    other := testPeer("other service")
+    other.ServHash = "other"
+    cache.AddPeer(other)
+
+    tests := []struct {
+        n    int
+        want []peer.ID
+    }{
+        {10, []peer.ID{"top", "fast", "slow"}},
+        {2, []peer.ID{"top", "fast"}},
+        {0, []peer.ID{}},
+    }
+    for _, test := range tests {
+        got := cache.GetPeers("svc", test.n)
+        if len(got) != len(test.want) {
+            t.Errorf("GetPeers(svc, %d) = %d peers, want %v", test.n, len(got), test.want)
+            continue
+        }
+        for i, c := range got {
+            if c.Info.ID != test.want[i] {
+                t.Errorf("GetPeers(svc, %d)[%d] = %s, want %s", test.n, i, c.Info.ID, test.want[i])
+            }
+        }
+    }
+}
@@ -0,0 +1,80 @@
+package pcache
+
+// Saving cached peers and restoring them after a restart
+// Restored peers aren't handed out until a probe shows they're still up
+
+import (
+    "time"
+
+    "github.com/PhysarumSM/common/p2putil"
+)
+
+// A cached peer as saved by SavedPeers
+type SavedPeer struct {
+    Info        p2putil.PeerInfo
+    Level       uint
+    RCount      uint
+    ServiceTime time.Duration
+    ErrorRate   float64
+}
+
+// Returns the cached peers that have been probed since they were added or
+// restored, best first
+func (cache *PeerCache) SavedPeers() []SavedPeer {
+    cache.mux.Lock()
+    defer cache.mux.Unlock()
+    var saved []SavedPeer
+    for _, p := range cache.sortedLocked(cache.peers) {
+        if !p.verified {
+            continue
+        }
+        saved = append(saved, SavedPeer{
+            Info: p.Info,
+            Level: p.Level,
+            RCount: p.RCount,
+            ServiceTime: p.ServiceTime,
+            ErrorRate: p.ErrorRate,
+        })
+    }
+    return saved
+}
+
+// Adds previously saved peers back into the cache, leaving any already cached
+// as they are, and returns how many were restored
+// Restored peers are probed on the next cache update, and only handed out
+// once they pass
+func (cache *PeerCache) RestorePeers(peers []SavedPeer) int {
+    cache.mux.Lock()
+    defer cache.mux.Unlock()
+    restored := 0
+    for _, saved := range peers {
+        if _, ok := cache.peers[saved.Info.ID]; ok || saved.Info.ID == "" {
+            continue
+        }
+        // Peers in the last level were due for removal anyway
+        if saved.Level >= cache.NLevels-1 {
+            continue
+        }
+        // Set up the peer as saved before adding it, so subscribers see the
+        // level it's restored to
+        p := cache.newPeerLocked(saved.Info)
+        p.verified = false
+        p.Level = saved.Level
+        // The scoring config may have changed since the peer was saved, so
+        // keep its RCount in range, and don't let it be promoted before it's
+        // been probed
+        scoring := cache.scoringLocked(saved.Info.ServName)
+        p.RCount = saved.RCount
+        if p.RCount > scoring.MaxRCount {
+            p.RCount = scoring.MaxRCount
+        }
+        if p.Level > 0 && p.RCount > scoring.PromoteAbove {
+            p.RCount = scoring.PromoteAbove
+        }
+        p.ServiceTime = saved.ServiceTime
+        p.ErrorRate = saved.ErrorRate
+        cache.insertPeerLocked(p)
+        restored++
+    }
+    return restored
+}
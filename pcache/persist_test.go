@@ -0,0 +1,94 @@
+package pcache
+
+import (
+    "testing"
+
+    "github.com/libp2p/go-libp2p-core/peer"
+
+    "github.com/PhysarumSM/common/p2putil"
+)
+
+func TestRestorePeers(t *testing.T) {
+    cache := newTestCache()
+    cached := p2putil.PeerInfo{ID: peer.ID("cached"), ServName: "svc", ServHash: "svc"}
+    cache.mux.Lock()
+    cache.insertPeerLocked(cache.newPeerLocked(cached))
+    cache.mux.Unlock()
+
+    events, unsubscribe := cache.Subscribe(10)
+    defer unsubscribe()
+
+    saved := []SavedPeer{
+        {Info: p2putil.PeerInfo{ID: peer.ID("top"), ServName: "svc", ServHash: "svc"},
+            Level: 0, RCount: 95},
+        {Info: p2putil.PeerInfo{ID: peer.ID("middle"), ServName: "svc", ServHash: "svc"},
+            Level: 1, RCount: 40},
+        // Saved under a higher MaxRCount
+        {Info: p2putil.PeerInfo{ID: peer.ID("over max"), ServName: "svc", ServHash: "svc"},
+            Level: 0, RCount: 500},
+        // Would be promoted on the first update, before being probed
+        {Info: p2putil.PeerInfo{ID: peer.ID("over promote"), ServName: "svc", ServHash: "svc"},
+            Level: 1, RCount: 95},
+        // Peers due for removal aren't restored
+        {Info: p2putil.PeerInfo{ID: peer.ID("last"), ServName: "svc", ServHash: "svc"},
+            Level: 2, RCount: 5},
+        {Info: cached, Level: 0, RCount: 99},
+        {Info: p2putil.PeerInfo{ServName: "svc", ServHash: "svc"}},
+    }
+    if n := cache.RestorePeers(saved); n != 4 {
+        t.Errorf("RestorePeers() = %d, want 4", n)
+    }
+
+    tests := []struct {
+        id     peer.ID
+        level  uint
+        rcount uint
+    }{
+        {peer.ID("top"), 0, 95},
+        {peer.ID("middle"), 1, 40},
+        {peer.ID("over max"), 0, 100},
+        {peer.ID("over promote"), 1, 90},
+    }
+    for _, test := range tests {
+        // Subscribers see each peer added straight into the level it's
+        // restored to
+        select {
+        case e := <-events:
+            if e.Type != PeerAdded || e.Peer.ID != test.id || e.To != int(test.level) {
+                t.Errorf("Got event %s for %s to level %d, want %s for %s to level %d",
+                            e.Type, e.Peer.ID, e.To, PeerAdded, test.id, test.level)
+            }
+        default:
+            t.Errorf("No event for %s", test.id)
+        }
+
+        cache.mux.Lock()
+        p, ok := cache.peers[test.id]
+        cache.mux.Unlock()
+        if !ok {
+            t.Errorf("%s: not restored", test.id)
+            continue
+        }
+        if p.Level != test.level || p.RCount != test.rcount || p.verified {
+            t.Errorf("%s: restored with level %d, RCount %d and verified %v, " +
+                        "want %d, %d and false", test.id, p.Level, p.RCount, p.verified,
+                        test.level, test.rcount)
+        }
+    }
+    select {
+    case e := <-events:
+        t.Errorf("Unexpected event %s for %s", e.Type, e.Peer.ID)
+    default:
+    }
+    cache.mux.Lock()
+    _, ok := cache.peers[peer.ID("last")]
+    cache.mux.Unlock()
+    if ok {
+        t.Errorf("last: restored, want skipped")
+    }
+
+    // Restored peers aren't saved again until they've been probed
+    if saved := cache.SavedPeers(); len(saved) != 1 || saved[0].Info.ID != cached.ID {
+        t.Errorf("SavedPeers() = %+v, want only %s", saved, cached.ID)
+    }
+}
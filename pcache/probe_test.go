@@ -0,0 +1,87 @@
+package pcache
+
+import (
+    "context"
+    "fmt"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/libp2p/go-libp2p-core/peer"
+
+    "github.com/PhysarumSM/common/p2putil"
+)
+
+func TestProbePeersConcurrently(t *testing.T) {
+    cache := newTestCache()
+    cache.mux.Lock()
+    cache.config.MaxPeersPerService = 0
+    cache.mux.Unlock()
+    const due = maxConcurrentProbes + 8
+    for i := 0; i < due; i++ {
+        cache.AddPeer(testPeer(fmt.Sprintf("peer%d", i)))
+    }
+    cache.AddPeer(testPeer("not due"))
+    cache.mux.Lock()
+    cache.peers[peer.ID("not due")].nextProbe = time.Now().Add(time.Minute)
+    cache.mux.Unlock()
+
+    var mux sync.Mutex
+    active, maxActive := 0, 0
+    full := make(chan struct{})
+    var fullOnce sync.Once
+    release := make(chan struct{})
+    cache.probe = func(ctx context.Context, info p2putil.PeerInfo) probeResult {
+        mux.Lock()
+        active++
+        if active > maxActive {
+            maxActive = active
+        }
+        if active == maxConcurrentProbes {
+            fullOnce.Do(func() { close(full) })
+        }
+        mux.Unlock()
+        <-release
+        mux.Lock()
+        active--
+        mux.Unlock()
+        return probeResult{perf: p2putil.PerfInd{RTT: time.Millisecond}}
+    }
+
+    done := make(chan map[peer.ID]probeResult)
+    go func() {
+        done <- cache.probePeers(context.Background())
+    }()
+    select {
+    case <-full:
+    case <-time.After(time.Second):
+        t.Fatalf("Probes didn't run concurrently")
+    }
+
+    // Lookups don't wait on probes under way
+    lookup := make(chan error)
+    go func() {
+        _, err := cache.GetPeer("svc")
+        lookup <- err
+    }()
+    select {
+    case err := <-lookup:
+        if err != nil {
+            t.Errorf("GetPeer() during probes failed: %v", err)
+        }
+    case <-time.After(time.Second):
+        t.Errorf("GetPeer() blocked on probes under way")
+    }
+
+    close(release)
+    results := <-done
+    if len(results) != due {
+        t.Errorf("probePeers() probed %d peers, want %d", len(results), due)
+    }
+    if _, ok := results[peer.ID("not due")]; ok {
+        t.Errorf("probePeers() probed a peer that wasn't due")
+    }
+    if maxActive != maxConcurrentProbes {
+        t.Errorf("%d probes ran at once, want %d", maxActive, maxConcurrentProbes)
+    }
+}
@@ -0,0 +1,296 @@
+package pcache
+
+// Scoring strategies for combining a cached peer's probe results
+// A peer's score decides whether it's dropped, whether it meets its service's
+// soft requirement (and so gains or loses RCount), and how it ranks within its
+// level. Scoring over several probes keeps one noisy ping from demoting an
+// otherwise good peer.
+
+import (
+    "fmt"
+    "time"
+
+    "github.com/PhysarumSM/common/p2putil"
+
+    "github.com/PhysarumSM/service-manager/conf"
+)
+
+// Names of the available scorers
+const (
+    ScorerRCount = "rcount"
+    ScorerEWMA = "ewma"
+    ScorerJitter = "jitter"
+    ScorerLoss = "loss"
+)
+
+// Settings used for any the configuration file leaves out
+const (
+    defaultEWMAWeight = 0.2
+    defaultJitterWeight = 2.0
+    defaultLossWindow = 10
+    defaultLossMinProbes = 3
+    defaultMaxLoss = 0.3
+)
+
+// Keeps track of a single cached peer's probe results
+// Only used with the cache's lock held
+type PeerScore interface {
+    // Records a probe, with an RTT of 0 if the peer didn't answer
+    Observe(rtt time.Duration)
+    // Performance the peer is ranked by and checked against its service's
+    // requirements, with an RTT of 0 if there's nothing to go on yet
+    Perf() p2putil.PerfInd
+    // Whether the peer should be dropped from the cache
+    Down() bool
+}
+
+// Creates the score kept for each cached peer of a service
+type Scorer interface {
+    NewScore() PeerScore
+}
+
+// Returns a new Scorer given the service's scoring settings
+// An empty name returns the default, ScorerRCount
+func NewScorer(cfg conf.PeerScoring) (Scorer, error) {
+    weight := defaultEWMAWeight
+    if cfg.EWMAWeight != nil {
+        weight = *cfg.EWMAWeight
+    }
+    if weight <= 0 || weight > 1 {
+        return nil, fmt.Errorf("EWMAWeight (%v) must be above 0 and at most 1", weight)
+    }
+
+    switch cfg.Scorer {
+    case "", ScorerRCount:
+        return RCountScorer{}, nil
+    case ScorerEWMA:
+        return EWMAScorer{Weight: weight}, nil
+    case ScorerJitter:
+        jitterWeight := defaultJitterWeight
+        if cfg.JitterWeight != nil {
+            jitterWeight = *cfg.JitterWeight
+        }
+        if jitterWeight < 0 {
+            return nil, fmt.Errorf("JitterWeight (%v) must not be negative", jitterWeight)
+        }
+        return JitterScorer{Weight: weight, JitterWeight: jitterWeight}, nil
+    case ScorerLoss:
+        window := uint(defaultLossWindow)
+        if cfg.LossWindow != nil {
+            window = *cfg.LossWindow
+        }
+        if window == 0 {
+            return nil, fmt.Errorf("LossWindow must be at least 1")
+        }
+        minProbes := uint(defaultLossMinProbes)
+        if cfg.LossMinProbes != nil {
+            minProbes = *cfg.LossMinProbes
+        }
+        if minProbes > window {
+            return nil, fmt.Errorf("LossMinProbes (%d) must be at most LossWindow (%d)",
+                                    minProbes, window)
+        }
+        maxLoss := defaultMaxLoss
+        if cfg.MaxLoss != nil {
+            maxLoss = *cfg.MaxLoss
+        }
+        if maxLoss < 0 || maxLoss >= 1 {
+            return nil, fmt.Errorf("MaxLoss (%v) must be at least 0 and below 1", maxLoss)
+        }
+        return LossScorer{Window: window, MinProbes: minProbes, MaxLoss: maxLoss}, nil
+    default:
+        return nil, fmt.Errorf("Unknown scorer: %s", cfg.Scorer)
+    }
+}
+
+// Starts a new score for the peer, seeded with its last known performance
+func (p *RPeerInfo) resetScore(s Scorer) {
+    p.score = s.NewScore()
+    if p.Info.Perf.RTT > 0 {
+        p.score.Observe(p.Info.Perf.RTT)
+    }
+}
+
+// Scores peers on their last probe alone, leaving RCount to smooth out noise
+// A peer is dropped as soon as it misses a probe
+type RCountScorer struct{}
+
+func (s RCountScorer) NewScore() PeerScore {
+    return &rcountScore{}
+}
+
+type rcountScore struct {
+    last time.Duration
+}
+
+func (s *rcountScore) Observe(rtt time.Duration) {
+    s.last = rtt
+}
+
+func (s *rcountScore) Perf() p2putil.PerfInd {
+    return p2putil.PerfInd{RTT: s.last}
+}
+
+func (s *rcountScore) Down() bool {
+    return s.last == 0
+}
+
+// Scores peers on an exponentially weighted moving average of their RTT
+// A peer is dropped as soon as it misses a probe
+type EWMAScorer struct {
+    // Weight of each new probe, between 0 and 1
+    Weight float64
+}
+
+func (s EWMAScorer) NewScore() PeerScore {
+    return &ewmaScore{weight: s.Weight}
+}
+
+type ewmaScore struct {
+    weight float64
+    srtt   time.Duration
+    down   bool
+}
+
+func (s *ewmaScore) Observe(rtt time.Duration) {
+    if s.down = rtt == 0; s.down {
+        return
+    }
+    if s.srtt == 0 {
+        s.srtt = rtt
+    } else {
+        s.srtt = ewma(s.srtt, rtt, s.weight)
+    }
+}
+
+func (s *ewmaScore) Perf() p2putil.PerfInd {
+    return p2putil.PerfInd{RTT: s.srtt}
+}
+
+func (s *ewmaScore) Down() bool {
+    return s.down
+}
+
+// Scores peers on their average RTT plus a multiple of how much it varies, as
+// TCP does for its retransmission timeout, so steady peers rank above jittery
+// ones with the same average
+// A peer is dropped as soon as it misses a probe
+type JitterScorer struct {
+    // Weight of each new probe in the averages, between 0 and 1
+    Weight       float64
+    // Multiple of the mean RTT deviation added to the average RTT
+    JitterWeight float64
+}
+
+func (s JitterScorer) NewScore() PeerScore {
+    return &jitterScore{weight: s.Weight, jitterWeight: s.JitterWeight}
+}
+
+type jitterScore struct {
+    weight       float64
+    jitterWeight float64
+    srtt         time.Duration
+    rttvar       time.Duration
+    down         bool
+}
+
+func (s *jitterScore) Observe(rtt time.Duration) {
+    if s.down = rtt == 0; s.down {
+        return
+    }
+    if s.srtt == 0 {
+        s.srtt = rtt
+        s.rttvar = rtt / 2
+        return
+    }
+    dev := s.srtt - rtt
+    if dev < 0 {
+        dev = -dev
+    }
+    s.rttvar = ewma(s.rttvar, dev, s.weight)
+    s.srtt = ewma(s.srtt, rtt, s.weight)
+}
+
+func (s *jitterScore) Perf() p2putil.PerfInd {
+    return p2putil.PerfInd{RTT: s.srtt + time.Duration(s.jitterWeight * float64(s.rttvar))}
+}
+
+func (s *jitterScore) Down() bool {
+    return s.down
+}
+
+// Scores peers over their last Window probes, tolerating some lost ones
+// The average RTT of answered probes is scaled up by the fraction lost, giving
+// the expected time to get an answer when retrying, and a peer is only
+// dropped once more than MaxLoss of its recent probes were lost, and at
+// least MinProbes probes were made so one lost probe can't drop it
+type LossScorer struct {
+    Window    uint
+    // At most Window
+    MinProbes uint
+    // Fraction of lost probes, at least 0 and below 1
+    MaxLoss   float64
+}
+
+func (s LossScorer) NewScore() PeerScore {
+    return &lossScore{samples: make([]time.Duration, 0, s.Window),
+                        minProbes: s.MinProbes, maxLoss: s.MaxLoss}
+}
+
+type lossScore struct {
+    // Ring buffer of the most recent probes
+    samples   []time.Duration
+    next      int
+    minProbes uint
+    maxLoss   float64
+}
+
+func (s *lossScore) Observe(rtt time.Duration) {
+    if len(s.samples) < cap(s.samples) {
+        s.samples = append(s.samples, rtt)
+        return
+    }
+    s.samples[s.next] = rtt
+    s.next = (s.next + 1) % len(s.samples)
+}
+
+func (s *lossScore) lossRate() float64 {
+    if len(s.samples) == 0 {
+        return 0
+    }
+    lost := 0
+    for _, rtt := range s.samples {
+        if rtt == 0 {
+            lost++
+        }
+    }
+    return float64(lost) / float64(len(s.samples))
+}
+
+func (s *lossScore) Perf() p2putil.PerfInd {
+    var total time.Duration
+    answered := 0
+    for _, rtt := range s.samples {
+        if rtt != 0 {
+            total += rtt
+            answered++
+        }
+    }
+    if answered == 0 {
+        return p2putil.PerfInd{}
+    }
+    mean := float64(total) / float64(answered)
+    return p2putil.PerfInd{RTT: time.Duration(mean / (1 - s.lossRate()))}
+}
+
+func (s *lossScore) Down() bool {
+    if len(s.samples) == 0 || uint(len(s.samples)) < s.minProbes {
+        return false
+    }
+    return s.lossRate() > s.maxLoss
+}
+
+// Moves avg towards sample by weight
+func ewma(avg time.Duration, sample time.Duration, weight float64) time.Duration {
+    return time.Duration(weight * float64(sample) + (1 - weight) * float64(avg))
+}
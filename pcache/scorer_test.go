@@ -0,0 +1,198 @@
+package pcache
+
+import (
+    "reflect"
+    "testing"
+    "time"
+
+    "github.com/PhysarumSM/service-manager/conf"
+)
+
+func uintPtr(n uint) *uint {
+    return &n
+}
+
+func floatPtr(f float64) *float64 {
+    return &f
+}
+
+func TestNewScorer(t *testing.T) {
+    tests := []struct {
+        name    string
+        cfg     conf.PeerScoring
+        want    Scorer
+        wantErr bool
+    }{
+        {
+            name: "default",
+            want: RCountScorer{},
+        },
+        {
+            name: "ewma",
+            cfg: conf.PeerScoring{Scorer: ScorerEWMA},
+            want: EWMAScorer{Weight: defaultEWMAWeight},
+        },
+        {
+            name: "ewma weight of 1",
+            cfg: conf.PeerScoring{Scorer: ScorerEWMA, EWMAWeight: floatPtr(1)},
+            want: EWMAScorer{Weight: 1},
+        },
+        {
+            name: "ewma weight of 0",
+            cfg: conf.PeerScoring{Scorer: ScorerEWMA, EWMAWeight: floatPtr(0)},
+            wantErr: true,
+        },
+        {
+            name: "ewma weight above 1",
+            cfg: conf.PeerScoring{Scorer: ScorerEWMA, EWMAWeight: floatPtr(1.5)},
+            wantErr: true,
+        },
+        {
+            name: "jitter",
+            cfg: conf.PeerScoring{Scorer: ScorerJitter},
+            want: JitterScorer{Weight: defaultEWMAWeight, JitterWeight: defaultJitterWeight},
+        },
+        {
+            name: "jitter weight of 0",
+            cfg: conf.PeerScoring{Scorer: ScorerJitter, JitterWeight: floatPtr(0)},
+            want: JitterScorer{Weight: defaultEWMAWeight, JitterWeight: 0},
+        },
+        {
+            name: "negative jitter weight",
+            cfg: conf.PeerScoring{Scorer: ScorerJitter, JitterWeight: floatPtr(-1)},
+            wantErr: true,
+        },
+        {
+            name: "loss",
+            cfg: conf.PeerScoring{Scorer: ScorerLoss},
+            want: LossScorer{Window: defaultLossWindow, MinProbes: defaultLossMinProbes,
+                                MaxLoss: defaultMaxLoss},
+        },
+        {
+            name: "loss with no tolerance",
+            cfg: conf.PeerScoring{Scorer: ScorerLoss, LossWindow: uintPtr(1),
+                                    LossMinProbes: uintPtr(0), MaxLoss: floatPtr(0)},
+            want: LossScorer{Window: 1, MinProbes: 0, MaxLoss: 0},
+        },
+        {
+            name: "loss window of 0",
+            cfg: conf.PeerScoring{Scorer: ScorerLoss, LossWindow: uintPtr(0)},
+            wantErr: true,
+        },
+        {
+            name: "loss min probes above window",
+            cfg: conf.PeerScoring{Scorer: ScorerLoss, LossWindow: uintPtr(5),
+                                    LossMinProbes: uintPtr(6)},
+            wantErr: true,
+        },
+        {
+            name: "max loss of 1",
+            cfg: conf.PeerScoring{Scorer: ScorerLoss, MaxLoss: floatPtr(1)},
+            wantErr: true,
+        },
+        {
+            name: "unknown",
+            cfg: conf.PeerScoring{Scorer: "median"},
+            wantErr: true,
+        },
+    }
+    for _, test := range tests {
+        got, err := NewScorer(test.cfg)
+        if test.wantErr {
+            if err == nil {
+                t.Errorf("%s: NewScorer() = %+v, want error", test.name, got)
+            }
+            continue
+        }
+        if err != nil {
+            t.Errorf("%s: NewScorer() failed: %v", test.name, err)
+        } else if !reflect.DeepEqual(got, test.want) {
+            t.Errorf("%s: NewScorer() = %+v, want %+v", test.name, got, test.want)
+        }
+    }
+}
+
+func TestScores(t *testing.T) {
+    ms := time.Millisecond
+    tests := []struct {
+        name   string
+        scorer Scorer
+        rtts   []time.Duration
+        rtt    time.Duration
+        down   bool
+    }{
+        {"rcount no probes", RCountScorer{}, nil, 0, true},
+        {"rcount last probe", RCountScorer{}, []time.Duration{10 * ms, 20 * ms}, 20 * ms, false},
+        {"rcount missed probe", RCountScorer{}, []time.Duration{10 * ms, 0}, 0, true},
+
+        {"ewma first probe", EWMAScorer{Weight: 0.5}, []time.Duration{10 * ms}, 10 * ms, false},
+        {"ewma average", EWMAScorer{Weight: 0.5},
+            []time.Duration{10 * ms, 20 * ms, 40 * ms}, 27500 * time.Microsecond, false},
+        // The average is kept through a missed probe
+        {"ewma missed probe", EWMAScorer{Weight: 0.5},
+            []time.Duration{10 * ms, 0}, 10 * ms, true},
+        {"ewma recovered", EWMAScorer{Weight: 0.5},
+            []time.Duration{10 * ms, 0, 20 * ms}, 15 * ms, false},
+
+        // RTT variation starts at half the first RTT
+        {"jitter first probe", JitterScorer{Weight: 0.5, JitterWeight: 2},
+            []time.Duration{10 * ms}, 20 * ms, false},
+        {"jitter steady", JitterScorer{Weight: 0.5, JitterWeight: 2},
+            []time.Duration{10 * ms, 10 * ms}, 15 * ms, false},
+        {"jitter varying", JitterScorer{Weight: 0.5, JitterWeight: 2},
+            []time.Duration{10 * ms, 30 * ms}, 45 * ms, false},
+        {"jitter ignored", JitterScorer{Weight: 0.5, JitterWeight: 0},
+            []time.Duration{10 * ms, 30 * ms}, 20 * ms, false},
+        {"jitter missed probe", JitterScorer{Weight: 0.5, JitterWeight: 2},
+            []time.Duration{10 * ms, 0}, 20 * ms, true},
+    }
+    for _, test := range tests {
+        score := test.scorer.NewScore()
+        for _, rtt := range test.rtts {
+            score.Observe(rtt)
+        }
+        if rtt := score.Perf().RTT; rtt != test.rtt {
+            t.Errorf("%s: Perf().RTT = %v, want %v", test.name, rtt, test.rtt)
+        }
+        if down := score.Down(); down != test.down {
+            t.Errorf("%s: Down() = %v, want %v", test.name, down, test.down)
+        }
+    }
+}
+
+func TestLossScore(t *testing.T) {
+    ms := time.Millisecond
+    scorer := LossScorer{Window: 4, MinProbes: 2, MaxLoss: 0.5}
+    tests := []struct {
+        name string
+        rtts []time.Duration
+        rtt  time.Duration
+        down bool
+    }{
+        // Nothing to go on, so the peer is neither ranked nor dropped
+        {"no probes", nil, 0, false},
+        {"one lost probe", []time.Duration{0}, 0, false},
+        {"all answered", []time.Duration{10 * ms, 20 * ms}, 15 * ms, false},
+        // Mean RTT over answered probes, scaled up by the loss rate
+        {"some lost", []time.Duration{15 * ms, 0, 15 * ms, 15 * ms}, 20 * ms, false},
+        {"at max loss", []time.Duration{10 * ms, 0, 10 * ms, 0}, 20 * ms, false},
+        {"above max loss", []time.Duration{10 * ms, 0, 0, 0}, 40 * ms, true},
+        {"all lost", []time.Duration{0, 0}, 0, true},
+        // Only the last Window probes count
+        {"old losses forgotten", []time.Duration{0, 0, 0, 10 * ms, 10 * ms, 10 * ms, 10 * ms},
+            10 * ms, false},
+        {"old answers forgotten", []time.Duration{10 * ms, 10 * ms, 0, 0, 0}, 40 * ms, true},
+    }
+    for _, test := range tests {
+        score := scorer.NewScore()
+        for _, rtt := range test.rtts {
+            score.Observe(rtt)
+        }
+        if rtt := score.Perf().RTT; rtt != test.rtt {
+            t.Errorf("%s: Perf().RTT = %v, want %v", test.name, rtt, test.rtt)
+        }
+        if down := score.Down(); down != test.down {
+            t.Errorf("%s: Down() = %v, want %v", test.name, down, test.down)
+        }
+    }
+}
@@ -0,0 +1,97 @@
+package pcache
+
+// Passive measurements of cached peers, taken from the requests and tunnels
+// the proxies send through them
+// Pings only measure the network, so a slow or failing service behind a fast
+// network would otherwise rank as well as any other
+
+import (
+    "time"
+
+    "github.com/libp2p/go-libp2p-core/peer"
+
+    "github.com/PhysarumSM/common/p2putil"
+)
+
+// Weight of each new request in a peer's averages
+const (
+    serviceTimeWeight = 0.2
+    errorRateWeight = 0.1
+)
+
+// How a request to a peer ended
+type Outcome int
+const (
+    OutcomeSuccess Outcome = iota
+    // Transport errors, timeouts, and 5xx responses
+    OutcomeFailure
+    // The request was cancelled before it completed, e.g. because a hedged
+    // copy of it won or the client went away, which says nothing about the
+    // peer either way
+    OutcomeCancelled
+)
+
+// Highest error rate taken into account when ranking, so that a peer failing
+// every request still ranks after the others rather than overflowing
+const maxRankedErrorRate = 0.9
+
+// Records a request or tunnel setup made through the peer id
+// latency is how long it took end to end, and is ignored if 0, as it should
+// be for requests that didn't complete. outcome is fed to the peer's circuit
+// breaker, as in EndRequest.
+func (cache *PeerCache) ObserveRequest(id peer.ID, latency time.Duration, outcome Outcome) {
+    cache.mux.Lock()
+    defer cache.mux.Unlock()
+    cache.observeRequestLocked(id, latency, outcome)
+}
+
+func (cache *PeerCache) observeRequestLocked(id peer.ID, latency time.Duration, outcome Outcome) {
+    if outcome == OutcomeCancelled {
+        // Nothing learned, but let another half-open probe through in its place
+        if cb, ok := cache.breakers[id]; ok {
+            cb.Release()
+        }
+        return
+    }
+    success := outcome == OutcomeSuccess
+    cache.breakerLocked(id).Record(success)
+
+    if p, ok := cache.peers[id]; ok {
+        p.observeRequest(latency, success)
+    }
+}
+
+func (p *RPeerInfo) observeRequest(latency time.Duration, success bool) {
+    failed := 0.0
+    if !success {
+        failed = 1
+    }
+    p.ErrorRate = errorRateWeight * failed + (1 - errorRateWeight) * p.ErrorRate
+
+    if latency == 0 || !success {
+        return
+    }
+    // Whatever the network RTT doesn't account for is time spent in the
+    // service (and its proxy)
+    serviceTime := latency - p.Info.Perf.RTT
+    if serviceTime < 0 {
+        serviceTime = 0
+    }
+    if p.ServiceTime == 0 {
+        p.ServiceTime = serviceTime
+    } else {
+        p.ServiceTime = ewma(p.ServiceTime, serviceTime, serviceTimeWeight)
+    }
+}
+
+// Returns the performance the peer is ranked by
+// Starts from the scored network performance, adds the time the service takes
+// to answer requests, and scales it up by the fraction of requests failing
+func (p *RPeerInfo) EffectivePerf() p2putil.PerfInd {
+    errorRate := p.ErrorRate
+    if errorRate > maxRankedErrorRate {
+        errorRate = maxRankedErrorRate
+    }
+    rtt := float64(p.Info.Perf.RTT + p.ServiceTime) / (1 - errorRate)
+    return p2putil.PerfInd{RTT: time.Duration(rtt)}
+}
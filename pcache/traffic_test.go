@@ -0,0 +1,170 @@
+package pcache
+
+import (
+    "testing"
+    "time"
+
+    "github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestCancelledRequests(t *testing.T) {
+    tests := []struct {
+        name      string
+        outcome   Outcome
+        wantState BreakerState
+        // Whether another probe can be sent afterwards
+        wantAvail bool
+        wantError bool
+    }{
+        {"success closes the breaker", OutcomeSuccess, BreakerClosed, true, false},
+        {"failure reopens the breaker", OutcomeFailure, BreakerOpen, false, true},
+        {"cancelled gives the probe back", OutcomeCancelled, BreakerHalfOpen, true, false},
+    }
+    for _, test := range tests {
+        cache := newTestCache()
+        cfg := testBreakerConfig()
+        cfg.HalfOpenProbes = 1
+        cache.SetBreakerConfig(cfg)
+        id := peer.ID("peer")
+        cache.peers[id] = &RPeerInfo{}
+
+        cache.mux.Lock()
+        cb := cache.breakerLocked(id)
+        cache.mux.Unlock()
+        openBreaker(cb)
+        expireOpen(cb)
+
+        if !cache.AcquireBreaker(id) {
+            t.Fatalf("%s: AcquireBreaker() failed while half-open", test.name)
+        }
+        cache.StartRequest(id)
+        cache.EndRequest(id, time.Millisecond, test.outcome)
+
+        if state := cb.State(); state != test.wantState {
+            t.Errorf("%s: State() = %s, want %s", test.name, state, test.wantState)
+        }
+        if avail := cb.Available(); avail != test.wantAvail {
+            t.Errorf("%s: Available() = %v, want %v", test.name, avail, test.wantAvail)
+        }
+        if failed := cache.peers[id].ErrorRate > 0; failed != test.wantError {
+            t.Errorf("%s: ErrorRate = %v", test.name, cache.peers[id].ErrorRate)
+        }
+    }
+}
+
+func TestReleaseOnlyOutstandingProbes(t *testing.T) {
+    cfg := testBreakerConfig()
+    cb := NewCircuitBreaker(cfg)
+    openBreaker(cb)
+    expireOpen(cb)
+
+    cb.Acquire()
+    cb.Acquire()
+    cb.Record(true)
+    // One probe passed, one cancelled, leaving a single probe to be sent
+    cb.Release()
+    cb.Release()
+    if !cb.Acquire() {
+        t.Errorf("Acquire() failed after a probe was released")
+    }
+    if cb.Acquire() {
+        t.Errorf("Release() gave back a probe that had already passed")
+    }
+}
+
+func TestEffectivePerf(t *testing.T) {
+    tests := []struct {
+        name        string
+        rtt         time.Duration
+        serviceTime time.Duration
+        errorRate   float64
+        want        time.Duration
+    }{
+        {"network only", 20 * time.Millisecond, 0, 0, 20 * time.Millisecond},
+        {"service time", 20 * time.Millisecond, 30 * time.Millisecond, 0, 50 * time.Millisecond},
+        {"errors", 20 * time.Millisecond, 30 * time.Millisecond, 0.5, 100 * time.Millisecond},
+        // Capped so the result stays finite
+        {"every request failing", 10 * time.Millisecond, 0, 1, 100 * time.Millisecond},
+    }
+    for _, test := range tests {
+        p := RPeerInfo{ServiceTime: test.serviceTime, ErrorRate: test.errorRate}
+        p.Info.Perf.RTT = test.rtt
+        if got := p.EffectivePerf().RTT; got != test.want {
+            t.Errorf("%s: EffectivePerf() = %s, want %s", test.name, got, test.want)
+        }
+    }
+}
+
+func TestObserveRequest(t *testing.T) {
+    type request struct {
+        latency time.Duration
+        success bool
+    }
+    tests := []struct {
+        name        string
+        requests    []request
+        serviceTime time.Duration
+        errorRate   float64
+    }{
+        {"first request", []request{{30 * time.Millisecond, true}}, 20 * time.Millisecond, 0},
+        {
+            "averaged",
+            []request{{30 * time.Millisecond, true}, {60 * time.Millisecond, true}},
+            // 0.2 * 50ms + 0.8 * 20ms
+            26 * time.Millisecond, 0,
+        },
+        // Faster than the network RTT, e.g. RTT went up since the last probe
+        {"faster than RTT", []request{{5 * time.Millisecond, true}}, 0, 0},
+        // Failures and incomplete requests don't say how long the service takes
+        {
+            "failed",
+            []request{{30 * time.Millisecond, true}, {time.Second, false}},
+            20 * time.Millisecond, 0.1,
+        },
+        {"no latency", []request{{0, true}}, 0, 0},
+    }
+    for _, test := range tests {
+        p := RPeerInfo{}
+        p.Info.Perf.RTT = 10 * time.Millisecond
+        for _, r := range test.requests {
+            p.observeRequest(r.latency, r.success)
+        }
+        if p.ServiceTime != test.serviceTime || p.ErrorRate != test.errorRate {
+            t.Errorf("%s: ServiceTime %s and ErrorRate %v, want %s and %v", test.name,
+                        p.ServiceTime, p.ErrorRate, test.serviceTime, test.errorRate)
+        }
+    }
+}
+
+func TestRankedByEffectivePerf(t *testing.T) {
+    cache := newTestCache()
+    cache.mux.Lock()
+    defer cache.mux.Unlock()
+    peers := map[peer.ID]*RPeerInfo{
+        peer.ID("close but slow"): {ServiceTime: 100 * time.Millisecond},
+        peer.ID("far"): {},
+        peer.ID("close"): {},
+        peer.ID("top level"): {Level: 0},
+    }
+    rtts := map[peer.ID]time.Duration{
+        peer.ID("close but slow"): 5 * time.Millisecond,
+        peer.ID("far"): 50 * time.Millisecond,
+        peer.ID("close"): 5 * time.Millisecond,
+        peer.ID("top level"): 80 * time.Millisecond,
+    }
+    for id, p := range peers {
+        p.Info.ID = id
+        p.Info.Perf.RTT = rtts[id]
+        if id != peer.ID("top level") {
+            p.Level = 1
+        }
+    }
+
+    want := []peer.ID{"top level", "close", "far", "close but slow"}
+    sorted := cache.sortedLocked(peers)
+    for i, p := range sorted {
+        if p.Info.ID != want[i] {
+            t.Errorf("sortedLocked()[%d] = %s, want %s", i, p.Info.ID, want[i])
+        }
+    }
+}
@@ -0,0 +1,267 @@
+package main
+
+// Hedged requests
+// For latency-sensitive services, a copy of an idempotent request is sent to
+// the next-best cached instance if the first hasn't answered after a delay.
+// Whichever response comes back first is used and the other is cancelled.
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "math"
+    "net/http"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/libp2p/go-libp2p-core/peer"
+
+    "github.com/PhysarumSM/service-manager/conf"
+)
+
+const (
+    // Number of recent request latencies kept per service
+    latencyWindowSize = 100
+    // Latencies needed before percentile based hedging kicks in
+    minLatencySamples = 20
+    // Largest request body that will be buffered so a request can be hedged
+    maxHedgeBodySize = 1 << 20
+)
+
+var (
+    // Per-service hedging settings
+    hedgeConfig conf.Config
+    // Recent request latencies per service
+    latencies = newLatencyTracker()
+)
+
+// Checks the hedging settings for every service in the config
+func validateHedging(config conf.Config) error {
+    check := func(name string, sc conf.ServiceConfig) error {
+        if sc.HedgeDelayMs != nil && *sc.HedgeDelayMs < 0 {
+            return fmt.Errorf("%s: HedgeDelayMs must not be negative", name)
+        }
+        if p := sc.HedgePercentile; p != nil && (*p < 0 || *p > 100) {
+            return fmt.Errorf("%s: HedgePercentile must be in [0, 100], got %v", name, *p)
+        }
+        return nil
+    }
+
+    if err := check("Defaults", config.Defaults); err != nil {
+        return err
+    }
+    for servName, sc := range config.Services {
+        if err := check("Service " + servName, sc); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Returns how long to wait before hedging a request to servName, or 0 if
+// requests to it shouldn't be hedged
+func hedgeDelay(servName string) time.Duration {
+    sc := hedgeConfig.ForService(servName)
+    if p := sc.HedgePercentile; p != nil && *p > 0 {
+        if d, ok := latencies.Percentile(servName, *p); ok {
+            return d
+        }
+    }
+    if sc.HedgeDelayMs == nil {
+        return 0
+    }
+    return time.Duration(*sc.HedgeDelayMs) * time.Millisecond
+}
+
+// Only requests that are safe to send twice may be hedged
+func isIdempotent(method string) bool {
+    switch method {
+    case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace,
+            http.MethodPut, http.MethodDelete:
+        return true
+    default:
+        return false
+    }
+}
+
+type hedgeResult struct {
+    id   peer.ID
+    resp *http.Response
+    err  error
+}
+
+// Sends req to the peer id, and to the next-best cached instance of the
+// service if id hasn't responded after delay
+func runHedgedRequest(servName string, servHash string, id peer.ID,
+                        req *http.Request, delay time.Duration) (*http.Response, error) {
+    body, ok, err := bufferBody(req)
+    if err != nil {
+        return nil, err
+    }
+    if !ok {
+        log.Printf("Request body too large to hedge, sending to peer ID %s only\n", id)
+        return sendRequest(servName, id, req)
+    }
+
+    // Each attempt gets its own context so the loser can be cancelled
+    results := make(chan hedgeResult, 2)
+    var cancels []context.CancelFunc
+    defer func() {
+        for _, cancel := range cancels {
+            cancel()
+        }
+    }()
+    launch := func(id peer.ID) {
+        ctx, cancel := context.WithCancel(req.Context())
+        cancels = append(cancels, cancel)
+        attempt := req.Clone(ctx)
+        if body != nil {
+            attempt.Body = ioutil.NopCloser(bytes.NewReader(body))
+        }
+        go func() {
+            resp, err := sendRequest(servName, id, attempt)
+            results <- hedgeResult{id: id, resp: resp, err: err}
+        }()
+    }
+
+    launch(id)
+    outstanding := 1
+    timer := time.NewTimer(delay)
+    defer timer.Stop()
+    for {
+        select {
+        case <-timer.C:
+            backup := nextBestPeer(servHash, id)
+            if backup == peer.ID("") {
+                // The peer cache may have found another instance by then
+                log.Printf("No other cached instance of %s to hedge to, checking again in %s\n",
+                            servName, delay)
+                timer.Reset(delay)
+                continue
+            }
+            log.Printf("No response from peer ID %s after %s, hedging to peer ID %s\n",
+                        id, delay, backup)
+            launch(backup)
+            outstanding++
+        case res := <-results:
+            outstanding--
+            if res.err == nil {
+                log.Printf("Using response from peer ID %s\n", res.id)
+                // Clean up after the other attempt once it's been cancelled
+                if outstanding > 0 {
+                    go discardResults(results, outstanding)
+                }
+                return res.resp, nil
+            }
+            if outstanding == 0 {
+                return nil, res.err
+            }
+        }
+    }
+}
+
+// Returns the best cached peer offering the service other than exclude
+// Reserves a request with the peer's circuit breaker, so a half-open peer
+// only gets its allowed probes
+func nextBestPeer(servHash string, exclude peer.ID) peer.ID {
+    for _, c := range peerCache.GetPeers(servHash, 2) {
+        if c.Info.ID != exclude && peerCache.AcquireBreaker(c.Info.ID) {
+            return c.Info.ID
+        }
+    }
+    return peer.ID("")
+}
+
+func discardResults(results <-chan hedgeResult, n int) {
+    for i := 0; i < n; i++ {
+        res := <-results
+        if res.resp != nil {
+            res.resp.Body.Close()
+        }
+    }
+}
+
+// Reads in a request's body so it can be sent more than once
+// Returns false if the body is too large to hold on to, in which case the
+// request's body is left readable from the start
+func bufferBody(req *http.Request) ([]byte, bool, error) {
+    if req.Body == nil || req.Body == http.NoBody {
+        return nil, true, nil
+    }
+    if req.ContentLength > maxHedgeBodySize {
+        return nil, false, nil
+    }
+
+    body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxHedgeBodySize + 1))
+    if err != nil {
+        req.Body.Close()
+        return nil, false, fmt.Errorf("Unable to read request body\n%w\n", err)
+    }
+    if len(body) > maxHedgeBodySize {
+        req.Body = struct {
+            io.Reader
+            io.Closer
+        }{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+        return nil, false, nil
+    }
+    req.Body.Close()
+    return body, true, nil
+}
+
+// Fixed size window of recent latencies
+type latencyWindow struct {
+    samples []time.Duration
+    next    int
+}
+
+type latencyTracker struct {
+    windows map[string]*latencyWindow
+    mux     sync.Mutex
+}
+
+func newLatencyTracker() *latencyTracker {
+    return &latencyTracker{windows: make(map[string]*latencyWindow)}
+}
+
+// Records the latency of a successful request to servName
+func (lt *latencyTracker) Record(servName string, d time.Duration) {
+    lt.mux.Lock()
+    defer lt.mux.Unlock()
+    w, ok := lt.windows[servName]
+    if !ok {
+        w = &latencyWindow{}
+        lt.windows[servName] = w
+    }
+    if len(w.samples) < latencyWindowSize {
+        w.samples = append(w.samples, d)
+    } else {
+        w.samples[w.next] = d
+    }
+    w.next = (w.next + 1) % latencyWindowSize
+}
+
+// Returns the p-th percentile (0 to 100) of servName's recent latencies
+// Returns false if too few requests have been seen for it to mean much
+func (lt *latencyTracker) Percentile(servName string, p float64) (time.Duration, bool) {
+    lt.mux.Lock()
+    w, ok := lt.windows[servName]
+    if !ok || len(w.samples) < minLatencySamples {
+        lt.mux.Unlock()
+        return 0, false
+    }
+    sorted := make([]time.Duration, len(w.samples))
+    copy(sorted, w.samples)
+    lt.mux.Unlock()
+
+    sort.Slice(sorted, func(i, j int) bool {
+        return sorted[i] < sorted[j]
+    })
+    i := int(math.Ceil(p / 100 * float64(len(sorted)))) - 1
+    if i < 0 {
+        i = 0
+    }
+    return sorted[i], true
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+    "bytes"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/PhysarumSM/service-manager/conf"
+)
+
+func TestIsIdempotent(t *testing.T) {
+    tests := []struct {
+        method string
+        want   bool
+    }{
+        {http.MethodGet, true},
+        {http.MethodHead, true},
+        {http.MethodPut, true},
+        {http.MethodDelete, true},
+        {http.MethodPost, false},
+        {http.MethodPatch, false},
+    }
+    for _, test := range tests {
+        if got := isIdempotent(test.method); got != test.want {
+            t.Errorf("isIdempotent(%s) = %v, want %v", test.method, got, test.want)
+        }
+    }
+}
+
+func TestLatencyPercentile(t *testing.T) {
+    lt := newLatencyTracker()
+    for i := 1; i < minLatencySamples; i++ {
+        lt.Record("svc", time.Duration(i) * time.Millisecond)
+    }
+    if d, ok := lt.Percentile("svc", 50); ok {
+        t.Errorf("Percentile() = %s with too few samples", d)
+    }
+    lt.Record("svc", minLatencySamples * time.Millisecond)
+
+    tests := []struct {
+        p    float64
+        want time.Duration
+    }{
+        {0, 1 * time.Millisecond},
+        {50, 10 * time.Millisecond},
+        {95, 19 * time.Millisecond},
+        {100, 20 * time.Millisecond},
+    }
+    for _, test := range tests {
+        d, ok := lt.Percentile("svc", test.p)
+        if !ok || d != test.want {
+            t.Errorf("Percentile(%v) = (%s, %v), want %s", test.p, d, ok, test.want)
+        }
+    }
+    if _, ok := lt.Percentile("other", 50); ok {
+        t.Errorf("Percentile() succeeded for a service without samples")
+    }
+}
+
+func TestLatencyWindow(t *testing.T) {
+    lt := newLatencyTracker()
+    for i := 0; i < latencyWindowSize; i++ {
+        lt.Record("svc", time.Second)
+    }
+    // Older samples are replaced once the window is full
+    for i := 0; i < latencyWindowSize; i++ {
+        lt.Record("svc", time.Millisecond)
+    }
+    if d, _ := lt.Percentile("svc", 100); d != time.Millisecond {
+        t.Errorf("Percentile(100) = %s, want %s", d, time.Millisecond)
+    }
+}
+
+func TestBufferBody(t *testing.T) {
+    small := "hello"
+    large := strings.Repeat("x", maxHedgeBodySize + 1)
+
+    tests := []struct {
+        name   string
+        body   string
+        wantOK bool
+    }{
+        {"no body", "", true},
+        {"small body", small, true},
+        {"large body", large, false},
+    }
+    for _, test := range tests {
+        req := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(test.body))
+        if test.body == "" {
+            req.Body = http.NoBody
+        }
+        // Chunked requests don't say how large they are up front
+        req.ContentLength = -1
+
+        body, ok, err := bufferBody(req)
+        if err != nil {
+            t.Errorf("%s: bufferBody() failed: %v", test.name, err)
+            continue
+        }
+        if ok != test.wantOK {
+            t.Errorf("%s: bufferBody() ok = %v, want %v", test.name, ok, test.wantOK)
+            continue
+        }
+        if ok && !bytes.Equal(body, []byte(test.body)) {
+            t.Errorf("%s: bufferBody() = %q, want %q", test.name, body, test.body)
+        }
+        // Bodies too large to buffer must still be readable in full
+        if !ok {
+            rest, _ := ioutil.ReadAll(req.Body)
+            if string(rest) != test.body {
+                t.Errorf("%s: request body changed, %d bytes left of %d",
+                            test.name, len(rest), len(test.body))
+            }
+        }
+    }
+}
+
+func TestHedgeDelay(t *testing.T) {
+    delayMs := func(ms int) *int {
+        return &ms
+    }
+    percentile := func(p float64) *float64 {
+        return &p
+    }
+    prev := hedgeConfig
+    defer func() {
+        hedgeConfig = prev
+    }()
+    hedgeConfig = conf.Config{
+        Defaults: conf.ServiceConfig{HedgeDelayMs: delayMs(50)},
+        Services: map[string]conf.ServiceConfig{
+            "inherit": {},
+            "longer": {HedgeDelayMs: delayMs(200)},
+            // 0 turns off hedging rather than inheriting it
+            "off": {HedgeDelayMs: delayMs(0)},
+            "percentile": {HedgePercentile: percentile(50)},
+        },
+    }
+
+    tests := []struct {
+        servName string
+        want     time.Duration
+    }{
+        {"unlisted", 50 * time.Millisecond},
+        {"inherit", 50 * time.Millisecond},
+        {"longer", 200 * time.Millisecond},
+        {"off", 0},
+        // Falls back on HedgeDelayMs until enough latencies are seen
+        {"percentile", 50 * time.Millisecond},
+    }
+    for _, test := range tests {
+        if got := hedgeDelay(test.servName); got != test.want {
+            t.Errorf("hedgeDelay(%q) = %v, want %v", test.servName, got, test.want)
+        }
+    }
+}
@@ -8,10 +8,13 @@ import (
     "fmt"
     "io"
     "io/ioutil"
-    "log"
+    "net"
     "net/http"
     "os"
+    "os/signal"
+    "strconv"
     "strings"
+    "syscall"
     "time"
 
     "github.com/libp2p/go-libp2p-core/peer"
@@ -20,22 +23,28 @@ import (
     "github.com/multiformats/go-multiaddr"
 
     "github.com/PhysarumSM/common/p2pnode"
-    "github.com/PhysarumSM/common/p2putil"
     "github.com/PhysarumSM/common/util"
 
     "github.com/PhysarumSM/service-registry/registry"
 
+    "github.com/PhysarumSM/service-manager/admin"
+    "github.com/PhysarumSM/service-manager/cachefile"
     "github.com/PhysarumSM/service-manager/conf"
     "github.com/PhysarumSM/service-manager/lca"
+    "github.com/PhysarumSM/service-manager/limiter"
+    "github.com/PhysarumSM/service-manager/logging"
+    "github.com/PhysarumSM/service-manager/metrics"
     "github.com/PhysarumSM/service-manager/pcache"
     "github.com/PhysarumSM/service-manager/rcache"
+    "github.com/PhysarumSM/service-manager/resolver"
+    "github.com/PhysarumSM/service-manager/tracing"
+
+    "github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-const defaultKeyFile = "~/.privKeyProxy"
+var log = logging.New("proxy")
 
-func init() {
-    log.SetFlags(log.Ldate | log.Lmicroseconds | log.Lshortfile)
-}
+const defaultKeyFile = "~/.privKeyProxy"
 
 var (
     // Global LCA Manager instance to handle peer search and allocation
@@ -44,130 +53,124 @@ var (
     peerCache *pcache.PeerCache
     // Global Registry Cache instance to cache service registry info
     registryCache *rcache.RegistryCache
+    // Global Resolver instance to find or allocate service instances
+    serviceResolver *resolver.Resolver
+    // Global limits on requests sent to each service
+    serviceLimiter *limiter.Limiter
 )
 
 
 func runRequest(servName string, servInfo registry.ServiceInfo, req *http.Request) (*http.Response, error) {
-    var err error
-    var id peer.ID
-    var perf p2putil.PerfInd
-    serviceHash := servInfo.ContentHash
-    dockerHash := servInfo.DockerHash
-
-    // 2. Search for cached instances, allocate new instance if none found
-    id, err = peerCache.GetPeer(serviceHash)
-    if err == nil {
-        log.Printf("Found cached peer with ID %s for service %s\n", id, servName)
-    } else {
-        // Search for an instance in the network, allocating a new one if need be.
-        // Maximum of 3 allocation attempts.
-        // TODO: It's totally possible for an allocation attempt to succeed,
-        // but the service takes a long time to come up, leading to subsequent
-        // allocation attempts. This is a future problem to solve.
-        startTime := time.Now()
-        for attempts := 0; attempts < 3 && id == peer.ID(""); attempts++ {
-            if attempts > 0 {
-                log.Printf("Unable to successfully find or allocate, retrying...")
-            }
+    // Search for cached instances, allocate new instance if none found
+    id, err := serviceResolver.FindOrAllocateContext(req.Context(), servName, servInfo)
+    if err != nil {
+        return nil, errors.New("Not found")
+    }
 
-            // TODO: Always pass perf req into AllocService()
-            //       Need to combine AllocService and AllocBetterService
-            //       Need to obtain perf req from registry-service
-            log.Println("Finding best existing service instance")
-            id, perf, err = manager.FindService(serviceHash)
-            if err != nil {
-                log.Println("Could not find, creating new service instance")
-                _, _, err = manager.AllocService(dockerHash)
-                if err != nil {
-                    log.Println("Service allocation failed\n", err)
-                    continue // Or return error right away?
-                }
-
-                // Re-do FindService() to ensure the new instance is connected
-                // to the network. Sleep 200ms or so to allow the service to
-                // come up. If not found, perform exponential backoff and attempt
-                // to re-find it (max 3 times). If it's still found, there may be
-                // something wrong with it (or it's taking too long to boot).
-                wait := 200 * time.Millisecond
-                time.Sleep(wait)
-                backoff, err := util.NewExpoBackoffAttempts(wait, time.Second, 5)
-                if err != nil {
-                    log.Printf("ERROR: Unable to create ExpoBackoffAttempts\n")
-                }
-                for backoff.Attempt() {
-                    id, perf, err = manager.FindService(serviceHash)
-                    if err == nil {
-                        break
-                    }
-                }
-            } else if servInfo.NetworkSoftReq.LessThan(perf) {
-                log.Printf("Found service's performance (%s) does not meet requirements (%s)\n", perf, servInfo.NetworkSoftReq)
-                _, _, err = manager.AllocBetterService(dockerHash, perf)
-                if err != nil {
-                    log.Println("No services able to be created, using previously found peer")
-                }
-            }
+    if delay := hedgeDelay(servName); delay > 0 && isIdempotent(req.Method) {
+        return runHedgedRequest(servName, servInfo.ContentHash, id, req, delay)
+    }
+    return sendRequest(servName, id, req)
+}
 
-            if err == nil && id != peer.ID("") {
-                // Cache peer information
-                peerCache.AddPeer(p2putil.PeerInfo{
-                    ID: id,
-                    ServName: servName,
-                    ServHash: serviceHash,
-                })
-            }
+// Sends a request to the peer id, keeping track of the outcome
+func sendRequest(servName string, id peer.ID, req *http.Request) (*http.Response, error) {
+    resp, elapsed, err := serviceResolver.Request(servName, id, req)
+    if err != nil {
+        return nil, err
+    }
+    latencies.Record(servName, elapsed)
+    return resp, nil
+}
+
+// Sends a request on to the service servName, with uri as the path?query
+// Returns the service's response, or the status code and error to report
+// back to the client
+func proxyRequest(r *http.Request, servName string, uri string) (*http.Response, int, error) {
+    // Continue the client's trace, if it sent one
+    ctx, span := tracing.Start(tracing.Extract(r.Context(), r.Header),
+                                tracing.Server, "proxy request")
+    defer span.End()
+    span.SetAttr("service", servName)
+    span.SetAttr("http.method", r.Method)
+
+    resp, status, err := forwardRequest(r.WithContext(ctx), servName, uri)
+    if resp != nil {
+        status = resp.StatusCode
+    }
+    span.SetError(err)
+    span.SetAttr("http.status_code", strconv.Itoa(status))
+    metrics.ProxyRequests.WithLabelValues(servName, strconv.Itoa(status)).Inc()
+    return resp, status, err
+}
+
+func forwardRequest(r *http.Request, servName string, uri string) (*http.Response, int, error) {
+    log := log.With(logging.FieldService, servName)
+    info, err := registryCache.GetOrRequestService(servName)
+    if err != nil {
+        log.Printf("ERROR: Registry lookup failed\n%s\n", err)
+        if errors.Is(err, rcache.ErrNotFound) {
+            return nil, http.StatusNotFound, err
         }
+        return nil, http.StatusBadGateway, err
+    }
 
-        elapsedTime := time.Now().Sub(startTime)
-        log.Println("Find/alloc service took:", elapsedTime)
+    if err = setServiceURI(r, servName, uri); err != nil {
+        log.Printf("ERROR: Invalid request URI %s\n%v\n", uri, err)
+        return nil, http.StatusBadRequest, err
     }
 
-    if id == peer.ID("") {
-        return nil, errors.New("Not found")
+    // Let the service know who the request is from and where it's been
+    clientAddr, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        clientAddr = r.RemoteAddr
     }
-    log.Printf("Running request to peer ID %s\n", id)
-    resp, err := manager.Request(id, req)
+    lca.AddForwardedHeaders(r, clientAddr, manager.Host.Host.ID().Pretty())
+    manager.SetCallerHeaders(r)
+
+    release, wait, ok := serviceLimiter.Acquire(servName)
+    if !ok {
+        log.Printf("Rejecting request to %s, over its limits\n", servName)
+        return limiter.NewResponse(r, wait), http.StatusTooManyRequests, nil
+    }
+    defer release()
+
+    // Run request
+    resp, err := runRequest(servName, info, r)
     if err != nil {
-        log.Printf("ERROR: HTTP request over P2P failed\n%v\n", err)
-        go peerCache.RemovePeer(id)
+        log.Println("Request to service returned an error:\n", err)
+        if resp != nil {
+            resp.Body.Close()
+        }
+        return nil, http.StatusBadGateway, errors.New("Service error")
     }
 
-    return resp, err
+    return resp, http.StatusOK, nil
 }
 
 // Handles the "proxying" part of proxy
-// TODO: Refactor this function
 func httpRequestHandler(w http.ResponseWriter, r *http.Request) {
-    log.Println("Got request:", r.URL.RequestURI()[1:])
-
-    // URL.RequestURI() includes path?query (URL.Path only has the path)
-    tokens := strings.SplitN(r.URL.RequestURI(), "/", 3)
-    log.Println(tokens)
-    // tokens[0] should be an empty string from parsing the initial "/"
-    serviceName := tokens[1]
-    info, err := registryCache.GetOrRequestService(serviceName)
+    log.Println("Got request:", r.Method, r.RequestURI)
+
+    if r.Method == http.MethodConnect {
+        connectHandler(w, r)
+        return
+    }
+
+    serviceName, uri, err := routeRequest(r)
     if err != nil {
-        http.Error(w, "404 Not Found", http.StatusNotFound)
+        http.Error(w, "400 Bad Request", http.StatusBadRequest)
         fmt.Fprintf(w, "%s\n", err)
-        log.Printf("ERROR: Registry lookup failed\n%s\n", err)
         return
     }
-    // Run request
-    resp, err := runRequest(serviceName, info, r)
-    if resp != nil {
-        defer resp.Body.Close()
-    }
-    if err != nil {
-        log.Println("Request to service returned an error:\n", err)
 
-        // Propagate error code and message to client
-        if resp != nil {
-            http.Error(w, "Service error: " + resp.Status, resp.StatusCode)
-        } else {
-            http.Error(w, "Service error", http.StatusBadGateway)
-        }
+    resp, status, err := proxyRequest(r, serviceName, uri)
+    if err != nil {
+        http.Error(w, fmt.Sprintf("%d %s", status, http.StatusText(status)), status)
+        fmt.Fprintf(w, "%s\n", err)
         return
     }
+    defer resp.Body.Close()
 
     // Return result
     // This returns errors as well
@@ -241,6 +244,23 @@ func main() {
     flag.StringVar(&configPath, "configfile", "../conf/conf.json", "Path to configuration file to use")
     var rcacheTTL int
     flag.IntVar(&rcacheTTL, "rcache-ttl", 3600, "Time-to-live in seconds for registry cache entries")
+    var hostRouting, forwardProxy bool
+    flag.BoolVar(&hostRouting, "host-routing", false,
+        "Route requests using the Host header as the service name")
+    flag.BoolVar(&forwardProxy, "forward-proxy", false,
+        "Accept absolute-form URIs and CONNECT so clients can use this proxy as HTTP_PROXY")
+    var promPort string
+    flag.StringVar(&promPort, "prometheus-port", "",
+        "Port to serve Prometheus metrics on at /metrics, disabled if empty")
+    var adminPort string
+    flag.StringVar(&adminPort, "admin-port", "",
+        "Local port for the admin API to listen on, disabled if empty")
+    var shutdownTimeout int
+    flag.IntVar(&shutdownTimeout, "shutdown-timeout", 30,
+        "Seconds to wait for in-flight requests to finish when shutting down")
+    traceFlags := tracing.AddFlags()
+    logFlags := logging.AddFlags()
+    cacheFlags := cachefile.AddFlags()
 
     var keyFlags util.KeyFlags
     var bootstraps *[]multiaddr.Multiaddr
@@ -303,6 +323,32 @@ func main() {
     }
     configFile.Close()
 
+    if err = logFlags.Configure(config.Logging); err != nil {
+        log.Fatalf("ERROR: Invalid logging configuration\n%s\n", err)
+    }
+
+    // Command line flags can enable routing modes, but not disable them
+    routing = config.Routing
+    routing.HostHeader = routing.HostHeader || hostRouting
+    routing.ForwardProxy = routing.ForwardProxy || forwardProxy
+    if pathPrefixes, err = normalizePathPrefixes(routing.PathPrefixes); err != nil {
+        log.Fatalf("ERROR: Invalid path prefixes\n%s\n", err)
+    }
+
+    if err = validateHedging(config); err != nil {
+        log.Fatalf("ERROR: Invalid hedging configuration\n%s\n", err)
+    }
+    hedgeConfig = config
+
+    serviceLimiter, err = limiter.NewServiceLimiter(config)
+    if err != nil {
+        log.Fatalf("ERROR: Invalid service limits\n%s\n", err)
+    }
+    callerLimiter, err := limiter.NewCallerLimiter(config)
+    if err != nil {
+        log.Fatalf("ERROR: Invalid caller limits\n%s\n", err)
+    }
+
     if len(*bootstraps) == 0 {
         if len(config.Bootstraps) == 0 {
             envBootstraps, err := util.GetEnvBootstraps()
@@ -355,25 +401,85 @@ func main() {
     if err != nil {
         log.Fatalf("ERROR: Unable to create LCA Manager\n%s", err)
     }
+    manager.Limiter = callerLimiter
+
+    // Spans are attributed to the service this proxy represents, if any
+    traceName := "proxy"
+    if mode == "service" {
+        traceName = service
+    }
+    if err = traceFlags.Init(traceName); err != nil {
+        log.Fatalf("ERROR: Unable to start tracing\n%s\n", err)
+    }
+
+    if mode == "service" {
+        scalerConfig, enabled, err := lca.NewScalerConfig(config.Scaling)
+        if err != nil {
+            log.Fatalf("ERROR: Invalid scaling configuration\n%s\n", err)
+        }
+        if enabled {
+            manager.Scaler, err = lca.NewScaler(manager, scalerConfig)
+            if err != nil {
+                log.Fatalf("ERROR: Unable to set up scaling\n%s\n", err)
+            }
+        }
+    }
 
 
     // Setup registry cache
     registryCache = rcache.NewRegistryCache(manager.Host.Ctx, manager.Host.Host,
         manager.Host.RoutingDiscovery, rcacheTTL)
+    registryCache.Configure(config)
+    manager.Registry = registryCache
 
     // Create peer cache instance and start cache update loop
     log.Println("Launching proxy PeerCache instance")
     peerCache = pcache.NewPeerCache(&(manager.Host), registryCache)
-    go peerCache.UpdateCache()
+    if err = peerCache.Configure(config); err != nil {
+        log.Fatalf("ERROR: Invalid peer cache configuration\n%s\n", err)
+    }
+    saveCaches := cacheFlags.Start(peerCache, registryCache)
+    cacheCtx, stopCache := context.WithCancel(manager.Host.Ctx)
+    go peerCache.UpdateCache(cacheCtx)
+    go registryCache.UpdateCache(cacheCtx)
+
+    serviceResolver = resolver.NewResolver(manager, peerCache, registryCache)
+
+    // Setup admin API, on a separate port so it's never exposed by accident
+    var adminHTTPServer *http.Server
+    if adminPort != "" {
+        adminServer := admin.NewServer(serviceResolver)
+        log.Println("Starting admin API on 127.0.0.1:" + adminPort)
+        adminHTTPServer = &http.Server{
+            Addr: "127.0.0.1:" + adminPort,
+            Handler: adminServer,
+        }
+        go serve(adminHTTPServer)
+    }
 
     // Setup HTTP proxy service
     // This port number must be fixed in order for the proxy to be portable
     // Docker must route this port to an available one externally
-    httpRequestMux := http.NewServeMux()
-    httpRequestMux.HandleFunc("/", httpRequestHandler)
+    // NOTE: Not using a ServeMux as it doesn't route CONNECT or absolute-form
+    //       requests the way a forward proxy needs, and all paths go to the
+    //       same handler anyway.
     log.Println("Starting HTTP Proxy on 127.0.0.1:" + port)
-    go http.ListenAndServe("127.0.0.1:" + port, httpRequestMux)
+    proxyServer := &http.Server{
+        Addr: "127.0.0.1:" + port,
+        Handler: http.HandlerFunc(httpRequestHandler),
+    }
+    go serve(proxyServer)
+
+    var promServer *http.Server
+    if promPort != "" {
+        promMux := http.NewServeMux()
+        promMux.Handle("/metrics", promhttp.Handler())
+        log.Println("Starting Prometheus endpoint on :" + promPort)
+        promServer = &http.Server{Addr: ":" + promPort, Handler: promMux}
+        go serve(promServer)
+    }
 
+    var metricsServer *http.Server
     if mode == "service" {
         httpMetricsMux := http.NewServeMux()
         httpMetricsMux.HandleFunc("/", httpMetricsHandler)
@@ -381,8 +487,62 @@ func main() {
         manager.Tolsr = time.Now()
         manager.TolsrMux.Unlock()
         log.Println("Starting HTTP Metrics Service on 127.0.0.1:" + metricsPort)
-        go http.ListenAndServe("127.0.0.1:" + metricsPort, httpMetricsMux)
+        metricsServer = &http.Server{
+            Addr: "127.0.0.1:" + metricsPort,
+            Handler: httpMetricsMux,
+        }
+        go serve(metricsServer)
     }
 
-    select {}
+    sig := waitForSignal()
+    log.Printf("Got %s, shutting down (send again to force)\n", sig)
+    shutdownCtx, cancel := context.WithTimeout(context.Background(),
+                                        time.Duration(shutdownTimeout) * time.Second)
+    defer cancel()
+
+    // Stop advertising first so clients move on to other instances while
+    // in-flight requests drain
+    manager.StopAdvertising()
+    if err = proxyServer.Shutdown(shutdownCtx); err != nil {
+        log.Printf("ERROR: Unable to shut down HTTP Proxy cleanly\n%v\n", err)
+    }
+    stopCache()
+    saveCaches()
+    if adminHTTPServer != nil {
+        adminHTTPServer.Close()
+    }
+    if err = manager.Shutdown(shutdownCtx); err != nil {
+        log.Printf("ERROR: Unable to shut down LCA Manager cleanly\n%v\n", err)
+    }
+    // Keep the metrics service up until the end so the allocator doesn't
+    // see the service as unused while it's still draining
+    if metricsServer != nil {
+        metricsServer.Close()
+    }
+    if promServer != nil {
+        promServer.Close()
+    }
+    if err = tracing.Shutdown(shutdownCtx); err != nil {
+        log.Printf("ERROR: Unable to export remaining trace spans\n%v\n", err)
+    }
+    log.Println("Shutdown complete")
+}
+
+// Runs an HTTP server until it's shut down
+func serve(server *http.Server) {
+    err := server.ListenAndServe()
+    if err != nil && err != http.ErrServerClosed {
+        log.Printf("ERROR: HTTP server on %s failed\n%v\n", server.Addr, err)
+    }
+}
+
+// Blocks until the process is asked to terminate
+// Further signals are left to their default behaviour, so a second one ends
+// the process right away
+func waitForSignal() os.Signal {
+    sigs := make(chan os.Signal, 1)
+    signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+    sig := <-sigs
+    signal.Stop(sigs)
+    return sig
 }
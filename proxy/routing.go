@@ -0,0 +1,217 @@
+/* Request routing modes for the HTTP proxy. Determines which service a
+ * request is meant for, and the URI to pass on to that service. In order of
+ * precedence:
+ *   - Forward proxy: absolute-form URIs (http://service-name/path) and
+ *     CONNECT tunnels, so clients can set HTTP_PROXY and use URLs unchanged
+ *   - Path prefixes: configured prefixes mapped to service names
+ *   - Host header: virtual hosting with "Host: service-name"
+ *   - Default: first path segment is the service name (/service-name/path)
+ */
+
+package main
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net"
+    "net/http"
+    "net/url"
+    "strings"
+
+    "github.com/PhysarumSM/service-manager/conf"
+)
+
+// Routing modes enabled for this proxy
+var routing conf.Routing
+
+// Configured path prefixes, normalised to a leading slash and no trailing
+// slash, mapped to service names
+var pathPrefixes map[string]string
+
+// Normalises the configured path prefixes, so routes compare the same way
+// however their slashes were written
+// Prefixes that normalise to the same path must map to the same service
+func normalizePathPrefixes(prefixes map[string]string) (map[string]string, error) {
+    normalized := make(map[string]string, len(prefixes))
+    for prefix, servName := range prefixes {
+        p := "/" + strings.Trim(prefix, "/")
+        if p == "/" {
+            return nil, errors.New("Path prefix must not be empty or /")
+        }
+        if other, ok := normalized[p]; ok && other != servName {
+            return nil, fmt.Errorf("Path prefix %s maps to both %s and %s", p, other, servName)
+        }
+        normalized[p] = servName
+    }
+    return normalized, nil
+}
+
+// Returns the service name and the URI (path?query) to pass to the service
+func routeRequest(r *http.Request) (string, string, error) {
+    path := r.URL.EscapedPath()
+    if path == "" {
+        path = "/"
+    }
+    query := ""
+    if r.URL.RawQuery != "" {
+        query = "?" + r.URL.RawQuery
+    }
+
+    // Absolute-form request URI, as sent to a forward proxy
+    if routing.ForwardProxy && r.URL.IsAbs() {
+        if r.URL.Scheme != "http" {
+            return "", "", fmt.Errorf("Unsupported scheme %s", r.URL.Scheme)
+        }
+        return r.URL.Hostname(), path + query, nil
+    }
+
+    // Configured path prefixes
+    if servName, rest, ok := matchPathPrefix(path); ok {
+        return servName, rest + query, nil
+    }
+
+    // Virtual hosting
+    if routing.HostHeader {
+        if servName := hostService(r.Host); servName != "" {
+            return servName, path + query, nil
+        }
+    }
+
+    // Default: /service-name/path
+    tokens := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+    if tokens[0] == "" {
+        return "", "", errors.New("No service name in request path")
+    }
+    rest := "/"
+    if len(tokens) == 2 {
+        rest += tokens[1]
+    }
+    return tokens[0], rest + query, nil
+}
+
+// Finds the longest configured prefix matching whole segments of path
+// Returns the mapped service name and the remainder of the path
+func matchPathPrefix(path string) (string, string, bool) {
+    var best string
+    for p := range pathPrefixes {
+        if path != p && !strings.HasPrefix(path, p + "/") {
+            continue
+        }
+        if len(p) > len(best) {
+            best = p
+        }
+    }
+    if best == "" {
+        return "", "", false
+    }
+
+    rest := strings.TrimPrefix(path, best)
+    if rest == "" {
+        rest = "/"
+    }
+    return pathPrefixes[best], rest, true
+}
+
+// Returns the service named by a Host header, or an empty string if the
+// host is an IP address or localhost (i.e. the client addressed the proxy)
+func hostService(host string) string {
+    if h, _, err := net.SplitHostPort(host); err == nil {
+        host = h
+    }
+    host = strings.TrimSuffix(host, ".")
+    if host == "" || host == "localhost" || net.ParseIP(host) != nil {
+        return ""
+    }
+    return host
+}
+
+// Rewrites the request URI to the form expected by the service's proxy,
+// which strips the leading service name before passing the request on
+func setServiceURI(r *http.Request, servName string, uri string) error {
+    u, err := url.ParseRequestURI("/" + servName + uri)
+    if err != nil {
+        return err
+    }
+    r.URL = u
+    r.RequestURI = ""
+    return nil
+}
+
+// Handles CONNECT requests in forward proxy mode
+// The tunnel is expected to carry plain HTTP to the service named by the
+// CONNECT target; each request read from it is proxied as usual.
+func connectHandler(w http.ResponseWriter, r *http.Request) {
+    if !routing.ForwardProxy {
+        http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    servName := hostService(r.Host)
+    if servName == "" {
+        http.Error(w, "400 Bad Request", http.StatusBadRequest)
+        return
+    }
+
+    hj, ok := w.(http.Hijacker)
+    if !ok {
+        http.Error(w, "Tunneling not supported", http.StatusInternalServerError)
+        return
+    }
+    conn, bufrw, err := hj.Hijack()
+    if err != nil {
+        log.Printf("ERROR: Unable to hijack connection for CONNECT\n%v\n", err)
+        return
+    }
+    defer conn.Close()
+
+    log.Printf("Opened CONNECT tunnel from %s to %s\n", r.RemoteAddr, servName)
+    bufrw.WriteString("HTTP/1.1 200 Connection Established\r\n\r\n")
+    if err = bufrw.Flush(); err != nil {
+        return
+    }
+
+    for {
+        req, err := http.ReadRequest(bufrw.Reader)
+        if err != nil {
+            if err != io.EOF {
+                log.Printf("ERROR: Unable to read request from CONNECT tunnel\n%v\n", err)
+            }
+            return
+        }
+        req.RemoteAddr = r.RemoteAddr
+
+        resp, status, err := proxyRequest(req, servName, req.URL.RequestURI())
+        if err != nil {
+            resp = newErrorResponse(req, status, err)
+        }
+        err = resp.Write(bufrw)
+        resp.Body.Close()
+        if err == nil {
+            err = bufrw.Flush()
+        }
+        if err != nil {
+            log.Printf("ERROR: Unable to write response to CONNECT tunnel\n%v\n", err)
+            return
+        }
+
+        if req.Close || resp.Close {
+            return
+        }
+    }
+}
+
+// Builds a plain text response for reporting errors through a CONNECT tunnel
+func newErrorResponse(req *http.Request, status int, err error) *http.Response {
+    body := fmt.Sprintf("%d %s\n%v\n", status, http.StatusText(status), err)
+    return &http.Response{
+        StatusCode: status,
+        ProtoMajor: 1,
+        ProtoMinor: 1,
+        Header: http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+        Body: ioutil.NopCloser(strings.NewReader(body)),
+        ContentLength: int64(len(body)),
+        Request: req,
+    }
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "testing"
+
+    "github.com/PhysarumSM/service-manager/conf"
+)
+
+// Sets the routing globals for a test, returns a function restoring them
+func setRouting(t *testing.T, r conf.Routing) func() {
+    prevRouting, prevPrefixes := routing, pathPrefixes
+    restore := func() {
+        routing, pathPrefixes = prevRouting, prevPrefixes
+    }
+
+    var err error
+    routing = r
+    if pathPrefixes, err = normalizePathPrefixes(r.PathPrefixes); err != nil {
+        restore()
+        t.Fatalf("normalizePathPrefixes(%v) failed: %v", r.PathPrefixes, err)
+    }
+    return restore
+}
+
+func TestNormalizePathPrefixes(t *testing.T) {
+    tests := []struct {
+        prefixes map[string]string
+        want     map[string]string
+        wantErr  bool
+    }{
+        {
+            prefixes: map[string]string{"api/hello/": "hello", "/api": "api"},
+            want: map[string]string{"/api/hello": "hello", "/api": "api"},
+        },
+        {
+            prefixes: map[string]string{"/api/": "api", "api": "api"},
+            want: map[string]string{"/api": "api"},
+        },
+        {
+            prefixes: map[string]string{"/api/": "api", "/api": "other"},
+            wantErr: true,
+        },
+        {
+            prefixes: map[string]string{"/": "root"},
+            wantErr: true,
+        },
+    }
+    for _, test := range tests {
+        got, err := normalizePathPrefixes(test.prefixes)
+        if test.wantErr {
+            if err == nil {
+                t.Errorf("normalizePathPrefixes(%v) = %v, want error", test.prefixes, got)
+            }
+            continue
+        }
+        if err != nil {
+            t.Errorf("normalizePathPrefixes(%v) failed: %v", test.prefixes, err)
+        } else if !reflect.DeepEqual(got, test.want) {
+            t.Errorf("normalizePathPrefixes(%v) = %v, want %v", test.prefixes, got, test.want)
+        }
+    }
+}
+
+func TestMatchPathPrefix(t *testing.T) {
+    defer setRouting(t, conf.Routing{PathPrefixes: map[string]string{
+        "/api/": "api",
+        "api/hello": "hello",
+        "/static": "static",
+    }})()
+
+    tests := []struct {
+        path     string
+        servName string
+        rest     string
+        ok       bool
+    }{
+        {"/api", "api", "/", true},
+        {"/api/", "api", "/", true},
+        {"/api/users", "api", "/users", true},
+        // Longest prefix wins, however the slashes were configured
+        {"/api/hello", "hello", "/", true},
+        {"/api/hello/x", "hello", "/x", true},
+        {"/api/hellox", "api", "/hellox", true},
+        // Prefixes only match whole segments
+        {"/apix", "", "", false},
+        {"/static/css/a.css", "static", "/css/a.css", true},
+        {"/other", "", "", false},
+    }
+    for _, test := range tests {
+        servName, rest, ok := matchPathPrefix(test.path)
+        if servName != test.servName || rest != test.rest || ok != test.ok {
+            t.Errorf("matchPathPrefix(%q) = (%q, %q, %v), want (%q, %q, %v)",
+                        test.path, servName, rest, ok, test.servName, test.rest, test.ok)
+        }
+    }
+}
+
+func TestHostService(t *testing.T) {
+    tests := []struct {
+        host string
+        want string
+    }{
+        {"hello-world-server", "hello-world-server"},
+        {"hello-world-server:1234", "hello-world-server"},
+        {"hello-world-server.", "hello-world-server"},
+        {"localhost:1234", ""},
+        {"127.0.0.1:1234", ""},
+        {"[::1]:1234", ""},
+        {"", ""},
+    }
+    for _, test := range tests {
+        if got := hostService(test.host); got != test.want {
+            t.Errorf("hostService(%q) = %q, want %q", test.host, got, test.want)
+        }
+    }
+}
+
+func TestRouteRequest(t *testing.T) {
+    defer setRouting(t, conf.Routing{
+        HostHeader: true,
+        ForwardProxy: true,
+        PathPrefixes: map[string]string{"/api/hello": "hello"},
+    })()
+
+    tests := []struct {
+        name     string
+        target   string
+        host     string
+        servName string
+        uri      string
+        wantErr  bool
+    }{
+        {"forward proxy", "http://fwd/x?q=1", "", "fwd", "/x?q=1", false},
+        {"forward proxy https", "https://fwd/x", "", "", "", true},
+        {"path prefix", "/api/hello/x?q=1", "vhost", "hello", "/x?q=1", false},
+        {"host header", "/x?q=1", "vhost:1234", "vhost", "/x?q=1", false},
+        {"default", "/svc/x/y?q=1", "127.0.0.1:1234", "svc", "/x/y?q=1", false},
+        {"default without path", "/svc", "localhost", "svc", "/", false},
+        {"no service name", "/", "localhost", "", "", true},
+    }
+    for _, test := range tests {
+        req := httptest.NewRequest(http.MethodGet, test.target, nil)
+        if test.host != "" {
+            req.Host = test.host
+        }
+        servName, uri, err := routeRequest(req)
+        if test.wantErr {
+            if err == nil {
+                t.Errorf("%s: routeRequest(%s) = (%q, %q), want error",
+                            test.name, test.target, servName, uri)
+            }
+            continue
+        }
+        if err != nil {
+            t.Errorf("%s: routeRequest(%s) failed: %v", test.name, test.target, err)
+        } else if servName != test.servName || uri != test.uri {
+            t.Errorf("%s: routeRequest(%s) = (%q, %q), want (%q, %q)",
+                        test.name, test.target, servName, uri, test.servName, test.uri)
+        }
+    }
+}
@@ -0,0 +1,74 @@
+package rcache
+
+// Settings for how the registry cache handles missing and expired entries
+
+import (
+    "time"
+
+    "github.com/PhysarumSM/service-manager/conf"
+)
+
+type Config struct {
+    // How long a service the registry doesn't know of is cached as not
+    // found, 0 to not cache it
+    NegativeTTL  time.Duration
+    // How long past its expiry an entry is still served while it's being
+    // refreshed, 0 to never serve expired entries
+    MaxStale     time.Duration
+    // How long before expiry hot entries are refreshed in the background,
+    // 0 to only refresh entries once they expire
+    // Capped at half the cache's TTL
+    RefreshAhead time.Duration
+    // Entries looked up within this long count as hot
+    Hot          time.Duration
+}
+
+// Returns the settings used when none are configured
+func DefaultConfig() Config {
+    return Config{
+        // Short, so a newly registered service is found soon after
+        NegativeTTL: 10 * time.Second,
+        MaxStale: 10 * time.Minute,
+        RefreshAhead: 1 * time.Minute,
+        Hot: 5 * time.Minute,
+    }
+}
+
+// Converts the configuration file's settings, using defaults for any unset
+// and turning off anything set negative
+func NewConfig(cfg conf.RegistryCache) Config {
+    c := DefaultConfig()
+    if cfg.NegativeTTLSecs < 0 {
+        c.NegativeTTL = 0
+    } else if cfg.NegativeTTLSecs != 0 {
+        c.NegativeTTL = time.Duration(cfg.NegativeTTLSecs) * time.Second
+    }
+    if cfg.MaxStaleSecs < 0 {
+        c.MaxStale = 0
+    } else if cfg.MaxStaleSecs != 0 {
+        c.MaxStale = time.Duration(cfg.MaxStaleSecs) * time.Second
+    }
+    if cfg.RefreshAheadSecs < 0 {
+        c.RefreshAhead = 0
+    } else if cfg.RefreshAheadSecs != 0 {
+        c.RefreshAhead = time.Duration(cfg.RefreshAheadSecs) * time.Second
+    }
+    if cfg.HotSecs < 0 {
+        c.Hot = 0
+    } else if cfg.HotSecs != 0 {
+        c.Hot = time.Duration(cfg.HotSecs) * time.Second
+    }
+    return c
+}
+
+// Applies new settings, to cached entries as well
+func (rc *RegistryCache) SetConfig(c Config) {
+    rc.mux.Lock()
+    rc.config = c
+    rc.mux.Unlock()
+}
+
+// Sets up the cache from a config
+func (rc *RegistryCache) Configure(config conf.Config) {
+    rc.SetConfig(NewConfig(config.RegistryCache))
+}
@@ -0,0 +1,143 @@
+package rcache
+
+// Refreshing entries before they're needed
+// Services that are looked up often are refreshed in the background shortly
+// before they expire, so lookups of them never wait on registry-service
+
+import (
+    "context"
+    "errors"
+    "time"
+
+    "github.com/PhysarumSM/service-registry/registry"
+)
+
+// Time between checks for entries due a refresh
+const refreshCheckInterval = 1 * time.Second
+
+// Time before retrying a refresh that failed, so an unreachable registry
+// isn't queried for every lookup of a stale entry
+const refreshRetryInterval = 10 * time.Second
+
+// A request to registry-service, shared by everyone looking up the service
+// while it's under way
+type lookup struct {
+    // Closed once info and err are set
+    done chan struct{}
+    info registry.ServiceInfo
+    err  error
+}
+
+type usage struct {
+    lastUsed time.Time
+    retryAt  time.Time
+}
+
+// Must be called with rc.mux held
+func (rc *RegistryCache) usageLocked(serviceName string) *usage {
+    u, ok := rc.usage[serviceName]
+    if !ok {
+        u = &usage{}
+        rc.usage[serviceName] = u
+    }
+    return u
+}
+
+// Returns the request for serviceName under way, starting one if there isn't
+// started is true if this call started it
+func (rc *RegistryCache) lookup(serviceName string) (l *lookup, started bool) {
+    rc.mux.Lock()
+    defer rc.mux.Unlock()
+    if l, ok := rc.inflight[serviceName]; ok {
+        return l, false
+    }
+    l = &lookup{done: make(chan struct{})}
+    rc.inflight[serviceName] = l
+
+    go func() {
+        l.info, l.err = rc.request(serviceName)
+        rc.mux.Lock()
+        delete(rc.inflight, serviceName)
+        rc.mux.Unlock()
+        close(l.done)
+    }()
+    return l, true
+}
+
+// Refreshes serviceName in the background, unless a refresh is already under
+// way or the last one failed too recently
+// If the registry can't be reached the stale entry is kept, to be served
+// until it's too old
+func (rc *RegistryCache) refresh(serviceName string) {
+    rc.mux.RLock()
+    u, ok := rc.usage[serviceName]
+    wait := ok && time.Now().Before(u.retryAt)
+    rc.mux.RUnlock()
+    if wait {
+        return
+    }
+
+    l, started := rc.lookup(serviceName)
+    if !started {
+        return
+    }
+    log.Printf("Refreshing registry cache entry for %s\n", serviceName)
+    go func() {
+        <-l.done
+        if l.err == nil || errors.Is(l.err, ErrNotFound) {
+            return
+        }
+        log.Printf("WARNING: Unable to refresh %s, serving cached entry\n%v\n",
+                    serviceName, l.err)
+        rc.mux.Lock()
+        rc.usageLocked(serviceName).retryAt = time.Now().Add(refreshRetryInterval)
+        rc.mux.Unlock()
+    }()
+}
+
+// Periodically refreshes hot entries about to expire, and drops entries
+// too old to be served, until ctx is cancelled
+func (rc *RegistryCache) UpdateCache(ctx context.Context) {
+    ticker := time.NewTicker(refreshCheckInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+            for _, name := range rc.dueForRefresh() {
+                rc.refresh(name)
+            }
+        }
+    }
+}
+
+// Returns the services whose entries are hot and expire within the refresh
+// ahead time, dropping any entries too old to be served
+func (rc *RegistryCache) dueForRefresh() []string {
+    now := time.Now()
+    rc.mux.Lock()
+    defer rc.mux.Unlock()
+
+    ahead := rc.config.RefreshAhead
+    if ahead > rc.ttl / 2 {
+        ahead = rc.ttl / 2
+    }
+
+    var due []string
+    for name, entry := range rc.data {
+        if now.After(rc.servableUntilLocked(entry)) {
+            delete(rc.data, name)
+            delete(rc.usage, name)
+            continue
+        }
+        // Unknown services aren't refreshed, they'd only cost DHT queries
+        if entry.NotFound || ahead == 0 || now.Before(entry.Expiry.Add(-ahead)) {
+            continue
+        }
+        if u, ok := rc.usage[name]; ok && now.Sub(u.lastUsed) < rc.config.Hot {
+            due = append(due, name)
+        }
+    }
+    return due
+}
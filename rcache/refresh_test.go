@@ -0,0 +1,208 @@
+package rcache
+
+import (
+    "errors"
+    "reflect"
+    "sort"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/PhysarumSM/service-registry/registry"
+)
+
+func TestCoalescedLookups(t *testing.T) {
+    stub := newStubRegistry()
+    stub.set("svc", registry.ServiceInfo{ContentHash: "svc"})
+    stub.block = make(chan struct{})
+    rc := newStubCache(stub, DefaultConfig())
+
+    first, started := rc.lookup("svc")
+    if !started {
+        t.Fatalf("lookup() didn't start a request")
+    }
+    if l, started := rc.lookup("svc"); started || l != first {
+        t.Errorf("lookup() started a second request while one was under way")
+    }
+
+    // Anyone looking the service up meanwhile waits on the same request,
+    // and anyone after finds it cached
+    const lookups = 10
+    var wg sync.WaitGroup
+    errs := make(chan error, lookups)
+    for i := 0; i < lookups; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            info, err := rc.GetOrRequestService("svc")
+            if err == nil && info.ContentHash != "svc" {
+                err = errors.New("wrong service info")
+            }
+            errs <- err
+        }()
+    }
+    close(stub.block)
+    wg.Wait()
+    close(errs)
+    for err := range errs {
+        if err != nil {
+            t.Errorf("GetOrRequestService() failed: %v", err)
+        }
+    }
+    if n := stub.count(); n != 1 {
+        t.Errorf("Registry queried %d times, want 1", n)
+    }
+}
+
+func TestDueForRefresh(t *testing.T) {
+    rc := newStubCache(newStubRegistry(), Config{
+        MaxStale: time.Minute,
+        RefreshAhead: 20 * time.Second,
+        Hot: time.Minute,
+    })
+
+    now := time.Now()
+    tests := []struct {
+        name     string
+        expiry   time.Duration
+        notFound bool
+        lastUsed time.Duration
+        due      bool
+        kept     bool
+    }{
+        {"hot, expiring", 10 * time.Second, false, -time.Second, true, true},
+        {"hot, expired", -10 * time.Second, false, -time.Second, true, true},
+        {"hot, not expiring", 50 * time.Second, false, -time.Second, false, true},
+        {"cold, expiring", 10 * time.Second, false, -2 * time.Minute, false, true},
+        {"never used, expiring", 10 * time.Second, false, 0, false, true},
+        {"not found, expiring", 5 * time.Second, true, -time.Second, false, true},
+        {"hot, too old", -2 * time.Minute, false, -time.Second, false, false},
+    }
+    rc.mux.Lock()
+    for _, test := range tests {
+        rc.data[test.name] = Entry{Expiry: now.Add(test.expiry), NotFound: test.notFound}
+        if test.lastUsed != 0 {
+            rc.usageLocked(test.name).lastUsed = now.Add(test.lastUsed)
+        }
+    }
+    rc.mux.Unlock()
+
+    var want []string
+    for _, test := range tests {
+        if test.due {
+            want = append(want, test.name)
+        }
+    }
+    due := rc.dueForRefresh()
+    sort.Strings(due)
+    sort.Strings(want)
+    if !reflect.DeepEqual(due, want) {
+        t.Errorf("dueForRefresh() = %v, want %v", due, want)
+    }
+
+    entries := rc.Entries()
+    for _, test := range tests {
+        if _, ok := entries[test.name]; ok != test.kept {
+            t.Errorf("%s: entry kept: %v, want %v", test.name, ok, test.kept)
+        }
+    }
+}
+
+func TestRefreshAheadCapped(t *testing.T) {
+    // With a TTL of a minute, entries are refreshed at most 30s early
+    rc := newStubCache(newStubRegistry(), Config{RefreshAhead: 10 * time.Minute, Hot: time.Minute})
+    now := time.Now()
+    rc.mux.Lock()
+    rc.data["early"] = Entry{Expiry: now.Add(40 * time.Second)}
+    rc.data["due"] = Entry{Expiry: now.Add(20 * time.Second)}
+    rc.usageLocked("early").lastUsed = now
+    rc.usageLocked("due").lastUsed = now
+    rc.mux.Unlock()
+
+    if due := rc.dueForRefresh(); !reflect.DeepEqual(due, []string{"due"}) {
+        t.Errorf("dueForRefresh() = %v, want [due]", due)
+    }
+}
+
+func TestRefreshRetry(t *testing.T) {
+    stub := newStubRegistry()
+    stub.setErr(errors.New("unreachable"))
+    rc := newStubCache(stub, Config{MaxStale: time.Minute})
+    rc.Add("svc", registry.ServiceInfo{ContentHash: "old"})
+    age(rc, "svc", 90 * time.Second)
+
+    rc.refresh("svc")
+    waitForLookups(t, rc)
+    // The failure is recorded once the refresh's result is in
+    deadline := time.Now().Add(time.Second)
+    for {
+        rc.mux.RLock()
+        u, ok := rc.usage["svc"]
+        failed := ok && !u.retryAt.IsZero()
+        rc.mux.RUnlock()
+        if failed {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("Failed refresh wasn't recorded")
+        }
+        time.Sleep(time.Millisecond)
+    }
+
+    // No refreshes until the retry interval is up
+    rc.refresh("svc")
+    if n := stub.count(); n != 1 {
+        t.Errorf("Registry queried %d times before the retry interval, want 1", n)
+    }
+
+    stub.setErr(nil)
+    stub.set("svc", registry.ServiceInfo{ContentHash: "updated"})
+    rc.mux.Lock()
+    rc.usage["svc"].retryAt = time.Now().Add(-time.Second)
+    rc.mux.Unlock()
+    rc.refresh("svc")
+    waitForLookups(t, rc)
+    if info, ok := rc.Get("svc"); !ok || info.ContentHash != "updated" {
+        t.Errorf("Get() after retrying = (%+v, %v), want the updated entry", info, ok)
+    }
+}
+
+func TestLookupsKeepEntriesHot(t *testing.T) {
+    tests := []struct {
+        name    string
+        touch   bool
+        cached  bool
+        found   bool
+        hot     bool
+    }{
+        {"client hit", true, true, true, true},
+        {"client miss", true, false, true, true},
+        {"client miss, not found", true, false, false, false},
+        // Background lookups, such as probes, don't keep entries hot
+        {"no touch hit", false, true, true, false},
+        {"no touch miss", false, false, true, false},
+    }
+    for _, test := range tests {
+        stub := newStubRegistry()
+        if test.found {
+            stub.set("svc", registry.ServiceInfo{ContentHash: "svc"})
+        }
+        rc := newStubCache(stub, DefaultConfig())
+        if test.cached {
+            rc.Add("svc", registry.ServiceInfo{ContentHash: "svc"})
+        }
+
+        if test.touch {
+            rc.GetOrRequestService("svc")
+        } else {
+            rc.GetOrRequestServiceNoTouch("svc")
+        }
+        rc.mux.RLock()
+        u, ok := rc.usage["svc"]
+        hot := ok && !u.lastUsed.IsZero()
+        rc.mux.RUnlock()
+        if hot != test.hot {
+            t.Errorf("%s: entry hot: %v, want %v", test.name, hot, test.hot)
+        }
+    }
+}
@@ -2,10 +2,14 @@ package rcache
 
 // Cache registry service info
 // Keeps track of when entries get cached and expires entries after a specified TTL
+// Services the registry doesn't know of are cached too, for a shorter TTL, and
+// expired entries are served for a while as they're refreshed in the background
+// Concurrent lookups of the same service share one request to registry-service
 
 import (
 	"context"
-	"log"
+	"errors"
+	"fmt"
 	"sync"
 	"time"
 
@@ -13,25 +17,48 @@ import (
     "github.com/libp2p/go-libp2p-discovery"
 
 	"github.com/PhysarumSM/service-registry/registry"
+
+	"github.com/PhysarumSM/service-manager/logging"
+	"github.com/PhysarumSM/service-manager/metrics"
 )
 
-func init() {
-    log.SetFlags(log.Ldate | log.Lmicroseconds | log.Lshortfile)
-}
+var log = logging.New("rcache")
 
 type RegistryCache struct {
 	ctx context.Context
 	host host.Host
 	routingDiscovery *discovery.RoutingDiscovery
+	// Queries registry-service, replaced in tests
+	query func(serviceName string) (registry.ServiceInfo, error)
 
 	ttl time.Duration // time-to-live
-	data map[string]cacheEntry
+	config Config
+	data map[string]Entry
+	// Requests to registry-service under way, by service name
+	inflight map[string]*lookup
+	// When each cached service was last looked up, and when a failed
+	// refresh can be retried
+	usage map[string]*usage
 	mux sync.RWMutex
 }
 
-type cacheEntry struct {
+// Cached service info along with when it expires
+type Entry struct {
 	Info registry.ServiceInfo
 	Expiry time.Time
+	// The registry didn't know of the service, Info is empty
+	NotFound bool
+}
+
+// Returned for services the registry doesn't know of
+var ErrNotFound = errors.New("Service not found in registry")
+
+// Error registry-service lookups return when the service isn't registered,
+// as opposed to when the registry couldn't be reached
+const registryNotFound = "registry: Error finding service info"
+
+func isNotFound(err error) bool {
+	return err != nil && err.Error() == registryNotFound
 }
 
 // Create new RegistryCache
@@ -40,19 +67,26 @@ type cacheEntry struct {
 func NewRegistryCache(ctx context.Context, host host.Host,
 	routingDiscovery *discovery.RoutingDiscovery, ttl int) *RegistryCache {
 
-	return &RegistryCache{
+	rc := &RegistryCache{
 		ctx: ctx,
 		host: host,
 		routingDiscovery: routingDiscovery,
 		ttl: time.Duration(ttl) * time.Second,
-		data: make(map[string]cacheEntry),
+		config: DefaultConfig(),
+		data: make(map[string]Entry),
+		inflight: make(map[string]*lookup),
+		usage: make(map[string]*usage),
+	}
+	rc.query = func(serviceName string) (registry.ServiceInfo, error) {
+		return registry.GetServiceWithHostRouting(rc.ctx, rc.host, rc.routingDiscovery, serviceName)
 	}
+	return rc
 }
 
 // Maps serviceName to info in cache
 // Sets expiry by checking current time and adding TTL
 func (rc *RegistryCache) Add(serviceName string, info registry.ServiceInfo) {
-	entry := cacheEntry{
+	entry := Entry{
 		Info: info,
 		Expiry: time.Now().Add(rc.ttl),
 	}
@@ -61,13 +95,29 @@ func (rc *RegistryCache) Add(serviceName string, info registry.ServiceInfo) {
 	rc.mux.Unlock()
 }
 
-// If serviceName entry doesn't exist in cache or is expired, ok is false
+// Caches serviceName as not found in the registry, unless negative caching
+// is turned off
+func (rc *RegistryCache) addNotFound(serviceName string) {
+	rc.mux.Lock()
+	defer rc.mux.Unlock()
+	if rc.config.NegativeTTL == 0 {
+		delete(rc.data, serviceName)
+		return
+	}
+	rc.data[serviceName] = Entry{
+		Expiry: time.Now().Add(rc.config.NegativeTTL),
+		NotFound: true,
+	}
+}
+
+// If serviceName entry doesn't exist in cache, is expired, or is cached as
+// not found, ok is false
 // Otherwise, returns mapped ServiceInfo and ok is true
 func (rc *RegistryCache) Get(serviceName string) (info registry.ServiceInfo, ok bool) {
 	rc.mux.RLock()
 	entry, ok := rc.data[serviceName]
 	rc.mux.RUnlock()
-	if !ok {
+	if !ok || entry.NotFound {
 		return info, false
 	}
 	if time.Now().After(entry.Expiry) {
@@ -81,23 +131,119 @@ func (rc *RegistryCache) Get(serviceName string) (info registry.ServiceInfo, ok
 func (rc *RegistryCache) Delete(serviceName string) {
 	rc.mux.Lock()
 	delete(rc.data, serviceName)
+	delete(rc.usage, serviceName)
 	rc.mux.Unlock()
 }
 
+// Removes all entries from cache
+func (rc *RegistryCache) Flush() {
+	rc.mux.Lock()
+	rc.data = make(map[string]Entry)
+	rc.usage = make(map[string]*usage)
+	rc.mux.Unlock()
+}
+
+// Returns a copy of all entries in cache, including expired ones
+func (rc *RegistryCache) Entries() map[string]Entry {
+	rc.mux.RLock()
+	defer rc.mux.RUnlock()
+	entries := make(map[string]Entry, len(rc.data))
+	for name, entry := range rc.data {
+		entries[name] = entry
+	}
+	return entries
+}
+
+// Adds previously saved entries back into the cache, skipping those too old
+// to serve and any already cached, and returns how many were restored
+func (rc *RegistryCache) Restore(entries map[string]Entry) int {
+	now := time.Now()
+	rc.mux.Lock()
+	defer rc.mux.Unlock()
+	restored := 0
+	for name, entry := range entries {
+		if _, ok := rc.data[name]; ok || now.After(rc.servableUntilLocked(entry)) {
+			continue
+		}
+		rc.data[name] = entry
+		restored++
+	}
+	return restored
+}
+
+// Returns the last time entry can be served, including while it's stale
+func (rc *RegistryCache) servableUntilLocked(entry Entry) time.Time {
+	if entry.NotFound {
+		return entry.Expiry
+	}
+	return entry.Expiry.Add(rc.config.MaxStale)
+}
+
 // Try to get service info from cache
-// If not in cache or expired, request it from registry-service and add it to cache
+// If expired but not by more than the max staleness, returns the expired
+// info and refreshes it in the background
+// If not in cache or too old, request it from registry-service and add it to
+// cache, waiting on any request for it already under way
+// Returns ErrNotFound if the registry doesn't know of the service
+// Counts as use of the service, keeping its entry hot, so should only be
+// called for lookups made on behalf of clients
 func (rc *RegistryCache) GetOrRequestService(serviceName string) (info registry.ServiceInfo, err error) {
-    // TODO: Log print below commented for now due to updateCache() loop in pcache, spams screen
-    //       Can uncomment when a proper logging library with different levels is implemented
-    //log.Println("Looking for service with name", serviceName, "in registry cache")
-    info, ok := rc.Get(serviceName)
-    if !ok {
-        log.Println("Not cached or expired, try querying registry-service")
-        info, err = registry.GetServiceWithHostRouting(rc.ctx, rc.host, rc.routingDiscovery, serviceName)
-        if err != nil {
-            return info, err
-        }
-        rc.Add(serviceName, info)
-	}
-	return info, nil
+    return rc.getOrRequest(serviceName, true)
+}
+
+// Same as GetOrRequestService(), but doesn't count as use of the service
+// For background work, such as probing cached peers, which would otherwise
+// keep every service with a cached peer hot
+func (rc *RegistryCache) GetOrRequestServiceNoTouch(serviceName string) (info registry.ServiceInfo, err error) {
+    return rc.getOrRequest(serviceName, false)
+}
+
+func (rc *RegistryCache) getOrRequest(serviceName string, touch bool) (info registry.ServiceInfo, err error) {
+    // Debug level since the updateCache() loop in pcache calls this constantly
+    log.Debugln("Looking for service with name", serviceName, "in registry cache")
+    now := time.Now()
+    rc.mux.Lock()
+    entry, ok := rc.data[serviceName]
+    servableUntil := rc.servableUntilLocked(entry)
+    if ok && touch {
+        rc.usageLocked(serviceName).lastUsed = now
+    }
+    rc.mux.Unlock()
+
+    switch {
+    case ok && !now.After(entry.Expiry) && entry.NotFound:
+        metrics.RegistryCacheLookups.WithLabelValues("negative").Inc()
+        return info, fmt.Errorf("%w: %s", ErrNotFound, serviceName)
+    case ok && !now.After(entry.Expiry):
+        metrics.RegistryCacheLookups.WithLabelValues("hit").Inc()
+        return entry.Info, nil
+    case ok && !now.After(servableUntil):
+        metrics.RegistryCacheLookups.WithLabelValues("stale").Inc()
+        rc.refresh(serviceName)
+        return entry.Info, nil
+    }
+
+    metrics.RegistryCacheLookups.WithLabelValues("miss").Inc()
+    log.Println("Not cached or expired, try querying registry-service")
+    l, _ := rc.lookup(serviceName)
+    <-l.done
+    if touch && l.err == nil {
+        rc.mux.Lock()
+        rc.usageLocked(serviceName).lastUsed = now
+        rc.mux.Unlock()
+    }
+    return l.info, l.err
+}
+
+// Queries registry-service for serviceName and caches the result
+func (rc *RegistryCache) request(serviceName string) (info registry.ServiceInfo, err error) {
+    info, err = rc.query(serviceName)
+    if isNotFound(err) {
+        rc.addNotFound(serviceName)
+        return info, fmt.Errorf("%w: %s", ErrNotFound, serviceName)
+    } else if err != nil {
+        return info, err
+    }
+    rc.Add(serviceName, info)
+    return info, nil
 }
@@ -0,0 +1,343 @@
+package rcache
+
+import (
+    "context"
+    "errors"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/PhysarumSM/service-registry/registry"
+
+    "github.com/PhysarumSM/service-manager/conf"
+    "github.com/PhysarumSM/service-manager/metrics"
+
+    "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Stands in for registry-service, counting the queries made to it
+type stubRegistry struct {
+    services map[string]registry.ServiceInfo
+    // Returned for every query if set, as if the registry couldn't be reached
+    err      error
+    // Queries wait on this if set
+    block    chan struct{}
+    queries  int
+    mux      sync.Mutex
+}
+
+func (s *stubRegistry) query(serviceName string) (registry.ServiceInfo, error) {
+    s.mux.Lock()
+    s.queries++
+    block := s.block
+    s.mux.Unlock()
+    if block != nil {
+        <-block
+    }
+
+    s.mux.Lock()
+    defer s.mux.Unlock()
+    if s.err != nil {
+        return registry.ServiceInfo{}, s.err
+    }
+    info, ok := s.services[serviceName]
+    if !ok {
+        return info, errors.New(registryNotFound)
+    }
+    return info, nil
+}
+
+func (s *stubRegistry) set(serviceName string, info registry.ServiceInfo) {
+    s.mux.Lock()
+    s.services[serviceName] = info
+    s.mux.Unlock()
+}
+
+func (s *stubRegistry) setErr(err error) {
+    s.mux.Lock()
+    s.err = err
+    s.mux.Unlock()
+}
+
+func (s *stubRegistry) count() int {
+    s.mux.Lock()
+    defer s.mux.Unlock()
+    return s.queries
+}
+
+// Returns a cache with a TTL of a minute, querying stub instead of
+// registry-service
+func newStubCache(stub *stubRegistry, c Config) *RegistryCache {
+    rc := NewRegistryCache(context.Background(), nil, nil, 60)
+    rc.query = stub.query
+    rc.SetConfig(c)
+    return rc
+}
+
+func newStubRegistry() *stubRegistry {
+    return &stubRegistry{services: make(map[string]registry.ServiceInfo)}
+}
+
+// Moves the expiry of serviceName's entry back by d
+func age(rc *RegistryCache, serviceName string, d time.Duration) {
+    rc.mux.Lock()
+    entry := rc.data[serviceName]
+    entry.Expiry = entry.Expiry.Add(-d)
+    rc.data[serviceName] = entry
+    rc.mux.Unlock()
+}
+
+// Waits for requests to the registry under way to finish
+func waitForLookups(t *testing.T, rc *RegistryCache) {
+    deadline := time.Now().Add(time.Second)
+    for {
+        rc.mux.RLock()
+        n := len(rc.inflight)
+        rc.mux.RUnlock()
+        if n == 0 {
+            return
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("%d registry lookups still under way", n)
+        }
+        time.Sleep(time.Millisecond)
+    }
+}
+
+func TestNewConfig(t *testing.T) {
+    tests := []struct {
+        name string
+        cfg  conf.RegistryCache
+        want Config
+    }{
+        {"defaults", conf.RegistryCache{}, DefaultConfig()},
+        {
+            "overrides",
+            conf.RegistryCache{NegativeTTLSecs: 1, MaxStaleSecs: 2, RefreshAheadSecs: 3, HotSecs: 4},
+            Config{NegativeTTL: time.Second, MaxStale: 2 * time.Second,
+                    RefreshAhead: 3 * time.Second, Hot: 4 * time.Second},
+        },
+        {
+            "negative turns off",
+            conf.RegistryCache{NegativeTTLSecs: -1, MaxStaleSecs: -1, RefreshAheadSecs: -1, HotSecs: -1},
+            Config{},
+        },
+    }
+    for _, test := range tests {
+        if got := NewConfig(test.cfg); got != test.want {
+            t.Errorf("%s: NewConfig() = %+v, want %+v", test.name, got, test.want)
+        }
+    }
+}
+
+func TestNegativeCaching(t *testing.T) {
+    tests := []struct {
+        name        string
+        negativeTTL time.Duration
+        queries     int
+    }{
+        {"cached", 10 * time.Second, 1},
+        {"turned off", 0, 2},
+    }
+    for _, test := range tests {
+        stub := newStubRegistry()
+        rc := newStubCache(stub, Config{NegativeTTL: test.negativeTTL})
+        for i := 0; i < 2; i++ {
+            if _, err := rc.GetOrRequestService("svc"); !errors.Is(err, ErrNotFound) {
+                t.Errorf("%s: GetOrRequestService() #%d error = %v, want %v",
+                            test.name, i, err, ErrNotFound)
+            }
+        }
+        if n := stub.count(); n != test.queries {
+            t.Errorf("%s: registry queried %d times, want %d", test.name, n, test.queries)
+        }
+        if _, ok := rc.Get("svc"); ok {
+            t.Errorf("%s: Get() found a service the registry doesn't know of", test.name)
+        }
+    }
+}
+
+func TestNegativeEntryExpires(t *testing.T) {
+    stub := newStubRegistry()
+    rc := newStubCache(stub, Config{NegativeTTL: 10 * time.Second, MaxStale: time.Minute})
+    if _, err := rc.GetOrRequestService("svc"); !errors.Is(err, ErrNotFound) {
+        t.Fatalf("GetOrRequestService() error = %v, want %v", err, ErrNotFound)
+    }
+
+    // Once registered, the service is found as soon as the negative entry
+    // expires, it's never served stale
+    want := registry.ServiceInfo{ContentHash: "new"}
+    stub.set("svc", want)
+    age(rc, "svc", 11 * time.Second)
+    info, err := rc.GetOrRequestService("svc")
+    if err != nil || info != want {
+        t.Errorf("GetOrRequestService() = (%+v, %v), want (%+v, nil)", info, err, want)
+    }
+    if n := stub.count(); n != 2 {
+        t.Errorf("Registry queried %d times, want 2", n)
+    }
+}
+
+func TestUnreachableRegistryNotCached(t *testing.T) {
+    stub := newStubRegistry()
+    stub.setErr(errors.New("unreachable"))
+    rc := newStubCache(stub, DefaultConfig())
+    for i := 0; i < 2; i++ {
+        _, err := rc.GetOrRequestService("svc")
+        if err == nil || errors.Is(err, ErrNotFound) {
+            t.Errorf("GetOrRequestService() #%d error = %v, want the registry's error", i, err)
+        }
+    }
+    if n := stub.count(); n != 2 {
+        t.Errorf("Registry queried %d times, want 2", n)
+    }
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+    old := registry.ServiceInfo{ContentHash: "old"}
+    updated := registry.ServiceInfo{ContentHash: "updated"}
+    tests := []struct {
+        name     string
+        maxStale time.Duration
+        expired  time.Duration
+        // Whether the lookup is answered from the stale entry
+        stale    bool
+    }{
+        {"fresh", time.Minute, -time.Second, false},
+        {"within max stale", time.Minute, 30 * time.Second, true},
+        {"beyond max stale", time.Minute, 2 * time.Minute, false},
+        {"stale turned off", 0, time.Second, false},
+    }
+    for _, test := range tests {
+        stub := newStubRegistry()
+        rc := newStubCache(stub, Config{MaxStale: test.maxStale})
+        rc.Add("svc", old)
+        age(rc, "svc", time.Minute + test.expired)
+        stub.set("svc", updated)
+
+        want, queries := updated, 1
+        if test.stale {
+            want = old
+        } else if test.expired < 0 {
+            want, queries = old, 0
+        }
+        info, err := rc.GetOrRequestService("svc")
+        if err != nil || info != want {
+            t.Errorf("%s: GetOrRequestService() = (%+v, %v), want (%+v, nil)",
+                        test.name, info, err, want)
+        }
+
+        // Stale entries are refreshed in the background
+        waitForLookups(t, rc)
+        if n := stub.count(); n != queries {
+            t.Errorf("%s: registry queried %d times, want %d", test.name, n, queries)
+        }
+        if queries > 0 {
+            if info, ok := rc.Get("svc"); !ok || info != updated {
+                t.Errorf("%s: Get() after refresh = (%+v, %v), want (%+v, true)",
+                            test.name, info, ok, updated)
+            }
+        }
+    }
+}
+
+func TestStaleKeptWhenRefreshFails(t *testing.T) {
+    old := registry.ServiceInfo{ContentHash: "old"}
+    stub := newStubRegistry()
+    stub.setErr(errors.New("unreachable"))
+    rc := newStubCache(stub, Config{MaxStale: time.Minute})
+    rc.Add("svc", old)
+    age(rc, "svc", 90 * time.Second)
+
+    for i := 0; i < 2; i++ {
+        info, err := rc.GetOrRequestService("svc")
+        if err != nil || info != old {
+            t.Errorf("GetOrRequestService() #%d = (%+v, %v), want (%+v, nil)",
+                        i, info, err, old)
+        }
+        waitForLookups(t, rc)
+    }
+    if _, ok := rc.Entries()["svc"]; !ok {
+        t.Errorf("Stale entry dropped after a failed refresh")
+    }
+}
+
+func TestRestore(t *testing.T) {
+    now := time.Now()
+    rc := newStubCache(newStubRegistry(), Config{MaxStale: time.Minute})
+    rc.Add("cached", registry.ServiceInfo{ContentHash: "current"})
+
+    saved := map[string]Entry{
+        "cached": {Info: registry.ServiceInfo{ContentHash: "saved"}, Expiry: now.Add(time.Minute)},
+        "fresh": {Expiry: now.Add(time.Minute)},
+        "stale": {Expiry: now.Add(-30 * time.Second)},
+        "too old": {Expiry: now.Add(-2 * time.Minute)},
+        "not found": {Expiry: now.Add(time.Second), NotFound: true},
+        "expired not found": {Expiry: now.Add(-time.Second), NotFound: true},
+    }
+    if n := rc.Restore(saved); n != 3 {
+        t.Errorf("Restore() = %d, want 3", n)
+    }
+
+    tests := []struct {
+        name string
+        kept bool
+    }{
+        {"fresh", true},
+        {"stale", true},
+        {"too old", false},
+        {"not found", true},
+        {"expired not found", false},
+    }
+    entries := rc.Entries()
+    for _, test := range tests {
+        if _, ok := entries[test.name]; ok != test.kept {
+            t.Errorf("%s: entry restored: %v, want %v", test.name, ok, test.kept)
+        }
+    }
+    // Entries already cached are newer than the saved ones
+    if entries["cached"].Info.ContentHash != "current" {
+        t.Errorf("Restore() replaced an entry already cached")
+    }
+}
+
+func TestLookupMetrics(t *testing.T) {
+    tests := []struct {
+        name   string
+        // Expiry of the cached entry relative to now, nil for none
+        expiry *time.Duration
+        found  bool
+        result string
+    }{
+        {"miss", nil, true, "miss"},
+        {"hit", durationPtr(time.Minute), true, "hit"},
+        {"stale", durationPtr(-30 * time.Second), true, "stale"},
+        {"negative", durationPtr(time.Minute), false, "negative"},
+    }
+    for _, test := range tests {
+        stub := newStubRegistry()
+        stub.set("svc", registry.ServiceInfo{ContentHash: "svc"})
+        rc := newStubCache(stub, Config{MaxStale: time.Minute})
+        if test.expiry != nil {
+            rc.mux.Lock()
+            rc.data["svc"] = Entry{
+                Info: registry.ServiceInfo{ContentHash: "svc"},
+                Expiry: time.Now().Add(*test.expiry),
+                NotFound: !test.found,
+            }
+            rc.mux.Unlock()
+        }
+
+        counter := metrics.RegistryCacheLookups.WithLabelValues(test.result)
+        before := testutil.ToFloat64(counter)
+        rc.GetOrRequestService("svc")
+        waitForLookups(t, rc)
+        if got := testutil.ToFloat64(counter) - before; got != 1 {
+            t.Errorf("%s: %s lookups went up by %v, want 1", test.name, test.result, got)
+        }
+    }
+}
+
+func durationPtr(d time.Duration) *time.Duration {
+    return &d
+}
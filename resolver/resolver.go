@@ -0,0 +1,295 @@
+package resolver
+
+// Resolves human-readable service names to peers offering the service
+// Ties together the LCA Manager, peer cache, and registry cache so that the
+// HTTP proxy, L4 proxy, and library users all share the same logic
+
+import (
+    "context"
+    "fmt"
+    "net/http"
+    "time"
+
+    "github.com/libp2p/go-libp2p-core/peer"
+
+    "github.com/PhysarumSM/common/p2putil"
+    "github.com/PhysarumSM/service-registry/registry"
+
+    "github.com/PhysarumSM/service-manager/lca"
+    "github.com/PhysarumSM/service-manager/logging"
+    "github.com/PhysarumSM/service-manager/metrics"
+    "github.com/PhysarumSM/service-manager/pcache"
+    "github.com/PhysarumSM/service-manager/rcache"
+    "github.com/PhysarumSM/service-manager/tracing"
+)
+
+var log = logging.New("resolver")
+
+// Maximum number of find/allocate rounds before giving up on a service
+const maxAllocAttempts = 3
+
+// Maximum number of instances to add to the peer cache per find, so that
+// requests can be balanced across them
+const maxCachedPeers = 5
+
+type Resolver struct {
+    // LCA Manager used to find and allocate service instances
+    Manager *lca.LCAManager
+    // Cache of peers that were previously found to offer a service
+    PeerCache *pcache.PeerCache
+    // Cache of service name to service info mappings from registry-service
+    RegistryCache *rcache.RegistryCache
+}
+
+// Constructor for Resolver
+// All three components are expected to be created by the caller since they
+// are typically shared with other parts of the proxy
+func NewResolver(manager *lca.LCAManager, peerCache *pcache.PeerCache,
+                regCache *rcache.RegistryCache) *Resolver {
+    return &Resolver{
+        Manager: manager,
+        PeerCache: peerCache,
+        RegistryCache: regCache,
+    }
+}
+
+// Returns a peer offering servName. Searches the peer cache first and then
+// the network, allocating a new instance if none are found.
+func (r *Resolver) FindOrAllocate(servName string, servInfo registry.ServiceInfo) (peer.ID, error) {
+    return r.FindOrAllocateContext(context.Background(), servName, servInfo)
+}
+
+// Same as FindOrAllocate(), with ctx carrying the trace to record spans in
+func (r *Resolver) FindOrAllocateContext(ctx context.Context, servName string,
+                                        servInfo registry.ServiceInfo) (peer.ID, error) {
+    ctx, span := tracing.Start(ctx, tracing.Internal, "find or allocate")
+    defer span.End()
+    span.SetAttr("service", servName)
+
+    var err error
+    var id peer.ID
+    var perf p2putil.PerfInd
+    var found []p2putil.PeerInfo
+    serviceHash := servInfo.ContentHash
+    dockerHash := servInfo.DockerHash
+    startTime := time.Now()
+
+    // Search for cached instances
+    id, err = r.PeerCache.GetPeer(serviceHash)
+    if err == nil {
+        log.Printf("Found cached peer with ID %s for service %s\n", id, servName)
+        observeFindAlloc(span, "cached", startTime)
+        return id, nil
+    }
+
+    // Search for an instance in the network, allocating a new one if need be.
+    // Maximum of maxAllocAttempts allocation attempts.
+    // TODO: It's totally possible for an allocation attempt to succeed,
+    // but the service takes a long time to come up, leading to subsequent
+    // allocation attempts. This is a future problem to solve.
+    allocated := false
+    for attempts := 0; attempts < maxAllocAttempts && id == peer.ID(""); attempts++ {
+        if ctx.Err() != nil {
+            break
+        }
+        if attempts > 0 {
+            log.Printf("Unable to successfully find or allocate, retrying...")
+        }
+
+        // TODO: Always pass perf req into AllocService()
+        //       Need to combine AllocService and AllocBetterService
+        log.Println("Finding best existing service instance")
+        found, err = r.findAvailable(serviceHash)
+        if err == nil {
+            id, perf = found[0].ID, found[0].Perf
+        }
+        if err != nil {
+            log.Println("Could not find, creating new service instance")
+            _, allocSpan := tracing.Start(ctx, tracing.Client, "allocate")
+            _, _, err = r.Manager.AllocService(dockerHash)
+            allocSpan.SetError(err)
+            allocSpan.End()
+            if err != nil {
+                log.Println("Service allocation failed\n", err)
+                continue // Or return error right away?
+            }
+            allocated = true
+
+            // Re-do FindService() to ensure the new instance is connected
+            // to the network. Sleep 200ms or so to allow the service to
+            // come up. If not found, perform exponential backoff and attempt
+            // to re-find it (max 5 times). If it's still not found, there may
+            // be something wrong with it (or it's taking too long to boot).
+            // Stops waiting as soon as the caller gives up on the request
+            wait := 200 * time.Millisecond
+            for refinds := 0; refinds < 5; refinds++ {
+                if refinds > 1 {
+                    wait *= 2
+                    if wait > time.Second {
+                        wait = time.Second
+                    }
+                }
+                if sleepContext(ctx, wait) != nil {
+                    break
+                }
+                found, err = r.findAvailable(serviceHash)
+                if err == nil {
+                    id, perf = found[0].ID, found[0].Perf
+                    break
+                }
+            }
+        } else if servInfo.NetworkSoftReq.LessThan(perf) {
+            log.Printf("Found service's RTT (%s) is greater than requirement (%s)\n",
+                            perf.RTT, servInfo.NetworkSoftReq.RTT)
+            log.Println("Creating new service instance")
+            _, allocSpan := tracing.Start(ctx, tracing.Client, "allocate")
+            _, _, err = r.Manager.AllocBetterService(dockerHash, perf)
+            allocSpan.SetError(err)
+            allocSpan.End()
+            if err != nil {
+                log.Println("No services able to be created, using previously found peer")
+            }
+        }
+    }
+
+    if id == peer.ID("") && ctx.Err() != nil {
+        err = ctx.Err()
+        span.SetError(err)
+        observeFindAlloc(span, "failed", startTime)
+        return peer.ID(""), err
+    }
+    if id == peer.ID("") {
+        err = fmt.Errorf("Unable to find or allocate service\n")
+        span.SetError(err)
+        observeFindAlloc(span, "failed", startTime)
+        return peer.ID(""), err
+    }
+
+    // Cache peer information for the returned peer, along with the next best
+    // instances that meet the hard requirement so requests can be balanced
+    for i, p := range found {
+        if i >= maxCachedPeers {
+            break
+        }
+        if i > 0 && servInfo.NetworkHardReq.RTT > 0 &&
+                servInfo.NetworkHardReq.LessThan(p.Perf) {
+            continue
+        }
+        p.ServName = servName
+        p.ServHash = serviceHash
+        r.PeerCache.UpsertPeer(p)
+    }
+
+    elapsedTime := time.Now().Sub(startTime)
+    log.Println("Find/alloc service took:", elapsedTime)
+    if allocated {
+        observeFindAlloc(span, "allocated", startTime)
+    } else {
+        observeFindAlloc(span, "found", startTime)
+    }
+    span.SetAttr("peer.id", id.Pretty())
+
+    return id, nil
+}
+
+// Sleeps for d, returning early with ctx's error if ctx is done first
+func sleepContext(ctx context.Context, d time.Duration) error {
+    timer := time.NewTimer(d)
+    defer timer.Stop()
+    select {
+    case <-ctx.Done():
+        return ctx.Err()
+    case <-timer.C:
+        return nil
+    }
+}
+
+func observeFindAlloc(span *tracing.Span, outcome string, startTime time.Time) {
+    span.SetAttr("outcome", outcome)
+    metrics.FindAllocDuration.WithLabelValues(outcome).
+        Observe(time.Since(startTime).Seconds())
+}
+
+// Finds instances of a service in the network, leaving out any whose circuit
+// breaker isn't letting requests through, best first
+// The first instance is the one to send the request to, and has a request
+// reserved with its breaker as GetPeer() does, so a half-open instance only
+// gets its allowed probes
+func (r *Resolver) findAvailable(serviceHash string) ([]p2putil.PeerInfo, error) {
+    found, err := r.Manager.FindServices(serviceHash)
+    if err != nil {
+        return nil, err
+    }
+
+    available := found[:0]
+    for _, p := range found {
+        if len(available) == 0 {
+            if r.PeerCache.AcquireBreaker(p.ID) {
+                available = append(available, p)
+            }
+        } else if r.PeerCache.BreakerAvailable(p.ID) {
+            available = append(available, p)
+        }
+    }
+    if len(available) == 0 {
+        return nil, fmt.Errorf("All %d instances found have open circuit breakers", len(found))
+    }
+    return available, nil
+}
+
+// Sends req to the peer id offering servName, recording the outcome with the
+// peer cache and in metrics
+// Returns the response along with how long the request took
+func (r *Resolver) Request(servName string, id peer.ID,
+                        req *http.Request) (*http.Response, time.Duration, error) {
+    log.Printf("Running request to peer ID %s\n", id)
+    start := time.Now()
+    r.PeerCache.StartRequest(id)
+    resp, err := r.Manager.Request(id, req)
+    // Only completed requests say anything about how long the service takes
+    elapsed := time.Since(start)
+    latency := elapsed
+    if err != nil {
+        latency = 0
+    }
+    r.PeerCache.EndRequest(id, latency, lca.RequestOutcome(req, resp, err))
+    metrics.P2PRequestDuration.WithLabelValues(servName).Observe(elapsed.Seconds())
+    if err != nil {
+        // The peer's circuit breaker takes it out of rotation if it keeps
+        // failing, one failed request isn't enough to drop it
+        log.Printf("ERROR: HTTP request over P2P failed\n%v\n", err)
+        return nil, elapsed, err
+    }
+    return resp, elapsed, nil
+}
+
+// Performs the service name to hash lookup, and then finds an appropriate
+// peer that provides that service, allocating a new instance if necessary.
+// Returns the peer's ID, the service's info, and any errors
+func (r *Resolver) Resolve(servName string) (peer.ID, registry.ServiceInfo, error) {
+    return r.ResolveContext(context.Background(), servName)
+}
+
+// Same as Resolve(), with ctx carrying the trace to record spans in
+func (r *Resolver) ResolveContext(ctx context.Context,
+                                servName string) (peer.ID, registry.ServiceInfo, error) {
+    ctx, span := tracing.Start(ctx, tracing.Internal, "resolve")
+    defer span.End()
+    span.SetAttr("service", servName)
+
+    info, err := r.RegistryCache.GetOrRequestService(servName)
+    if err != nil {
+        span.SetError(err)
+        return "", info, fmt.Errorf("ERROR: Hash lookup for service %s failed\n%w\n",
+                                    servName, err)
+    }
+
+    id, err := r.FindOrAllocateContext(ctx, servName, info)
+    if err != nil {
+        span.SetError(err)
+        return "", info, fmt.Errorf("ERROR: Unable to find or allocate service %s (%s)\n%w\n",
+                                    servName, info.ContentHash, err)
+    }
+
+    return id, info, nil
+}
@@ -0,0 +1,35 @@
+package resolver
+
+import (
+    "context"
+    "testing"
+    "time"
+)
+
+func TestSleepContext(t *testing.T) {
+    cancelled, cancel := context.WithCancel(context.Background())
+    cancel()
+
+    tests := []struct {
+        name string
+        ctx  context.Context
+        d    time.Duration
+        err  error
+        // Upper bound on how long the sleep should take
+        max  time.Duration
+    }{
+        {"slept", context.Background(), 10 * time.Millisecond, nil, time.Second},
+        {"cancelled", cancelled, time.Minute, context.Canceled, time.Second},
+    }
+    for _, test := range tests {
+        start := time.Now()
+        err := sleepContext(test.ctx, test.d)
+        elapsed := time.Since(start)
+        if err != test.err {
+            t.Errorf("%s: sleepContext() = %v, want %v", test.name, err, test.err)
+        }
+        if elapsed > test.max || (test.err == nil && elapsed < test.d) {
+            t.Errorf("%s: sleepContext() took %s", test.name, elapsed)
+        }
+    }
+}
@@ -0,0 +1,354 @@
+package main
+
+// Command-line operator tool for the service-manager network
+// Joins the network as an anonymous LCA Manager and runs a single command
+
+import (
+    "context"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "os"
+    "strings"
+    "text/tabwriter"
+
+    "github.com/libp2p/go-libp2p-core/peer"
+    "github.com/libp2p/go-libp2p-core/pnet"
+
+    "github.com/multiformats/go-multiaddr"
+
+    "github.com/PhysarumSM/common/p2pnode"
+    "github.com/PhysarumSM/common/util"
+
+    "github.com/PhysarumSM/service-registry/registry"
+
+    "github.com/PhysarumSM/service-manager/conf"
+    "github.com/PhysarumSM/service-manager/lca"
+    "github.com/PhysarumSM/service-manager/logging"
+)
+
+var log = logging.New("smctl")
+
+const defaultKeyFile = "~/.privKeySmctl"
+
+// Subcommands, their arguments, and descriptions
+var commands = []struct {
+    name  string
+    args  string
+    usage string
+    run   func(manager *lca.LCAManager, args []string) error
+}{
+    {"allocators", "", "List reachable allocators with their RTT and capacity", listAllocators},
+    {"providers", "SERVICE", "List reachable instances of a service (name or content hash)", listProviders},
+    {"allocate", "ALLOCATOR SERVICE", "Start an instance of a service on an allocator", allocate},
+    {"stop", "ALLOCATOR CONTAINER", "Stop a container started by an allocator", stop},
+    {"call", "[-X METHOD] [-d DATA] SERVICE [PATH]", "Send an HTTP request to a service and print the response", call},
+}
+
+// Custom usage func to list subcommands
+func customUsage() {
+    out := flag.CommandLine.Output()
+    fmt.Fprintf(out, "Usage of %s:\n", os.Args[0])
+    fmt.Fprintf(out, "$ %s [OPTIONS ...] COMMAND [ARGS ...]\n", os.Args[0])
+
+    fmt.Fprintf(out, "\nOPTIONS:\n")
+    flag.PrintDefaults()
+
+    fmt.Fprintf(out, "\nCOMMANDS:\n")
+    for _, cmd := range commands {
+        fmt.Fprintf(out, "  %s %s\n    \t%s\n", cmd.name, cmd.args, cmd.usage)
+    }
+}
+
+func main() {
+    var err error
+
+    // Argument options
+    var configPath string
+    flag.StringVar(&configPath, "configfile", "../conf/conf.json", "Path to configuration file to use")
+    var verbose bool
+    flag.BoolVar(&verbose, "verbose", false, "Show log output")
+    logFlags := logging.AddFlags()
+
+    var keyFlags util.KeyFlags
+    var bootstraps *[]multiaddr.Multiaddr
+    var psk *pnet.PSK
+    if keyFlags, err = util.AddKeyFlags(defaultKeyFile); err != nil {
+        log.Fatalln(err)
+    }
+    if bootstraps, err = util.AddBootstrapFlags(); err != nil {
+        log.Fatalln(err)
+    }
+    if psk, err = util.AddPSKFlag(); err != nil {
+        log.Fatalln(err)
+    }
+    flag.Usage = customUsage // Do this only afer adding all flags
+    flag.Parse() // Parse flag arguments
+
+    if flag.NArg() < 1 {
+        flag.Usage()
+        os.Exit(1)
+    }
+    cmdName := flag.Arg(0)
+    var run func(*lca.LCAManager, []string) error
+    for _, cmd := range commands {
+        if cmd.name == cmdName {
+            run = cmd.run
+        }
+    }
+    if run == nil {
+        fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", cmdName)
+        flag.Usage()
+        os.Exit(1)
+    }
+
+    // Keep output to command results unless asked otherwise
+    if !verbose {
+        logging.SetOutput(ioutil.Discard)
+    }
+
+    priv, err := util.CreateOrLoadKey(keyFlags)
+    if err != nil {
+        log.Fatalln(err)
+    }
+
+    // Read in config file, it's only needed for bootstraps so it's optional
+    config := conf.Config{}
+    if configByte, err := ioutil.ReadFile(configPath); err == nil {
+        if err = json.Unmarshal(configByte, &config); err != nil {
+            fatalf("ERROR: Unable to parse configuration file\n%s\n", err)
+        }
+    }
+    if err = logFlags.Configure(config.Logging); err != nil {
+        fatalf("ERROR: Invalid logging configuration\n%s\n", err)
+    }
+
+    if len(*bootstraps) == 0 {
+        if len(config.Bootstraps) == 0 {
+            envBootstraps, err := util.GetEnvBootstraps()
+            if err != nil {
+                fatalf("%s\n", err)
+            }
+
+            if len(envBootstraps) == 0 {
+                fatalf("ERROR: Must specify at least one bootstrap node " +
+                    "through a command line flag, the configuration file, or " +
+                    "setting the %s environment variable.\n", util.ENV_KEY_BOOTSTRAPS)
+            }
+
+            *bootstraps = envBootstraps
+        } else {
+            *bootstraps, err = util.StringsToMultiaddrs(config.Bootstraps)
+            if err != nil {
+                fatalf("%s\n", err)
+            }
+        }
+    }
+
+    // If CLI didn't specify a PSK, check the environment variables
+    if *psk == nil {
+        envPsk, err := util.GetEnvPSK()
+        if err != nil {
+            fatalf("%s\n", err)
+        }
+
+        *psk = envPsk
+    }
+
+    // Set node configuration
+    nodeConfig := p2pnode.NewConfig()
+    nodeConfig.PrivKey = priv
+    nodeConfig.BootstrapPeers = *bootstraps
+    nodeConfig.PSK = *psk
+
+    manager, err := lca.NewLCAManager(context.Background(), nodeConfig, "", "")
+    if err != nil {
+        fatalf("ERROR: Unable to join the network\n%s\n", err)
+    }
+
+    err = run(manager, flag.Args()[1:])
+    manager.Shutdown(context.Background())
+    if err != nil {
+        fatalf("ERROR: %s\n", err)
+    }
+}
+
+func fatalf(format string, v ...interface{}) {
+    fmt.Fprintf(os.Stderr, format, v...)
+    os.Exit(1)
+}
+
+func checkArgs(args []string, min int, max int, usage string) error {
+    if len(args) < min || len(args) > max {
+        return fmt.Errorf("Expected arguments: %s", usage)
+    }
+    return nil
+}
+
+// Looks up a service's registry info by name
+func lookupService(manager *lca.LCAManager, servName string) (registry.ServiceInfo, error) {
+    return registry.GetServiceWithHostRouting(manager.Host.Ctx, manager.Host.Host,
+                                                manager.Host.RoutingDiscovery, servName)
+}
+
+func listAllocators(manager *lca.LCAManager, args []string) error {
+    if err := checkArgs(args, 0, 0, ""); err != nil {
+        return err
+    }
+
+    allocators, err := manager.FindAllocators()
+    if err != nil {
+        return err
+    }
+
+    w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    fmt.Fprintln(w, "ID\tRTT\tCPUS\tMEM AVAILABLE\tSERVICES")
+    for _, a := range allocators {
+        capacity, err := manager.GetCapacity(a.ID)
+        if err != nil {
+            fmt.Fprintf(w, "%s\t%s\t?\t?\t? (%v)\n", a.ID, a.Perf.RTT, err)
+            continue
+        }
+
+        var cids []string
+        for _, s := range capacity.Services {
+            cids = append(cids, s.Cid)
+        }
+        fmt.Fprintf(w, "%s\t%s\t%d\t%s / %s\t%d %s\n", a.ID, a.Perf.RTT,
+            capacity.NumCPU, formatBytes(capacity.MemAvailable),
+            formatBytes(capacity.MemTotal), len(cids), strings.Join(cids, ","))
+    }
+    return w.Flush()
+}
+
+func listProviders(manager *lca.LCAManager, args []string) error {
+    if err := checkArgs(args, 1, 1, "SERVICE"); err != nil {
+        return err
+    }
+
+    // Accept either a service name or its content hash
+    hash := args[0]
+    if info, err := lookupService(manager, args[0]); err == nil {
+        hash = info.ContentHash
+    }
+
+    providers, err := manager.FindServices(hash)
+    if err != nil {
+        return err
+    }
+
+    w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    fmt.Fprintln(w, "ID\tRTT")
+    for _, p := range providers {
+        fmt.Fprintf(w, "%s\t%s\n", p.ID, p.Perf.RTT)
+    }
+    return w.Flush()
+}
+
+func allocate(manager *lca.LCAManager, args []string) error {
+    if err := checkArgs(args, 2, 2, "ALLOCATOR SERVICE"); err != nil {
+        return err
+    }
+
+    allocator, err := peer.Decode(args[0])
+    if err != nil {
+        return fmt.Errorf("Invalid allocator ID %s\n%w", args[0], err)
+    }
+    info, err := lookupService(manager, args[1])
+    if err != nil {
+        return fmt.Errorf("Unable to look up service %s\n%w", args[1], err)
+    }
+
+    addr, err := manager.AllocServiceOn(allocator, info.DockerHash)
+    if err != nil {
+        return err
+    }
+    fmt.Printf("Started %s on allocator %s at %s\n", args[1], allocator, addr)
+    return nil
+}
+
+func stop(manager *lca.LCAManager, args []string) error {
+    if err := checkArgs(args, 2, 2, "ALLOCATOR CONTAINER"); err != nil {
+        return err
+    }
+
+    allocator, err := peer.Decode(args[0])
+    if err != nil {
+        return fmt.Errorf("Invalid allocator ID %s\n%w", args[0], err)
+    }
+    if err = manager.StopServiceOn(allocator, args[1]); err != nil {
+        return err
+    }
+    fmt.Printf("Stopped container %s on allocator %s\n", args[1], allocator)
+    return nil
+}
+
+func call(manager *lca.LCAManager, args []string) error {
+    fs := flag.NewFlagSet("call", flag.ContinueOnError)
+    method := fs.String("X", http.MethodGet, "HTTP method to use")
+    data := fs.String("d", "", "Request body to send")
+    if err := fs.Parse(args); err != nil {
+        return err
+    }
+    args = fs.Args()
+    if err := checkArgs(args, 1, 2, "[-X METHOD] [-d DATA] SERVICE [PATH]"); err != nil {
+        return err
+    }
+
+    servName := args[0]
+    path := ""
+    if len(args) == 2 {
+        path = strings.TrimPrefix(args[1], "/")
+    }
+
+    info, err := lookupService(manager, servName)
+    if err != nil {
+        return fmt.Errorf("Unable to look up service %s\n%w", servName, err)
+    }
+    providers, err := manager.FindServices(info.ContentHash)
+    if err != nil {
+        return err
+    }
+
+    // The service's proxy expects the service name as the first path segment
+    var body io.Reader
+    if *data != "" {
+        body = strings.NewReader(*data)
+    }
+    req, err := http.NewRequest(*method, "http://" + servName + "/" + servName + "/" + path, body)
+    if err != nil {
+        return err
+    }
+    manager.SetCallerHeaders(req)
+
+    fmt.Fprintf(os.Stderr, "Calling %s at peer %s (RTT %s)\n",
+        servName, providers[0].ID, providers[0].Perf.RTT)
+    resp, err := manager.Request(providers[0].ID, req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    fmt.Fprintf(os.Stderr, "%s %s\n", resp.Proto, resp.Status)
+    _, err = io.Copy(os.Stdout, resp.Body)
+    return err
+}
+
+func formatBytes(n uint64) string {
+    if n == 0 {
+        return "?"
+    }
+    const unit = 1024
+    if n < unit {
+        return fmt.Sprintf("%dB", n)
+    }
+    div, exp := uint64(unit), 0
+    for m := n / unit; m >= unit; m /= unit {
+        div *= unit
+        exp++
+    }
+    return fmt.Sprintf("%.1f%ciB", float64(n) / float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestFormatBytes(t *testing.T) {
+    tests := []struct {
+        n    uint64
+        want string
+    }{
+        // Unknown
+        {0, "?"},
+        {512, "512B"},
+        {1024, "1.0KiB"},
+        {1536, "1.5KiB"},
+        {8 * 1024 * 1024 * 1024, "8.0GiB"},
+    }
+    for _, test := range tests {
+        if got := formatBytes(test.n); got != test.want {
+            t.Errorf("formatBytes(%d) = %q, want %q", test.n, got, test.want)
+        }
+    }
+}
+
+func TestCheckArgs(t *testing.T) {
+    tests := []struct {
+        args []string
+        ok   bool
+    }{
+        {nil, false},
+        {[]string{"svc"}, true},
+        {[]string{"svc", "/path"}, true},
+        {[]string{"svc", "/path", "extra"}, false},
+    }
+    for _, test := range tests {
+        err := checkArgs(test.args, 1, 2, "<service> [path]")
+        if (err == nil) != test.ok {
+            t.Errorf("checkArgs(%v, 1, 2) = %v, want ok %v", test.args, err, test.ok)
+        }
+    }
+}
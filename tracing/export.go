@@ -0,0 +1,396 @@
+package tracing
+
+// Exporting finished spans
+// Spans are queued as they end and exported in batches by a background
+// goroutine, encoded as OTLP/JSON so that they can be loaded by any
+// OpenTelemetry-compatible tool, either from a file or over OTLP/HTTP
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "os"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/PhysarumSM/service-manager/logging"
+    "github.com/PhysarumSM/service-manager/metrics"
+)
+
+var log = logging.New("tracing")
+
+// Maximum number of spans per export
+const maxBatchSize = 256
+
+// How often to export spans when there aren't enough to fill a batch
+const exportInterval = 2 * time.Second
+
+// Number of finished spans that can be waiting for export before new ones
+// are dropped
+const maxQueueSize = 4096
+
+// Destination for finished spans
+type Exporter interface {
+    // Exports spans from the node serviceName
+    ExportSpans(serviceName string, spans []SpanData) error
+    Close() error
+}
+
+var (
+    queue       chan SpanData
+    exporterMux sync.RWMutex
+    exportDone  chan struct{}
+    // Spans dropped since exportLoop last reported them, updated atomically
+    dropped     uint64
+)
+
+func enabled() bool {
+    exporterMux.RLock()
+    defer exporterMux.RUnlock()
+    return queue != nil
+}
+
+// Queues a finished span, dropping it if the queue is full or tracing has
+// been shut down
+func enqueue(data SpanData) {
+    exporterMux.RLock()
+    defer exporterMux.RUnlock()
+    if queue == nil {
+        return
+    }
+    select {
+    case queue <- data:
+    default:
+        // Logged in summary by exportLoop, as the queue only fills up under
+        // load that would flood the log
+        atomic.AddUint64(&dropped, 1)
+        metrics.TracingDroppedSpans.Inc()
+    }
+}
+
+// Logs how many spans were dropped since the last call, if any
+func reportDropped() {
+    if n := atomic.SwapUint64(&dropped, 0); n > 0 {
+        log.Printf("WARNING: Trace export queue full, dropped %d spans\n", n)
+    }
+}
+
+// Starts recording spans and exporting them with exp
+// serviceName identifies this node in the exported traces
+func Init(serviceName string, exp Exporter) error {
+    exporterMux.Lock()
+    defer exporterMux.Unlock()
+    if queue != nil {
+        return errors.New("Tracing is already initialized")
+    }
+
+    queue = make(chan SpanData, maxQueueSize)
+    exportDone = make(chan struct{})
+    go exportLoop(serviceName, exp, queue, exportDone)
+    return nil
+}
+
+// Stops recording spans, then exports any that are queued and closes the
+// exporter, giving up once ctx is done
+func Shutdown(ctx context.Context) error {
+    exporterMux.Lock()
+    if queue == nil {
+        exporterMux.Unlock()
+        return nil
+    }
+    close(queue)
+    queue = nil
+    done := exportDone
+    exporterMux.Unlock()
+
+    select {
+    case <-done:
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+func exportLoop(serviceName string, exp Exporter, queue <-chan SpanData,
+                done chan<- struct{}) {
+    defer close(done)
+    ticker := time.NewTicker(exportInterval)
+    defer ticker.Stop()
+
+    var batch []SpanData
+    export := func() {
+        if len(batch) == 0 {
+            return
+        }
+        if err := exp.ExportSpans(serviceName, batch); err != nil {
+            log.Printf("ERROR: Unable to export %d spans\n%v\n", len(batch), err)
+        }
+        batch = nil
+    }
+
+    for {
+        select {
+        case data, ok := <-queue:
+            if !ok {
+                reportDropped()
+                export()
+                if err := exp.Close(); err != nil {
+                    log.Printf("ERROR: Unable to close trace exporter\n%v\n", err)
+                }
+                return
+            }
+            batch = append(batch, data)
+            if len(batch) >= maxBatchSize {
+                export()
+            }
+        case <-ticker.C:
+            reportDropped()
+            export()
+        }
+    }
+}
+
+// Writes spans to a file, one OTLP/JSON ExportTraceServiceRequest per line
+type FileExporter struct {
+    w   io.WriteCloser
+    mux sync.Mutex
+}
+
+// Constructor for FileExporter
+// Spans are appended to the file at path, which is created if need be.
+// A path of "-" writes to stdout instead.
+func NewFileExporter(path string) (*FileExporter, error) {
+    if path == "-" {
+        return &FileExporter{w: nopWriteCloser{os.Stdout}}, nil
+    }
+    f, err := os.OpenFile(path, os.O_WRONLY | os.O_CREATE | os.O_APPEND, 0644)
+    if err != nil {
+        return nil, fmt.Errorf("Unable to open trace file %s\n%w", path, err)
+    }
+    return &FileExporter{w: f}, nil
+}
+
+func (e *FileExporter) ExportSpans(serviceName string, spans []SpanData) error {
+    body, err := json.Marshal(newOTLPRequest(serviceName, spans))
+    if err != nil {
+        return err
+    }
+    e.mux.Lock()
+    defer e.mux.Unlock()
+    _, err = e.w.Write(append(body, '\n'))
+    return err
+}
+
+func (e *FileExporter) Close() error {
+    return e.w.Close()
+}
+
+type nopWriteCloser struct {
+    io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+    return nil
+}
+
+// Sends spans to an OpenTelemetry collector over OTLP/HTTP, using JSON
+type OTLPExporter struct {
+    // Full URL to post to, e.g. http://localhost:4318/v1/traces
+    Endpoint string
+    Client   *http.Client
+}
+
+// Constructor for OTLPExporter
+func NewOTLPExporter(endpoint string) *OTLPExporter {
+    return &OTLPExporter{
+        Endpoint: endpoint,
+        Client: &http.Client{Timeout: 10 * time.Second},
+    }
+}
+
+func (e *OTLPExporter) ExportSpans(serviceName string, spans []SpanData) error {
+    body, err := json.Marshal(newOTLPRequest(serviceName, spans))
+    if err != nil {
+        return err
+    }
+    resp, err := e.Client.Post(e.Endpoint, "application/json", bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    io.Copy(ioutil.Discard, resp.Body)
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+        return fmt.Errorf("OTLP endpoint %s returned %s", e.Endpoint, resp.Status)
+    }
+    return nil
+}
+
+func (e *OTLPExporter) Close() error {
+    return nil
+}
+
+// Exports spans with several exporters
+type multiExporter []Exporter
+
+func (m multiExporter) ExportSpans(serviceName string, spans []SpanData) error {
+    var errs []string
+    for _, exp := range m {
+        if err := exp.ExportSpans(serviceName, spans); err != nil {
+            errs = append(errs, err.Error())
+        }
+    }
+    if len(errs) > 0 {
+        return fmt.Errorf("%v", errs)
+    }
+    return nil
+}
+
+func (m multiExporter) Close() error {
+    var errs []string
+    for _, exp := range m {
+        if err := exp.Close(); err != nil {
+            errs = append(errs, err.Error())
+        }
+    }
+    if len(errs) > 0 {
+        return fmt.Errorf("%v", errs)
+    }
+    return nil
+}
+
+// Command line options for choosing exporters
+type Flags struct {
+    File         string
+    OTLPEndpoint string
+}
+
+// Adds the tracing flags to the default flag set
+func AddFlags() *Flags {
+    var f Flags
+    flag.StringVar(&f.File, "trace-file", "",
+        "File to append trace spans to as OTLP/JSON, '-' for stdout")
+    flag.StringVar(&f.OTLPEndpoint, "trace-otlp", "",
+        "OTLP/HTTP endpoint to send trace spans to, e.g. http://localhost:4318/v1/traces")
+    return &f
+}
+
+// Starts tracing with the exporters chosen by the flags, if any
+func (f *Flags) Init(serviceName string) error {
+    var exps multiExporter
+    if f.File != "" {
+        exp, err := NewFileExporter(f.File)
+        if err != nil {
+            return err
+        }
+        exps = append(exps, exp)
+    }
+    if f.OTLPEndpoint != "" {
+        exps = append(exps, NewOTLPExporter(f.OTLPEndpoint))
+    }
+
+    switch len(exps) {
+    case 0:
+        return nil
+    case 1:
+        return Init(serviceName, exps[0])
+    default:
+        return Init(serviceName, exps)
+    }
+}
+
+// OTLP/JSON encoding of spans
+// See: https://github.com/open-telemetry/opentelemetry-proto
+type otlpRequest struct {
+    ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+    Resource   otlpResource     `json:"resource"`
+    ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+    Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+    Scope otlpScope  `json:"scope"`
+    Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+    Name string `json:"name"`
+}
+
+type otlpSpan struct {
+    TraceID           string         `json:"traceId"`
+    SpanID            string         `json:"spanId"`
+    TraceState        string         `json:"traceState,omitempty"`
+    ParentSpanID      string         `json:"parentSpanId,omitempty"`
+    Name              string         `json:"name"`
+    Kind              SpanKind       `json:"kind"`
+    StartTimeUnixNano string         `json:"startTimeUnixNano"`
+    EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+    Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+    Status            otlpStatus     `json:"status"`
+}
+
+type otlpKeyValue struct {
+    Key   string    `json:"key"`
+    Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+    StringValue string `json:"stringValue"`
+}
+
+// Status codes: 0 unset, 2 error
+type otlpStatus struct {
+    Code    int    `json:"code,omitempty"`
+    Message string `json:"message,omitempty"`
+}
+
+func newOTLPRequest(serviceName string, spans []SpanData) otlpRequest {
+    var otlpSpans []otlpSpan
+    for _, s := range spans {
+        span := otlpSpan{
+            TraceID: s.Context.TraceID.String(),
+            SpanID: s.Context.SpanID.String(),
+            TraceState: s.Context.TraceState,
+            Name: s.Name,
+            Kind: s.Kind,
+            StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+            EndTimeUnixNano: strconv.FormatInt(s.End.UnixNano(), 10),
+        }
+        if s.ParentSpanID != (SpanID{}) {
+            span.ParentSpanID = s.ParentSpanID.String()
+        }
+        for k, v := range s.Attributes {
+            span.Attributes = append(span.Attributes, otlpKeyValue{k, otlpValue{v}})
+        }
+        if s.Error != "" {
+            span.Status = otlpStatus{Code: 2, Message: s.Error}
+        }
+        otlpSpans = append(otlpSpans, span)
+    }
+
+    return otlpRequest{
+        ResourceSpans: []otlpResourceSpans{{
+            Resource: otlpResource{
+                Attributes: []otlpKeyValue{{"service.name", otlpValue{serviceName}}},
+            },
+            ScopeSpans: []otlpScopeSpans{{
+                Scope: otlpScope{Name: "github.com/PhysarumSM/service-manager/tracing"},
+                Spans: otlpSpans,
+            }},
+        }},
+    }
+}
@@ -0,0 +1,302 @@
+package tracing
+
+// Minimal distributed tracing with W3C trace-context propagation
+// See: https://www.w3.org/TR/trace-context/
+//
+// Spans are only recorded once an exporter is set up with Init(). Until then,
+// or if the incoming trace isn't sampled, Start() returns a nil *Span (whose
+// methods do nothing) and leaves the context as is, so any incoming trace
+// context is still passed along untouched to the next hop.
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "fmt"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Header names defined by the W3C trace-context spec
+const (
+    TraceParentHeader = "traceparent"
+    TraceStateHeader  = "tracestate"
+)
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (id TraceID) String() string {
+    return hex.EncodeToString(id[:])
+}
+
+func (id SpanID) String() string {
+    return hex.EncodeToString(id[:])
+}
+
+// Identifies a span and the trace it's part of, as propagated between hops
+type SpanContext struct {
+    TraceID    TraceID
+    SpanID     SpanID
+    Sampled    bool
+    // Vendor-specific trace state, passed along as is
+    TraceState string
+}
+
+// Returns whether sc identifies an actual span (IDs can't be all zeroes)
+func (sc SpanContext) IsValid() bool {
+    return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Returns sc in the traceparent header format, e.g.
+//   00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func (sc SpanContext) TraceParent() string {
+    flags := "00"
+    if sc.Sampled {
+        flags = "01"
+    }
+    return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+// Parses a traceparent header value
+func ParseTraceParent(s string) (SpanContext, error) {
+    var sc SpanContext
+    tokens := strings.Split(strings.TrimSpace(s), "-")
+    // Future versions may append fields, but version 00 has exactly four
+    if len(tokens) < 4 || len(tokens[0]) != 2 || tokens[0] == "ff" ||
+            (tokens[0] == "00" && len(tokens) != 4) {
+        return sc, fmt.Errorf("Invalid traceparent %q", s)
+    }
+    if err := decodeHex(sc.TraceID[:], tokens[1]); err != nil {
+        return sc, fmt.Errorf("Invalid trace ID in traceparent %q\n%w", s, err)
+    }
+    if err := decodeHex(sc.SpanID[:], tokens[2]); err != nil {
+        return sc, fmt.Errorf("Invalid span ID in traceparent %q\n%w", s, err)
+    }
+    var flags [1]byte
+    if err := decodeHex(flags[:], tokens[3]); err != nil {
+        return sc, fmt.Errorf("Invalid flags in traceparent %q\n%w", s, err)
+    }
+    sc.Sampled = flags[0] & 0x01 != 0
+    if !sc.IsValid() {
+        return sc, fmt.Errorf("Invalid all-zero ID in traceparent %q", s)
+    }
+    return sc, nil
+}
+
+// Decodes a lowercase hex string that must exactly fill dst
+func decodeHex(dst []byte, s string) error {
+    if len(s) != hex.EncodedLen(len(dst)) || strings.ToLower(s) != s {
+        return fmt.Errorf("Expected %d lowercase hex digits", hex.EncodedLen(len(dst)))
+    }
+    _, err := hex.Decode(dst, []byte(s))
+    return err
+}
+
+// Kind of span, using the same values as OTLP
+type SpanKind int
+
+const (
+    Internal SpanKind = 1
+    Server   SpanKind = 2
+    Client   SpanKind = 3
+)
+
+// Snapshot of a finished span, as handed to exporters
+type SpanData struct {
+    Name         string
+    Kind         SpanKind
+    Context      SpanContext
+    ParentSpanID SpanID
+    Start        time.Time
+    End          time.Time
+    Attributes   map[string]string
+    // Empty unless the operation failed
+    Error        string
+}
+
+// A single timed operation within a trace
+// All methods are safe to call on a nil *Span, which is what Start() returns
+// when the span isn't being recorded
+type Span struct {
+    data  SpanData
+    ended bool
+    mux   sync.Mutex
+}
+
+// Sets an attribute on the span
+func (s *Span) SetAttr(key string, value string) {
+    if s == nil {
+        return
+    }
+    s.mux.Lock()
+    defer s.mux.Unlock()
+    // Attributes are handed off to the exporter once the span ends
+    if !s.ended {
+        s.data.Attributes[key] = value
+    }
+}
+
+// Marks the span as failed with err, if err isn't nil
+func (s *Span) SetError(err error) {
+    if s == nil || err == nil {
+        return
+    }
+    s.mux.Lock()
+    defer s.mux.Unlock()
+    s.data.Error = err.Error()
+}
+
+// Returns the span's context, for propagation
+func (s *Span) Context() SpanContext {
+    if s == nil {
+        return SpanContext{}
+    }
+    return s.data.Context
+}
+
+// Finishes the span and queues it for export
+// Calling End() more than once has no effect
+func (s *Span) End() {
+    if s == nil {
+        return
+    }
+    s.mux.Lock()
+    if s.ended {
+        s.mux.Unlock()
+        return
+    }
+    s.ended = true
+    s.data.End = time.Now()
+    data := s.data
+    s.mux.Unlock()
+    enqueue(data)
+}
+
+type ctxKey int
+
+const (
+    spanKey ctxKey = iota
+    remoteKey
+)
+
+// Returns the span in ctx, or nil if there is none
+func SpanFromContext(ctx context.Context) *Span {
+    s, _ := ctx.Value(spanKey).(*Span)
+    return s
+}
+
+// Returns the context of the innermost span in ctx, whether it was started
+// locally or received from another hop
+func SpanContextFromContext(ctx context.Context) SpanContext {
+    if s := SpanFromContext(ctx); s != nil {
+        return s.Context()
+    }
+    sc, _ := ctx.Value(remoteKey).(SpanContext)
+    return sc
+}
+
+// Returns a copy of ctx with sc as the parent for spans started from it
+func ContextWithRemoteSpanContext(ctx context.Context, sc SpanContext) context.Context {
+    return context.WithValue(ctx, remoteKey, sc)
+}
+
+// Starts a span named name as a child of the span in ctx, if any
+// Returns a context holding the new span, and the span. The caller must call
+// End() on the span once the operation it covers is done.
+func Start(ctx context.Context, kind SpanKind, name string) (context.Context, *Span) {
+    parent := SpanContextFromContext(ctx)
+    if !enabled() || (parent.IsValid() && !parent.Sampled) {
+        return ctx, nil
+    }
+
+    s := &Span{
+        data: SpanData{
+            Name: name,
+            Kind: kind,
+            Start: time.Now(),
+            Attributes: make(map[string]string),
+        },
+    }
+    sc := SpanContext{Sampled: true}
+    if parent.IsValid() {
+        sc.TraceID = parent.TraceID
+        sc.TraceState = parent.TraceState
+        s.data.ParentSpanID = parent.SpanID
+    } else {
+        randomID(sc.TraceID[:])
+    }
+    randomID(sc.SpanID[:])
+    s.data.Context = sc
+
+    return context.WithValue(ctx, spanKey, s), s
+}
+
+// Fills id with random bytes, making sure it's not all zeroes
+func randomID(id []byte) {
+    for {
+        if _, err := rand.Read(id); err != nil {
+            // Fall back on the time, which is better than no trace at all
+            now := time.Now().UnixNano()
+            for i := range id {
+                id[i] = byte(now >> (8 * (i % 8)))
+            }
+        }
+        for _, b := range id {
+            if b != 0 {
+                return
+            }
+        }
+    }
+}
+
+// Returns the traceparent value for the span in ctx, or an empty string if
+// there is none
+func TraceParent(ctx context.Context) string {
+    sc := SpanContextFromContext(ctx)
+    if !sc.IsValid() {
+        return ""
+    }
+    return sc.TraceParent()
+}
+
+// Returns a copy of ctx with the parent given in traceparent format
+// Returns ctx as is if traceParent is empty or invalid
+func WithTraceParent(ctx context.Context, traceParent string) context.Context {
+    if traceParent == "" {
+        return ctx
+    }
+    sc, err := ParseTraceParent(traceParent)
+    if err != nil {
+        return ctx
+    }
+    return ContextWithRemoteSpanContext(ctx, sc)
+}
+
+// Sets the trace-context headers for the span in ctx on h
+// Any trace-context headers already in h are replaced
+func Inject(ctx context.Context, h http.Header) {
+    sc := SpanContextFromContext(ctx)
+    if !sc.IsValid() {
+        return
+    }
+    h.Set(TraceParentHeader, sc.TraceParent())
+    if sc.TraceState != "" {
+        h.Set(TraceStateHeader, sc.TraceState)
+    } else {
+        h.Del(TraceStateHeader)
+    }
+}
+
+// Returns a copy of ctx with the parent given by the trace-context headers in
+// h, or ctx as is if there are none
+func Extract(ctx context.Context, h http.Header) context.Context {
+    sc, err := ParseTraceParent(h.Get(TraceParentHeader))
+    if err != nil {
+        return ctx
+    }
+    sc.TraceState = strings.Join(h[http.CanonicalHeaderKey(TraceStateHeader)], ",")
+    return ContextWithRemoteSpanContext(ctx, sc)
+}
@@ -0,0 +1,248 @@
+package tracing
+
+import (
+    "context"
+    "net/http"
+    "sync"
+    "sync/atomic"
+    "testing"
+)
+
+const (
+    testTraceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+    testTraceID     = "4bf92f3577b34da6a3ce929d0e0e4736"
+    testSpanID      = "00f067aa0ba902b7"
+)
+
+func TestParseTraceParent(t *testing.T) {
+    tests := []struct {
+        s       string
+        sampled bool
+        wantErr bool
+    }{
+        {testTraceParent, true, false},
+        {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", false, false},
+        {" " + testTraceParent + " ", true, false},
+        // Only the sampled bit of the flags matters
+        {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-03", true, false},
+        // Later versions may add fields
+        {"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true, false},
+        {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, true},
+        {"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, true},
+        {"0-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, true},
+        {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", false, true},
+        {"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false, true},
+        {"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01", false, true},
+        {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902bx-01", false, true},
+        {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-1", false, true},
+        {"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, true},
+        {"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, true},
+        {"", false, true},
+    }
+    for _, test := range tests {
+        sc, err := ParseTraceParent(test.s)
+        if test.wantErr {
+            if err == nil {
+                t.Errorf("ParseTraceParent(%q) = %+v, want error", test.s, sc)
+            }
+            continue
+        }
+        if err != nil {
+            t.Errorf("ParseTraceParent(%q) failed: %v", test.s, err)
+            continue
+        }
+        if sc.TraceID.String() != testTraceID || sc.SpanID.String() != testSpanID ||
+                sc.Sampled != test.sampled {
+            t.Errorf("ParseTraceParent(%q) = (%s, %s, %v), want (%s, %s, %v)",
+                        test.s, sc.TraceID, sc.SpanID, sc.Sampled,
+                        testTraceID, testSpanID, test.sampled)
+        }
+    }
+}
+
+func TestTraceParentRoundTrip(t *testing.T) {
+    for _, s := range []string{
+        testTraceParent,
+        "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00",
+    } {
+        sc, err := ParseTraceParent(s)
+        if err != nil {
+            t.Fatalf("ParseTraceParent(%q) failed: %v", s, err)
+        }
+        if got := sc.TraceParent(); got != s {
+            t.Errorf("TraceParent() = %q, want %q", got, s)
+        }
+    }
+}
+
+func TestInjectExtract(t *testing.T) {
+    tests := []struct {
+        name        string
+        header      http.Header
+        traceParent string
+        traceState  string
+    }{
+        {
+            name: "no trace context",
+            header: http.Header{},
+        },
+        {
+            name: "invalid traceparent",
+            header: http.Header{"Traceparent": {"garbage"}, "Tracestate": {"a=1"}},
+        },
+        {
+            name: "traceparent only",
+            header: http.Header{"Traceparent": {testTraceParent}},
+            traceParent: testTraceParent,
+        },
+        {
+            name: "trace state over several headers",
+            header: http.Header{
+                "Traceparent": {testTraceParent},
+                "Tracestate": {"a=1", "b=2"},
+            },
+            traceParent: testTraceParent,
+            traceState: "a=1,b=2",
+        },
+    }
+    for _, test := range tests {
+        ctx := Extract(context.Background(), test.header)
+        if got := TraceParent(ctx); got != test.traceParent {
+            t.Errorf("%s: TraceParent() = %q, want %q", test.name, got, test.traceParent)
+        }
+
+        // Whatever was there before is replaced
+        out := http.Header{"Tracestate": {"stale=1"}}
+        if test.traceParent == "" {
+            out = http.Header{}
+        }
+        Inject(ctx, out)
+        if got := out.Get(TraceParentHeader); got != test.traceParent {
+            t.Errorf("%s: injected traceparent %q, want %q", test.name, got, test.traceParent)
+        }
+        if got := out.Get(TraceStateHeader); got != test.traceState {
+            t.Errorf("%s: injected tracestate %q, want %q", test.name, got, test.traceState)
+        }
+    }
+}
+
+func TestWithTraceParent(t *testing.T) {
+    tests := []struct {
+        traceParent string
+        want        string
+    }{
+        {"", ""},
+        {"garbage", ""},
+        {testTraceParent, testTraceParent},
+    }
+    for _, test := range tests {
+        ctx := WithTraceParent(context.Background(), test.traceParent)
+        if got := TraceParent(ctx); got != test.want {
+            t.Errorf("WithTraceParent(%q): TraceParent() = %q, want %q",
+                        test.traceParent, got, test.want)
+        }
+    }
+}
+
+// Collects exported spans in memory
+type testExporter struct {
+    spans []SpanData
+    mux   sync.Mutex
+}
+
+func (e *testExporter) ExportSpans(serviceName string, spans []SpanData) error {
+    e.mux.Lock()
+    defer e.mux.Unlock()
+    e.spans = append(e.spans, spans...)
+    return nil
+}
+
+func (e *testExporter) Close() error {
+    return nil
+}
+
+func TestStart(t *testing.T) {
+    // Nothing is recorded before Init()
+    if _, span := Start(context.Background(), Server, "disabled"); span != nil {
+        t.Errorf("Start() before Init() returned a span")
+    }
+
+    exp := &testExporter{}
+    if err := Init("test", exp); err != nil {
+        t.Fatalf("Init() failed: %v", err)
+    }
+
+    parent, _ := ParseTraceParent(testTraceParent)
+    unsampled := parent
+    unsampled.Sampled = false
+
+    tests := []struct {
+        name     string
+        parent   *SpanContext
+        recorded bool
+    }{
+        {"root", nil, true},
+        {"sampled parent", &parent, true},
+        {"unsampled parent", &unsampled, false},
+    }
+    for _, test := range tests {
+        ctx := context.Background()
+        if test.parent != nil {
+            ctx = ContextWithRemoteSpanContext(ctx, *test.parent)
+        }
+        ctx, span := Start(ctx, Client, test.name)
+        if (span != nil) != test.recorded {
+            t.Errorf("%s: Start() returned span %v, want recorded: %v",
+                        test.name, span, test.recorded)
+        }
+        // Ending a nil span does nothing
+        span.End()
+        if span == nil {
+            continue
+        }
+
+        sc := span.Context()
+        if got := SpanContextFromContext(ctx); got != sc {
+            t.Errorf("%s: context holds %+v, want %+v", test.name, got, sc)
+        }
+        if test.parent != nil && (sc.TraceID != parent.TraceID ||
+                span.data.ParentSpanID != parent.SpanID) {
+            t.Errorf("%s: span %+v isn't a child of %+v", test.name, sc, parent)
+        }
+        if !sc.IsValid() || sc.SpanID == parent.SpanID {
+            t.Errorf("%s: span has invalid context %+v", test.name, sc)
+        }
+    }
+
+    if err := Shutdown(context.Background()); err != nil {
+        t.Fatalf("Shutdown() failed: %v", err)
+    }
+    exp.mux.Lock()
+    defer exp.mux.Unlock()
+    if len(exp.spans) != 2 {
+        t.Errorf("Exported %d spans, want 2", len(exp.spans))
+    }
+}
+
+func TestEnqueueDropsWhenFull(t *testing.T) {
+    exporterMux.Lock()
+    queue = make(chan SpanData, 2)
+    exporterMux.Unlock()
+    defer func() {
+        exporterMux.Lock()
+        queue = nil
+        exporterMux.Unlock()
+        atomic.StoreUint64(&dropped, 0)
+    }()
+
+    for i := 0; i < 5; i++ {
+        enqueue(SpanData{})
+    }
+    if n := atomic.LoadUint64(&dropped); n != 3 {
+        t.Errorf("Dropped %d spans, want 3", n)
+    }
+    reportDropped()
+    if n := atomic.LoadUint64(&dropped); n != 0 {
+        t.Errorf("%d dropped spans left after reporting, want 0", n)
+    }
+}
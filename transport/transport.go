@@ -0,0 +1,97 @@
+package transport
+
+// http.RoundTripper implementation that sends requests over libp2p
+// Allows Go programs to embed the service manager and talk to services using
+// a regular http.Client, e.g.
+//
+//     client := &http.Client{Transport: transport.NewTransport(res)}
+//     resp, err := client.Get("http://hello-world-server/hello")
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+    "strings"
+
+    "github.com/PhysarumSM/service-manager/lca"
+    "github.com/PhysarumSM/service-manager/logging"
+    "github.com/PhysarumSM/service-manager/resolver"
+)
+
+var log = logging.New("transport")
+
+// Maps http://<service-name>/path to a find-or-allocate of <service-name>,
+// followed by an HTTP request over a P2P stream to the resolved peer
+type Transport struct {
+    Resolver *resolver.Resolver
+}
+
+// Constructor for Transport
+func NewTransport(res *resolver.Resolver) *Transport {
+    return &Transport{Resolver: res}
+}
+
+// Convenience constructor for an http.Client using a new Transport
+func NewClient(res *resolver.Resolver) *http.Client {
+    return &http.Client{Transport: NewTransport(res)}
+}
+
+// Implements http.RoundTripper
+// The URL's host (minus any port) is taken to be the service name
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+    if req.URL == nil {
+        closeBody(req)
+        return nil, errors.New("Error: nil request URL")
+    }
+    if req.URL.Scheme != "http" {
+        closeBody(req)
+        return nil, fmt.Errorf("Error: unsupported protocol scheme %q", req.URL.Scheme)
+    }
+
+    servName := req.URL.Hostname()
+    if servName == "" {
+        closeBody(req)
+        return nil, errors.New("Error: no service name in request URL")
+    }
+
+    id, _, err := t.Resolver.ResolveContext(req.Context(), servName)
+    if err != nil {
+        closeBody(req)
+        return nil, err
+    }
+
+    outreq := outgoingRequest(req, servName)
+
+    // Request originated in-process, so there's no client address to record
+    manager := t.Resolver.Manager
+    lca.AddForwardedHeaders(outreq, "", manager.Host.Host.ID().Pretty())
+    manager.SetCallerHeaders(outreq)
+
+    resp, _, err := t.Resolver.Request(servName, id, outreq)
+    if err != nil {
+        return nil, err
+    }
+
+    // Responses are associated with the caller's original request
+    resp.Request = req
+    return resp, nil
+}
+
+// Returns a copy of req addressed to the service's proxy
+// The service's proxy expects the service name as the first path segment, and
+// strips it before forwarding the request to the service
+// RoundTrippers must not modify the original request, so this works on a copy
+func outgoingRequest(req *http.Request, servName string) *http.Request {
+    outreq := req.Clone(req.Context())
+    outreq.URL.Path = "/" + servName + "/" + strings.TrimPrefix(req.URL.Path, "/")
+    if req.URL.RawPath != "" {
+        outreq.URL.RawPath = "/" + servName + "/" + strings.TrimPrefix(req.URL.RawPath, "/")
+    }
+    return outreq
+}
+
+func closeBody(req *http.Request) {
+    if req.Body != nil {
+        req.Body.Close()
+    }
+}
@@ -0,0 +1,76 @@
+package transport
+
+import (
+    "io"
+    "net/http"
+    "strings"
+    "testing"
+)
+
+func TestOutgoingRequest(t *testing.T) {
+    tests := []struct {
+        url     string
+        path    string
+        rawPath string
+        want    string
+    }{
+        {"http://svc/hello", "/svc/hello", "", "http://svc/svc/hello"},
+        {"http://svc", "/svc/", "", "http://svc/svc/"},
+        {"http://svc:8080/a/b?x=1", "/svc/a/b", "", "http://svc:8080/svc/a/b?x=1"},
+        // Escaped slashes stay escaped
+        {"http://svc/a%2Fb", "/svc/a/b", "/svc/a%2Fb", "http://svc/svc/a%2Fb"},
+    }
+    for _, test := range tests {
+        req, err := http.NewRequest(http.MethodGet, test.url, nil)
+        if err != nil {
+            t.Fatalf("%s: NewRequest() failed: %v", test.url, err)
+        }
+        outreq := outgoingRequest(req, req.URL.Hostname())
+        if outreq.URL.Path != test.path || outreq.URL.RawPath != test.rawPath {
+            t.Errorf("%s: path = (%q, %q), want (%q, %q)", test.url,
+                        outreq.URL.Path, outreq.URL.RawPath, test.path, test.rawPath)
+        }
+        if got := outreq.URL.String(); got != test.want {
+            t.Errorf("%s: URL = %s, want %s", test.url, got, test.want)
+        }
+        // The caller's request is left as it was
+        if got := req.URL.String(); got != test.url {
+            t.Errorf("%s: original request's URL changed to %s", test.url, got)
+        }
+    }
+}
+
+type closeRecorder struct {
+    io.Reader
+    closed bool
+}
+
+func (c *closeRecorder) Close() error {
+    c.closed = true
+    return nil
+}
+
+func TestRoundTripRejectsBadURLs(t *testing.T) {
+    tests := []struct {
+        name string
+        url  string
+    }{
+        {"https", "https://svc/hello"},
+        {"no service name", "http:///hello"},
+    }
+    tr := NewTransport(nil)
+    for _, test := range tests {
+        body := &closeRecorder{Reader: strings.NewReader("body")}
+        req, err := http.NewRequest(http.MethodPost, test.url, body)
+        if err != nil {
+            t.Fatalf("%s: NewRequest() failed: %v", test.name, err)
+        }
+        if resp, err := tr.RoundTrip(req); err == nil || resp != nil {
+            t.Errorf("%s: RoundTrip() = (%v, %v), want an error", test.name, resp, err)
+        }
+        // RoundTrippers close the body even on errors
+        if !body.closed {
+            t.Errorf("%s: request body left open", test.name)
+        }
+    }
+}